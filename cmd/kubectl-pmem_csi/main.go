@@ -0,0 +1,17 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"os"
+
+	kubectlpmemcsi "github.com/intel/pmem-csi/pkg/kubectl-pmem_csi"
+)
+
+func main() {
+	os.Exit(kubectlpmemcsi.Main())
+}
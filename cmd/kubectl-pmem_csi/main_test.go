@@ -0,0 +1,18 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main_test
+
+import (
+	"testing"
+
+	"github.com/intel/pmem-csi/pkg/coverage"
+	kubectlpmemcsi "github.com/intel/pmem-csi/pkg/kubectl-pmem_csi"
+)
+
+func TestMain(t *testing.T) {
+	coverage.Run(kubectlpmemcsi.Main)
+}
@@ -9,12 +9,16 @@ package v1beta1
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/intel/pmem-csi/pkg/driverfeatures"
+	"github.com/intel/pmem-csi/pkg/hostpaths"
 )
 
 // DeviceMode type decleration for allowed driver device managers
@@ -60,6 +64,17 @@ const (
 	LogFormatJSON LogFormat = "json"
 )
 
+// Platform identifies the kind of cluster that PMEM-CSI gets deployed on.
+type Platform string
+
+const (
+	// PlatformKubernetes is for normal Kubernetes clusters.
+	PlatformKubernetes Platform = "Kubernetes"
+	// PlatformOpenShift enables the additional objects that are needed
+	// on OpenShift and disables settings which are not supported there.
+	PlatformOpenShift Platform = "OpenShift"
+)
+
 type MutatePods string
 
 const (
@@ -95,6 +110,22 @@ type DeploymentSpec struct {
 	ProvisionerImage string `json:"provisionerImage,omitempty"`
 	// NodeRegistrarImage CSI node driver registrar sidecar image
 	NodeRegistrarImage string `json:"nodeRegistrarImage,omitempty"`
+	// ResizerImage CSI resizer sidecar image, only used when the
+	// Expansion driver feature is enabled
+	ResizerImage string `json:"resizerImage,omitempty"`
+	// ImageRegistry, if set, replaces the registry of all images
+	// (driver and sidecars), for example with a local mirror in an
+	// air-gapped cluster. The repository path and tag or digest remain
+	// the same, except that official Docker Hub images get the implicit
+	// "library/" prefix.
+	ImageRegistry string `json:"imageRegistry,omitempty"`
+	// ImageOverrides maps an image reference as it would be used
+	// otherwise to the image reference that is to be used instead.
+	// This takes precedence over ImageRegistry and can be used to pin
+	// images to digests.
+	ImageOverrides map[string]string `json:"imageOverrides,omitempty"`
+	// ImagePullSecrets are added to all pods created by the operator.
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
 	// ProvisionerResources Compute resources required by provisioner sidecar container
 	ProvisionerResources *corev1.ResourceRequirements `json:"provisionerResources,omitempty"`
 	// NodeRegistrarResources Compute resources required by node registrar sidecar container
@@ -103,6 +134,9 @@ type DeploymentSpec struct {
 	NodeDriverResources *corev1.ResourceRequirements `json:"nodeDriverResources,omitempty"`
 	// ControllerDriverResources Compute resources required by central driver container
 	ControllerDriverResources *corev1.ResourceRequirements `json:"controllerDriverResources,omitempty"`
+	// NodeSetupResources Compute resources required by the container which prepares PMEM
+	// on worker nodes and by the container which removes it again when uninstalling
+	NodeSetupResources *corev1.ResourceRequirements `json:"nodeSetupResources,omitempty"`
 	// ControllerTLSSecret used to be the name of a secret which contains ca.crt, tls.crt and tls.key data
 	// for the scheduler extender and pod mutation webhook. It is now unused.
 	//
@@ -145,14 +179,229 @@ type DeploymentSpec struct {
 	// +kubebuilder:validation:Minimum=0
 	// +kubebuilder:validation:Maximum=100
 	PMEMPercentage uint16 `json:"pmemPercentage,omitempty"`
+	// PMEMPercentageNodeLabel, if set, is the name of a node label whose value
+	// overrides PMEMPercentage on nodes where that label is set. The value
+	// must be an integer between 0 and 100. This makes it possible to reserve
+	// a different amount of PMEM for non-CSI usage on individual nodes.
+	// The percentage applies to all regions of a node.
+	PMEMPercentageNodeLabel string `json:"pmemPercentageNodeLabel,omitempty"`
 	// Labels contains additional labels for all objects created by the operator.
 	Labels map[string]string `json:"labels,omitempty"`
+	// Annotations contains additional annotations for all pods created
+	// by the operator. Annotations which the operator sets itself
+	// cannot be overridden.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// PriorityClassName, if set, replaces the default priority class
+	// of all pods created by the operator (system-cluster-critical
+	// for the controller, system-node-critical for the node driver).
+	PriorityClassName string `json:"priorityClassName,omitempty"`
 	// KubeletDir kubelet's root directory path
 	KubeletDir string `json:"kubeletDir,omitempty"`
+	// HostLayout is the directory layout on the nodes. It determines
+	// the default for KubeletDir. The operator uses its -host-layout
+	// parameter if not set, the standard layout by default.
+	// +kubebuilder:validation:Enum=standard;microk8s;k0s
+	HostLayout hostpaths.Layout `json:"hostLayout,omitempty"`
 	// DaemonSets use the default RollingUpdate strategy with at most 1 node
 	// not having a running driver pod. That limit can be increased with
 	// this setting, either with a higher integer or a percentage.
 	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+	// SidecarLogging overrides the logging settings of the CSI sidecar
+	// containers (external-provisioner, node-driver-registrar).
+	SidecarLogging *SidecarLogging `json:"sidecarLogging,omitempty"`
+	// Platform, if set, overrides the auto-detection of the
+	// cluster type by the operator.
+	// +kubebuilder:validation:Enum=Kubernetes;OpenShift
+	Platform Platform `json:"platform,omitempty"`
+	// SeccompProfile, if set, is used for all pods.
+	SeccompProfile *corev1.SeccompProfile `json:"seccompProfile,omitempty"`
+	// AppArmorProfile, if set, is used for all containers. The value
+	// must be in the format of the AppArmor annotation
+	// (runtime/default, localhost/<profile>, unconfined). It is
+	// ignored on OpenShift, which uses SELinux instead.
+	AppArmorProfile string `json:"appArmorProfile,omitempty"`
+	// NodeReadOnlyRootFilesystem makes the root filesystem of the
+	// node driver, node setup and uninstall containers read-only.
+	// Directories which need to be writable are replaced with
+	// emptyDir volumes. The containers still need to be privileged
+	// for bidirectional mount propagation and access to PMEM devices.
+	// The sidecar containers always have a read-only root filesystem.
+	NodeReadOnlyRootFilesystem bool `json:"nodeReadOnlyRootFilesystem,omitempty"`
+	// DryRun makes the node driver simulate creating and deleting
+	// volumes in memory without modifying PMEM. This is meant for
+	// testing StorageClass parameters and scheduling on production
+	// clusters. Pods cannot use such volumes.
+	DryRun bool `json:"dryRun,omitempty"`
+	// ViewerRole enables the creation of a Role in the driver
+	// namespace and a ClusterRole which grant read-only access to
+	// the deployment, the objects created for it and the metrics of
+	// the driver. Binding those roles gives support staff
+	// visibility without edit rights.
+	ViewerRole bool `json:"viewerRole,omitempty"`
+	// GrafanaDashboards enables the creation of a ConfigMap with
+	// Grafana dashboards for the metrics of the driver. It has the
+	// grafana_dashboard label that the Grafana dashboard sidecar
+	// looks for.
+	GrafanaDashboards bool `json:"grafanaDashboards,omitempty"`
+	// NodeConfig contains settings for groups of nodes which differ
+	// from the rest of the cluster. Each entry results in a separate
+	// node DaemonSet. All entries must select nodes by one common
+	// label with a different value in each entry.
+	NodeConfig []NodeConfig `json:"nodeConfig,omitempty"`
+	// Patches get applied to the objects created by the operator
+	// before they are sent to the API server, in the order in
+	// which they are listed. This is meant for settings that are
+	// not covered by the other fields. The operator does not check
+	// whether the result makes sense.
+	Patches []ObjectPatch `json:"patches,omitempty"`
+	// PreserveManualChanges stops the operator from reverting
+	// changes that were made directly to the pod template of the
+	// node DaemonSet or controller Deployment, for example with
+	// "kubectl edit". Such changes are always reported with the
+	// Degraded condition. They get overwritten anyway when the
+	// operator needs to update the object.
+	PreserveManualChanges bool `json:"preserveManualChanges,omitempty"`
+	// TerminationLog, if set, changes where the driver writes
+	// its termination message and how Kubernetes retrieves it.
+	TerminationLog *TerminationLog `json:"terminationLog,omitempty"`
+	// DriverVersion is the <major>.<minor> version of the driver
+	// in Image. If not set, it is taken from the image tag when
+	// that has the form [v]<major>.<minor>[.<patch>]. When the
+	// version is known, the operator updates nodes in batches of
+	// MaxUnavailable and refuses downgrades to versions which
+	// cannot read the node state of the running version.
+	DriverVersion string `json:"driverVersion,omitempty"`
+	// CanaryNodeLabel is the name of a node label. During an
+	// upgrade, nodes which have that label get updated first, one
+	// at a time. If the new driver fails on one of them, the
+	// upgrade is paused.
+	CanaryNodeLabel string `json:"canaryNodeLabel,omitempty"`
+	// EphemeralQuotaPerPod, if set, limits the total size of the
+	// ephemeral inline volumes of a single pod on a node.
+	// Publishing a volume which would exceed it fails.
+	EphemeralQuotaPerPod *resource.Quantity `json:"ephemeralQuotaPerPod,omitempty"`
+	// EphemeralQuotaPerNode, if set, limits the total size of
+	// the ephemeral inline volumes of all pods on a node.
+	EphemeralQuotaPerNode *resource.Quantity `json:"ephemeralQuotaPerNode,omitempty"`
+	// LostNodeGracePeriod, if set, enables marking volumes as lost
+	// when their node was removed from the cluster for longer than
+	// this. Only then does the controller get permission to modify
+	// PVs.
+	LostNodeGracePeriod *metav1.Duration `json:"lostNodeGracePeriod,omitempty"`
+	// DeleteLostVolumes enables deleting released PVs of lost
+	// volumes. Requires LostNodeGracePeriod.
+	DeleteLostVolumes bool `json:"deleteLostVolumes,omitempty"`
+	// DriverFeatureGates enables or disables experimental
+	// features of the driver. Unknown features and features which
+	// do not work in the device mode are rejected.
+	// Features which are not listed keep their default.
+	DriverFeatureGates map[string]bool `json:"driverFeatureGates,omitempty"`
+	// DriverConfig contains settings for the controller and node
+	// driver, keyed by the name of the command line parameter
+	// without the leading hyphen. The operator stores them in a
+	// ConfigMap which is mounted into the driver pods. They replace
+	// parameters that the operator would set otherwise. Changing the
+	// log verbosity ("v") takes effect without restarting the pods.
+	DriverConfig map[string]string `json:"driverConfig,omitempty"`
+	// Paused stops the operator from making changes to the objects
+	// of the deployment, for example during maintenance of PMEM
+	// nodes. Changes of the spec are applied once it is unset again.
+	// Deleting the deployment still removes the driver.
+	Paused bool `json:"paused,omitempty"`
+}
+
+// PatchType determines how ObjectPatch.Patch is interpreted.
+type PatchType string
+
+const (
+	// PatchTypeStrategic is a strategic merge patch, the same as
+	// "kubectl patch --type=strategic".
+	PatchTypeStrategic PatchType = "strategic"
+	// PatchTypeJSON is a JSON patch (RFC 6902), the same as
+	// "kubectl patch --type=json".
+	PatchTypeJSON PatchType = "json"
+)
+
+// +k8s:deepcopy-gen=true
+// ObjectPatch modifies objects of a certain kind.
+type ObjectPatch struct {
+	// Kind of the objects that get patched, for example DaemonSet.
+	// +kubebuilder:validation:Required
+	Kind string `json:"kind"`
+	// Name, if set, limits the patch to the object with that name.
+	Name string `json:"name,omitempty"`
+	// Type of the patch, strategic merge by default.
+	// +kubebuilder:validation:Enum=strategic;json
+	Type PatchType `json:"type,omitempty"`
+	// Patch in YAML or JSON format.
+	// +kubebuilder:validation:Required
+	Patch string `json:"patch"`
+}
+
+// Matches checks whether the patch applies to the object with the
+// given kind and name.
+func (p ObjectPatch) Matches(kind, name string) bool {
+	return p.Kind == kind && (p.Name == "" || p.Name == name)
+}
+
+// NodeConfigLabel is set on the pods of a node DaemonSet for a
+// node configuration. The value is the name of the node configuration.
+// The default node DaemonSet only selects pods without it.
+const NodeConfigLabel = "pmem-csi.intel.com/node-config"
+
+// +k8s:deepcopy-gen=true
+// NodeConfig overrides some settings for nodes which match the node selector.
+type NodeConfig struct {
+	// Name is appended to the name of the node DaemonSet. It must be unique
+	// among all node configurations of a deployment.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name string `json:"name"`
+	// NodeSelector selects the nodes for this configuration. It gets
+	// combined with Spec.NodeSelector and must not be empty.
+	// +kubebuilder:validation:Required
+	NodeSelector map[string]string `json:"nodeSelector"`
+	// DeviceMode, if set, replaces Spec.DeviceMode on these nodes.
+	// +kubebuilder:validation:Enum=lvm;direct
+	DeviceMode DeviceMode `json:"deviceMode,omitempty"`
+	// PMEMPercentage, if non-zero, replaces Spec.PMEMPercentage on these nodes.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	PMEMPercentage uint16 `json:"pmemPercentage,omitempty"`
+	// NodeDriverResources, if set, replaces Spec.NodeDriverResources on these nodes.
+	NodeDriverResources *corev1.ResourceRequirements `json:"nodeDriverResources,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// SidecarLogging contains the klog settings that can be changed for
+// the CSI sidecar containers.
+type SidecarLogging struct {
+	// LogLevel, if set, replaces Spec.LogLevel for the sidecars.
+	LogLevel *uint16 `json:"logLevel,omitempty"`
+	// LogToStderr, if set, determines whether the sidecars log to stderr
+	// instead of files.
+	LogToStderr *bool `json:"logToStderr,omitempty"`
+	// StderrThreshold, if set, is the minimum severity of messages which
+	// are written to stderr in addition to files.
+	// +kubebuilder:validation:Enum=INFO;WARNING;ERROR;FATAL
+	StderrThreshold string `json:"stderrThreshold,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// TerminationLog contains the termination message settings of the
+// containers.
+type TerminationLog struct {
+	// Path, if set, replaces the default path of the termination
+	// log of the PMEM-CSI driver containers. The directory must be
+	// writable. For node containers with a read-only root
+	// filesystem, that means it must be under /tmp.
+	Path string `json:"path,omitempty"`
+	// Policy, if set, replaces the default terminationMessagePolicy
+	// (File) of all containers. FallbackToLogsOnError uses the end
+	// of the container log when the driver failed without writing
+	// a termination message.
+	// +kubebuilder:validation:Enum=File;FallbackToLogsOnError
+	Policy corev1.TerminationMessagePolicy `json:"policy,omitempty"`
 }
 
 // DeploymentConditionType type for representing a deployment status condition
@@ -162,6 +411,24 @@ const (
 	// DriverDeployed means that the all the sub-resources required for the deployment CR
 	// got created
 	DriverDeployed DeploymentConditionType = "DriverDeployed"
+	// Degraded means that the pod template of some sub-resource
+	// was modified outside of the operator and differs from what
+	// the operator created.
+	Degraded DeploymentConditionType = "Degraded"
+	// VersionSkew means that not all nodes run the driver version
+	// from the spec, either because an upgrade is in progress or
+	// because a downgrade was refused.
+	VersionSkew DeploymentConditionType = "VersionSkew"
+	// DriverCrashed means that a driver container terminated with
+	// an error. The reason contains its last termination message.
+	DriverCrashed DeploymentConditionType = "DriverCrashed"
+	// NameConflict means that another CSI driver with the same
+	// name is installed in the cluster. The reason describes
+	// where it was found.
+	NameConflict DeploymentConditionType = "NameConflict"
+	// Paused means that Spec.Paused is set and the operator does
+	// not reconcile the deployment.
+	Paused DeploymentConditionType = "Paused"
 )
 
 // +k8s:deepcopy-gen=true
@@ -212,6 +479,29 @@ type DriverStatus struct {
 
 // +k8s:deepcopy-gen=true
 
+// CapacityStatus summarizes the PMEM capacity that the node drivers
+// publish in CSIStorageCapacity objects.
+type CapacityStatus struct {
+	// Total is the PMEM on all nodes that can be used for volumes,
+	// i.e. free capacity plus the size of existing volumes.
+	Total resource.Quantity `json:"total"`
+	// Free is the PMEM on all nodes that is available for new volumes.
+	Free resource.Quantity `json:"free"`
+	// Nodes has one entry per node, sorted by name.
+	Nodes []NodeCapacity `json:"nodes,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+
+// NodeCapacity is the PMEM capacity of one node.
+type NodeCapacity struct {
+	Node  string            `json:"node"`
+	Total resource.Quantity `json:"total"`
+	Free  resource.Quantity `json:"free"`
+}
+
+// +k8s:deepcopy-gen=true
+
 // DeploymentStatus defines the observed state of Deployment
 type DeploymentStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
@@ -223,6 +513,29 @@ type DeploymentStatus struct {
 	// Conditions
 	Conditions []DeploymentCondition `json:"conditions,omitempty"`
 	Components []DriverStatus        `json:"driverComponents,omitempty"`
+	// PodTemplateHashes maps the name of each DaemonSet and
+	// Deployment to the hash of the pod template that the operator
+	// applied last. It is used to detect manual changes.
+	PodTemplateHashes map[string]string `json:"podTemplateHashes,omitempty"`
+	// DriverVersion is the version of the driver that runs on
+	// all nodes, if known.
+	DriverVersion string `json:"driverVersion,omitempty"`
+	// FeatureGates lists all operator features and whether they
+	// are enabled for the deployment.
+	FeatureGates map[string]bool `json:"featureGates,omitempty"`
+	// ObservedGeneration is the generation of the spec that the
+	// operator reconciled last.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Retries counts the consecutive failed attempts to reconcile
+	// the current generation. The operator retries with exponential
+	// backoff and gives up after a certain number of attempts.
+	Retries int32 `json:"retries,omitempty"`
+	// Capacity is the PMEM capacity reported by the node drivers,
+	// nil until at least one node has reported it.
+	Capacity *CapacityStatus `json:"capacity,omitempty"`
+	// LastAppliedSpec is the spec in JSON format that the operator
+	// applied successfully last. Changes against it get logged.
+	LastAppliedSpec string `json:"lastAppliedSpec,omitempty"`
 	// LastUpdated time of the deployment status
 	// +nullable
 	LastUpdated metav1.Time `json:"lastUpdated,omitempty"`
@@ -237,6 +550,8 @@ type DeploymentStatus struct {
 // +kubebuilder:printcolumn:name="NodeSelector",type=string,JSONPath=`.spec.nodeSelector`
 // +kubebuilder:printcolumn:name="Image",type=string,JSONPath=`.spec.image`
 // +kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Total",type=string,JSONPath=`.status.capacity.total`,priority=1
+// +kubebuilder:printcolumn:name="Free",type=string,JSONPath=`.status.capacity.free`,priority=1
 // +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 // +kubebuilder:storageversion
 type PmemCSIDeployment struct {
@@ -267,6 +582,39 @@ const (
 	EventReasonRunning = "Running"
 	// EventReasonFailed driver deployment failed, Event.Message holds detailed information
 	EventReasonFailed = "Failed"
+	// EventReasonDeleting driver deployment is being deleted, Event.Message explains what it is waiting for
+	EventReasonDeleting = "Deleting"
+	// EventReasonUninstalling the driver is being removed from the nodes, Event.Message explains what it is waiting for
+	EventReasonUninstalling = "Uninstalling"
+	// EventReasonManualChange the pod template of a sub-resource was modified outside of the operator
+	EventReasonManualChange = "ManualChange"
+	// EventReasonUpgrading the driver on a node is getting replaced with a different version
+	EventReasonUpgrading = "Upgrading"
+	// EventReasonUpgradePaused the driver failed on a canary node, Event.Message holds detailed information
+	EventReasonUpgradePaused = "UpgradePaused"
+)
+
+const (
+	// NodeDriverFinalizer keeps a deleted deployment and its node
+	// driver until no pod uses a PMEM-CSI volume anymore, because
+	// those volumes cannot be unmounted without the node driver.
+	NodeDriverFinalizer = "pmem-csi.intel.com/node-driver"
+	// ForceDeleteAnnotation, if set to "true" on a deleted
+	// deployment, removes it without waiting for pods.
+	ForceDeleteAnnotation = "pmem-csi.intel.com/force-delete"
+	// UninstallAnnotation, if set to "true" on a deployment before
+	// deleting it, removes all volumes, the PMEM setup and the
+	// state of the driver from the nodes as part of the deletion.
+	// "force" also deletes volumes which still have PVs.
+	UninstallAnnotation = "pmem-csi.intel.com/uninstall"
+	// FeatureGatesAnnotation overrides the feature gates of the
+	// operator for a deployment, using the same key=value,...
+	// format as the operator's -feature-gates parameter.
+	FeatureGatesAnnotation = "pmem-csi.intel.com/feature-gates"
+	// UninstallDoneFile gets created by the driver in uninstall
+	// mode once it is done on a node. The operator checks for it
+	// with a readiness probe.
+	UninstallDoneFile = "/tmp/pmem-csi-uninstalled"
 )
 
 const (
@@ -290,6 +638,9 @@ const (
 	// DefaultRegistrarImage default node driver registrar image to use
 	DefaultRegistrarImage = "registry.k8s.io/sig-storage/csi-node-driver-registrar:v2.5.1"
 
+	// DefaultResizerImage default external resizer image to use
+	DefaultResizerImage = "registry.k8s.io/sig-storage/csi-resizer:v1.5.0"
+
 	// Below resource requests and limits are derived(with minor adjustments) from
 	// recommendations reported by VirtualPodAutoscaler(LowerBound -> Requests and UpperBound -> Limits)
 
@@ -308,6 +659,11 @@ const (
 	// DefaultNodeRegistrarRequestMemory default memory resource request used for node registrar container
 	DefaultNodeRegistrarRequestMemory = "128Mi"
 
+	// DefaultNodeSetupRequestCPU default CPU resource request used for node setup container
+	DefaultNodeSetupRequestCPU = "12m"
+	// DefaultNodeSetupRequestMemory default memory resource request used for node setup container
+	DefaultNodeSetupRequestMemory = "128Mi"
+
 	// DefaultProvisionerRequestCPU default CPU resource request used for provisioner container
 	DefaultProvisionerRequestCPU = "12m"
 	// DefaultProvisionerRequestMemory default memory resource request used for node registrar container
@@ -349,7 +705,8 @@ const (
 )
 
 func (d *PmemCSIDeployment) SetCondition(t DeploymentConditionType, state corev1.ConditionStatus, reason string) {
-	for _, c := range d.Status.Conditions {
+	for i := range d.Status.Conditions {
+		c := &d.Status.Conditions[i]
 		if c.Type == t {
 			c.Status = state
 			c.Reason = reason
@@ -416,6 +773,10 @@ func (d *PmemCSIDeployment) EnsureDefaults(operatorImage string) error {
 		d.Spec.NodeRegistrarImage = DefaultRegistrarImage
 	}
 
+	if d.Spec.ResizerImage == "" {
+		d.Spec.ResizerImage = DefaultResizerImage
+	}
+
 	if d.Spec.NodeSelector == nil {
 		d.Spec.NodeSelector = DefaultNodeSelector
 	}
@@ -424,46 +785,161 @@ func (d *PmemCSIDeployment) EnsureDefaults(operatorImage string) error {
 		d.Spec.PMEMPercentage = DefaultPMEMPercentage
 	}
 
+	hostPaths, err := hostpaths.Get(d.Spec.HostLayout)
+	if err != nil {
+		return fmt.Errorf("hostLayout: %v", err)
+	}
 	if d.Spec.KubeletDir == "" {
-		d.Spec.KubeletDir = DefaultKubeletDir
+		d.Spec.KubeletDir = hostPaths.KubeletDir
 	}
 
-	if d.Spec.ControllerDriverResources == nil {
-		d.Spec.ControllerDriverResources = &corev1.ResourceRequirements{
-			Requests: corev1.ResourceList{
-				corev1.ResourceCPU:    resource.MustParse(DefaultControllerResourceRequestCPU),
-				corev1.ResourceMemory: resource.MustParse(DefaultControllerResourceRequestMemory),
-			},
+	d.Spec.ControllerDriverResources = defaultResources(d.Spec.ControllerDriverResources,
+		DefaultControllerResourceRequestCPU, DefaultControllerResourceRequestMemory)
+	d.Spec.ProvisionerResources = defaultResources(d.Spec.ProvisionerResources,
+		DefaultProvisionerRequestCPU, DefaultProvisionerRequestMemory)
+	d.Spec.NodeDriverResources = defaultResources(d.Spec.NodeDriverResources,
+		DefaultNodeResourceRequestCPU, DefaultNodeResourceRequestMemory)
+	d.Spec.NodeRegistrarResources = defaultResources(d.Spec.NodeRegistrarResources,
+		DefaultNodeRegistrarRequestCPU, DefaultNodeRegistrarRequestMemory)
+	d.Spec.NodeSetupResources = defaultResources(d.Spec.NodeSetupResources,
+		DefaultNodeSetupRequestCPU, DefaultNodeSetupRequestMemory)
+	for what, r := range map[string]*corev1.ResourceRequirements{
+		"controllerDriverResources": d.Spec.ControllerDriverResources,
+		"provisionerResources":      d.Spec.ProvisionerResources,
+		"nodeDriverResources":       d.Spec.NodeDriverResources,
+		"nodeRegistrarResources":    d.Spec.NodeRegistrarResources,
+		"nodeSetupResources":        d.Spec.NodeSetupResources,
+	} {
+		if err := validateResources(r); err != nil {
+			return fmt.Errorf("%s: %v", what, err)
 		}
 	}
 
-	if d.Spec.ProvisionerResources == nil {
-		d.Spec.ProvisionerResources = &corev1.ResourceRequirements{
-			Requests: corev1.ResourceList{
-				corev1.ResourceCPU:    resource.MustParse(DefaultProvisionerRequestCPU),
-				corev1.ResourceMemory: resource.MustParse(DefaultProvisionerRequestMemory),
-			},
+	switch d.Spec.Platform {
+	case "", PlatformKubernetes, PlatformOpenShift:
+	default:
+		return fmt.Errorf("invalid platform %q", d.Spec.Platform)
+	}
+
+	for what, q := range map[string]*resource.Quantity{
+		"ephemeralQuotaPerPod":  d.Spec.EphemeralQuotaPerPod,
+		"ephemeralQuotaPerNode": d.Spec.EphemeralQuotaPerNode,
+	} {
+		if q != nil && q.Sign() < 0 {
+			return fmt.Errorf("%s: must not be negative", what)
 		}
 	}
 
-	if d.Spec.NodeDriverResources == nil {
-		d.Spec.NodeDriverResources = &corev1.ResourceRequirements{
-			Requests: corev1.ResourceList{
-				corev1.ResourceCPU:    resource.MustParse(DefaultNodeResourceRequestCPU),
-				corev1.ResourceMemory: resource.MustParse(DefaultNodeResourceRequestMemory),
-			},
+	if p := d.Spec.LostNodeGracePeriod; p != nil && p.Duration <= 0 {
+		return errors.New("lostNodeGracePeriod: must be positive")
+	}
+	if d.Spec.DeleteLostVolumes && d.Spec.LostNodeGracePeriod == nil {
+		return errors.New("deleteLostVolumes: requires lostNodeGracePeriod")
+	}
+
+	if err := driverfeatures.Validate(d.Spec.DriverFeatureGates, string(d.Spec.DeviceMode)); err != nil {
+		return fmt.Errorf("driverFeatureGates: %v", err)
+	}
+	for name := range d.Spec.DriverConfig {
+		if name == "" || strings.HasPrefix(name, "-") || name == "config" {
+			return fmt.Errorf("driverConfig: invalid parameter name %q", name)
 		}
 	}
 
-	if d.Spec.NodeRegistrarResources == nil {
-		d.Spec.NodeRegistrarResources = &corev1.ResourceRequirements{
-			Requests: corev1.ResourceList{
-				corev1.ResourceCPU:    resource.MustParse(DefaultNodeRegistrarRequestCPU),
-				corev1.ResourceMemory: resource.MustParse(DefaultNodeRegistrarRequestMemory),
-			},
+	names := map[string]bool{}
+	for _, nc := range d.Spec.NodeConfig {
+		if nc.Name == "" {
+			return errors.New("node configuration without name")
+		}
+		if names[nc.Name] {
+			return fmt.Errorf("node configuration %q: duplicate name", nc.Name)
+		}
+		names[nc.Name] = true
+		if len(nc.NodeSelector) == 0 {
+			return fmt.Errorf("node configuration %q: empty node selector", nc.Name)
+		}
+		switch nc.DeviceMode {
+		case "", DeviceModeDirect, DeviceModeLVM:
+		default:
+			return fmt.Errorf("node configuration %q: invalid device mode %q", nc.Name, nc.DeviceMode)
 		}
+		if nc.DeviceMode != "" {
+			if err := driverfeatures.Validate(d.Spec.DriverFeatureGates, string(nc.DeviceMode)); err != nil {
+				return fmt.Errorf("node configuration %q: driverFeatureGates: %v", nc.Name, err)
+			}
+		}
+		if err := validateResources(nc.NodeDriverResources); err != nil {
+			return fmt.Errorf("node configuration %q: nodeDriverResources: %v", nc.Name, err)
+		}
+	}
+	if len(d.Spec.NodeConfig) > 0 && d.NodeConfigKey() == "" {
+		return errors.New("node configurations must all select nodes by one common label with a different value in each entry")
+	}
+
+	for i, p := range d.Spec.Patches {
+		if p.Kind == "" {
+			return fmt.Errorf("patch #%d: kind not set", i)
+		}
+		if p.Patch == "" {
+			return fmt.Errorf("patch #%d: empty patch", i)
+		}
+		switch p.Type {
+		case "", PatchTypeStrategic, PatchTypeJSON:
+		default:
+			return fmt.Errorf("patch #%d: invalid type %q", i, p.Type)
+		}
+	}
+
+	return nil
+}
+
+// defaultResources adds requests for CPU and memory unless the
+// user already specified a request or limit for them. Kubernetes
+// uses the limit as request when only the limit is set.
+func defaultResources(r *corev1.ResourceRequirements, cpu, memory string) *corev1.ResourceRequirements {
+	if r == nil {
+		r = &corev1.ResourceRequirements{}
+	}
+	for _, request := range []struct {
+		name  corev1.ResourceName
+		value string
+	}{
+		{corev1.ResourceCPU, cpu},
+		{corev1.ResourceMemory, memory},
+	} {
+		if _, ok := r.Requests[request.name]; ok {
+			continue
+		}
+		if _, ok := r.Limits[request.name]; ok {
+			continue
+		}
+		if r.Requests == nil {
+			r.Requests = corev1.ResourceList{}
+		}
+		r.Requests[request.name] = resource.MustParse(request.value)
 	}
+	return r
+}
 
+// validateResources catches mistakes that otherwise would only be
+// reported by the apiserver when creating pods.
+func validateResources(r *corev1.ResourceRequirements) error {
+	if r == nil {
+		return nil
+	}
+	for name, limit := range r.Limits {
+		if limit.Sign() < 0 {
+			return fmt.Errorf("negative %s limit %s", name, limit.String())
+		}
+	}
+	for name, request := range r.Requests {
+		if request.Sign() < 0 {
+			return fmt.Errorf("negative %s request %s", name, request.String())
+		}
+		if limit, ok := r.Limits[name]; ok && request.Cmp(limit) > 0 {
+			return fmt.Errorf("%s request %s exceeds limit %s", name, request.String(), limit.String())
+		}
+	}
 	return nil
 }
 
@@ -517,6 +993,30 @@ func (d *PmemCSIDeployment) WebhooksClusterRoleName() string {
 	return d.GetHyphenedName() + "-webhooks-runner"
 }
 
+// ViewerClusterRoleName returns the name of the read-only
+// ClusterRole for the deployment.
+func (d *PmemCSIDeployment) ViewerClusterRoleName() string {
+	return d.GetHyphenedName() + "-viewer"
+}
+
+// ViewerRoleName returns the name of the read-only Role in the
+// namespace of the driver.
+func (d *PmemCSIDeployment) ViewerRoleName() string {
+	return d.GetHyphenedName() + "-viewer"
+}
+
+// GrafanaDashboardsName returns the name of the ConfigMap with
+// the Grafana dashboards for the deployment.
+func (d *PmemCSIDeployment) GrafanaDashboardsName() string {
+	return d.GetHyphenedName() + "-grafana-dashboards"
+}
+
+// DriverConfigName returns the name of the ConfigMap with
+// DriverConfig for the deployment.
+func (d *PmemCSIDeployment) DriverConfigName() string {
+	return d.GetHyphenedName() + "-config"
+}
+
 // WebhooksClusterRoleBindingName returns the name of the
 // webhooks' ClusterRoleBinding object name used by the deployment
 func (d *PmemCSIDeployment) WebhooksClusterRoleBindingName() string {
@@ -535,6 +1035,12 @@ func (d *PmemCSIDeployment) NodeOpenShiftRoleBindingName() string {
 	return d.GetHyphenedName() + "-node-openshift-cfg"
 }
 
+// NodeSetupOpenShiftRoleBindingName returns the name of the RoleBinding
+// for the node setup service account on OpenShift.
+func (d *PmemCSIDeployment) NodeSetupOpenShiftRoleBindingName() string {
+	return d.GetHyphenedName() + "-node-setup-openshift-cfg"
+}
+
 // ProvisionerRoleName returns the name of the provisioner's
 // RBAC Role object name used by the deployment
 func (d *PmemCSIDeployment) ProvisionerRoleName() string {
@@ -559,12 +1065,59 @@ func (d *PmemCSIDeployment) ProvisionerClusterRoleBindingName() string {
 	return d.GetHyphenedName() + "-csi-provisioner-role"
 }
 
+// ResizerClusterRoleName returns the name of the ClusterRole for the
+// external resizer, only created when volume expansion is enabled.
+func (d *PmemCSIDeployment) ResizerClusterRoleName() string {
+	return d.GetHyphenedName() + "-external-resizer-runner"
+}
+
+// ResizerClusterRoleBindingName returns the name of the
+// ClusterRoleBinding for the external resizer.
+func (d *PmemCSIDeployment) ResizerClusterRoleBindingName() string {
+	return d.GetHyphenedName() + "-csi-resizer-role"
+}
+
 // NodeDriverName returns the name of the driver
 // DaemonSet object name used by the deployment
 func (d *PmemCSIDeployment) NodeDriverName() string {
 	return d.GetHyphenedName() + "-node"
 }
 
+// NodeConfigDriverName returns the name of the driver
+// DaemonSet object for the node configuration with the given name.
+func (d *PmemCSIDeployment) NodeConfigDriverName(name string) string {
+	return d.NodeDriverName() + "-" + name
+}
+
+// NodeConfigKey returns the node label which separates the node
+// configurations: all of them select nodes by this label and each
+// with a different value, so no node matches more than one of them.
+// Empty if there is no such label.
+func (d *PmemCSIDeployment) NodeConfigKey() string {
+	if len(d.Spec.NodeConfig) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(d.Spec.NodeConfig[0].NodeSelector))
+	for key := range d.Spec.NodeConfig[0].NodeSelector {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		values := map[string]bool{}
+		for _, nc := range d.Spec.NodeConfig {
+			value, ok := nc.NodeSelector[key]
+			if !ok || values[value] {
+				break
+			}
+			values[value] = true
+		}
+		if len(values) == len(d.Spec.NodeConfig) {
+			return key
+		}
+	}
+	return ""
+}
+
 // ControllerDriverName returns the name of the controller
 // StatefulSet object name used by the deployment
 func (d *PmemCSIDeployment) ControllerDriverName() string {
@@ -595,6 +1148,12 @@ func (d *PmemCSIDeployment) NodeSetupName() string {
 	return d.GetHyphenedName() + "-node-setup"
 }
 
+// NodeUninstallName returns the name of the DaemonSet which
+// removes the driver from the nodes when uninstalling.
+func (d *PmemCSIDeployment) NodeUninstallName() string {
+	return d.GetHyphenedName() + "-node-uninstall"
+}
+
 // GetOwnerReference returns self owner reference could be used by other object
 // to add this deployment to it's owner reference list.
 func (d *PmemCSIDeployment) GetOwnerReference() metav1.OwnerReference {
@@ -617,3 +1176,38 @@ func (d *PmemCSIDeployment) GetControllerReplicas() int {
 	}
 	return d.Spec.ControllerReplicas
 }
+
+// OnOpenShift determines whether OpenShift specific objects and
+// settings are needed. Spec.Platform takes precedence over the
+// result of the cluster auto-detection.
+func (d *PmemCSIDeployment) OnOpenShift(detected bool) bool {
+	if d.Spec.Platform != "" {
+		return d.Spec.Platform == PlatformOpenShift
+	}
+	return detected
+}
+
+// ImageReference returns the image that is to be used instead of the
+// given one: an entry in ImageOverrides wins, otherwise the registry
+// gets replaced with ImageRegistry if that is set.
+func (d *PmemCSIDeployment) ImageReference(image string) string {
+	if override, ok := d.Spec.ImageOverrides[image]; ok {
+		return override
+	}
+	if d.Spec.ImageRegistry == "" {
+		return image
+	}
+	// The first path component is a registry if it looks like
+	// a host name, as in the Docker reference grammar.
+	registry, path := "docker.io", image
+	if parts := strings.SplitN(image, "/", 2); len(parts) == 2 &&
+		(strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		registry, path = parts[0], parts[1]
+	}
+	// Official Docker Hub images like "busybox" are really
+	// "library/busybox", which is what a mirror has to serve.
+	if (registry == "docker.io" || registry == "index.docker.io") && !strings.Contains(path, "/") {
+		path = "library/" + path
+	}
+	return strings.TrimSuffix(d.Spec.ImageRegistry, "/") + "/" + path
+}
@@ -12,10 +12,13 @@ import (
 
 	"github.com/intel/pmem-csi/pkg/apis"
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/hostpaths"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
 	apiextensions "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/scheme"
 )
 
@@ -45,6 +48,7 @@ var _ = Describe("Operator", func() {
 			Expect(d.Spec.PullPolicy).Should(BeEquivalentTo(api.DefaultImagePullPolicy), "default image pull policy mismatch")
 			Expect(d.Spec.ProvisionerImage).Should(BeEquivalentTo(api.DefaultProvisionerImage), "default provisioner image mismatch")
 			Expect(d.Spec.NodeRegistrarImage).Should(BeEquivalentTo(api.DefaultRegistrarImage), "default node driver registrar image mismatch")
+			Expect(d.Spec.ResizerImage).Should(BeEquivalentTo(api.DefaultResizerImage), "default resizer image mismatch")
 
 			Expect(d.Spec.ControllerDriverResources).ShouldNot(BeNil(), "default controller resources not set")
 
@@ -63,6 +67,11 @@ var _ = Describe("Operator", func() {
 			rs = d.Spec.ProvisionerResources.Requests
 			Expect(rs.Cpu().String()).Should(BeEquivalentTo(api.DefaultProvisionerRequestCPU), "provisioner 'cpu' resource request mismatch")
 			Expect(rs.Memory().String()).Should(BeEquivalentTo(api.DefaultProvisionerRequestMemory), "provisioner 'cpu' resource request mismatch")
+
+			Expect(d.Spec.NodeSetupResources).ShouldNot(BeNil(), "default node setup resources not set")
+			rs = d.Spec.NodeSetupResources.Requests
+			Expect(rs.Cpu().String()).Should(BeEquivalentTo(api.DefaultNodeSetupRequestCPU), "node setup 'cpu' resource request mismatch")
+			Expect(rs.Memory().String()).Should(BeEquivalentTo(api.DefaultNodeSetupRequestMemory), "node setup 'memory' resource request mismatch")
 		})
 
 		It("shall be able to set values", func() {
@@ -93,6 +102,10 @@ spec:
     requests:
       cpu: 50m
       memory: 150Mi
+  nodeSetupResources:
+    requests:
+      cpu: 20m
+      memory: 50Mi
 `
 			decode := scheme.Codecs.UniversalDeserializer().Decode
 
@@ -130,6 +143,199 @@ spec:
 			rs = d.Spec.ProvisionerResources.Requests
 			Expect(rs.Cpu().Cmp(resource.MustParse("50m"))).Should(BeZero(), "provisioner 'cpu' resource requests mismatch")
 			Expect(rs.Memory().Cmp(resource.MustParse("150Mi"))).Should(BeZero(), "provisioner 'memory' resource requests mismatch")
+
+			Expect(d.Spec.NodeSetupResources).ShouldNot(BeNil(), "node setup resources not set")
+			rs = d.Spec.NodeSetupResources.Requests
+			Expect(rs.Cpu().Cmp(resource.MustParse("20m"))).Should(BeZero(), "node setup 'cpu' resource requests mismatch")
+			Expect(rs.Memory().Cmp(resource.MustParse("50Mi"))).Should(BeZero(), "node setup 'memory' resource requests mismatch")
+		})
+
+		It("shall reject invalid node configurations", func() {
+			for name, nodeConfig := range map[string][]api.NodeConfig{
+				"no name": {
+					{NodeSelector: map[string]string{"a": "b"}},
+				},
+				"no selector": {
+					{Name: "foo"},
+				},
+				"duplicate name": {
+					{Name: "foo", NodeSelector: map[string]string{"a": "b"}},
+					{Name: "foo", NodeSelector: map[string]string{"c": "d"}},
+				},
+				"invalid device mode": {
+					{Name: "foo", NodeSelector: map[string]string{"a": "b"}, DeviceMode: "fake"},
+				},
+				"different labels": {
+					{Name: "foo", NodeSelector: map[string]string{"a": "b"}},
+					{Name: "bar", NodeSelector: map[string]string{"c": "d"}},
+				},
+				"same value": {
+					{Name: "foo", NodeSelector: map[string]string{"a": "b", "c": "d"}},
+					{Name: "bar", NodeSelector: map[string]string{"a": "b"}},
+				},
+			} {
+				By(name)
+				d := api.PmemCSIDeployment{}
+				d.Spec.NodeConfig = nodeConfig
+				err := d.EnsureDefaults("")
+				Expect(err).Should(HaveOccurred(), "ensure defaults")
+			}
+		})
+
+		It("shall find the label which separates node configurations", func() {
+			d := api.PmemCSIDeployment{}
+			d.Spec.NodeConfig = []api.NodeConfig{
+				{Name: "direct", NodeSelector: map[string]string{"pmem-mode": "direct", "zone": "a"}},
+				{Name: "lvm", NodeSelector: map[string]string{"pmem-mode": "lvm", "zone": "a"}},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults")
+			Expect(d.NodeConfigKey()).Should(Equal("pmem-mode"), "node configuration label")
+		})
+
+		It("shall complete partial resources", func() {
+			d := api.PmemCSIDeployment{}
+			d.Spec.NodeDriverResources = &corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{
+					corev1.ResourceMemory: resource.MustParse("1Gi"),
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults")
+			rs := d.Spec.NodeDriverResources.Requests
+			Expect(rs.Cpu().String()).Should(BeEquivalentTo(api.DefaultNodeResourceRequestCPU), "node driver 'cpu' resource request")
+			_, ok := rs[corev1.ResourceMemory]
+			Expect(ok).Should(BeFalse(), "node driver 'memory' resource request must come from the limit")
+		})
+
+		It("shall reject invalid resources", func() {
+			for name, resources := range map[string]corev1.ResourceRequirements{
+				"negative request": {
+					Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("-1")},
+				},
+				"negative limit": {
+					Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("-1Mi")},
+				},
+				"request above limit": {
+					Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("2Gi")},
+					Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+				},
+			} {
+				By(name)
+				resources := resources
+				d := api.PmemCSIDeployment{}
+				d.Spec.ControllerDriverResources = &resources
+				err := d.EnsureDefaults("")
+				Expect(err).Should(HaveOccurred(), "ensure defaults")
+				Expect(err.Error()).Should(ContainSubstring("controllerDriverResources"), "error message")
+			}
+		})
+
+		It("shall reject negative ephemeral volume quota", func() {
+			quota := resource.MustParse("-1Gi")
+			d := api.PmemCSIDeployment{}
+			d.Spec.EphemeralQuotaPerPod = &quota
+			err := d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults")
+			Expect(err.Error()).Should(ContainSubstring("ephemeralQuotaPerPod"), "error message")
+		})
+
+		It("shall reject a non-positive lost node grace period", func() {
+			d := api.PmemCSIDeployment{}
+			d.Spec.LostNodeGracePeriod = &metav1.Duration{}
+			err := d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults")
+			Expect(err.Error()).Should(ContainSubstring("lostNodeGracePeriod"), "error message")
+		})
+
+		It("shall reject deleting lost volumes without grace period", func() {
+			d := api.PmemCSIDeployment{}
+			d.Spec.DeleteLostVolumes = true
+			err := d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults")
+			Expect(err.Error()).Should(ContainSubstring("deleteLostVolumes"), "error message")
+		})
+
+		It("shall reject unknown driver features", func() {
+			d := api.PmemCSIDeployment{}
+			d.Spec.DriverFeatureGates = map[string]bool{"NoSuchFeature": true}
+			err := d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults")
+			Expect(err.Error()).Should(ContainSubstring("driverFeatureGates"), "error message")
+		})
+
+		It("shall reject driver features which do not work in the device mode", func() {
+			d := api.PmemCSIDeployment{}
+			d.Spec.DeviceMode = api.DeviceModeDirect
+			d.Spec.DriverFeatureGates = map[string]bool{"Expansion": true}
+			err := d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "direct mode")
+			Expect(err.Error()).Should(ContainSubstring("Expansion"), "error message")
+
+			d = api.PmemCSIDeployment{}
+			d.Spec.DriverFeatureGates = map[string]bool{"Expansion": true}
+			d.Spec.NodeConfig = []api.NodeConfig{{
+				Name:         "direct",
+				NodeSelector: map[string]string{"pmem-mode": "direct"},
+				DeviceMode:   api.DeviceModeDirect,
+			}}
+			err = d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "direct mode in node configuration")
+			Expect(err.Error()).Should(ContainSubstring(`node configuration "direct"`), "error message")
+		})
+
+		It("shall reject invalid driver config", func() {
+			d := api.PmemCSIDeployment{}
+			d.Spec.DriverConfig = map[string]string{"-v": "3"}
+			err := d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults")
+			Expect(err.Error()).Should(ContainSubstring("driverConfig"), "error message")
+		})
+
+		It("shall take the kubelet directory from the host layout", func() {
+			d := api.PmemCSIDeployment{}
+			d.Spec.HostLayout = hostpaths.MicroK8s
+			err := d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults")
+			Expect(d.Spec.KubeletDir).Should(Equal("/var/snap/microk8s/common/var/lib/kubelet"), "kubelet directory")
+
+			d = api.PmemCSIDeployment{}
+			d.Spec.HostLayout = "foobar"
+			err = d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults")
+			Expect(err.Error()).Should(ContainSubstring("hostLayout"), "error message")
+		})
+
+		It("shall rewrite image references", func() {
+			d := api.PmemCSIDeployment{}
+			Expect(d.ImageReference(api.DefaultProvisionerImage)).Should(Equal(api.DefaultProvisionerImage), "no rewriting")
+
+			d.Spec.ImageRegistry = "mirror.example.com/"
+			d.Spec.ImageOverrides = map[string]string{
+				"intel/pmem-csi-driver:canary": "other.example.com/pmem-csi-driver@sha256:1234",
+			}
+			for image, expected := range map[string]string{
+				"registry.k8s.io/sig-storage/csi-provisioner:v3.2.1": "mirror.example.com/sig-storage/csi-provisioner:v3.2.1",
+				"localhost:5000/intel/pmem-csi-driver:v1.0.0":        "mirror.example.com/intel/pmem-csi-driver:v1.0.0",
+				"intel/pmem-csi-driver:v1.0.0":                       "mirror.example.com/intel/pmem-csi-driver:v1.0.0",
+				"intel/pmem-csi-driver:canary":                       "other.example.com/pmem-csi-driver@sha256:1234",
+				"busybox":                                            "mirror.example.com/library/busybox",
+				"busybox:1.36":                                       "mirror.example.com/library/busybox:1.36",
+				"docker.io/busybox":                                  "mirror.example.com/library/busybox",
+				"docker.io/library/busybox":                          "mirror.example.com/library/busybox",
+				"localhost:5000/busybox":                             "mirror.example.com/busybox",
+			} {
+				Expect(d.ImageReference(image)).Should(Equal(expected), image)
+			}
+		})
+
+		It("shall update existing conditions", func() {
+			d := api.PmemCSIDeployment{}
+			d.SetCondition(api.Degraded, corev1.ConditionTrue, "changed")
+			d.SetCondition(api.Degraded, corev1.ConditionFalse, "reverted")
+			Expect(d.Status.Conditions).Should(HaveLen(1), "conditions")
+			Expect(d.Status.Conditions[0].Status).Should(Equal(corev1.ConditionFalse), "status")
+			Expect(d.Status.Conditions[0].Reason).Should(Equal("reverted"), "reason")
 		})
 
 		It("should have valid json schema", func() {
@@ -166,7 +372,13 @@ spec:
 				"nodeDriverResources":       "object",
 				"provisionerResources":      "object",
 				"nodeRegistrarResources":    "object",
+				"nodeSetupResources":        "object",
 				"kubeletDir":                "string",
+				"hostLayout":                "string",
+				"nodeConfig":                "array",
+				"imageRegistry":             "string",
+				"imageOverrides":            "object",
+				"imagePullSecrets":          "array",
 			}
 
 			for key := range spec.Properties {
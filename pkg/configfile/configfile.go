@@ -0,0 +1,173 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package configfile sets command line flags from a YAML file. The
+// keys in the file are the names of the flags without the leading
+// hyphen. Scalar values are used as they are, maps and lists get
+// passed to the flag in JSON format:
+//
+//	v: 3
+//	maxDeviceOperations: 8
+//	namespaceQuota:
+//	  "*": 100Gi
+//
+// Flags which are set on the command line take precedence over the
+// file.
+package configfile
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// Dynamic lists the flags which get updated while the binary runs
+// when the file changes. Changing any other setting needs a restart.
+var Dynamic = map[string]bool{
+	"v":       true,
+	"vmodule": true,
+}
+
+// File is a configuration file which was loaded.
+type File struct {
+	fs   *flag.FlagSet
+	path string
+	// explicit contains the flags which were set on the command line.
+	explicit map[string]bool
+	// current contains the settings which were applied last.
+	current map[string]string
+}
+
+// Load sets all flags from the file which were not set on the command
+// line. Unknown settings and invalid values are errors.
+func Load(fs *flag.FlagSet, path string) (*File, error) {
+	f := &File{
+		fs:       fs,
+		path:     path,
+		explicit: map[string]bool{},
+	}
+	fs.Visit(func(flag *flag.Flag) {
+		f.explicit[flag.Name] = true
+	})
+	settings, err := read(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range sortedKeys(settings) {
+		if f.explicit[name] {
+			continue
+		}
+		if err := set(fs, name, settings[name]); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	f.current = settings
+	return f, nil
+}
+
+// Watch checks the file for changes until the context is done and
+// then updates the dynamic settings. Errors and changes which need a
+// restart are logged.
+func (f *File) Watch(ctx context.Context, interval time.Duration) {
+	logger := klog.FromContext(ctx).WithName("configfile")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		f.reload(logger)
+	}
+}
+
+func (f *File) reload(logger klog.Logger) {
+	settings, err := read(f.path)
+	if err != nil {
+		logger.Error(err, "Ignoring invalid configuration")
+		return
+	}
+	for _, name := range sortedKeys(settings) {
+		value := settings[name]
+		if old, ok := f.current[name]; ok && old == value || f.explicit[name] {
+			continue
+		}
+		if !Dynamic[name] {
+			logger.Info("Changed setting only takes effect after a restart", "setting", name)
+			continue
+		}
+		if err := set(f.fs, name, value); err != nil {
+			logger.Error(err, "Ignoring invalid setting", "path", f.path)
+			continue
+		}
+		logger.Info("Updated setting", "setting", name, "value", value)
+	}
+	for name := range f.current {
+		if _, ok := settings[name]; !ok && !f.explicit[name] {
+			logger.Info("Removed setting only takes effect after a restart", "setting", name)
+		}
+	}
+	f.current = settings
+}
+
+// read returns the values in the file as strings that can be passed
+// to flag.Value.Set.
+func read(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err = yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	var raw map[string]json.RawMessage
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%s: must contain a map from flag names to values: %v", path, err)
+	}
+	settings := make(map[string]string, len(raw))
+	for name, value := range raw {
+		var str string
+		if err := json.Unmarshal(value, &str); err == nil {
+			settings[name] = str
+		} else {
+			settings[name] = string(value)
+		}
+	}
+	return settings, nil
+}
+
+func set(fs *flag.FlagSet, name, value string) error {
+	if name == "config" {
+		return fmt.Errorf("setting %q is not allowed in the configuration file", name)
+	}
+	if fs.Lookup(name) == nil {
+		return fmt.Errorf("unknown setting %q, must be a command line flag without the leading hyphen", name)
+	}
+	if err := fs.Set(name, value); err != nil {
+		return fmt.Errorf("setting %q: invalid value %q: %v", name, value, err)
+	}
+	return nil
+}
+
+func sortedKeys(settings map[string]string) []string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package configfile
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+)
+
+type jsonMap map[string]string
+
+func (m *jsonMap) String() string {
+	data, _ := json.Marshal(*m)
+	return string(data)
+}
+
+func (m *jsonMap) Set(value string) error {
+	return json.Unmarshal([]byte(value), m)
+}
+
+func newFlagSet() (*flag.FlagSet, *int, *string, *jsonMap) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	v := fs.Int("v", 0, "")
+	name := fs.String("name", "", "")
+	quota := &jsonMap{}
+	fs.Var(quota, "quota", "")
+	fs.String("config", "", "")
+	return fs, v, name, quota
+}
+
+func writeFile(t *testing.T, path, content string) {
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644), "write %s", path)
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	for name, tc := range map[string]struct {
+		content string
+		args    []string
+		err     string
+	}{
+		"valid": {
+			content: "v: 3\nname: foo\nquota:\n  \"*\": 1Gi\n",
+		},
+		"command line": {
+			content: "v: 3\nname: bar\nquota:\n  \"*\": 1Gi\n",
+			args:    []string{"-name=foo"},
+		},
+		"unknown": {
+			content: "no-such-flag: 1\n",
+			err:     `unknown setting "no-such-flag"`,
+		},
+		"invalid": {
+			content: "v: abc\n",
+			err:     `setting "v": invalid value "abc"`,
+		},
+		"config": {
+			content: "config: /tmp/other.yaml\n",
+			err:     `setting "config" is not allowed`,
+		},
+		"no map": {
+			content: "- v\n",
+			err:     "must contain a map",
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			writeFile(t, path, tc.content)
+			fs, v, name, quota := newFlagSet()
+			require.NoError(t, fs.Parse(tc.args), "parse args")
+			_, err := Load(fs, path)
+			if tc.err != "" {
+				require.Error(t, err, "load")
+				assert.Contains(t, err.Error(), tc.err, "error")
+				return
+			}
+			require.NoError(t, err, "load")
+			assert.Equal(t, 3, *v, "v")
+			assert.Equal(t, "foo", *name, "name")
+			assert.Equal(t, jsonMap{"*": "1Gi"}, *quota, "quota")
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	logger, _ := ktesting.NewTestContext(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, path, "v: 3\nname: foo\n")
+	fs, v, name, _ := newFlagSet()
+	f, err := Load(fs, path)
+	require.NoError(t, err, "load")
+
+	writeFile(t, path, "v: 5\nname: bar\n")
+	f.reload(logger)
+	assert.Equal(t, 5, *v, "dynamic setting gets updated")
+	assert.Equal(t, "foo", *name, "other setting needs restart")
+
+	writeFile(t, path, "v: [")
+	f.reload(logger)
+	assert.Equal(t, 5, *v, "invalid file is ignored")
+}
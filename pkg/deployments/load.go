@@ -15,6 +15,8 @@ import (
 
 	"github.com/intel/pmem-csi/deploy"
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/driverfeatures"
+	"github.com/intel/pmem-csi/pkg/k8sutil"
 	"github.com/intel/pmem-csi/pkg/types"
 	"github.com/intel/pmem-csi/pkg/version"
 
@@ -35,9 +37,11 @@ var driverNameRegex = regexp.MustCompile(`(?m)(name|app\.kubernetes.io/instance)
 
 // LoadAndCustomizeObjects reads all objects stored in a pmem-csi.yaml reference file
 // and updates them on-the-fly according to the deployment spec, namespace and name.
+// openShift is the result of the cluster auto-detection, as in the operator.
 func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMode,
-	namespace string, deployment api.PmemCSIDeployment,
+	namespace string, deployment api.PmemCSIDeployment, openShift bool,
 ) ([]unstructured.Unstructured, error) {
+	onOpenShift := deployment.OnOpenShift(openShift)
 
 	// Conceptually this function is similar to calling "kustomize" for
 	// our deployments. But because we controll the input, we can do some
@@ -86,14 +90,27 @@ func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMo
 			[]byte(`-nodeSelector={"storage":"pmem"}`),
 			[]byte("-nodeSelector="+nodeSelector.String()))
 
-		*yaml = pmemImage.ReplaceAll(*yaml, []byte("image: "+deployment.Spec.Image))
+		if deployment.Spec.Image != "" {
+			*yaml = pmemImage.ReplaceAll(*yaml, []byte("image: "+deployment.Spec.Image))
+		}
 	}
 
+	// The YAML files do not have the external-resizer because
+	// the Expansion feature is off by default.
+	expansion := deployment.Spec.DriverFeatureGates[string(driverfeatures.Expansion)]
+
 	enabled := func(obj *unstructured.Unstructured) bool {
+		if obj.GetKind() == "RoleBinding" {
+			switch obj.GetName() {
+			case deployment.NodeOpenShiftRoleBindingName(),
+				deployment.NodeSetupOpenShiftRoleBindingName():
+				return onOpenShift
+			}
+		}
 		return true
 	}
 
-	patchUnstructured := func(obj *unstructured.Unstructured) {
+	patchUnstructured := func(obj *unstructured.Unstructured) error {
 		if deployment.Spec.Labels != nil {
 			labels := obj.GetLabels()
 			if labels == nil {
@@ -110,39 +127,75 @@ func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMo
 			resources := map[string]*corev1.ResourceRequirements{
 				"pmem-driver": deployment.Spec.ControllerDriverResources,
 			}
-			if err := patchPodTemplate(obj, deployment, resources); err != nil {
-				// TODO: avoid panic
-				panic(fmt.Errorf("set controller resources: %v", err))
+			if err := patchPodTemplate(obj, deployment, onOpenShift, resources); err != nil {
+				return fmt.Errorf("set controller resources: %v", err)
+			}
+			outerSpec, err := nestedMap(obj.Object, "spec")
+			if err != nil {
+				return err
 			}
-			outerSpec := obj.Object["spec"].(map[string]interface{})
 			replicas := int64(deployment.Spec.ControllerReplicas)
 			if replicas == 0 {
 				replicas = 1
 			}
 			outerSpec["replicas"] = replicas
+		case "ClusterRole":
+			if obj.GetName() == deployment.WebhooksClusterRoleName() && deployment.Spec.LostNodeGracePeriod != nil {
+				verbs := []interface{}{"patch", "update"}
+				if deployment.Spec.DeleteLostVolumes {
+					verbs = append(verbs, "delete")
+				}
+				rules, _ := obj.Object["rules"].([]interface{})
+				obj.Object["rules"] = append(rules, map[string]interface{}{
+					"apiGroups": []interface{}{""},
+					"resources": []interface{}{"persistentvolumes"},
+					"verbs":     verbs,
+				})
+			}
 		case "DaemonSet":
 			switch obj.GetName() {
 			case deployment.NodeSetupName():
-				if err := patchPodTemplate(obj, deployment, nil); err != nil {
-					// TODO: avoid panic
-					panic(fmt.Errorf("set node resources: %v", err))
+				resources := map[string]*corev1.ResourceRequirements{
+					"pmem-driver": deployment.Spec.NodeSetupResources,
+				}
+				if err := patchPodTemplate(obj, deployment, onOpenShift, resources); err != nil {
+					return fmt.Errorf("set node resources: %v", err)
 				}
 			case deployment.NodeDriverName():
+				spec, err := nestedMap(obj.Object, "spec", "template", "spec")
+				if err != nil {
+					return err
+				}
+				if expansion {
+					containers, _ := spec["containers"].([]interface{})
+					spec["containers"] = append(containers, resizerContainer(deployment))
+				}
 				resources := map[string]*corev1.ResourceRequirements{
 					"pmem-driver":          deployment.Spec.NodeDriverResources,
 					"external-provisioner": deployment.Spec.ProvisionerResources,
 					"driver-registrar":     deployment.Spec.NodeRegistrarResources,
 				}
-				if err := patchPodTemplate(obj, deployment, resources); err != nil {
-					// TODO: avoid panic
-					panic(fmt.Errorf("set node resources: %v", err))
+				if err := patchPodTemplate(obj, deployment, onOpenShift, resources); err != nil {
+					return fmt.Errorf("set node resources: %v", err)
+				}
+				// The operator excludes the pods of node
+				// configurations, the YAML files keep the
+				// original selector for upgrades.
+				selector, err := nestedMap(obj.Object, "spec", "selector")
+				if err != nil {
+					return err
+				}
+				selector["matchExpressions"] = []interface{}{
+					map[string]interface{}{
+						"key":      api.NodeConfigLabel,
+						"operator": "DoesNotExist",
+					},
+				}
+				rollingUpdate, err := nestedMap(obj.Object, "spec", "updateStrategy", "rollingUpdate")
+				if err != nil {
+					return err
 				}
-				outerSpec := obj.Object["spec"].(map[string]interface{})
-				updateStrategy := outerSpec["updateStrategy"].(map[string]interface{})
-				rollingUpdate := updateStrategy["rollingUpdate"].(map[string]interface{})
 				rollingUpdate["maxUnavailable"] = deployment.Spec.MaxUnavailable
-				template := outerSpec["template"].(map[string]interface{})
-				spec := template["spec"].(map[string]interface{})
 				if deployment.Spec.NodeSelector != nil {
 					selector := map[string]interface{}{}
 					for key, value := range deployment.Spec.NodeSelector {
@@ -152,29 +205,137 @@ func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMo
 				}
 			}
 		}
+
+		if len(deployment.Spec.Patches) > 0 {
+			dataStruct, err := scheme.Scheme.New(obj.GroupVersionKind())
+			if err != nil {
+				return fmt.Errorf("patch %s: %v", obj.GetKind(), err)
+			}
+			if err := k8sutil.PatchObject(obj, obj.GetKind(), deployment.Spec.Patches, dataStruct); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
 	objects, err := loadYAML(yamlPath(kubernetes, deviceMode), patchYAML, enabled, patchUnstructured)
 	if err != nil {
 		return nil, err
 	}
+	if expansion {
+		for _, obj := range resizerRBAC(namespace, deployment) {
+			if err := patchUnstructured(&obj); err != nil {
+				return nil, fmt.Errorf("customize %s %s: %v", obj.GetKind(), obj.GetName(), err)
+			}
+			objects = append(objects, obj)
+		}
+	}
 
 	return objects, nil
 }
 
-func patchPodTemplate(obj *unstructured.Unstructured, deployment api.PmemCSIDeployment, resources map[string]*corev1.ResourceRequirements) error {
-	outerSpec := obj.Object["spec"].(map[string]interface{})
-	template := outerSpec["template"].(map[string]interface{})
-	spec := template["spec"].(map[string]interface{})
-	metadata := template["metadata"].(map[string]interface{})
+// resizerContainer returns the external-resizer sidecar of the node
+// DaemonSet, like getResizerContainer in the operator. Image, log
+// flags and resources get set by patchPodTemplate.
+func resizerContainer(deployment api.PmemCSIDeployment) map[string]interface{} {
+	return map[string]interface{}{
+		"name":            "external-resizer",
+		"image":           deployment.Spec.ResizerImage,
+		"imagePullPolicy": string(deployment.Spec.PullPolicy),
+		"args": []interface{}{
+			fmt.Sprintf("-v=%d", deployment.Spec.LogLevel),
+			"--csi-address=/csi/csi.sock",
+			"--leader-election=true",
+			"--handle-volume-inuse-error=false",
+			"--timeout=5m",
+		},
+		"volumeMounts": []interface{}{
+			map[string]interface{}{
+				"name":      "socket-dir",
+				"mountPath": "/csi",
+			},
+		},
+		"securityContext": map[string]interface{}{
+			"readOnlyRootFilesystem": true,
+		},
+	}
+}
+
+// resizerRBAC returns the ClusterRole and ClusterRoleBinding for the
+// external-resizer, like getResizerClusterRole and
+// getResizerClusterRoleBinding in the operator.
+func resizerRBAC(namespace string, deployment api.PmemCSIDeployment) []unstructured.Unstructured {
+	rule := func(resource string, verbs ...interface{}) interface{} {
+		return map[string]interface{}{
+			"apiGroups": []interface{}{""},
+			"resources": []interface{}{resource},
+			"verbs":     verbs,
+		}
+	}
+	return []unstructured.Unstructured{
+		{
+			Object: map[string]interface{}{
+				"apiVersion": "rbac.authorization.k8s.io/v1",
+				"kind":       "ClusterRole",
+				"metadata": map[string]interface{}{
+					"name": deployment.ResizerClusterRoleName(),
+				},
+				"rules": []interface{}{
+					rule("persistentvolumes", "get", "list", "watch", "patch"),
+					rule("persistentvolumeclaims", "get", "list", "watch"),
+					rule("persistentvolumeclaims/status", "patch"),
+					rule("events", "list", "watch", "create", "update", "patch"),
+				},
+			},
+		},
+		{
+			Object: map[string]interface{}{
+				"apiVersion": "rbac.authorization.k8s.io/v1",
+				"kind":       "ClusterRoleBinding",
+				"metadata": map[string]interface{}{
+					"name": deployment.ResizerClusterRoleBindingName(),
+				},
+				"roleRef": map[string]interface{}{
+					"apiGroup": "rbac.authorization.k8s.io",
+					"kind":     "ClusterRole",
+					"name":     deployment.ResizerClusterRoleName(),
+				},
+				"subjects": []interface{}{
+					map[string]interface{}{
+						"kind":      "ServiceAccount",
+						"name":      deployment.ProvisionerServiceAccountName(),
+						"namespace": namespace,
+					},
+				},
+			},
+		},
+	}
+}
+
+// defaultPriorityClassNames are the priority classes used by the
+// reference deployment. Spec.PriorityClassName only replaces those.
+var defaultPriorityClassNames = map[string]bool{
+	"system-cluster-critical": true,
+	"system-node-critical":    true,
+}
+
+func patchPodTemplate(obj *unstructured.Unstructured, deployment api.PmemCSIDeployment, onOpenShift bool, resources map[string]*corev1.ResourceRequirements) error {
+	spec, err := nestedMap(obj.Object, "spec", "template", "spec")
+	if err != nil {
+		return err
+	}
+	metadata, err := nestedMap(obj.Object, "spec", "template", "metadata")
+	if err != nil {
+		return err
+	}
 
 	if deployment.Spec.Labels != nil {
-		labels := metadata["labels"]
-		var labelsMap map[string]interface{}
-		if labels == nil {
+		labelsMap, ok := metadata["labels"].(map[string]interface{})
+		if !ok && metadata["labels"] != nil {
+			return fmt.Errorf("pod labels: expected map, got %T", metadata["labels"])
+		}
+		if labelsMap == nil {
 			labelsMap = map[string]interface{}{}
-		} else {
-			labelsMap = labels.(map[string]interface{})
 		}
 		for key, value := range deployment.Spec.Labels {
 			labelsMap[key] = value
@@ -182,6 +343,75 @@ func patchPodTemplate(obj *unstructured.Unstructured, deployment api.PmemCSIDepl
 		metadata["labels"] = labelsMap
 	}
 
+	if len(deployment.Spec.Annotations) > 0 {
+		annotations, _ := metadata["annotations"].(map[string]interface{})
+		if annotations == nil {
+			annotations = map[string]interface{}{}
+			metadata["annotations"] = annotations
+		}
+		for key, value := range deployment.Spec.Annotations {
+			if _, ok := annotations[key]; !ok {
+				annotations[key] = value
+			}
+		}
+	}
+	if deployment.Spec.PriorityClassName != "" {
+		current, _ := spec["priorityClassName"].(string)
+		if current == "" || defaultPriorityClassNames[current] {
+			spec["priorityClassName"] = deployment.Spec.PriorityClassName
+		}
+	}
+
+	if len(deployment.Spec.ImagePullSecrets) > 0 {
+		secrets := []interface{}{}
+		for _, secret := range deployment.Spec.ImagePullSecrets {
+			secrets = append(secrets, map[string]interface{}{"name": secret.Name})
+		}
+		spec["imagePullSecrets"] = secrets
+	}
+	containers, ok := spec["containers"].([]interface{})
+	if !ok {
+		return fmt.Errorf("containers: expected list, got %T", spec["containers"])
+	}
+	for i, container := range containers {
+		container, ok := container.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("container #%d: expected map, got %T", i, containers[i])
+		}
+		containerName, ok := container["name"].(string)
+		if !ok {
+			return fmt.Errorf("container #%d: expected name string, got %T", i, container["name"])
+		}
+		image, ok := container["image"].(string)
+		if !ok {
+			return fmt.Errorf("container %s: expected image string, got %T", containerName, container["image"])
+		}
+		container["image"] = deployment.ImageReference(image)
+		if deployment.Spec.AppArmorProfile != "" && !onOpenShift {
+			annotations, _ := metadata["annotations"].(map[string]interface{})
+			if annotations == nil {
+				annotations = map[string]interface{}{}
+				metadata["annotations"] = annotations
+			}
+			annotations["container.apparmor.security.beta.kubernetes.io/"+containerName] = deployment.Spec.AppArmorProfile
+		}
+		if tl := deployment.Spec.TerminationLog; tl != nil {
+			patchTerminationLog(container, tl)
+		}
+	}
+	if profile := deployment.Spec.SeccompProfile; profile != nil {
+		securityContext, _ := spec["securityContext"].(map[string]interface{})
+		if securityContext == nil {
+			securityContext = map[string]interface{}{}
+			spec["securityContext"] = securityContext
+		}
+		seccomp := map[string]interface{}{"type": string(profile.Type)}
+		if profile.LocalhostProfile != nil {
+			seccomp["localhostProfile"] = *profile.LocalhostProfile
+		}
+		securityContext["seccompProfile"] = seccomp
+	}
+
 	if resources == nil {
 		return nil
 	}
@@ -199,8 +429,8 @@ func patchPodTemplate(obj *unstructured.Unstructured, deployment api.PmemCSIDepl
 		return obj, nil
 	}
 
-	containers := spec["containers"].([]interface{})
 	for _, container := range containers {
+		// Types were checked above.
 		container := container.(map[string]interface{})
 		containerName := container["name"].(string)
 		obj, err := resourceObj(resources[containerName])
@@ -210,15 +440,12 @@ func patchPodTemplate(obj *unstructured.Unstructured, deployment api.PmemCSIDepl
 		container["resources"] = obj
 
 		// Override driver name in env var.
-		env := container["env"]
-		if env != nil {
-			env := env.([]interface{})
-			for _, entry := range env {
-				entry := entry.(map[string]interface{})
-				if entry["name"].(string) == "PMEM_CSI_DRIVER_NAME" {
-					entry["value"] = deployment.GetName()
-					break
-				}
+		env, _ := container["env"].([]interface{})
+		for _, entry := range env {
+			entry, _ := entry.(map[string]interface{})
+			if name, _ := entry["name"].(string); name == "PMEM_CSI_DRIVER_NAME" {
+				entry["value"] = deployment.GetName()
+				break
 			}
 		}
 
@@ -226,25 +453,144 @@ func patchPodTemplate(obj *unstructured.Unstructured, deployment api.PmemCSIDepl
 		switch containerName {
 		case "external-provisioner":
 			image = deployment.Spec.ProvisionerImage
+			if err := patchSidecarLogArgs(container, deployment); err != nil {
+				return fmt.Errorf("container %s: %v", containerName, err)
+			}
 		case "driver-registrar":
 			image = deployment.Spec.NodeRegistrarImage
+			if err := patchSidecarLogArgs(container, deployment); err != nil {
+				return fmt.Errorf("container %s: %v", containerName, err)
+			}
+		case "external-resizer":
+			image = deployment.Spec.ResizerImage
+			if err := patchSidecarLogArgs(container, deployment); err != nil {
+				return fmt.Errorf("container %s: %v", containerName, err)
+			}
 		case "pmem-driver":
-			cmd := container["command"].([]interface{})
+			cmd, ok := container["command"].([]interface{})
+			if !ok {
+				return fmt.Errorf("container %s: expected command list, got %T", containerName, container["command"])
+			}
+			isNode := false
 			for i := range cmd {
-				arg := cmd[i].(string)
+				arg, _ := cmd[i].(string)
 				if strings.HasPrefix(arg, "-pmemPercentage=") {
 					cmd[i] = fmt.Sprintf("-pmemPercentage=%d", deployment.Spec.PMEMPercentage)
+					isNode = true
+					break
+				}
+			}
+			if isNode && deployment.Spec.PMEMPercentageNodeLabel != "" {
+				cmd = append(cmd, "-pmemPercentageLabel="+deployment.Spec.PMEMPercentageNodeLabel)
+				container["command"] = cmd
+			}
+			if isNode && deployment.Spec.DryRun {
+				cmd = append(cmd, "-dryRun")
+				container["command"] = cmd
+			}
+			if isNode && deployment.Spec.EphemeralQuotaPerPod != nil {
+				cmd = append(cmd, "-ephemeralQuotaPerPod="+deployment.Spec.EphemeralQuotaPerPod.String())
+				container["command"] = cmd
+			}
+			if isNode && deployment.Spec.EphemeralQuotaPerNode != nil {
+				cmd = append(cmd, "-ephemeralQuotaPerNode="+deployment.Spec.EphemeralQuotaPerNode.String())
+				container["command"] = cmd
+			}
+			if isNode && len(deployment.Spec.DriverFeatureGates) > 0 {
+				cmd = append(cmd, "-feature-gates="+driverfeatures.Format(deployment.Spec.DriverFeatureGates))
+				container["command"] = cmd
+			}
+			isController := false
+			for _, arg := range cmd {
+				if arg == "-mode=webhooks" {
+					isController = true
 					break
 				}
 			}
+			if isController && deployment.Spec.LostNodeGracePeriod != nil {
+				cmd = append(cmd, "-lostNodeGracePeriod="+deployment.Spec.LostNodeGracePeriod.Duration.String())
+				container["command"] = cmd
+			}
+			if isController && deployment.Spec.DeleteLostVolumes {
+				cmd = append(cmd, "-deleteLostVolumes")
+				container["command"] = cmd
+			}
 		}
 		if image != "" {
-			container["image"] = image
+			container["image"] = deployment.ImageReference(image)
 		}
 	}
 	return nil
 }
 
+// nestedMap returns the map at the given path without copying it.
+func nestedMap(obj map[string]interface{}, fields ...string) (map[string]interface{}, error) {
+	path := strings.Join(fields, ".")
+	value, found, err := unstructured.NestedFieldNoCopy(obj, fields...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: not found", path)
+	}
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: expected map, got %T", path, value)
+	}
+	return m, nil
+}
+
+// patchSidecarLogArgs replaces the leading -v argument of a sidecar
+// with the settings from SidecarLogging. The other arguments are
+// kept.
+func patchSidecarLogArgs(container map[string]interface{}, deployment api.PmemCSIDeployment) error {
+	sl := deployment.Spec.SidecarLogging
+	if sl == nil {
+		return nil
+	}
+	args, ok := container["args"].([]interface{})
+	if !ok && container["args"] != nil {
+		return fmt.Errorf("expected args list, got %T", container["args"])
+	}
+	if len(args) > 0 {
+		if arg, _ := args[0].(string); strings.HasPrefix(arg, "-v=") {
+			args = args[1:]
+		}
+	}
+	logLevel := deployment.Spec.LogLevel
+	if sl.LogLevel != nil {
+		logLevel = *sl.LogLevel
+	}
+	logArgs := []interface{}{fmt.Sprintf("-v=%d", logLevel)}
+	if sl.LogToStderr != nil {
+		logArgs = append(logArgs, fmt.Sprintf("--logtostderr=%t", *sl.LogToStderr))
+	}
+	if sl.StderrThreshold != "" {
+		logArgs = append(logArgs, "--stderrthreshold="+sl.StderrThreshold)
+	}
+	container["args"] = append(logArgs, args...)
+	return nil
+}
+
+// patchTerminationLog does the same as setTerminationLog in the
+// operator.
+func patchTerminationLog(container map[string]interface{}, tl *api.TerminationLog) {
+	if tl.Policy != "" {
+		container["terminationMessagePolicy"] = string(tl.Policy)
+	}
+	if tl.Path == "" {
+		return
+	}
+	env, _ := container["env"].([]interface{})
+	for _, entry := range env {
+		entry, _ := entry.(map[string]interface{})
+		if name, _ := entry["name"].(string); name == "TERMINATION_LOG_PATH" {
+			entry["value"] = tl.Path
+			container["terminationMessagePath"] = tl.Path
+		}
+	}
+}
+
 func yamlPath(kubernetes version.Version, deviceMode api.DeviceMode) string {
 	return fmt.Sprintf("kubernetes-%s/pmem-csi-%s.yaml", kubernetes, deviceMode)
 }
@@ -252,7 +598,7 @@ func yamlPath(kubernetes version.Version, deviceMode api.DeviceMode) string {
 func loadYAML(path string,
 	patchYAML func(yaml *[]byte),
 	enabled func(obj *unstructured.Unstructured) bool,
-	patchUnstructured func(obj *unstructured.Unstructured)) ([]unstructured.Unstructured, error) {
+	patchUnstructured func(obj *unstructured.Unstructured) error) ([]unstructured.Unstructured, error) {
 	// We load the builtin yaml files. If they exist, we prefer
 	// the version without the patched in coverage support.
 	yaml, err := deploy.Asset("nocoverage/" + path)
@@ -286,7 +632,9 @@ func loadYAML(path string,
 			continue
 		}
 		if patchUnstructured != nil {
-			patchUnstructured(&obj)
+			if err := patchUnstructured(&obj); err != nil {
+				return nil, fmt.Errorf("customize %s %s from file %q: %v", obj.GetKind(), obj.GetName(), path, err)
+			}
 		}
 		objects = append(objects, obj)
 	}
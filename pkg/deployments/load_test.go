@@ -11,7 +11,9 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 
 	"github.com/intel/pmem-csi/deploy"
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
@@ -51,7 +53,7 @@ func TestLoadObjects(t *testing.T) {
 					Name: "pmem-csi.example.org",
 				},
 			}
-			objects, err = deployments.LoadAndCustomizeObjects(testCase.Kubernetes, testCase.DeviceMode, namespace, deployment)
+			objects, err = deployments.LoadAndCustomizeObjects(testCase.Kubernetes, testCase.DeviceMode, namespace, deployment, false)
 			if assert.NoError(t, err, "load and customize yaml") {
 				assert.NotEmpty(t, objects, "have customized objects")
 
@@ -72,3 +74,152 @@ func TestLoadObjects(t *testing.T) {
 		})
 	}
 }
+
+func TestCustomizeObjects(t *testing.T) {
+	yamls := deploy.ListAll()
+	require.NotEmpty(t, yamls, "should have builtin yaml deployments")
+	testCase := yamls[0]
+	logLevel := uint16(5)
+	deployment := api.PmemCSIDeployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "pmem-csi.example.org",
+		},
+		Spec: api.DeploymentSpec{
+			LogLevel:          3,
+			PriorityClassName: "pmem-csi-critical",
+			SidecarLogging:    &api.SidecarLogging{LogLevel: &logLevel},
+		},
+	}
+	deployment.Spec.Patches = []api.ObjectPatch{{
+		Kind:  "DaemonSet",
+		Name:  deployment.NodeDriverName(),
+		Patch: `{"spec": {"template": {"spec": {"priorityClassName": "user-critical"}}}}`,
+	}}
+
+	objects, err := deployments.LoadAndCustomizeObjects(testCase.Kubernetes, testCase.DeviceMode, "default", deployment, false)
+	require.NoError(t, err, "load and customize yaml")
+	found := 0
+	for _, obj := range objects {
+		if obj.GetKind() != "DaemonSet" && obj.GetKind() != "Deployment" {
+			continue
+		}
+		priorityClassName, _, err := unstructured.NestedString(obj.Object, "spec", "template", "spec", "priorityClassName")
+		require.NoError(t, err, "priority class of %s", obj.GetName())
+		containers, _, err := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+		require.NoError(t, err, "containers of %s", obj.GetName())
+		for _, container := range containers {
+			container := container.(map[string]interface{})
+			image, _ := container["image"].(string)
+			assert.NotEmpty(t, image, "image of container %s in %s", container["name"], obj.GetName())
+		}
+		if obj.GetName() == deployment.NodeDriverName() {
+			found++
+			assert.Equal(t, "user-critical", priorityClassName, "patched priority class of %s", obj.GetName())
+			containers, _, err := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+			require.NoError(t, err, "containers")
+			for _, container := range containers {
+				container := container.(map[string]interface{})
+				if container["name"] == "driver-registrar" {
+					args := container["args"].([]interface{})
+					assert.Equal(t, "-v=5", args[0], "sidecar log level")
+					assert.NotContains(t, args[1:], "-v=3", "old log level removed")
+				}
+			}
+		} else {
+			assert.Equal(t, "pmem-csi-critical", priorityClassName, "priority class of %s", obj.GetName())
+		}
+	}
+	assert.Equal(t, 1, found, "node DaemonSet")
+
+	deployment.Spec.Patches[0].Patch = "[not valid"
+	_, err = deployments.LoadAndCustomizeObjects(testCase.Kubernetes, testCase.DeviceMode, "default", deployment, false)
+	assert.Error(t, err, "invalid patch")
+}
+
+func TestOpenShiftObjects(t *testing.T) {
+	yamls := deploy.ListAll()
+	require.NotEmpty(t, yamls, "should have builtin yaml deployments")
+	testCase := yamls[0]
+
+	for name, tc := range map[string]struct {
+		platform  api.Platform
+		openShift bool
+		expected  bool
+	}{
+		"kubernetes":          {},
+		"detected":            {openShift: true, expected: true},
+		"explicit":            {platform: api.PlatformOpenShift, expected: true},
+		"explicit-kubernetes": {platform: api.PlatformKubernetes, openShift: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			deployment := api.PmemCSIDeployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "pmem-csi.example.org",
+				},
+				Spec: api.DeploymentSpec{
+					Platform:        tc.platform,
+					AppArmorProfile: "runtime/default",
+				},
+			}
+			objects, err := deployments.LoadAndCustomizeObjects(testCase.Kubernetes, testCase.DeviceMode, "default", deployment, tc.openShift)
+			require.NoError(t, err, "load and customize yaml")
+			roleBindings := map[string]bool{}
+			for _, obj := range objects {
+				if obj.GetKind() == "RoleBinding" {
+					roleBindings[obj.GetName()] = true
+				}
+				if obj.GetName() == deployment.NodeDriverName() {
+					annotations, _, err := unstructured.NestedStringMap(obj.Object, "spec", "template", "metadata", "annotations")
+					require.NoError(t, err, "annotations")
+					assert.Equal(t, !tc.expected, annotations["container.apparmor.security.beta.kubernetes.io/pmem-driver"] != "", "AppArmor annotation")
+				}
+			}
+			assert.Equal(t, tc.expected, roleBindings[deployment.NodeOpenShiftRoleBindingName()], "node OpenShift role binding")
+			assert.Equal(t, tc.expected, roleBindings[deployment.NodeSetupOpenShiftRoleBindingName()], "node setup OpenShift role binding")
+		})
+	}
+}
+
+func TestExpansionObjects(t *testing.T) {
+	yamls := deploy.ListAll()
+	require.NotEmpty(t, yamls, "should have builtin yaml deployments")
+	testCase := yamls[0]
+
+	for _, expansion := range []bool{false, true} {
+		t.Run(fmt.Sprintf("%v", expansion), func(t *testing.T) {
+			deployment := api.PmemCSIDeployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "pmem-csi.example.org",
+				},
+				Spec: api.DeploymentSpec{
+					ResizerImage:       "example.com/csi-resizer:v1.0.0",
+					DriverFeatureGates: map[string]bool{"Expansion": expansion},
+				},
+			}
+			objects, err := deployments.LoadAndCustomizeObjects(testCase.Kubernetes, testCase.DeviceMode, "default", deployment, false)
+			require.NoError(t, err, "load and customize yaml")
+			names := map[string]bool{}
+			var resizerImage string
+			for _, obj := range objects {
+				names[obj.GetKind()+"/"+obj.GetName()] = true
+				if obj.GetKind() == "DaemonSet" && obj.GetName() == deployment.NodeDriverName() {
+					containers, _, err := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+					require.NoError(t, err, "containers")
+					for _, container := range containers {
+						container := container.(map[string]interface{})
+						if container["name"] == "external-resizer" {
+							resizerImage, _ = container["image"].(string)
+						}
+					}
+				}
+			}
+			assert.Equal(t, expansion, names["ClusterRole/"+deployment.ResizerClusterRoleName()], "resizer ClusterRole")
+			assert.Equal(t, expansion, names["ClusterRoleBinding/"+deployment.ResizerClusterRoleBindingName()], "resizer ClusterRoleBinding")
+			if expansion {
+				assert.Equal(t, "example.com/csi-resizer:v1.0.0", resizerImage, "resizer container")
+			} else {
+				assert.Empty(t, resizerImage, "no resizer container")
+			}
+		})
+	}
+}
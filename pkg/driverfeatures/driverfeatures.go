@@ -0,0 +1,99 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package driverfeatures defines the feature gates of the PMEM-CSI
+// driver. Experimental features start out disabled and must be
+// enabled explicitly with the -feature-gates parameter of the driver
+// or the driverFeatureGates field of a PmemCSIDeployment. The
+// package is shared by the driver, the operator and the API.
+package driverfeatures
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/component-base/featuregate"
+)
+
+const (
+	// Expansion enables resizing of volumes. Needs LVM mode.
+	Expansion featuregate.Feature = "Expansion"
+)
+
+// DefaultFeatureGates lists all driver features and their defaults.
+var DefaultFeatureGates = map[featuregate.Feature]featuregate.FeatureSpec{
+	Expansion: {Default: false, PreRelease: featuregate.Alpha},
+}
+
+// deviceModes lists the device modes in which a feature works, for
+// those features which do not work in all of them. The fake device
+// mode for testing supports all features. The modes are strings
+// because the API package, which defines the DeviceMode type, uses
+// this package.
+var deviceModes = map[featuregate.Feature][]string{
+	Expansion: {"lvm", "fake"},
+}
+
+// NewFeatureGate returns a feature gate which knows about all
+// driver features.
+func NewFeatureGate() featuregate.MutableFeatureGate {
+	featureGate := featuregate.NewFeatureGate()
+	utilruntime.Must(featureGate.Add(DefaultFeatureGates))
+	return featureGate
+}
+
+// Validate checks that all features are known and, if the device mode
+// is not empty, can be used in that mode.
+func Validate(gates map[string]bool, deviceMode string) error {
+	gate := NewFeatureGate()
+	if err := gate.SetFromMap(gates); err != nil {
+		return err
+	}
+	if deviceMode == "" {
+		return nil
+	}
+	return CheckDeviceMode(gate, deviceMode)
+}
+
+// CheckDeviceMode rejects enabled features which cannot work in the
+// device mode.
+func CheckDeviceMode(gate featuregate.FeatureGate, deviceMode string) error {
+	var features []featuregate.Feature
+	for feature := range deviceModes {
+		features = append(features, feature)
+	}
+	// Deterministic error message when more than one is wrong.
+	sort.Slice(features, func(i, j int) bool { return features[i] < features[j] })
+	for _, feature := range features {
+		if !gate.Enabled(feature) || supports(deviceModes[feature], deviceMode) {
+			continue
+		}
+		return fmt.Errorf("feature %s needs device mode %q, not %q", feature, deviceModes[feature][0], deviceMode)
+	}
+	return nil
+}
+
+func supports(modes []string, deviceMode string) bool {
+	for _, mode := range modes {
+		if mode == deviceMode {
+			return true
+		}
+	}
+	return false
+}
+
+// Format turns the map into the value for the -feature-gates
+// parameter. The features are sorted by name.
+func Format(gates map[string]bool) string {
+	var values []string
+	for name, enabled := range gates {
+		values = append(values, fmt.Sprintf("%s=%t", name, enabled))
+	}
+	sort.Strings(values)
+	return strings.Join(values, ",")
+}
@@ -0,0 +1,40 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package driverfeatures
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeatures(t *testing.T) {
+	gate := NewFeatureGate()
+	for feature := range DefaultFeatureGates {
+		assert.False(t, gate.Enabled(feature), "%s disabled by default", feature)
+	}
+
+	gates := map[string]bool{"Expansion": true}
+	require.NoError(t, Validate(gates, ""), "known features")
+	assert.Error(t, Validate(map[string]bool{"NoSuchFeature": true}, ""), "unknown feature")
+
+	value := Format(map[string]bool{"Expansion": true, "Other": false})
+	assert.Equal(t, "Expansion=true,Other=false", value, "formatted")
+	require.NoError(t, gate.Set(Format(gates)), "parse formatted value")
+	assert.True(t, gate.Enabled(Expansion), "Expansion enabled")
+}
+
+func TestDeviceMode(t *testing.T) {
+	require.NoError(t, Validate(nil, "direct"), "defaults")
+	require.NoError(t, Validate(map[string]bool{"Expansion": false}, "direct"), "disabled expansion in direct mode")
+	require.NoError(t, Validate(map[string]bool{"Expansion": true}, "lvm"), "expansion in LVM mode")
+	require.NoError(t, Validate(map[string]bool{"Expansion": true}, "fake"), "expansion in fake mode")
+	err := Validate(map[string]bool{"Expansion": true}, "direct")
+	require.Error(t, err, "expansion in direct mode")
+	assert.Contains(t, err.Error(), "Expansion", "error message")
+}
@@ -10,7 +10,9 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/kubernetes-csi/csi-lib-utils/metrics"
 	"google.golang.org/grpc"
@@ -29,6 +31,7 @@ type Service interface {
 type NonBlockingGRPCServer struct {
 	wg      sync.WaitGroup
 	servers []*grpc.Server
+	sockets []string // Unix domain sockets which get removed by Wait
 }
 
 func NewNonBlockingGRPCServer() *NonBlockingGRPCServer {
@@ -41,12 +44,15 @@ func (s *NonBlockingGRPCServer) Start(ctx context.Context, endpoint, errorPrefix
 	}
 	rpcServer, l, err := pmemgrpc.NewServer(endpoint, errorPrefix, tlsConfig, csiMetricsManager)
 	if err != nil {
-		return nil
+		return err
 	}
 	for _, service := range services {
 		service.RegisterService(rpcServer)
 	}
 	s.servers = append(s.servers, rpcServer)
+	if proto, addr, _ := pmemgrpc.ParseEndpoint(endpoint); proto == "unix" {
+		s.sockets = append(s.sockets, addr)
+	}
 
 	logger := klog.FromContext(ctx).WithName("GRPC-server").WithValues("endpoint", endpoint)
 	s.wg.Add(1)
@@ -62,8 +68,18 @@ func (s *NonBlockingGRPCServer) Start(ctx context.Context, endpoint, errorPrefix
 	return nil
 }
 
+// Wait blocks until all servers have stopped and then removes their
+// Unix domain sockets. Normally the listener already does that when
+// it gets closed, but a socket that is left behind would make
+// kubelet and the sidecars believe that the driver is still running.
 func (s *NonBlockingGRPCServer) Wait() {
 	s.wg.Wait()
+	for _, socket := range s.sockets {
+		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+			klog.Background().Error(err, "Removing socket failed", "socket", socket)
+		}
+	}
+	s.sockets = nil
 }
 
 func (s *NonBlockingGRPCServer) Stop() {
@@ -72,6 +88,29 @@ func (s *NonBlockingGRPCServer) Stop() {
 	}
 }
 
+// Shutdown stops accepting new calls and waits for pending calls to
+// complete, like Stop. Calls that are still running after the
+// timeout get aborted with ForceStop. The result is false in that
+// case.
+func (s *NonBlockingGRPCServer) Shutdown(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Stop()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		s.ForceStop()
+		<-done
+		return false
+	}
+}
+
 func (s *NonBlockingGRPCServer) ForceStop() {
 	for _, s := range s.servers {
 		s.Stop()
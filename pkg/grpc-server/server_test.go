@@ -0,0 +1,94 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"k8s.io/klog/v2/ktesting"
+
+	pmemgrpc "github.com/intel/pmem-csi/pkg/pmem-grpc"
+)
+
+// blockingIdentity blocks in Probe until the call gets aborted or
+// released.
+type blockingIdentity struct {
+	csi.UnimplementedIdentityServer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingIdentity) RegisterService(s *grpc.Server) {
+	csi.RegisterIdentityServer(s, b)
+}
+
+func (b *blockingIdentity) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	close(b.started)
+	select {
+	case <-b.release:
+		return &csi.ProbeResponse{}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	for name, tc := range map[string]struct {
+		release  bool
+		graceful bool
+	}{
+		"pending-call-completes": {release: true, graceful: true},
+		"pending-call-aborted":   {release: false, graceful: false},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+			socket := filepath.Join(t.TempDir(), "csi.sock")
+			endpoint := "unix://" + socket
+			identity := &blockingIdentity{started: make(chan struct{}), release: make(chan struct{})}
+			s := NewNonBlockingGRPCServer()
+			require.NoError(t, s.Start(ctx, endpoint, "", nil, nil, identity), "start server")
+			defer func() {
+				s.ForceStop()
+				s.Wait()
+			}()
+
+			conn, err := pmemgrpc.Connect(endpoint, nil)
+			require.NoError(t, err, "connect")
+			defer conn.Close()
+			result := make(chan error, 1)
+			go func() {
+				_, err := csi.NewIdentityClient(conn).Probe(ctx, &csi.ProbeRequest{})
+				result <- err
+			}()
+			<-identity.started
+
+			if tc.release {
+				// Let the call complete while the server is
+				// already shutting down.
+				time.AfterFunc(100*time.Millisecond, func() { close(identity.release) })
+			}
+			assert.Equal(t, tc.graceful, s.Shutdown(time.Second), "graceful shutdown")
+			s.Wait()
+			if tc.release {
+				assert.NoError(t, <-result, "pending call")
+			} else {
+				assert.Error(t, <-result, "pending call")
+			}
+			_, err = os.Stat(socket)
+			assert.True(t, os.IsNotExist(err), "socket removed: %v", err)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package hostpaths describes where the directories that PMEM-CSI
+// needs are located on the host. Most Linux distributions (Ubuntu,
+// Debian, RHEL, Fedora CoreOS, Flatcar Container Linux) use the same
+// layout, but some Kubernetes distributions put the kubelet
+// directory elsewhere. All other directories (/dev, /sys, /var/lib)
+// are the same everywhere.
+package hostpaths
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Layout identifies a certain host layout.
+type Layout string
+
+const (
+	// Standard is the layout used by kubeadm and most
+	// distributions.
+	Standard Layout = "standard"
+	// MicroK8s is for Canonical's MicroK8s, which runs kubelet
+	// from a snap.
+	MicroK8s Layout = "microk8s"
+	// K0s is for Mirantis k0s.
+	K0s Layout = "k0s"
+)
+
+// Paths contains the host directories.
+type Paths struct {
+	// KubeletDir is the root directory of kubelet.
+	KubeletDir string
+}
+
+var layouts = map[Layout]Paths{
+	Standard: {
+		KubeletDir: "/var/lib/kubelet",
+	},
+	MicroK8s: {
+		KubeletDir: "/var/snap/microk8s/common/var/lib/kubelet",
+	},
+	K0s: {
+		KubeletDir: "/var/lib/k0s/kubelet",
+	},
+}
+
+// Get returns the paths for a layout. The empty layout is the same
+// as Standard.
+func Get(layout Layout) (Paths, error) {
+	if layout == "" {
+		layout = Standard
+	}
+	paths, ok := layouts[layout]
+	if !ok {
+		return Paths{}, fmt.Errorf("unknown host layout %q, must be one of %s", layout, strings.Join(Names(), ", "))
+	}
+	return paths, nil
+}
+
+// Names returns all known layouts, sorted alphabetically.
+func Names() []string {
+	var names []string
+	for layout := range layouts {
+		names = append(names, string(layout))
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,27 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package hostpaths
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGet(t *testing.T) {
+	paths, err := Get("")
+	require.NoError(t, err, "default layout")
+	assert.Equal(t, "/var/lib/kubelet", paths.KubeletDir, "kubelet dir")
+
+	paths, err = Get(MicroK8s)
+	require.NoError(t, err, "MicroK8s")
+	assert.Equal(t, "/var/snap/microk8s/common/var/lib/kubelet", paths.KubeletDir, "kubelet dir")
+
+	_, err = Get("no-such-layout")
+	assert.Error(t, err, "unknown layout")
+}
@@ -72,14 +72,17 @@ func GetKubernetesVersion(cfg *rest.Config) (*version.Version, error) {
 	return &v, nil
 }
 
+// OpenShiftCRDName is the CRD of the OpenShift scheduler operator.
+// For our purposes we run on OpenShift if it is installed.
+const OpenShiftCRDName = "schedulers.config.openshift.io"
+
 // IsOpenShift determines whether the cluster is based on OpenShift.
 func IsOpenShift(cfg *rest.Config) (bool, error) {
 	client, err := apiclient.NewForConfig(cfg)
 	if err != nil {
 		return false, err
 	}
-	// For our purposed we run on OpenShift if the scheduler operator is installed.
-	if _, err := client.ApiextensionsV1().CustomResourceDefinitions().Get(context.Background(), "schedulers.config.openshift.io", metav1.GetOptions{}); err != nil {
+	if _, err := client.ApiextensionsV1().CustomResourceDefinitions().Get(context.Background(), OpenShiftCRDName, metav1.GetOptions{}); err != nil {
 		if apierrors.IsNotFound(err) {
 			return false, nil
 		}
@@ -0,0 +1,87 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package k8sutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"sigs.k8s.io/yaml"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+)
+
+// ApplyPatch applies the patch to the JSON encoding of an object.
+// dataStruct must be a typed instance of the object, it provides
+// the merge keys for strategic merge patches. The patch may be
+// written in YAML.
+func ApplyPatch(original []byte, p api.ObjectPatch, dataStruct interface{}) ([]byte, error) {
+	patch, err := yaml.YAMLToJSON([]byte(p.Patch))
+	if err != nil {
+		return nil, fmt.Errorf("parse patch: %v", err)
+	}
+	switch p.Type {
+	case "", api.PatchTypeStrategic:
+		patched, err := strategicpatch.StrategicMergePatch(original, patch, dataStruct)
+		if err != nil {
+			return nil, fmt.Errorf("apply strategic merge patch: %v", err)
+		}
+		return patched, nil
+	case api.PatchTypeJSON:
+		decoded, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return nil, fmt.Errorf("decode JSON patch: %v", err)
+		}
+		patched, err := decoded.Apply(original)
+		if err != nil {
+			return nil, fmt.Errorf("apply JSON patch: %v", err)
+		}
+		return patched, nil
+	default:
+		return nil, fmt.Errorf("unsupported patch type %q", p.Type)
+	}
+}
+
+// PatchObject applies all matching patches to the object. The
+// object is replaced with the result. Patches must not change the
+// name or namespace.
+func PatchObject(obj metav1.Object, kind string, patches []api.ObjectPatch, dataStruct interface{}) error {
+	name, namespace := obj.GetName(), obj.GetNamespace()
+	for i, p := range patches {
+		if !p.Matches(kind, name) {
+			continue
+		}
+		original, err := json.Marshal(obj)
+		if err != nil {
+			return fmt.Errorf("encode %s %s: %v", kind, name, err)
+		}
+		patched, err := ApplyPatch(original, p, dataStruct)
+		if err != nil {
+			return fmt.Errorf("patch #%d for %s %s: %v", i, kind, name, err)
+		}
+		if err := unmarshalInto(patched, obj); err != nil {
+			return fmt.Errorf("patch #%d for %s %s: decode result: %v", i, kind, name, err)
+		}
+		if obj.GetName() != name || obj.GetNamespace() != namespace {
+			return fmt.Errorf("patch #%d for %s %s: changing name or namespace is not allowed", i, kind, name)
+		}
+	}
+	return nil
+}
+
+// unmarshalInto replaces the content of obj, which must be a
+// pointer, instead of merging into it like json.Unmarshal does.
+// Otherwise fields removed by a patch would survive.
+func unmarshalInto(data []byte, obj interface{}) error {
+	v := reflect.ValueOf(obj).Elem()
+	v.Set(reflect.Zero(v.Type()))
+	return json.Unmarshal(data, obj)
+}
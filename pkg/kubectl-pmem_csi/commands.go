@@ -0,0 +1,245 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package kubectlpmemcsi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/prometheus/common/expfmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+// driverPod is a running node driver.
+type driverPod struct {
+	pod    *corev1.Pod
+	driver string
+	// port is the metrics port of the driver container, empty if
+	// the driver was deployed without metrics support.
+	port string
+}
+
+func (d driverPod) node() string {
+	return d.pod.Spec.NodeName
+}
+
+// driverPods finds the node driver pods, sorted by node and driver
+// name. Both the operator and the YAML files label them the same way.
+func driverPods(ctx context.Context, client kubernetes.Interface) ([]driverPod, error) {
+	selector := "app.kubernetes.io/name=pmem-csi-node"
+	if *driverName != "" {
+		selector += ",app.kubernetes.io/instance=" + *driverName
+	}
+	opts := metav1.ListOptions{LabelSelector: selector}
+	if *nodeName != "" {
+		opts.FieldSelector = "spec.nodeName=" + *nodeName
+	}
+	pods, err := client.CoreV1().Pods(*namespace).List(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("list node driver pods: %v", err)
+	}
+	result := make([]driverPod, 0, len(pods.Items))
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		d := driverPod{
+			pod:    pod,
+			driver: pod.Labels["app.kubernetes.io/instance"],
+		}
+		for _, c := range pod.Spec.Containers {
+			if c.Name != "pmem-driver" {
+				continue
+			}
+			for _, port := range c.Ports {
+				if port.Name == "metrics" {
+					d.port = fmt.Sprintf("%d", port.ContainerPort)
+				}
+			}
+		}
+		result = append(result, d)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].node() != result[j].node() {
+			return result[i].node() < result[j].node()
+		}
+		return result[i].driver < result[j].driver
+	})
+	return result, nil
+}
+
+// proxyGet retrieves a path from the metrics endpoint of the driver.
+// A variable so that tests can replace it.
+var proxyGet = func(ctx context.Context, client kubernetes.Interface, d driverPod, path string) ([]byte, error) {
+	if d.port == "" {
+		return nil, fmt.Errorf("node driver %s has no metrics port", d.pod.Name)
+	}
+	return client.CoreV1().Pods(d.pod.Namespace).ProxyGet("http", d.pod.Name, d.port, path, nil).DoRaw(ctx)
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// listNodes shows the node drivers and whether kubelet knows about
+// them. A driver that is running without registration cannot be
+// used for volumes on that node.
+func listNodes(ctx context.Context, client kubernetes.Interface, w *tabwriter.Writer) error {
+	pods, err := driverPods(ctx, client)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "NODE\tDRIVER\tPOD\tREADY\tREGISTERED")
+	for _, d := range pods {
+		registered := "false"
+		csiNode, err := client.StorageV1().CSINodes().Get(ctx, d.node(), metav1.GetOptions{})
+		switch {
+		case apierrors.IsNotFound(err):
+		case err != nil:
+			registered = "unknown"
+		default:
+			for _, driver := range csiNode.Spec.Drivers {
+				if driver.Name == d.driver {
+					registered = "true"
+				}
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s/%s\t%t\t%s\n", d.node(), d.driver, d.pod.Namespace, d.pod.Name, podReady(d.pod), registered)
+	}
+	return nil
+}
+
+// volumesReport contains the fields of the /volumes response of the
+// node driver that are shown by listVolumes.
+type volumesReport struct {
+	Volumes []struct {
+		ID         string            `json:"id"`
+		Size       int64             `json:"size"`
+		Parameters map[string]string `json:"parameters"`
+		DevicePath string            `json:"devicePath"`
+		Mounts     []struct {
+			Kind string `json:"kind"`
+		} `json:"mounts"`
+	} `json:"volumes"`
+}
+
+func listVolumes(ctx context.Context, client kubernetes.Interface, w *tabwriter.Writer) error {
+	pods, err := driverPods(ctx, client)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "NODE\tDRIVER\tVOLUME\tSIZE\tPVC\tDEVICE\tSTAGED\tPUBLISHED")
+	var failed []string
+	for _, d := range pods {
+		data, err := proxyGet(ctx, client, d, "/volumes")
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", d.node(), err))
+			continue
+		}
+		var report volumesReport
+		if err := json.Unmarshal(data, &report); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: decode volumes: %v", d.node(), err))
+			continue
+		}
+		for _, vol := range report.Volumes {
+			pvc := "-"
+			if name := vol.Parameters[parameters.PVCName]; name != "" {
+				pvc = vol.Parameters[parameters.PVCNamespace] + "/" + name
+			}
+			staged, published := 0, 0
+			for _, m := range vol.Mounts {
+				switch m.Kind {
+				case "staging":
+					staged++
+				case "target":
+					published++
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%t\t%d\n", d.node(), d.driver, vol.ID,
+				resource.NewQuantity(vol.Size, resource.BinarySI), pvc, vol.DevicePath, staged > 0, published)
+		}
+	}
+	return joinErrors(failed)
+}
+
+// capacityMetrics are the metrics of the device manager which are
+// shown by showCapacity, in that order.
+var capacityMetrics = []string{
+	"pmem_amount_available",
+	"pmem_amount_max_volume_size",
+	"pmem_amount_managed",
+	"pmem_amount_total",
+}
+
+// parseCapacity extracts the capacity of the node from the Prometheus
+// metrics of the node driver.
+func parseCapacity(data []byte) (map[string]int64, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("parse metrics: %v", err)
+	}
+	capacity := map[string]int64{}
+	for _, name := range capacityMetrics {
+		family, ok := families[name]
+		if !ok || len(family.Metric) == 0 {
+			return nil, fmt.Errorf("metric %s not found", name)
+		}
+		capacity[name] = int64(family.Metric[0].GetGauge().GetValue())
+	}
+	return capacity, nil
+}
+
+func showCapacity(ctx context.Context, client kubernetes.Interface, w *tabwriter.Writer) error {
+	pods, err := driverPods(ctx, client)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "NODE\tDRIVER\tAVAILABLE\tMAX VOLUME SIZE\tMANAGED\tTOTAL")
+	var failed []string
+	for _, d := range pods {
+		data, err := proxyGet(ctx, client, d, "/metrics")
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", d.node(), err))
+			continue
+		}
+		capacity, err := parseCapacity(data)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", d.node(), err))
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s", d.node(), d.driver)
+		for _, name := range capacityMetrics {
+			fmt.Fprintf(w, "\t%s", resource.NewQuantity(capacity[name], resource.BinarySI))
+		}
+		fmt.Fprintln(w)
+	}
+	return joinErrors(failed)
+}
+
+// joinErrors reports all nodes which could not be queried. The other
+// nodes are still shown.
+func joinErrors(failed []string) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("some nodes could not be queried:\n%s", strings.Join(failed, "\n"))
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package kubectlpmemcsi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"text/tabwriter"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func driverPodObject(name, node string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "pmem-csi",
+			Labels: map[string]string{
+				"app.kubernetes.io/name":     "pmem-csi-node",
+				"app.kubernetes.io/instance": "pmem-csi.intel.com",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: node,
+			Containers: []corev1.Container{{
+				Name:  "pmem-driver",
+				Ports: []corev1.ContainerPort{{Name: "metrics", ContainerPort: 10010}},
+			}},
+		},
+		Status: corev1.PodStatus{
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+}
+
+func run(t *testing.T, client kubernetes.Interface, cmd func(context.Context, kubernetes.Interface, *tabwriter.Writer) error) (string, error) {
+	var buffer bytes.Buffer
+	w := tabwriter.NewWriter(&buffer, 0, 8, 1, ' ', 0)
+	err := cmd(context.Background(), client, w)
+	require.NoError(t, w.Flush(), "flush")
+	return buffer.String(), err
+}
+
+func fakeProxy(t *testing.T, responses map[string]string) {
+	old := proxyGet
+	t.Cleanup(func() { proxyGet = old })
+	proxyGet = func(ctx context.Context, client kubernetes.Interface, d driverPod, path string) ([]byte, error) {
+		response, ok := responses[d.node()+path]
+		if !ok {
+			return nil, errors.New("connection refused")
+		}
+		return []byte(response), nil
+	}
+}
+
+func TestListNodes(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		driverPodObject("pmem-csi-node-a", "worker-2"),
+		driverPodObject("pmem-csi-node-b", "worker-1"),
+		&storagev1.CSINode{
+			ObjectMeta: metav1.ObjectMeta{Name: "worker-1"},
+			Spec: storagev1.CSINodeSpec{
+				Drivers: []storagev1.CSINodeDriver{{Name: "pmem-csi.intel.com"}},
+			},
+		},
+	)
+	out, err := run(t, client, listNodes)
+	require.NoError(t, err, "list nodes")
+	assert.Equal(t, `NODE     DRIVER             POD                      READY REGISTERED
+worker-1 pmem-csi.intel.com pmem-csi/pmem-csi-node-b true  true
+worker-2 pmem-csi.intel.com pmem-csi/pmem-csi-node-a true  false
+`, out)
+}
+
+func TestListVolumes(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		driverPodObject("pmem-csi-node-a", "worker-1"),
+		driverPodObject("pmem-csi-node-b", "worker-2"),
+	)
+	fakeProxy(t, map[string]string{
+		"worker-1/volumes": `{"volumes": [{
+  "id": "pvc-12-abc",
+  "size": 4194304,
+  "parameters": {"csi.storage.k8s.io/pvc/name": "data", "csi.storage.k8s.io/pvc/namespace": "default"},
+  "devicePath": "/dev/ndbus0region0fsdax/pvc-12-abc",
+  "mounts": [{"kind": "staging"}, {"kind": "target"}]
+}]}`,
+	})
+	out, err := run(t, client, listVolumes)
+	assert.Error(t, err, "second node fails")
+	assert.Contains(t, err.Error(), "worker-2: connection refused", "error")
+	assert.Equal(t, `NODE     DRIVER             VOLUME     SIZE PVC          DEVICE                             STAGED PUBLISHED
+worker-1 pmem-csi.intel.com pvc-12-abc 4Mi  default/data /dev/ndbus0region0fsdax/pvc-12-abc true   1
+`, out)
+}
+
+func TestShowCapacity(t *testing.T) {
+	client := fake.NewSimpleClientset(driverPodObject("pmem-csi-node-a", "worker-1"))
+	fakeProxy(t, map[string]string{
+		"worker-1/metrics": `# TYPE pmem_amount_available gauge
+pmem_amount_available{driver_name="pmem-csi.intel.com",node="worker-1"} 1.073741824e+09
+# TYPE pmem_amount_managed gauge
+pmem_amount_managed{driver_name="pmem-csi.intel.com",node="worker-1"} 2.147483648e+09
+# TYPE pmem_amount_max_volume_size gauge
+pmem_amount_max_volume_size{driver_name="pmem-csi.intel.com",node="worker-1"} 5.36870912e+08
+# TYPE pmem_amount_total gauge
+pmem_amount_total{driver_name="pmem-csi.intel.com",node="worker-1"} 4.294967296e+09
+`,
+	})
+	out, err := run(t, client, showCapacity)
+	require.NoError(t, err, "show capacity")
+	assert.Equal(t, `NODE     DRIVER             AVAILABLE MAX VOLUME SIZE MANAGED TOTAL
+worker-1 pmem-csi.intel.com 1Gi       512Mi           2Gi     4Gi
+`, out)
+
+	_, err = parseCapacity([]byte("# TYPE pmem_amount_available gauge\npmem_amount_available 1\n"))
+	assert.Error(t, err, "incomplete metrics")
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package kubectlpmemcsi implements "kubectl pmem-csi", a kubectl
+// plugin for inspecting a PMEM-CSI installation. It only needs access
+// to the Kubernetes API: information about volumes and capacity comes
+// from the metrics endpoint of the node drivers, reached through the
+// pod proxy of the API server.
+package kubectlpmemcsi
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var (
+	kubeconfig  = flag.String("kubeconfig", "", "Path to the kubeconfig file, uses the same defaults as kubectl if empty.")
+	kubecontext = flag.String("context", "", "Name of the kubeconfig context to use.")
+	namespace   = flag.String("namespace", "", "Namespace of the PMEM-CSI installation, all namespaces if empty.")
+	driverName  = flag.String("driver", "", "Name of the PMEM-CSI driver instance, all instances if empty.")
+	nodeName    = flag.String("node", "", "Only show this node.")
+	version     = "unknown" // Set version during build time
+)
+
+var commands = map[string]struct {
+	help string
+	run  func(ctx context.Context, client kubernetes.Interface, w *tabwriter.Writer) error
+}{
+	"nodes": {
+		help: "list the node drivers and whether kubelet has registered them",
+		run:  listNodes,
+	},
+	"volumes": {
+		help: "list the volumes on each node with their PVC and mounts",
+		run:  listVolumes,
+	},
+	"capacity": {
+		help: "show the PMEM capacity of each node",
+		run:  showCapacity,
+	},
+	"version": {
+		help: "print the version of the plugin",
+		run: func(ctx context.Context, client kubernetes.Interface, w *tabwriter.Writer) error {
+			fmt.Println(version)
+			return nil
+		},
+	},
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: kubectl pmem-csi [flags] <command>\n\nCommands:\n")
+	for _, name := range []string{"nodes", "volumes", "capacity", "version"} {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %-10s %s\n", name, commands[name].help)
+	}
+	fmt.Fprintf(flag.CommandLine.Output(), "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func Main() int {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+		return 2
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+		usage()
+		return 2
+	}
+
+	var client kubernetes.Interface
+	if flag.Arg(0) != "version" {
+		var err error
+		client, err = newClient()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if err := cmd.run(context.Background(), client, w); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flag.Arg(0), err)
+		return 1
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// newClient loads the kubeconfig like kubectl does.
+func newClient() (kubernetes.Interface, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = *kubeconfig
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules,
+		&clientcmd.ConfigOverrides{CurrentContext: *kubecontext}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("load kubeconfig: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("create Kubernetes client: %v", err)
+	}
+	return client, nil
+}
@@ -5,6 +5,10 @@ package ndctl
 //#include <ndctl/libndctl.h>
 //#include <ndctl/ndctl.h>
 import "C"
+import (
+	"fmt"
+	"unsafe"
+)
 
 // Dimm is a go wrapper for ndctl_dimm.
 type Dimm interface {
@@ -20,6 +24,16 @@ type Dimm interface {
 	DeviceName() string
 	// Handle returns the dimm's handle.
 	Handle() int16
+	// Health queries the SMART data of the dimm. It returns an
+	// error if the dimm does not support that.
+	Health() (DimmHealth, error)
+	// Labels reads and validates the label index area of the
+	// dimm. The error describes why the labels could not be read.
+	Labels() (LabelState, error)
+	// AvailableLabels returns the number of unused namespace
+	// labels. Each namespace in a region needs one label on each
+	// of the dimms which provide storage for the region.
+	AvailableLabels() uint
 }
 
 type dimm = C.struct_ndctl_dimm
@@ -50,6 +64,79 @@ func (d *dimm) Handle() int16 {
 	return int16(C.ndctl_dimm_get_handle(d))
 }
 
+func (d *dimm) Health() (DimmHealth, error) {
+	health := DimmHealth{
+		State:            HealthUnknown,
+		SparesPercentage: -1,
+		Failed:           C.ndctl_dimm_failed_map(d) != 0,
+	}
+	cmd := C.ndctl_dimm_cmd_new_smart(d)
+	if cmd == nil {
+		return health, fmt.Errorf("dimm %s: SMART data not supported", d.DeviceName())
+	}
+	defer C.ndctl_cmd_unref(cmd)
+	if rc := C.ndctl_cmd_submit(cmd); rc < 0 {
+		return health, fmt.Errorf("dimm %s: get SMART data: %s", d.DeviceName(), cErrorString(rc))
+	}
+
+	flags := C.ndctl_cmd_smart_get_flags(cmd)
+	if flags&C.ND_SMART_HEALTH_VALID != 0 {
+		state := C.ndctl_cmd_smart_get_health(cmd)
+		switch {
+		case state&C.ND_SMART_FATAL_HEALTH != 0:
+			health.State = HealthFatal
+		case state&C.ND_SMART_CRITICAL_HEALTH != 0:
+			health.State = HealthCritical
+		case state&C.ND_SMART_NON_CRITICAL_HEALTH != 0:
+			health.State = HealthNonCritical
+		default:
+			health.State = HealthOK
+		}
+	}
+	if flags&C.ND_SMART_SPARES_VALID != 0 {
+		health.SparesPercentage = int(C.ndctl_cmd_smart_get_spares(cmd))
+	}
+	return health, nil
+}
+
+func (d *dimm) Labels() (LabelState, error) {
+	if C.ndctl_dimm_is_cmd_supported(d, C.ND_CMD_GET_CONFIG_DATA) == 0 {
+		return LabelsUnsupported, nil
+	}
+	cmd := C.ndctl_dimm_read_label_index(d)
+	if cmd == nil {
+		return LabelsUnknown, fmt.Errorf("dimm %s: read label index failed", d.DeviceName())
+	}
+	defer C.ndctl_cmd_unref(cmd)
+
+	size := C.ndctl_cmd_cfg_read_get_size(cmd)
+	if size > 0 {
+		buf := make([]byte, size)
+		if rc := C.ndctl_cmd_cfg_read_get_data(cmd, unsafe.Pointer(&buf[0]), C.uint(size), 0); rc < 0 {
+			return LabelsUnknown, fmt.Errorf("dimm %s: get label data: %s", d.DeviceName(), cErrorString(C.int(rc)))
+		}
+		empty := true
+		for _, b := range buf {
+			if b != 0 {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			return LabelsEmpty, nil
+		}
+	}
+
+	if rc := C.ndctl_dimm_validate_labels(d); rc < 0 {
+		return LabelsCorrupted, nil
+	}
+	return LabelsValid, nil
+}
+
+func (d *dimm) AvailableLabels() uint {
+	return uint(C.ndctl_dimm_get_available_labels(d))
+}
+
 // Strings formats all relevant attributes as JSON.
 func (d *dimm) String() string {
 	return marshal(map[string]interface{}{
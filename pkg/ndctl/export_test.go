@@ -0,0 +1,32 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ndctl
+
+import (
+	"time"
+)
+
+// Internals for the tests, which cannot be in this package because
+// they use the fake implementation.
+
+var IsNamespaceUevent = isNamespaceUevent
+
+func (inv *Inventory) SetNow(now func() time.Time) {
+	inv.now = now
+}
+
+func (inv *Inventory) IsValid() bool {
+	return inv.isValid()
+}
+
+// ResetLabelChecks clears the cache of CheckRegionLabels.
+func ResetLabelChecks(now func() time.Time) {
+	labelChecks.mutex.Lock()
+	defer labelChecks.mutex.Unlock()
+	labelChecks.now = now
+	labelChecks.results = map[string]labelCheck{}
+}
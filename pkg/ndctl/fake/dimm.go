@@ -17,6 +17,11 @@ type Dimm struct {
 	PhysicalID_ int
 	DeviceName_ string
 	Handle_     int16
+	Health_     ndctl.DimmHealth
+	HealthErr_  error
+	Labels_     ndctl.LabelState
+	LabelsErr_  error
+	Available_  uint
 }
 
 var _ ndctl.Dimm = &Dimm{}
@@ -44,3 +49,18 @@ func (d *Dimm) DeviceName() string {
 func (d *Dimm) Handle() int16 {
 	return d.Handle_
 }
+
+func (d *Dimm) Health() (ndctl.DimmHealth, error) {
+	return d.Health_, d.HealthErr_
+}
+
+func (d *Dimm) Labels() (ndctl.LabelState, error) {
+	if d.Labels_ == "" && d.LabelsErr_ == nil {
+		return ndctl.LabelsValid, nil
+	}
+	return d.Labels_, d.LabelsErr_
+}
+
+func (d *Dimm) AvailableLabels() uint {
+	return d.Available_
+}
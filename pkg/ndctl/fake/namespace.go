@@ -24,6 +24,7 @@ type Namespace struct {
 	Active_          bool
 	UUID_            uuid.UUID
 	Location_        ndctl.MapLocation
+	BadBlocks_       []ndctl.BadBlock
 
 	Region_ ndctl.Region
 }
@@ -82,6 +83,10 @@ func (ns *Namespace) Region() ndctl.Region {
 	return ns.Region_
 }
 
+func (ns *Namespace) BadBlocks() []ndctl.BadBlock {
+	return ns.BadBlocks_
+}
+
 func (ns *Namespace) SetAltName(name string) error {
 	return nil
 }
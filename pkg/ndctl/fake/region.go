@@ -26,6 +26,7 @@ type Region struct {
 	Enabled_            bool
 	Readonly_           bool
 	InterleaveWays_     uint64
+	NumaNode_           int
 	RegionAlign_        uint64
 
 	Mappings_   []ndctl.Mapping
@@ -75,6 +76,10 @@ func (r *Region) InterleaveWays() uint64 {
 	return r.InterleaveWays_
 }
 
+func (r *Region) NumaNode() int {
+	return r.NumaNode_
+}
+
 func (r *Region) ActiveNamespaces() []ndctl.Namespace {
 	var namespaces []ndctl.Namespace
 	for _, namespace := range r.Namespaces_ {
@@ -0,0 +1,155 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ndctl
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// HealthState summarizes the SMART health status of a DIMM.
+type HealthState string
+
+const (
+	HealthOK          HealthState = "ok"
+	HealthNonCritical HealthState = "non-critical"
+	HealthCritical    HealthState = "critical"
+	HealthFatal       HealthState = "fatal"
+	HealthUnknown     HealthState = "unknown"
+)
+
+// DimmHealth is the equivalent of "ndctl list --dimms --health".
+type DimmHealth struct {
+	// State is HealthUnknown if the DIMM does not report it.
+	State HealthState
+	// SparesPercentage is the remaining spare capacity,
+	// -1 if unknown.
+	SparesPercentage int
+	// Failed is true if the DIMM failed to map its capacity
+	// (= "flag_failed_map" in ndctl).
+	Failed bool
+}
+
+// Failing returns true if new data should not be stored on the DIMM
+// anymore. Non-critical warnings are tolerated.
+func (h DimmHealth) Failing() bool {
+	return h.Failed || h.State == HealthCritical || h.State == HealthFatal
+}
+
+// LabelState describes the content of the label index area of a DIMM.
+type LabelState string
+
+const (
+	// LabelsValid means that the label index area is consistent.
+	LabelsValid LabelState = "valid"
+	// LabelsEmpty means that the label area was never initialized.
+	LabelsEmpty LabelState = "empty"
+	// LabelsCorrupted means that the label index area has content
+	// which does not pass validation.
+	LabelsCorrupted LabelState = "corrupted"
+	// LabelsUnsupported means that the DIMM has no label area.
+	LabelsUnsupported LabelState = "unsupported"
+	// LabelsUnknown is returned together with an error when reading
+	// the labels failed.
+	LabelsUnknown LabelState = "unknown"
+)
+
+// BadBlock describes a range of known media errors. Offset and
+// length are counted in 512 byte sectors, relative to the start of
+// the namespace.
+type BadBlock struct {
+	Offset uint64
+	Length uint64
+}
+
+// CheckRegionHealth returns an error which describes the problem if
+// any of the DIMMs that provide storage for the region is failing.
+// DIMMs whose health cannot be determined are assumed to be okay,
+// because not all platforms support querying SMART data.
+func CheckRegionHealth(r Region) error {
+	for _, m := range r.Mappings() {
+		d := m.Dimm()
+		if d == nil {
+			continue
+		}
+		health, err := d.Health()
+		if err != nil {
+			continue
+		}
+		if health.Failing() {
+			return fmt.Errorf("region %s: DIMM %s is failing: health %s, failed map %v",
+				r.DeviceName(), d.DeviceName(), health.State, health.Failed)
+		}
+	}
+	return nil
+}
+
+// labelCheckMaxAge determines how long the result of
+// CheckRegionLabels is reused. Reading the label index area is a
+// firmware command, which is too slow to repeat for each new
+// namespace, while the labels only change when namespaces get
+// created or an admin repairs them.
+const labelCheckMaxAge = 10 * time.Minute
+
+type labelCheck struct {
+	err     error
+	checked time.Time
+}
+
+// labelChecks caches the result of CheckRegionLabels per region.
+var labelChecks = struct {
+	mutex   sync.Mutex
+	now     func() time.Time
+	results map[string]labelCheck
+}{
+	now:     time.Now,
+	results: map[string]labelCheck{},
+}
+
+// CheckRegionLabels returns an error which describes the problem if
+// the label area of any of the DIMMs that provide storage for the
+// region is corrupted or cannot be read. Creating namespaces in such
+// a region would write new labels over inconsistent metadata.
+// Empty label areas and DIMMs without labels are okay.
+//
+// The result is cached for a while, so a repaired region is only
+// used again after some time or a restart of the driver.
+func CheckRegionLabels(r Region) error {
+	key := r.DeviceName()
+	if bus := r.Bus(); bus != nil {
+		key = bus.DeviceName() + "/" + key
+	}
+	labelChecks.mutex.Lock()
+	defer labelChecks.mutex.Unlock()
+	now := labelChecks.now()
+	if check, ok := labelChecks.results[key]; ok && now.Sub(check.checked) < labelCheckMaxAge {
+		return check.err
+	}
+	err := checkRegionLabels(r)
+	labelChecks.results[key] = labelCheck{err: err, checked: now}
+	return err
+}
+
+func checkRegionLabels(r Region) error {
+	for _, m := range r.Mappings() {
+		d := m.Dimm()
+		if d == nil {
+			continue
+		}
+		state, err := d.Labels()
+		if err != nil {
+			return fmt.Errorf("region %s: DIMM %s: cannot read labels: %v",
+				r.DeviceName(), d.DeviceName(), err)
+		}
+		if state == LabelsCorrupted {
+			return fmt.Errorf("region %s: DIMM %s: label index area is corrupted, check with \"ndctl check-labels %s\"",
+				r.DeviceName(), d.DeviceName(), d.DeviceName())
+		}
+	}
+	return nil
+}
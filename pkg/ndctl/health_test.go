@@ -0,0 +1,133 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ndctl_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	"github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestCheckRegionHealth(t *testing.T) {
+	testcases := map[string]struct {
+		dimms         []*fake.Dimm
+		expectFailing bool
+	}{
+		"no DIMMs": {},
+		"healthy": {
+			dimms: []*fake.Dimm{
+				{DeviceName_: "nmem0", Health_: ndctl.DimmHealth{State: ndctl.HealthOK, SparesPercentage: 100}},
+				{DeviceName_: "nmem1", Health_: ndctl.DimmHealth{State: ndctl.HealthNonCritical, SparesPercentage: 10}},
+			},
+		},
+		"no SMART data": {
+			dimms: []*fake.Dimm{
+				{DeviceName_: "nmem0", HealthErr_: errors.New("not supported")},
+			},
+		},
+		"critical": {
+			dimms: []*fake.Dimm{
+				{DeviceName_: "nmem0", Health_: ndctl.DimmHealth{State: ndctl.HealthOK}},
+				{DeviceName_: "nmem1", Health_: ndctl.DimmHealth{State: ndctl.HealthCritical}},
+			},
+			expectFailing: true,
+		},
+		"fatal": {
+			dimms: []*fake.Dimm{
+				{DeviceName_: "nmem0", Health_: ndctl.DimmHealth{State: ndctl.HealthFatal}},
+			},
+			expectFailing: true,
+		},
+		"failed map": {
+			dimms: []*fake.Dimm{
+				{DeviceName_: "nmem0", Health_: ndctl.DimmHealth{State: ndctl.HealthUnknown, Failed: true}},
+			},
+			expectFailing: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			region := &fake.Region{DeviceName_: "region0"}
+			for _, dimm := range tc.dimms {
+				region.Mappings_ = append(region.Mappings_, &fake.Mapping{Dimm_: dimm})
+			}
+			err := ndctl.CheckRegionHealth(region)
+			if tc.expectFailing {
+				assert.Error(t, err, "failing DIMM")
+			} else {
+				assert.NoError(t, err, "healthy DIMMs")
+			}
+		})
+	}
+}
+
+// countingDimm counts how often the labels get read.
+type countingDimm struct {
+	*fake.Dimm
+	reads int
+}
+
+func (d *countingDimm) Labels() (ndctl.LabelState, error) {
+	d.reads++
+	return d.Dimm.Labels()
+}
+
+func TestCheckRegionLabels(t *testing.T) {
+	now := time.Now()
+	ndctl.ResetLabelChecks(func() time.Time { return now })
+	defer ndctl.ResetLabelChecks(time.Now)
+
+	good := &countingDimm{Dimm: &fake.Dimm{DeviceName_: "nmem0", Labels_: ndctl.LabelsValid}}
+	bad := &countingDimm{Dimm: &fake.Dimm{DeviceName_: "nmem1", Labels_: ndctl.LabelsCorrupted}}
+	unreadable := &countingDimm{Dimm: &fake.Dimm{DeviceName_: "nmem2", LabelsErr_: errors.New("firmware error")}}
+	empty := &countingDimm{Dimm: &fake.Dimm{DeviceName_: "nmem3", Labels_: ndctl.LabelsEmpty}}
+	ndctx := fake.NewContext(&fake.Context{
+		Buses: []ndctl.Bus{
+			&fake.Bus{
+				DeviceName_: "ndbus0",
+				Regions_: []ndctl.Region{
+					&fake.Region{DeviceName_: "region0", Mappings_: []ndctl.Mapping{&fake.Mapping{Dimm_: good}, &fake.Mapping{Dimm_: empty}}},
+					&fake.Region{DeviceName_: "region1", Mappings_: []ndctl.Mapping{&fake.Mapping{Dimm_: bad}}},
+					&fake.Region{DeviceName_: "region2", Mappings_: []ndctl.Mapping{&fake.Mapping{Dimm_: unreadable}}},
+				},
+			},
+		},
+	})
+	regions := ndctx.GetBuses()[0].AllRegions()
+
+	check := func(what string) {
+		assert.NoError(t, ndctl.CheckRegionLabels(regions[0]), "%s: region0", what)
+		err := ndctl.CheckRegionLabels(regions[1])
+		if assert.Error(t, err, "%s: region1", what) {
+			assert.Contains(t, err.Error(), "corrupted", "%s: region1", what)
+		}
+		err = ndctl.CheckRegionLabels(regions[2])
+		if assert.Error(t, err, "%s: region2", what) {
+			assert.Contains(t, err.Error(), "firmware error", "%s: region2", what)
+		}
+	}
+	reads := func() []int {
+		return []int{good.reads, empty.reads, bad.reads, unreadable.reads}
+	}
+
+	check("first check")
+	assert.Equal(t, []int{1, 1, 1, 1}, reads(), "labels read once")
+	check("cached")
+	assert.Equal(t, []int{1, 1, 1, 1}, reads(), "labels not read again")
+
+	// The admin repairs the labels, which is noticed after a while.
+	bad.Labels_ = ndctl.LabelsValid
+	now = now.Add(time.Hour)
+	assert.NoError(t, ndctl.CheckRegionLabels(regions[1]), "repaired region1")
+	assert.Equal(t, []int{1, 1, 2, 1}, reads(), "labels read after expiration")
+}
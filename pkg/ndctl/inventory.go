@@ -0,0 +1,201 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ndctl
+
+import (
+	"bytes"
+	gocontext "context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+)
+
+// NamespaceInfo is a snapshot of the properties of a namespace.
+// Unlike Namespace, it remains valid after the context which it was
+// retrieved from is freed.
+type NamespaceInfo struct {
+	Name            string
+	BlockDeviceName string
+	Size            uint64
+	Mode            NamespaceMode
+	Active          bool
+}
+
+// Inventory caches the list of all namespaces. Enumerating them
+// with libndctl scans sysfs, which is slow on systems with many
+// namespaces. The cached list is used until it gets invalidated,
+// either explicitly by the owner after modifying namespaces, by a
+// kernel uevent for the "nd" subsystem (see WatchUevents), or
+// because it is older than the maximum age.
+//
+// Like all libndctl calls, Refresh must not be called concurrently
+// with other operations that use libndctl. Methods which use the
+// cached list don't have that restriction.
+type Inventory struct {
+	maxAge time.Duration
+	now    func() time.Time
+
+	mutex      sync.Mutex
+	valid      bool
+	updated    time.Time
+	namespaces []NamespaceInfo
+}
+
+// NewInventory creates an empty inventory. A maxAge of zero disables
+// time-based invalidation.
+func NewInventory(maxAge time.Duration) *Inventory {
+	return &Inventory{
+		maxAge: maxAge,
+		now:    time.Now,
+	}
+}
+
+// Invalidate ensures that the next call of Namespaces rescans.
+func (inv *Inventory) Invalidate() {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	inv.valid = false
+}
+
+// Refresh enumerates all namespaces and replaces the cached list.
+func (inv *Inventory) Refresh() error {
+	ndctx, err := NewContext()
+	if err != nil {
+		return err
+	}
+	defer ndctx.Free()
+
+	inv.Update(ndctx)
+	return nil
+}
+
+// Update replaces the cached list with the namespaces of the context.
+func (inv *Inventory) Update(ndctx Context) {
+	var namespaces []NamespaceInfo
+	for _, ns := range GetAllNamespaces(ndctx) {
+		namespaces = append(namespaces, NamespaceInfo{
+			Name:            ns.Name(),
+			BlockDeviceName: ns.BlockDeviceName(),
+			Size:            ns.Size(),
+			Mode:            ns.Mode(),
+			Active:          ns.Active(),
+		})
+	}
+
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	inv.namespaces = namespaces
+	inv.updated = inv.now()
+	inv.valid = true
+}
+
+// Namespaces returns the cached list, after refreshing it if
+// necessary. The result must not be modified.
+func (inv *Inventory) Namespaces() ([]NamespaceInfo, error) {
+	if !inv.isValid() {
+		if err := inv.Refresh(); err != nil {
+			return nil, err
+		}
+	}
+
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	return inv.namespaces, nil
+}
+
+// NamespaceByName looks up a namespace in the cached list.
+func (inv *Inventory) NamespaceByName(name string) (*NamespaceInfo, error) {
+	namespaces, err := inv.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+	for i := range namespaces {
+		if namespaces[i].Name == name {
+			ns := namespaces[i]
+			return &ns, nil
+		}
+	}
+	return nil, pmemerr.DeviceNotFound
+}
+
+func (inv *Inventory) isValid() bool {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	return inv.valid &&
+		(inv.maxAge == 0 || inv.now().Sub(inv.updated) < inv.maxAge)
+}
+
+// WatchUevents invalidates the inventory whenever the kernel reports
+// a change of a device in the "nd" subsystem or of a PMEM block
+// device. That covers changes made outside of PMEM-CSI, for example
+// with the ndctl command. It returns an error if the netlink socket
+// cannot be opened, otherwise it watches in the background until the
+// context is done.
+func (inv *Inventory) WatchUevents(ctx gocontext.Context) error {
+	logger := klog.FromContext(ctx).WithName("WatchUevents")
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return fmt.Errorf("create netlink socket: %v", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1}); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("bind netlink socket: %v", err)
+	}
+	// A timeout is needed to notice when the context is done.
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1}); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("set netlink socket timeout: %v", err)
+	}
+
+	go func() {
+		defer unix.Close(fd)
+		buffer := make([]byte, 64*1024)
+		for ctx.Err() == nil {
+			n, _, err := unix.Recvfrom(fd, buffer, 0)
+			switch {
+			case err == unix.EAGAIN || err == unix.EINTR:
+				continue
+			case err != nil:
+				// Continuing without events is better than
+				// not caching at all, the owner still
+				// invalidates after its own changes.
+				logger.Error(err, "Receiving uevents failed, no longer watching")
+				return
+			}
+			if isNamespaceUevent(buffer[:n]) {
+				logger.V(5).Info("Namespaces changed", "uevent", strings.ReplaceAll(string(buffer[:n]), "\x00", " "))
+				inv.Invalidate()
+			}
+		}
+	}()
+	return nil
+}
+
+// isNamespaceUevent checks a kernel uevent message, which consists
+// of a header (action@devpath) followed by KEY=VALUE pairs, all
+// separated by null bytes.
+func isNamespaceUevent(msg []byte) bool {
+	var subsystem, devname string
+	for _, field := range bytes.Split(msg, []byte{0}) {
+		switch {
+		case bytes.HasPrefix(field, []byte("SUBSYSTEM=")):
+			subsystem = string(field[len("SUBSYSTEM="):])
+		case bytes.HasPrefix(field, []byte("DEVNAME=")):
+			devname = string(field[len("DEVNAME="):])
+		}
+	}
+	return subsystem == "nd" ||
+		subsystem == "block" && strings.HasPrefix(devname, "pmem")
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ndctl_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	"github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestInventory(t *testing.T) {
+	ndctx := fake.NewContext(&fake.Context{
+		Buses: []ndctl.Bus{
+			&fake.Bus{
+				DeviceName_: "ndbus0",
+				Regions_: []ndctl.Region{
+					&fake.Region{
+						DeviceName_: "region0",
+						Enabled_:    true,
+						Namespaces_: []ndctl.Namespace{
+							&fake.Namespace{
+								Name_:            "pvc-0",
+								BlockDeviceName_: "pmem0",
+								Size_:            4 * 1024 * 1024 * 1024,
+								Mode_:            ndctl.FsdaxMode,
+								Active_:          true,
+							},
+							&fake.Namespace{
+								Name_:            "pvc-1",
+								BlockDeviceName_: "pmem0.1",
+								Size_:            1024 * 1024 * 1024,
+								Mode_:            ndctl.SectorMode,
+							},
+							&fake.Namespace{
+								// Unused namespace, not listed.
+								Name_: "",
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+
+	inv := ndctl.NewInventory(time.Minute)
+	now := time.Now()
+	inv.SetNow(func() time.Time { return now })
+	assert.False(t, inv.IsValid(), "initially valid")
+
+	inv.Update(ndctx)
+	assert.True(t, inv.IsValid(), "valid after update")
+	namespaces, err := inv.Namespaces()
+	require.NoError(t, err, "namespaces")
+	assert.Equal(t, []ndctl.NamespaceInfo{
+		{Name: "pvc-0", BlockDeviceName: "pmem0", Size: 4 * 1024 * 1024 * 1024, Mode: ndctl.FsdaxMode, Active: true},
+		{Name: "pvc-1", BlockDeviceName: "pmem0.1", Size: 1024 * 1024 * 1024, Mode: ndctl.SectorMode},
+	}, namespaces, "namespaces")
+
+	ns, err := inv.NamespaceByName("pvc-1")
+	require.NoError(t, err, "pvc-1")
+	assert.Equal(t, "pmem0.1", ns.BlockDeviceName, "pvc-1 block device")
+	ns.Name = "modified"
+	_, err = inv.NamespaceByName("pvc-1")
+	assert.NoError(t, err, "modifying the result does not change the cache")
+	_, err = inv.NamespaceByName("pvc-2")
+	assert.ErrorIs(t, err, pmemerr.DeviceNotFound, "pvc-2")
+
+	inv.Invalidate()
+	assert.False(t, inv.IsValid(), "valid after invalidation")
+	inv.Update(ndctx)
+
+	now = now.Add(59 * time.Second)
+	assert.True(t, inv.IsValid(), "valid before max age")
+	now = now.Add(time.Second)
+	assert.False(t, inv.IsValid(), "valid after max age")
+
+	inv = ndctl.NewInventory(0)
+	inv.SetNow(func() time.Time { return now })
+	inv.Update(ndctx)
+	now = now.Add(24 * time.Hour)
+	assert.True(t, inv.IsValid(), "valid without max age")
+}
+
+func TestIsNamespaceUevent(t *testing.T) {
+	uevent := func(fields ...string) []byte {
+		return []byte(strings.Join(fields, "\x00") + "\x00")
+	}
+
+	testcases := map[string]struct {
+		msg      []byte
+		expected bool
+	}{
+		"namespace": {
+			msg:      uevent("add@/devices/ndbus0/region0/namespace0.1", "ACTION=add", "SUBSYSTEM=nd", "DEVTYPE=nd_namespace_io"),
+			expected: true,
+		},
+		"pmem block device": {
+			msg:      uevent("remove@/devices/ndbus0/region0/namespace0.1/block/pmem0.1", "ACTION=remove", "SUBSYSTEM=block", "DEVNAME=pmem0.1"),
+			expected: true,
+		},
+		"other block device": {
+			msg: uevent("add@/devices/virtual/block/dm-0", "ACTION=add", "SUBSYSTEM=block", "DEVNAME=dm-0"),
+		},
+		"other subsystem": {
+			msg: uevent("change@/devices/system/cpu/cpu0", "ACTION=change", "SUBSYSTEM=cpu"),
+		},
+		"empty": {},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, ndctl.IsNamespaceUevent(tc.msg))
+		})
+	}
+}
@@ -104,6 +104,8 @@ type Namespace interface {
 	Location() MapLocation
 	// Region returns reference to the region that contains the namespace.
 	Region() Region
+	// BadBlocks returns all known media errors in the namespace.
+	BadBlocks() []BadBlock
 
 	// SetAltName changes the alternative name of the namespace.
 	SetAltName(name string) error
@@ -295,6 +297,14 @@ func (ns *namespace) Region() Region {
 
 }
 
+func (ns *namespace) BadBlocks() []BadBlock {
+	var badblocks []BadBlock
+	for bb := C.ndctl_namespace_get_first_badblock(ns); bb != nil; bb = C.ndctl_namespace_get_next_badblock(ns) {
+		badblocks = append(badblocks, BadBlock{Offset: uint64(bb.offset), Length: uint64(bb.len)})
+	}
+	return badblocks
+}
+
 func (ns *namespace) SetAltName(name string) error {
 	if rc := C.ndctl_namespace_set_alt_name(ns, C.CString(name)); rc != 0 {
 		return fmt.Errorf("Failed to set namespace name: %s", cErrorString(rc))
@@ -10,6 +10,7 @@ import "C"
 import (
 	gocontext "context"
 	"fmt"
+	"sort"
 
 	pmemerr "github.com/intel/pmem-csi/pkg/errors"
 )
@@ -29,6 +30,9 @@ type CreateNamespaceOpts struct {
 	Type       NamespaceType
 	Mode       NamespaceMode
 	Location   MapLocation
+	// Region, if set, is the device name of the only region
+	// (like region0) in which the namespace may be created.
+	Region string
 }
 
 // Context is a go wrapper for ndctl context
@@ -69,16 +73,50 @@ func (ndctx *context) GetBuses() []Bus {
 	return buses
 }
 
-// CreateNamespace creates a new namespace with given opts in some arbitrary
-// region. It returns an error if creation fails in all regions.
+// CreateNamespace creates a new namespace with given opts in the
+// region where it fits best, i.e. the region with the smallest
+// sufficiently large free extent. That keeps larger extents available
+// for larger namespaces. Regions with failing DIMMs are skipped. It
+// returns an error if creation fails in all regions.
 func CreateNamespace(ctx gocontext.Context, ndctx Context, opts CreateNamespaceOpts) (Namespace, error) {
-	var err error
-	var ns Namespace
+	type candidate struct {
+		region  Region
+		maxSize uint64
+	}
+	var candidates []candidate
 	for _, bus := range ndctx.GetBuses() {
 		for _, r := range bus.ActiveRegions() {
-			if ns, err = r.CreateNamespace(ctx, opts); err == nil {
-				return ns, nil
+			if opts.Region != "" && r.DeviceName() != opts.Region {
+				continue
 			}
+			candidates = append(candidates, candidate{region: r, maxSize: MaxNamespaceSize(r)})
+		}
+	}
+	fits := func(c candidate) bool {
+		return c.maxSize >= opts.Size
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if fits(candidates[i]) != fits(candidates[j]) {
+			return fits(candidates[i])
+		}
+		return candidates[i].maxSize < candidates[j].maxSize
+	})
+
+	err := fmt.Errorf("no active region: %w", pmemerr.NotEnoughSpace)
+	var ns Namespace
+	for _, c := range candidates {
+		if healthErr := CheckRegionHealth(c.region); healthErr != nil {
+			// Not a hard failure, the volume might fit elsewhere
+			// or on a different node.
+			err = fmt.Errorf("%w: %v", pmemerr.NotEnoughSpace, healthErr)
+			continue
+		}
+		if labelErr := CheckRegionLabels(c.region); labelErr != nil {
+			err = fmt.Errorf("%w: %v", pmemerr.NotEnoughSpace, labelErr)
+			continue
+		}
+		if ns, err = c.region.CreateNamespace(ctx, opts); err == nil {
+			return ns, nil
 		}
 	}
 	return nil, err
@@ -139,7 +177,8 @@ func GetAllNamespaces(ndctx Context) []Namespace {
 func IsSpaceAvailable(ndctx Context, size uint64) bool {
 	for _, bus := range ndctx.GetBuses() {
 		for _, r := range bus.ActiveRegions() {
-			if r.MaxAvailableExtent() >= size && NamespaceType(r.Type()) == PmemNamespace {
+			if MaxNamespaceSize(r) >= size && NamespaceType(r.Type()) == PmemNamespace &&
+				CheckRegionHealth(r) == nil {
 				return true
 			}
 		}
@@ -48,6 +48,9 @@ type Region interface {
 	Readonly() bool
 	// InterleaveWays returns the interleaving of the region.
 	InterleaveWays() uint64
+	// NumaNode returns the NUMA node that the region is attached
+	// to, -1 if unknown.
+	NumaNode() int
 	// ActiveNamespaces returns all active namespaces in the region.
 	ActiveNamespaces() []Namespace
 	// AllNamespaces returns all non-zero sized namespaces in the region
@@ -122,6 +125,10 @@ func (r *region) InterleaveWays() uint64 {
 	return uint64(C.ndctl_region_get_interleave_ways(r))
 }
 
+func (r *region) NumaNode() int {
+	return int(C.ndctl_region_get_numa_node(r))
+}
+
 func (r *region) ActiveNamespaces() []Namespace {
 	return r.namespaces(true)
 }
@@ -199,10 +206,7 @@ func (r *region) CreateNamespace(ctx gocontext.Context, opts CreateNamespaceOpts
 
 	align, alignInfo := CalculateAlignment(r)
 	size := opts.Size
-	available := r.MaxAvailableExtent()
-	if available == uint64(C.ULLONG_MAX) {
-		available = r.AvailableSize()
-	}
+	available := maxAvailableExtent(r)
 	logger = logger.WithValues(
 		"region", r.DeviceName(),
 	).WithValues(alignInfo...).WithValues(
@@ -377,6 +381,59 @@ func (r *region) namespaces(onlyActive bool) []Namespace {
 	return namespaces
 }
 
+// maxAvailableExtent returns the largest contiguous free space in
+// the region. Old kernels don't report it, then the total free space
+// is used instead.
+func maxAvailableExtent(r Region) uint64 {
+	available := r.MaxAvailableExtent()
+	if available == uint64(C.ULLONG_MAX) {
+		available = r.AvailableSize()
+	}
+	return available
+}
+
+// MaxNamespaceSize returns the size of the largest namespace that
+// currently can be created in the region, considering alignment and
+// fragmentation of the free space. A namespace cannot span more than
+// one region (= interleave set), so the largest volume that can be
+// created is the maximum of this over all regions, not the sum of
+// their free space. It is zero for regions where no namespaces can be
+// created.
+func MaxNamespaceSize(r Region) uint64 {
+	if !r.Enabled() || r.Readonly() {
+		return 0
+	}
+	align, _ := CalculateAlignment(r)
+	return maxAvailableExtent(r) / align * align
+}
+
+// MaxNamespaces returns how many namespaces the region can hold in
+// total. Each namespace needs a label on each of the DIMMs which
+// provide storage for the region, so the DIMM with the fewest unused
+// labels determines how many more namespaces can be created. Regions
+// without DIMMs, like legacy PMEM, support only one namespace.
+func MaxNamespaces(r Region) uint {
+	if !r.Enabled() || r.Readonly() {
+		return 0
+	}
+	var available uint
+	hasDimms := false
+	for _, m := range r.Mappings() {
+		d := m.Dimm()
+		if d == nil {
+			continue
+		}
+		if labels := d.AvailableLabels(); !hasDimms || labels < available {
+			available = labels
+		}
+		hasDimms = true
+	}
+	if !hasDimms {
+		return 1
+	}
+	return uint(len(r.ActiveNamespaces())) + available
+}
+
 // CalculateAlignment considers region and namespace alignment.
 // It returns the final alignment value and key/value pairs for logging.
 func CalculateAlignment(r Region) (uint64, []interface{}) {
@@ -0,0 +1,109 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package pmemcapacity calculates the PMEM capacity of a driver
+// deployment from the CSIStorageCapacity objects that
+// external-provisioner maintains for it and the existing volumes.
+// The package is shared by the driver, which exports the result as
+// metrics, and the operator, which stores it in the deployment
+// status.
+package pmemcapacity
+
+import (
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Segment is the capacity of one topology segment.
+type Segment struct {
+	// Node is the value of the driver topology key, empty if
+	// the segment is not specific to a node.
+	Node string
+	// Segment is the node topology in label selector format.
+	Segment string
+	// Free is the capacity that is available for new volumes.
+	Free int64
+	// Total is the free capacity plus the size of existing
+	// volumes on the node.
+	Total int64
+}
+
+// BySegment combines the CSIStorageCapacity objects of the driver's
+// storage classes with the existing volumes. Different storage
+// classes describe the same PMEM, so the largest capacity reported
+// for a segment is used. provisioners maps storage class names to
+// their provisioner.
+func BySegment(capacities []*storagev1.CSIStorageCapacity, provisioners map[string]string, pvs []*v1.PersistentVolume, driverName, topologyKey string) []Segment {
+	segments := map[string]*Segment{}
+	for _, capacity := range capacities {
+		if provisioners[capacity.StorageClassName] != driverName ||
+			capacity.NodeTopology == nil ||
+			capacity.Capacity == nil {
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(capacity.NodeTopology)
+		if err != nil {
+			continue
+		}
+		key := selector.String()
+		s := segments[key]
+		if s == nil {
+			s = &Segment{
+				Node:    capacity.NodeTopology.MatchLabels[topologyKey],
+				Segment: key,
+			}
+			segments[key] = s
+		}
+		if free := capacity.Capacity.Value(); free > s.Free {
+			s.Free = free
+		}
+	}
+
+	allocated := map[string]int64{}
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			continue
+		}
+		if node := VolumeNode(pv, topologyKey); node != "" {
+			size := pv.Spec.Capacity[v1.ResourceStorage]
+			allocated[node] += size.Value()
+		}
+	}
+
+	result := make([]Segment, 0, len(segments))
+	for _, s := range segments {
+		s.Total = s.Free
+		if s.Node != "" {
+			s.Total += allocated[s.Node]
+		}
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Segment < result[j].Segment
+	})
+	return result
+}
+
+// VolumeNode returns the node that a PMEM-CSI volume is
+// bound to according to its node affinity.
+func VolumeNode(pv *v1.PersistentVolume, topologyKey string) string {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return ""
+	}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			if expr.Key == topologyKey &&
+				expr.Operator == v1.NodeSelectorOpIn &&
+				len(expr.Values) == 1 {
+				return expr.Values[0]
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcapacity
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const driverName = "pmem-csi.intel.com"
+
+func TestCapacityBySegment(t *testing.T) {
+	topologyKey := driverName + "/node"
+	capacity := func(sc, node, free string) *storagev1.CSIStorageCapacity {
+		quantity := resource.MustParse(free)
+		return &storagev1.CSIStorageCapacity{
+			StorageClassName: sc,
+			NodeTopology: &metav1.LabelSelector{
+				MatchLabels: map[string]string{topologyKey: node},
+			},
+			Capacity: &quantity,
+		}
+	}
+	pv := func(name, node, size string) *v1.PersistentVolume {
+		pv := &v1.PersistentVolume{}
+		pv.Name = name
+		pv.Spec.CSI = &v1.CSIPersistentVolumeSource{Driver: driverName}
+		pv.Spec.Capacity = v1.ResourceList{v1.ResourceStorage: resource.MustParse(size)}
+		pv.Spec.NodeAffinity = &v1.VolumeNodeAffinity{
+			Required: &v1.NodeSelector{
+				NodeSelectorTerms: []v1.NodeSelectorTerm{{
+					MatchExpressions: []v1.NodeSelectorRequirement{{
+						Key:      topologyKey,
+						Operator: v1.NodeSelectorOpIn,
+						Values:   []string{node},
+					}},
+				}},
+			},
+		}
+		return pv
+	}
+	provisioners := map[string]string{
+		"pmem-csi-sc":      driverName,
+		"pmem-csi-sc-fsio": driverName,
+		"other-sc":         "other." + driverName,
+	}
+
+	testcases := map[string]struct {
+		capacities []*storagev1.CSIStorageCapacity
+		pvs        []*v1.PersistentVolume
+		expect     []Segment
+	}{
+		"empty": {
+			expect: []Segment{},
+		},
+		"other-driver": {
+			capacities: []*storagev1.CSIStorageCapacity{capacity("other-sc", "node-a", "1Gi")},
+			expect:     []Segment{},
+		},
+		"nodes": {
+			capacities: []*storagev1.CSIStorageCapacity{
+				capacity("pmem-csi-sc", "node-b", "2Gi"),
+				capacity("pmem-csi-sc", "node-a", "1Gi"),
+			},
+			pvs: []*v1.PersistentVolume{
+				pv("a", "node-a", "1Gi"),
+				pv("c", "node-c", "1Gi"),
+			},
+			expect: []Segment{
+				{Node: "node-a", Segment: topologyKey + "=node-a", Free: 1 << 30, Total: 2 << 30},
+				{Node: "node-b", Segment: topologyKey + "=node-b", Free: 2 << 30, Total: 2 << 30},
+			},
+		},
+		"storage-classes": {
+			capacities: []*storagev1.CSIStorageCapacity{
+				capacity("pmem-csi-sc", "node-a", "1Gi"),
+				capacity("pmem-csi-sc-fsio", "node-a", "2Gi"),
+			},
+			expect: []Segment{
+				{Node: "node-a", Segment: topologyKey + "=node-a", Free: 2 << 30, Total: 2 << 30},
+			},
+		},
+	}
+
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			actual := BySegment(tc.capacities, provisioners, tc.pvs, driverName, topologyKey)
+			assert.Equal(t, tc.expect, actual)
+		})
+	}
+}
@@ -7,9 +7,14 @@ SPDX-License-Identifier: Apache-2.0
 package pmemcommon
 
 import (
+	"regexp"
+	"strconv"
+
 	"github.com/intel/pmem-csi/pkg/ndctl"
 )
 
+var vgNameRe = regexp.MustCompile(`^ndbus[0-9]+region([0-9]+)fsdax$`)
+
 func VgName(bus ndctl.Bus, region ndctl.Region) string {
 	// Hard-coded string to indicate all namespaces are in "FSDAX" mode.
 	nsmode := "fsdax"
@@ -17,3 +22,23 @@ func VgName(bus ndctl.Bus, region ndctl.Region) string {
 	// before the sector-mode support was dropped.
 	return bus.DeviceName() + region.DeviceName() + nsmode
 }
+
+// IsVgName returns true if the name has the format of names
+// generated by VgName.
+func IsVgName(name string) bool {
+	return vgNameRe.MatchString(name)
+}
+
+// VgRegionID returns the ID of the region for a volume group name
+// generated by VgName and true, false for other names.
+func VgRegionID(name string) (uint, bool) {
+	match := vgNameRe.FindStringSubmatch(name)
+	if match == nil {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(match[1], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint(id), true
+}
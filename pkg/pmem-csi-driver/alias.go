@@ -0,0 +1,82 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+
+	grpcserver "github.com/intel/pmem-csi/pkg/grpc-server"
+	pmemgrpc "github.com/intel/pmem-csi/pkg/pmem-grpc"
+)
+
+// aliasEndpoint returns the Unix domain socket for an additional
+// driver name. It is in the same directory as the main socket, so the
+// node-driver-registrar for the alias can use the same volume.
+func aliasEndpoint(endpoint, alias string) (string, error) {
+	proto, addr, err := pmemgrpc.ParseEndpoint(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if proto != "unix" {
+		return "", fmt.Errorf("driver name aliases need a Unix domain socket as endpoint, not %q", endpoint)
+	}
+	return "unix://" + filepath.Join(filepath.Dir(addr), alias+".sock"), nil
+}
+
+// checkAliases rejects empty and duplicate driver names.
+func checkAliases(driverName string, aliases []string) error {
+	names := map[string]bool{driverName: true}
+	for _, alias := range aliases {
+		if alias == "" {
+			return fmt.Errorf("empty driver name alias")
+		}
+		if names[alias] {
+			return fmt.Errorf("duplicate driver name %q", alias)
+		}
+		names[alias] = true
+	}
+	return nil
+}
+
+// aliasNodeServer is the node service for an additional driver name.
+// Kubelet turns the topology segments returned by NodeGetInfo into
+// node labels and existing volumes of the alias have node affinity
+// for those, so the keys must use the alias as prefix.
+type aliasNodeServer struct {
+	*nodeServer
+	driverName string
+	alias      string
+}
+
+var _ csi.NodeServer = &aliasNodeServer{}
+var _ grpcserver.Service = &aliasNodeServer{}
+
+func (s *aliasNodeServer) RegisterService(rpcServer *grpc.Server) {
+	csi.RegisterNodeServer(rpcServer, s)
+}
+
+func (s *aliasNodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	resp, err := s.nodeServer.NodeGetInfo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	segments := map[string]string{}
+	for key, value := range resp.AccessibleTopology.Segments {
+		if strings.HasPrefix(key, s.driverName+"/") {
+			key = s.alias + strings.TrimPrefix(key, s.driverName)
+		}
+		segments[key] = value
+	}
+	resp.AccessibleTopology.Segments = segments
+	return resp, nil
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestAliasEndpoint(t *testing.T) {
+	endpoint, err := aliasEndpoint("unix:///csi/csi.sock", "pmem-csi.intel.com")
+	require.NoError(t, err, "unix endpoint")
+	assert.Equal(t, "unix:///csi/pmem-csi.intel.com.sock", endpoint, "alias endpoint")
+
+	_, err = aliasEndpoint("tcp://localhost:10000", "pmem-csi.intel.com")
+	assert.Error(t, err, "tcp endpoint")
+}
+
+func TestCheckAliases(t *testing.T) {
+	assert.NoError(t, checkAliases("new.example.com", nil), "no aliases")
+	assert.NoError(t, checkAliases("new.example.com", []string{"pmem-csi.intel.com"}), "one alias")
+	assert.Error(t, checkAliases("new.example.com", []string{""}), "empty alias")
+	assert.Error(t, checkAliases("new.example.com", []string{"new.example.com"}), "driver name")
+	assert.Error(t, checkAliases("new.example.com", []string{"a", "a"}), "duplicate alias")
+}
+
+func TestAliasNodeGetInfo(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ns := NewNodeServer(newFakeNodeControllerServer(ctx, t), t.TempDir())
+	oldKeys := []string{DriverTopologyKey, DriverRegionTopologyKeyPrefix}
+	defer func() {
+		DriverTopologyKey, DriverRegionTopologyKeyPrefix = oldKeys[0], oldKeys[1]
+	}()
+	DriverTopologyKey, DriverRegionTopologyKeyPrefix = "test/node", "test/region-"
+
+	s := &aliasNodeServer{nodeServer: ns, driverName: "test", alias: "old"}
+	resp, err := s.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	require.NoError(t, err, "NodeGetInfo")
+	assert.Equal(t, map[string]string{
+		"old/node":     "node",
+		"old/region-0": "true",
+	}, resp.GetAccessibleTopology().GetSegments(), "topology")
+
+	// The original node service must not be affected.
+	resp, err = ns.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	require.NoError(t, err, "NodeGetInfo")
+	assert.Equal(t, "node", resp.GetAccessibleTopology().GetSegments()["test/node"], "original topology")
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// backgroundOperations runs operations which may take longer than the
+// caller is willing to wait, like mkfs on a large volume. When the
+// caller gives up, the operation continues. A retry with the same key
+// waits for it instead of starting it again, so the operation itself
+// only needs to be idempotent once it has finished. Operations which
+// must not overlap with it, like deleting the device, cancel it and
+// wait for it first.
+type backgroundOperations struct {
+	mutex sync.Mutex
+	ops   map[string]*backgroundOperation
+}
+
+type backgroundOperation struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	err    error
+}
+
+// run starts the operation unless one with the same key is still
+// running, then waits for it. If the context ends first, it returns
+// DEADLINE_EXCEEDED or CANCELLED to the caller which started the
+// operation and ABORTED to callers which found it running, as
+// defined by the CSI spec for "operation pending for volume".
+func (b *backgroundOperations) run(ctx context.Context, key string, op func(ctx context.Context) error) error {
+	logger := klog.FromContext(ctx)
+
+	b.mutex.Lock()
+	if b.ops == nil {
+		b.ops = map[string]*backgroundOperation{}
+	}
+	o, pending := b.ops[key]
+	if !pending {
+		// Logging still goes to the caller's logger.
+		opCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		o = &backgroundOperation{done: make(chan struct{}), cancel: cancel}
+		b.ops[key] = o
+		go func() {
+			defer cancel()
+			o.err = op(opCtx)
+			b.mutex.Lock()
+			delete(b.ops, key)
+			b.mutex.Unlock()
+			close(o.done)
+		}()
+	}
+	b.mutex.Unlock()
+
+	if pending {
+		logger.V(3).Info("Waiting for operation started earlier", "operation", key)
+	}
+	select {
+	case <-o.done:
+		return o.err
+	case <-ctx.Done():
+		logger.Info("Operation continues in the background", "operation", key)
+		if pending {
+			return status.Errorf(codes.Aborted, "%s: operation still in progress", key)
+		}
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// cancel cancels the operation with the key, if there is one, and
+// waits for it to terminate. Commands which were already started
+// by the operation still complete, the operation has to check its
+// context before starting the next one. If the context ends first,
+// ABORTED is returned.
+func (b *backgroundOperations) cancel(ctx context.Context, key string) error {
+	logger := klog.FromContext(ctx)
+
+	b.mutex.Lock()
+	o, pending := b.ops[key]
+	b.mutex.Unlock()
+	if !pending {
+		return nil
+	}
+
+	logger.V(3).Info("Canceling operation and waiting for it", "operation", key)
+	o.cancel()
+	select {
+	case <-o.done:
+		return nil
+	case <-ctx.Done():
+		return status.Errorf(codes.Aborted, "%s: operation still in progress", key)
+	}
+}
+
+// formatOperation is the key of the operation which formats a volume.
+func formatOperation(volumeID string) string {
+	return "format " + volumeID
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestBackgroundOperations(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	var b backgroundOperations
+
+	// Fast operations just return their result.
+	fakeErr := errors.New("fake error")
+	err := b.run(ctx, "fast", func(ctx context.Context) error { return fakeErr })
+	require.Equal(t, fakeErr, err, "fast operation")
+
+	// A slow operation continues after the caller gave up.
+	unblock := make(chan struct{})
+	slow := func(ctx context.Context) error {
+		<-unblock
+		return ctx.Err()
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err = b.run(timeoutCtx, "slow", slow)
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err), "first call: %v", err)
+
+	// A retry finds it still running.
+	timeoutCtx2, cancel2 := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel2()
+	err = b.run(timeoutCtx2, "slow", slow)
+	require.Equal(t, codes.Aborted, status.Code(err), "retry while pending: %v", err)
+
+	// The next retry gets the result, which must not be affected
+	// by the canceled context of the first caller.
+	done := make(chan error)
+	go func() {
+		done <- b.run(ctx, "slow", slow)
+	}()
+	close(unblock)
+	require.NoError(t, <-done, "retry after completion")
+	require.Empty(t, b.ops, "pending operations")
+}
+
+func TestBackgroundOperationsCancel(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	var b backgroundOperations
+
+	// Nothing to cancel.
+	require.NoError(t, b.cancel(ctx, "none"), "cancel without operation")
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	slow := func(ctx context.Context) error {
+		close(started)
+		<-unblock
+		return ctx.Err()
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err := b.run(timeoutCtx, "slow", slow)
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err), "first call: %v", err)
+	<-started
+
+	// Canceling waits for the operation.
+	timeoutCtx2, cancel2 := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel2()
+	err = b.cancel(timeoutCtx2, "slow")
+	require.Equal(t, codes.Aborted, status.Code(err), "cancel while still running: %v", err)
+
+	close(unblock)
+	require.NoError(t, b.cancel(ctx, "slow"), "cancel after operation returned")
+	require.Empty(t, b.ops, "pending operations")
+}
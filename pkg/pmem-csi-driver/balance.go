@@ -0,0 +1,194 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelistersv1 "k8s.io/client-go/listers/core/v1"
+	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/klog/v2"
+
+	pmemcapacity "github.com/intel/pmem-csi/pkg/pmem-capacity"
+)
+
+// balancePath is the HTTP path under which the controller reports
+// the allocation balance analysis.
+const balancePath = "/balance"
+
+// BalanceReport describes how PMEM volumes are distributed across
+// the nodes which run the driver. Nodes without volumes are included
+// because they are the ones which could take over some load. Nodes
+// with volumes which no longer run the driver are also listed.
+// The report is purely informational:
+// nothing gets moved automatically because PMEM volumes are local
+// to a node and moving them requires copying data, which is something
+// that only an admin can decide to do.
+type BalanceReport struct {
+	// Nodes contains one entry per node, sorted by name.
+	Nodes []NodeAllocation `json:"nodes"`
+	// MeanBytes is the average amount of allocated bytes per node.
+	MeanBytes int64 `json:"meanBytes"`
+	// ImbalanceBytes is the difference between the most and
+	// the least loaded node.
+	ImbalanceBytes int64 `json:"imbalanceBytes"`
+	// Candidates are volumes on nodes with more than the
+	// average allocation. Moving their workloads elsewhere would
+	// bring the node closer to the average.
+	Candidates []RebalanceCandidate `json:"candidates,omitempty"`
+}
+
+// NodeAllocation is the sum of all volumes on a node.
+type NodeAllocation struct {
+	Node           string `json:"node"`
+	Volumes        int    `json:"volumes"`
+	AllocatedBytes int64  `json:"allocatedBytes"`
+}
+
+// RebalanceCandidate identifies one volume and its claim.
+type RebalanceCandidate struct {
+	Node      string `json:"node"`
+	PV        string `json:"pv"`
+	Namespace string `json:"namespace,omitempty"`
+	PVC       string `json:"pvc,omitempty"`
+	Bytes     int64  `json:"bytes"`
+}
+
+type volumeAllocation struct {
+	pv   *v1.PersistentVolume
+	size int64
+}
+
+// analyzeBalance computes a BalanceReport for the given nodes and all
+// persistent volumes which belong to the driver. Volumes without node
+// affinity for the driver topology key are ignored.
+func analyzeBalance(nodes []string, pvs []*v1.PersistentVolume, driverName, topologyKey string) BalanceReport {
+	perNode := map[string][]volumeAllocation{}
+	for _, node := range nodes {
+		perNode[node] = nil
+	}
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			continue
+		}
+		node := pmemcapacity.VolumeNode(pv, topologyKey)
+		if node == "" {
+			continue
+		}
+		size := pv.Spec.Capacity[v1.ResourceStorage]
+		perNode[node] = append(perNode[node], volumeAllocation{pv: pv, size: size.Value()})
+	}
+
+	report := BalanceReport{}
+	if len(perNode) == 0 {
+		return report
+	}
+
+	var total int64
+	for node, volumes := range perNode {
+		allocation := NodeAllocation{
+			Node:    node,
+			Volumes: len(volumes),
+		}
+		for _, volume := range volumes {
+			allocation.AllocatedBytes += volume.size
+		}
+		total += allocation.AllocatedBytes
+		report.Nodes = append(report.Nodes, allocation)
+	}
+	sort.Slice(report.Nodes, func(i, j int) bool {
+		return report.Nodes[i].Node < report.Nodes[j].Node
+	})
+	report.MeanBytes = total / int64(len(report.Nodes))
+
+	min, max := report.Nodes[0].AllocatedBytes, report.Nodes[0].AllocatedBytes
+	for _, allocation := range report.Nodes {
+		if allocation.AllocatedBytes < min {
+			min = allocation.AllocatedBytes
+		}
+		if allocation.AllocatedBytes > max {
+			max = allocation.AllocatedBytes
+		}
+	}
+	report.ImbalanceBytes = max - min
+
+	// On each node above the average, pick the largest volumes
+	// which still fit into the excess. That way we suggest as
+	// few moves as possible without overshooting.
+	for _, allocation := range report.Nodes {
+		excess := allocation.AllocatedBytes - report.MeanBytes
+		if excess <= 0 {
+			continue
+		}
+		volumes := perNode[allocation.Node]
+		sort.Slice(volumes, func(i, j int) bool {
+			if volumes[i].size != volumes[j].size {
+				return volumes[i].size > volumes[j].size
+			}
+			return volumes[i].pv.Name < volumes[j].pv.Name
+		})
+		for _, volume := range volumes {
+			if volume.size == 0 || volume.size > excess {
+				continue
+			}
+			candidate := RebalanceCandidate{
+				Node:  allocation.Node,
+				PV:    volume.pv.Name,
+				Bytes: volume.size,
+			}
+			if ref := volume.pv.Spec.ClaimRef; ref != nil {
+				candidate.Namespace = ref.Namespace
+				candidate.PVC = ref.Name
+			}
+			report.Candidates = append(report.Candidates, candidate)
+			excess -= volume.size
+		}
+	}
+
+	return report
+}
+
+// balanceHandler serves the current BalanceReport as JSON.
+type balanceHandler struct {
+	driverName    string
+	pvLister      corelistersv1.PersistentVolumeLister
+	csiNodeLister storagelistersv1.CSINodeLister
+}
+
+func (b balanceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := klog.FromContext(r.Context()).WithName("balance")
+	pvs, err := b.pvLister.List(labels.Everything())
+	if err != nil {
+		logger.Error(err, "List PVs")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	csiNodes, err := b.csiNodeLister.List(labels.Everything())
+	if err != nil {
+		logger.Error(err, "List CSINodes")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var nodes []string
+	for _, csiNode := range csiNodes {
+		for _, driver := range csiNode.Spec.Drivers {
+			if driver.Name == b.driverName {
+				nodes = append(nodes, csiNode.Name)
+				break
+			}
+		}
+	}
+	report := analyzeBalance(nodes, pvs, b.driverName, DriverTopologyKey)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logger.Error(err, "Encode report")
+	}
+}
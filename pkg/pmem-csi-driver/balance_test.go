@@ -0,0 +1,121 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestAnalyzeBalance(t *testing.T) {
+	topologyKey := driverName + "/node"
+	pv := func(name, node, size string) *v1.PersistentVolume {
+		pv := &v1.PersistentVolume{}
+		pv.Name = name
+		pv.Spec.CSI = &v1.CSIPersistentVolumeSource{Driver: driverName}
+		pv.Spec.Capacity = v1.ResourceList{v1.ResourceStorage: resource.MustParse(size)}
+		pv.Spec.ClaimRef = &v1.ObjectReference{Namespace: "default", Name: "pvc-" + name}
+		pv.Spec.NodeAffinity = &v1.VolumeNodeAffinity{
+			Required: &v1.NodeSelector{
+				NodeSelectorTerms: []v1.NodeSelectorTerm{{
+					MatchExpressions: []v1.NodeSelectorRequirement{{
+						Key:      topologyKey,
+						Operator: v1.NodeSelectorOpIn,
+						Values:   []string{node},
+					}},
+				}},
+			},
+		}
+		return pv
+	}
+
+	other := pv("other", "node-a", "1Gi")
+	other.Spec.CSI.Driver = "other." + driverName
+
+	testcases := map[string]struct {
+		nodes  []string
+		pvs    []*v1.PersistentVolume
+		expect BalanceReport
+	}{
+		"empty": {},
+		"other-driver": {
+			pvs: []*v1.PersistentVolume{other},
+		},
+		"balanced": {
+			pvs: []*v1.PersistentVolume{
+				pv("a", "node-a", "1Gi"),
+				pv("b", "node-b", "1Gi"),
+			},
+			expect: BalanceReport{
+				Nodes: []NodeAllocation{
+					{Node: "node-a", Volumes: 1, AllocatedBytes: 1 << 30},
+					{Node: "node-b", Volumes: 1, AllocatedBytes: 1 << 30},
+				},
+				MeanBytes: 1 << 30,
+			},
+		},
+		"imbalanced": {
+			pvs: []*v1.PersistentVolume{
+				pv("a1", "node-a", "4Gi"),
+				pv("a2", "node-a", "2Gi"),
+				pv("a3", "node-a", "1Gi"),
+				pv("b1", "node-b", "1Gi"),
+				other,
+			},
+			expect: BalanceReport{
+				Nodes: []NodeAllocation{
+					{Node: "node-a", Volumes: 3, AllocatedBytes: 7 << 30},
+					{Node: "node-b", Volumes: 1, AllocatedBytes: 1 << 30},
+				},
+				MeanBytes:      4 << 30,
+				ImbalanceBytes: 6 << 30,
+				Candidates: []RebalanceCandidate{
+					{Node: "node-a", PV: "a2", Namespace: "default", PVC: "pvc-a2", Bytes: 2 << 30},
+					{Node: "node-a", PV: "a3", Namespace: "default", PVC: "pvc-a3", Bytes: 1 << 30},
+				},
+			},
+		},
+		"node-without-volumes": {
+			nodes: []string{"node-a", "node-b", "node-c"},
+			pvs: []*v1.PersistentVolume{
+				pv("a1", "node-a", "2Gi"),
+				pv("a2", "node-a", "1Gi"),
+				pv("b1", "node-b", "3Gi"),
+			},
+			expect: BalanceReport{
+				Nodes: []NodeAllocation{
+					{Node: "node-a", Volumes: 2, AllocatedBytes: 3 << 30},
+					{Node: "node-b", Volumes: 1, AllocatedBytes: 3 << 30},
+					{Node: "node-c"},
+				},
+				MeanBytes:      2 << 30,
+				ImbalanceBytes: 3 << 30,
+				Candidates: []RebalanceCandidate{
+					{Node: "node-a", PV: "a2", Namespace: "default", PVC: "pvc-a2", Bytes: 1 << 30},
+				},
+			},
+		},
+		"no-volumes": {
+			nodes: []string{"node-a"},
+			expect: BalanceReport{
+				Nodes: []NodeAllocation{
+					{Node: "node-a"},
+				},
+			},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			report := analyzeBalance(tc.nodes, tc.pvs, driverName, topologyKey)
+			assert.Equal(t, tc.expect, report)
+		})
+	}
+}
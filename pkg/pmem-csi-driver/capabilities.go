@@ -0,0 +1,104 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/component-base/featuregate"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/driverfeatures"
+)
+
+// capabilities determines which optional parts of the CSI spec get
+// advertised by the identity, controller and node service. The
+// sidecars and kubelet rely on that when deciding which RPCs to call,
+// so something must only be enabled when the driver really supports
+// it with the current device mode.
+//
+// Snapshots are not supported in any mode: namespaces cannot be
+// snapshotted and neither dm-snapshot nor thin pools support DAX.
+type capabilities struct {
+	// expansion enables NodeExpandVolume. Volumes are local to a
+	// node, so there is nothing to do in ControllerExpandVolume and
+	// the central csi-resizer could not reach the right node anyway.
+	// Instead, csi-resizer runs next to each node driver and
+	// kubelet grows device and filesystem with NodeExpandVolume.
+	// Only logical volumes can grow, see checkFeatures.
+	expansion bool
+}
+
+// checkFeatures rejects enabled features which cannot work in the
+// device mode. The fake device manager accepts all of them.
+func checkFeatures(gate featuregate.FeatureGate, mode api.DeviceMode) error {
+	return driverfeatures.CheckDeviceMode(gate, string(mode))
+}
+
+// enableFeatures turns on the capabilities of enabled features.
+// checkFeatures must have accepted the features for the device mode.
+func (c *capabilities) enableFeatures(gate featuregate.FeatureGate) {
+	if gate.Enabled(driverfeatures.Expansion) {
+		c.expansion = true
+	}
+}
+
+func (c capabilities) plugin() []*csi.PluginCapability {
+	caps := []*csi.PluginCapability{
+		{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+				},
+			},
+		},
+		{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+				},
+			},
+		},
+	}
+	if c.expansion {
+		caps = append(caps, &csi.PluginCapability{
+			Type: &csi.PluginCapability_VolumeExpansion_{
+				VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+					Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+				},
+			},
+		})
+	}
+	return caps
+}
+
+func (c capabilities) controller() []csi.ControllerServiceCapability_RPC_Type {
+	return []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+	}
+}
+
+func (c capabilities) node() []*csi.NodeServiceCapability {
+	types := []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+	}
+	if c.expansion {
+		types = append(types, csi.NodeServiceCapability_RPC_EXPAND_VOLUME)
+	}
+	caps := make([]*csi.NodeServiceCapability, 0, len(types))
+	for _, t := range types {
+		caps = append(caps, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: t,
+				},
+			},
+		})
+	}
+	return caps
+}
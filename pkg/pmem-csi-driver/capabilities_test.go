@@ -0,0 +1,107 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/driverfeatures"
+)
+
+func TestCapabilities(t *testing.T) {
+	var none capabilities
+	assert.Len(t, none.plugin(), 2, "default plugin capabilities")
+	assert.Len(t, none.node(), 1, "default node capabilities")
+	all := capabilities{expansion: true}
+	assert.Len(t, all.plugin(), 3, "plugin capabilities")
+	assert.Equal(t, none.controller(), all.controller(), "controller capabilities")
+	assert.NotContains(t, all.controller(), csi.ControllerServiceCapability_RPC_EXPAND_VOLUME, "controller capabilities")
+	assert.NotContains(t, all.controller(), csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT, "controller capabilities")
+	assert.Len(t, all.node(), 2, "node capabilities")
+
+	for name, caps := range map[string]capabilities{"default": none, "all": all} {
+		t.Run(name, func(t *testing.T) {
+			testAdvertisedRPCs(t, caps)
+		})
+	}
+}
+
+// testAdvertisedRPCs checks that the driver implements all RPCs which
+// it advertises.
+func testAdvertisedRPCs(t *testing.T, caps capabilities) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+	cs.caps = caps
+	ns := NewNodeServer(cs, t.TempDir())
+	ids := NewIdentityServer("pmem-csi.intel.com", "test", cs.caps)
+
+	pluginCaps, err := ids.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{})
+	require.NoError(t, err, "GetPluginCapabilities")
+	expansion := false
+	for _, cap := range pluginCaps.Capabilities {
+		if cap.GetVolumeExpansion() != nil {
+			expansion = true
+		}
+	}
+	assert.Equal(t, caps.expansion, expansion, "volume expansion advertised")
+
+	controllerCaps, err := cs.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+	require.NoError(t, err, "ControllerGetCapabilities")
+	for _, cap := range controllerCaps.Capabilities {
+		var err error
+		switch cap.GetRpc().GetType() {
+		case csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME:
+			_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{})
+		case csi.ControllerServiceCapability_RPC_LIST_VOLUMES:
+			_, err = cs.ListVolumes(ctx, &csi.ListVolumesRequest{})
+		case csi.ControllerServiceCapability_RPC_GET_CAPACITY:
+			_, err = cs.GetCapacity(ctx, &csi.GetCapacityRequest{})
+		default:
+			t.Errorf("unexpected controller capability %s", cap.GetRpc().GetType())
+		}
+		assert.NotEqual(t, codes.Unimplemented, status.Code(err), "%s", cap.GetRpc().GetType())
+	}
+
+	nodeCaps, err := ns.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	require.NoError(t, err, "NodeGetCapabilities")
+	expansion = false
+	for _, cap := range nodeCaps.Capabilities {
+		var err error
+		switch cap.GetRpc().GetType() {
+		case csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME:
+			_, err = ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{})
+		case csi.NodeServiceCapability_RPC_EXPAND_VOLUME:
+			expansion = true
+			_, err = ns.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{})
+		default:
+			t.Errorf("unexpected node capability %s", cap.GetRpc().GetType())
+		}
+		assert.NotEqual(t, codes.Unimplemented, status.Code(err), "%s", cap.GetRpc().GetType())
+	}
+	assert.Equal(t, caps.expansion, expansion, "node expansion advertised")
+}
+
+func TestCheckFeatures(t *testing.T) {
+	gate := driverfeatures.NewFeatureGate()
+	require.NoError(t, checkFeatures(gate, api.DeviceModeDirect), "defaults")
+	require.NoError(t, gate.Set("Expansion=true"), "enable expansion")
+	require.NoError(t, checkFeatures(gate, api.DeviceModeLVM), "expansion in LVM mode")
+	require.NoError(t, checkFeatures(gate, api.DeviceModeFake), "expansion in fake mode")
+	require.Error(t, checkFeatures(gate, api.DeviceModeDirect), "expansion in direct mode")
+
+	var caps capabilities
+	caps.enableFeatures(gate)
+	assert.True(t, caps.expansion, "expansion enabled")
+}
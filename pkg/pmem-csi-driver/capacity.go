@@ -0,0 +1,93 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// adaptiveCapacity caches the capacity of a device manager. The
+// external-provisioner polls GetCapacity at a fixed interval, but
+// capacity usually only changes when volumes get created or
+// deleted. While nothing changes, the cached value is used for
+// longer and longer, up to maxInterval. Creating or deleting a volume
+// invalidates the cache and resets the interval to minInterval, so
+// capacity is fresh when there is churn.
+//
+// A minInterval of zero disables caching.
+type adaptiveCapacity struct {
+	pmdmanager.PmemDeviceCapacity
+	minInterval, maxInterval time.Duration
+	now                      func() time.Time
+
+	mutex    sync.Mutex
+	cached   *pmdmanager.Capacity
+	updated  time.Time
+	interval time.Duration
+}
+
+var _ pmdmanager.PmemDeviceCapacity = &adaptiveCapacity{}
+
+func newAdaptiveCapacity(dm pmdmanager.PmemDeviceCapacity, minInterval, maxInterval time.Duration) *adaptiveCapacity {
+	if maxInterval < minInterval {
+		maxInterval = minInterval
+	}
+	return &adaptiveCapacity{
+		PmemDeviceCapacity: dm,
+		minInterval:        minInterval,
+		maxInterval:        maxInterval,
+		now:                time.Now,
+		interval:           minInterval,
+	}
+}
+
+func (c *adaptiveCapacity) GetCapacity(ctx context.Context) (pmdmanager.Capacity, error) {
+	logger := klog.FromContext(ctx).WithName("adaptiveCapacity")
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	if c.cached != nil && now.Sub(c.updated) < c.interval {
+		logger.V(5).Info("Using cached capacity", "age", now.Sub(c.updated), "interval", c.interval)
+		return *c.cached, nil
+	}
+
+	capacity, err := c.PmemDeviceCapacity.GetCapacity(ctx)
+	if err != nil {
+		return capacity, err
+	}
+	if c.cached != nil && *c.cached == capacity {
+		// Idle, check less often.
+		c.interval *= 2
+		if c.interval > c.maxInterval {
+			c.interval = c.maxInterval
+		}
+	} else {
+		c.interval = c.minInterval
+	}
+	logger.V(5).Info("Refreshed capacity", "capacity", capacity, "interval", c.interval)
+	c.cached = &capacity
+	c.updated = now
+	return capacity, nil
+}
+
+// invalidate ensures that the next GetCapacity call queries the
+// device manager and resets the interval.
+func (c *adaptiveCapacity) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.cached = nil
+	c.interval = c.minInterval
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+type countingCapacity struct {
+	capacity pmdmanager.Capacity
+	calls    int
+}
+
+func (c *countingCapacity) GetCapacity(ctx context.Context) (pmdmanager.Capacity, error) {
+	c.calls++
+	return c.capacity, nil
+}
+
+func TestAdaptiveCapacity(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm := &countingCapacity{capacity: pmdmanager.Capacity{Available: 100}}
+	c := newAdaptiveCapacity(dm, time.Second, 4*time.Second)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	get := func(expectedCalls int, expectedInterval time.Duration) {
+		t.Helper()
+		capacity, err := c.GetCapacity(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, dm.capacity, capacity, "capacity")
+		assert.Equal(t, expectedCalls, dm.calls, "calls")
+		assert.Equal(t, expectedInterval, c.interval, "interval")
+	}
+
+	get(1, time.Second)
+	get(1, time.Second)
+
+	// Idle: the interval grows up to the maximum.
+	now = now.Add(time.Second)
+	get(2, 2*time.Second)
+	now = now.Add(time.Second)
+	get(2, 2*time.Second)
+	now = now.Add(time.Second)
+	get(3, 4*time.Second)
+	now = now.Add(4 * time.Second)
+	get(4, 4*time.Second)
+
+	// Changes reset the interval.
+	dm.capacity.Available = 50
+	now = now.Add(4 * time.Second)
+	get(5, time.Second)
+
+	// So does invalidation.
+	now = now.Add(time.Second)
+	get(6, 2*time.Second)
+	c.invalidate()
+	get(7, time.Second)
+}
+
+func TestAdaptiveCapacityDisabled(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm := &countingCapacity{}
+	c := newAdaptiveCapacity(dm, 0, 0)
+	for i := 1; i <= 3; i++ {
+		_, err := c.GetCapacity(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, i, dm.calls, "calls")
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	corelistersv1 "k8s.io/client-go/listers/core/v1"
+	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/klog/v2"
+
+	pmemcapacity "github.com/intel/pmem-csi/pkg/pmem-capacity"
+)
+
+var (
+	capacityTotalDesc = prometheus.NewDesc(
+		"pmem_capacity_total",
+		"PMEM in the topology segment that can be used for volumes, i.e. free capacity plus the size of existing volumes.",
+		[]string{"node", "segment"}, nil,
+	)
+	capacityFreeDesc = prometheus.NewDesc(
+		"pmem_capacity_free",
+		"PMEM in the topology segment that is available for new volumes.",
+		[]string{"node", "segment"}, nil,
+	)
+)
+
+// capacityCollector reports capacity per topology segment, based on
+// the CSIStorageCapacity objects that external-provisioner maintains
+// on the nodes.
+type capacityCollector struct {
+	driverName     string
+	capacityLister storagelistersv1.CSIStorageCapacityLister
+	// capacitySynced, if set, returns false while the
+	// CSIStorageCapacity objects are still being retrieved.
+	capacitySynced func() bool
+	scLister       storagelistersv1.StorageClassLister
+	pvLister       corelistersv1.PersistentVolumeLister
+}
+
+// hasCSIStorageCapacityV1 checks whether the apiserver serves
+// CSIStorageCapacity objects in storage.k8s.io/v1, which is the
+// case since Kubernetes 1.24.
+func hasCSIStorageCapacityV1(client kubernetes.Interface) (bool, error) {
+	resources, err := client.Discovery().ServerResourcesForGroupVersion(storagev1.SchemeGroupVersion.String())
+	if err != nil {
+		return false, fmt.Errorf("discover %s resources: %v", storagev1.SchemeGroupVersion, err)
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == "csistoragecapacities" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// MustRegister adds the collector to the registry, using labels to tag each sample with the driver name.
+func (cc capacityCollector) MustRegister(reg prometheus.Registerer) {
+	labels := prometheus.Labels{
+		"driver_name": cc.driverName,
+	}
+	prometheus.WrapRegistererWith(labels, reg).MustRegister(cc)
+}
+
+// Describe implements prometheus.Collector.Describe.
+func (cc capacityCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- capacityTotalDesc
+	ch <- capacityFreeDesc
+}
+
+// Collect implements prometheus.Collector.Collect.
+func (cc capacityCollector) Collect(ch chan<- prometheus.Metric) {
+	logger := klog.Background().WithName("capacity-metrics")
+	if cc.capacitySynced != nil && !cc.capacitySynced() {
+		// Incomplete data would look like lost capacity.
+		return
+	}
+	capacities, err := cc.capacityLister.List(labels.Everything())
+	if err != nil {
+		logger.Error(err, "List CSIStorageCapacity objects")
+		return
+	}
+	scs, err := cc.scLister.List(labels.Everything())
+	if err != nil {
+		logger.Error(err, "List storage classes")
+		return
+	}
+	provisioners := make(map[string]string, len(scs))
+	for _, sc := range scs {
+		provisioners[sc.Name] = sc.Provisioner
+	}
+	pvs, err := cc.pvLister.List(labels.Everything())
+	if err != nil {
+		logger.Error(err, "List PVs")
+		return
+	}
+
+	for _, s := range pmemcapacity.BySegment(capacities, provisioners, pvs, cc.driverName, DriverTopologyKey) {
+		ch <- prometheus.MustNewConstMetric(capacityTotalDesc, prometheus.GaugeValue, float64(s.Total), s.Node, s.Segment)
+		ch <- prometheus.MustNewConstMetric(capacityFreeDesc, prometheus.GaugeValue, float64(s.Free), s.Node, s.Segment)
+	}
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestHasCSIStorageCapacityV1(t *testing.T) {
+	for name, tc := range map[string]struct {
+		resources []metav1.APIResource
+		expected  bool
+	}{
+		"1.23": {
+			resources: []metav1.APIResource{{Name: "csinodes"}, {Name: "storageclasses"}},
+		},
+		"1.24": {
+			resources: []metav1.APIResource{{Name: "csinodes"}, {Name: "csistoragecapacities"}, {Name: "storageclasses"}},
+			expected:  true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			client.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{
+				GroupVersion: storagev1.SchemeGroupVersion.String(),
+				APIResources: tc.resources,
+			}}
+			actual, err := hasCSIStorageCapacityV1(client)
+			require.NoError(t, err, "discovery")
+			assert.Equal(t, tc.expected, actual, "CSIStorageCapacity v1 supported")
+		})
+	}
+}
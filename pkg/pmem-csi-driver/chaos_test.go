@@ -0,0 +1,331 @@
+//go:build chaos
+// +build chaos
+
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"k8s.io/klog/v2/ktesting"
+	"k8s.io/utils/mount"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+var (
+	chaosRounds = flag.Int("chaos-rounds", 20, "number of volume life cycles in TestChaos")
+	chaosSeed   = flag.Int64("chaos-seed", 0, "seed for the random faults in TestChaos, 0 picks one based on the current time")
+)
+
+const (
+	// chaosFaultPercent is the probability of each kind of RPC
+	// fault: request dropped, response dropped, caller timing out.
+	chaosFaultPercent = 10
+	// chaosRestartPercent is the probability of restarting the
+	// driver before retrying an operation.
+	chaosRestartPercent = 10
+	// chaosMkfsKillPercent is the probability of killing mkfs
+	// before it finishes.
+	chaosMkfsKillPercent = 30
+	// chaosMaxAttempts is the number of attempts after which an
+	// operation is considered to not converge.
+	chaosMaxAttempts = 100
+)
+
+// TestChaos repeatedly goes through the life cycle of a volume on the
+// node while injecting faults: mkfs gets killed midway, requests or
+// responses get lost, callers give up early and the driver restarts
+// between operations. Like kubelet, the test retries each operation
+// until it succeeds and then checks that the node is in the expected
+// state.
+//
+// The fake device manager hands out a loop device, so the test needs
+// root privileges and really formats and mounts it. It is not part of
+// the normal unit tests and must be enabled explicitly:
+//
+//	sudo go test -tags chaos -run TestChaos ./pkg/pmem-csi-driver/ -chaos-rounds 100
+//
+// A failure can be reproduced with the seed that gets logged.
+func TestChaos(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chaos test needs root privileges")
+	}
+	for _, cmd := range []string{"losetup", "wipefs", "mkfs.ext4", "e2fsck", "timeout", "bash", "file", "blkid", "mount"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			t.Skipf("chaos test needs %s: %v", cmd, err)
+		}
+	}
+
+	_, ctx := ktesting.NewTestContext(t)
+	seed := *chaosSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("chaos seed: %d", seed)
+
+	tmp := t.TempDir()
+	loop := loopDevice(ctx, t, tmp, 64*1024*1024)
+	killingMkfs(t, filepath.Join(tmp, "bin"), chaosMkfsKillPercent)
+	d := newChaosDriver(ctx, t, tmp, rand.New(rand.NewSource(seed)))
+
+	for round := 0; round < *chaosRounds; round++ {
+		t.Logf("round #%d", round)
+		_, err := pmemexec.RunCommand(ctx, "wipefs", "-a", loop)
+		require.NoError(t, err, "wipe loop device")
+		d.lifecycle(ctx, fmt.Sprintf("pvc-chaos-%d", round), loop)
+	}
+
+	devices, err := d.dm.ListDevices(ctx)
+	require.NoError(t, err, "list devices")
+	require.Empty(t, devices, "leaked devices")
+	require.Empty(t, d.cs.pmemVolumes, "leaked volumes")
+	mounts, err := mount.New("").List()
+	require.NoError(t, err, "list mounts")
+	for _, mp := range mounts {
+		require.False(t, strings.HasPrefix(mp.Path, tmp), "leaked mount %s of %s", mp.Path, mp.Device)
+	}
+}
+
+// chaosDriver is a node driver which can be restarted. The device
+// manager and the state directory survive a restart, everything
+// else is created anew.
+type chaosDriver struct {
+	t        *testing.T
+	rand     *rand.Rand
+	dir      string
+	dm       pmdmanager.PmemDeviceManager
+	cs       *nodeControllerServer
+	ns       *nodeServer
+	restarts int
+}
+
+func newChaosDriver(ctx context.Context, t *testing.T, dir string, r *rand.Rand) *chaosDriver {
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100)
+	require.NoError(t, err, "create fake device manager")
+	d := &chaosDriver{
+		t:    t,
+		rand: r,
+		dir:  dir,
+		dm:   dm,
+	}
+	d.start(ctx)
+	return d
+}
+
+func (d *chaosDriver) start(ctx context.Context) {
+	sm, err := pmemstate.NewFileState(filepath.Join(d.dir, "state"))
+	require.NoError(d.t, err, "create state")
+	d.cs = NewNodeControllerServer(ctx, nodeName, d.dm, sm)
+	d.ns = NewNodeServer(d.cs, filepath.Join(d.dir, "mount"))
+}
+
+// restart replaces the driver instance. Operations which continue in
+// the background are waited for because they would have been killed
+// together with the driver process. Their effect on the device, an
+// interrupted mkfs, is covered by killing mkfs directly.
+func (d *chaosDriver) restart(ctx context.Context) {
+	d.restarts++
+	klog.FromContext(ctx).Info("Restarting driver", "restarts", d.restarts)
+	for {
+		d.cs.operations.mutex.Lock()
+		pending := len(d.cs.operations.ops)
+		d.cs.operations.mutex.Unlock()
+		if pending == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	d.start(ctx)
+}
+
+// call invokes the operation with random faults injected. The
+// operation must use the current driver instance when it gets
+// invoked.
+func (d *chaosDriver) call(ctx context.Context, op func(ctx context.Context) error) error {
+	switch n := d.rand.Intn(100); {
+	case n < chaosFaultPercent:
+		return status.Error(codes.Unavailable, "chaos: request dropped")
+	case n < 2*chaosFaultPercent:
+		if err := op(ctx); err != nil {
+			return err
+		}
+		return status.Error(codes.Unavailable, "chaos: response dropped")
+	case n < 3*chaosFaultPercent:
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(d.rand.Intn(100))*time.Millisecond)
+		defer cancel()
+		return op(ctx)
+	default:
+		return op(ctx)
+	}
+}
+
+// converge retries the operation until it succeeds, restarting the
+// driver randomly in between.
+func (d *chaosDriver) converge(ctx context.Context, what string, op func(ctx context.Context) error) {
+	logger := klog.FromContext(ctx)
+	for attempt := 1; ; attempt++ {
+		err := d.call(ctx, op)
+		if err == nil {
+			return
+		}
+		logger.Info("Operation failed", "operation", what, "attempt", attempt, "err", err)
+		require.Less(d.t, attempt, chaosMaxAttempts, "%s does not converge, last error: %v", what, err)
+		if d.rand.Intn(100) < chaosRestartPercent {
+			d.restart(ctx)
+		}
+	}
+}
+
+// lifecycle creates, stages, publishes, uses and removes one volume.
+func (d *chaosDriver) lifecycle(ctx context.Context, name, devicePath string) {
+	t := d.t
+	stagingPath := filepath.Join(d.dir, "staging")
+	targetPath := filepath.Join(d.dir, "target")
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	var volume *csi.Volume
+	d.converge(ctx, "CreateVolume", func(ctx context.Context) error {
+		resp, err := d.cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			VolumeCapabilities: []*csi.VolumeCapability{capability},
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 32 * 1024 * 1024},
+		})
+		volume = resp.GetVolume()
+		return err
+	})
+	// The fake device manager returns the same instance each time,
+	// so this redirects staging and publishing to the loop device.
+	device, err := d.dm.GetDevice(ctx, volume.VolumeId)
+	require.NoError(t, err, "get device")
+	device.Path = devicePath
+
+	d.converge(ctx, "NodeStageVolume", func(ctx context.Context) error {
+		_, err := d.ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          volume.VolumeId,
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  capability,
+			VolumeContext:     volume.VolumeContext,
+		})
+		return err
+	})
+	if d.rand.Intn(2) == 0 {
+		d.restart(ctx)
+	}
+	d.converge(ctx, "NodePublishVolume", func(ctx context.Context) error {
+		_, err := d.ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:          volume.VolumeId,
+			StagingTargetPath: stagingPath,
+			TargetPath:        targetPath,
+			VolumeCapability:  capability,
+			VolumeContext:     volume.VolumeContext,
+		})
+		return err
+	})
+
+	// The bind mount must show the staged filesystem.
+	data := []byte(name)
+	require.NoError(t, os.WriteFile(filepath.Join(targetPath, "data"), data, 0644), "write into published volume")
+	staged, err := os.ReadFile(filepath.Join(stagingPath, "data"))
+	require.NoError(t, err, "read from staged volume")
+	require.Equal(t, data, staged, "content of staged volume")
+
+	d.converge(ctx, "NodeUnpublishVolume", func(ctx context.Context) error {
+		_, err := d.ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   volume.VolumeId,
+			TargetPath: targetPath,
+		})
+		return err
+	})
+	_, err = os.Lstat(targetPath)
+	require.True(t, os.IsNotExist(err), "target removed, got: %v", err)
+
+	d.converge(ctx, "NodeUnstageVolume", func(ctx context.Context) error {
+		_, err := d.ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+			VolumeId:          volume.VolumeId,
+			StagingTargetPath: stagingPath,
+		})
+		return err
+	})
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(stagingPath)
+	require.NoError(t, err, "check staging path")
+	require.True(t, notMnt, "staging path unmounted")
+
+	// Interrupted mkfs runs must not have left a broken filesystem
+	// behind that then got used.
+	_, err = pmemexec.RunCommand(ctx, "e2fsck", "-f", "-n", devicePath)
+	require.NoError(t, err, "check filesystem")
+
+	d.converge(ctx, "DeleteVolume", func(ctx context.Context) error {
+		_, err := d.cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+			VolumeId: volume.VolumeId,
+		})
+		return err
+	})
+}
+
+// loopDevice creates a loop device of the given size that gets
+// removed together with all mounts below dir when the test is done.
+func loopDevice(ctx context.Context, t *testing.T, dir string, size int64) string {
+	file := filepath.Join(dir, "loop.img")
+	f, err := os.Create(file)
+	require.NoError(t, err, "create loop file")
+	require.NoError(t, f.Truncate(size), "resize loop file")
+	require.NoError(t, f.Close(), "close loop file")
+	output, err := pmemexec.RunCommand(ctx, "losetup", "--find", "--show", file)
+	require.NoError(t, err, "create loop device")
+	loop := strings.TrimSpace(output)
+	t.Cleanup(func() {
+		if mounts, err := mount.New("").List(); err == nil {
+			for i := len(mounts) - 1; i >= 0; i-- {
+				if strings.HasPrefix(mounts[i].Path, dir) {
+					_, _ = pmemexec.RunCommand(ctx, "umount", mounts[i].Path)
+				}
+			}
+		}
+		_, _ = pmemexec.RunCommand(ctx, "losetup", "-d", loop)
+	})
+	return loop
+}
+
+// killingMkfs installs a wrapper for mkfs.ext4 in dir and puts it
+// first in PATH. The wrapper kills the real mkfs.ext4 after a few
+// milliseconds with the given probability.
+func killingMkfs(t *testing.T, dir string, percent int) {
+	mkfs, err := exec.LookPath("mkfs.ext4")
+	require.NoError(t, err, "find mkfs.ext4")
+	require.NoError(t, os.MkdirAll(dir, 0755), "create directory for mkfs wrapper")
+	script := fmt.Sprintf(`#!/bin/bash
+if [ $((RANDOM %% 100)) -lt %d ]; then
+    exec timeout -s KILL 0.0$((RANDOM %% 9 + 1)) %s "$@"
+fi
+exec %s "$@"
+`, percent, mkfs, mkfs)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "mkfs.ext4"), []byte(script), 0755), "create mkfs wrapper")
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
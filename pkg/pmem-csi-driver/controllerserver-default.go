@@ -43,12 +43,17 @@ func (cs *DefaultControllerServer) DeleteVolume(ctx context.Context, req *csi.De
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
+// ControllerPublishVolume is not needed because PMEM is local to the
+// node. The PUBLISH_UNPUBLISH_VOLUME capability is never advertised
+// and the CSIDriver object has attachRequired=false, so Kubernetes
+// doesn't create VolumeAttachment objects and never calls this.
 func (cs *DefaultControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	return nil, status.Error(codes.Unimplemented, "attaching volumes is not required")
 }
 
+// ControllerUnpublishVolume is not needed, see ControllerPublishVolume.
 func (cs *DefaultControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	return nil, status.Error(codes.Unimplemented, "attaching volumes is not required")
 }
 
 func (cs *DefaultControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
@@ -14,16 +14,20 @@ import (
 	"math"
 	"strconv"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/wrapperspb"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/google/uuid"
 
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
 	pmemerr "github.com/intel/pmem-csi/pkg/errors"
 	grpcserver "github.com/intel/pmem-csi/pkg/grpc-server"
 	pmemlog "github.com/intel/pmem-csi/pkg/logger"
@@ -41,11 +45,25 @@ type nodeVolume struct {
 
 type nodeControllerServer struct {
 	*DefaultControllerServer
-	nodeID      string
-	dm          pmdmanager.PmemDeviceManager
-	sm          pmemstate.StateManager
-	pmemVolumes map[string]*nodeVolume // map of reqID:nodeVolume
-	mutex       sync.Mutex             // lock for pmemVolumes
+	caps           capabilities // the optional features that get advertised in the current mode
+	nodeID         string
+	dm             pmdmanager.PmemDeviceManager
+	sm             pmemstate.StateManager
+	capacity       *adaptiveCapacity
+	hook           *volumeHook            // optional, notified about created and deleted volumes
+	quota          NamespaceQuota         // optional, limits volume size per PVC namespace
+	ephemeralQuota EphemeralQuota         // optional, limits ephemeral volume size per pod and node
+	quotaMutex     sync.Mutex             // serializes checking the quota or volume limit and reserving space
+	maxVolumes     int                    // optional, limits the number of volumes on the node
+	recorder       record.EventRecorder   // optional, used for events about the node
+	limiter        deviceLimiter          // optional, limits concurrent device operations
+	inFlight       inFlight               // rejects retries of running CreateVolume and DeleteVolume calls
+	operations     backgroundOperations   // formatting which continues after NodeStageVolume returned
+	pool           *volumePool            // optional, provides pre-formatted devices
+	pmemVolumes    map[string]*nodeVolume // map of reqID:nodeVolume
+	volumeIDs      map[string]string      // map of volume name:reqID, index for pmemVolumes
+	reservations   map[*reservation]bool  // space for volumes which are being created or grown
+	mutex          sync.Mutex             // lock for pmemVolumes, volumeIDs and reservations
 }
 
 var _ csi.ControllerServer = &nodeControllerServer{}
@@ -56,18 +74,17 @@ var nodeVolumeMutex = keymutex.NewHashed(-1)
 func NewNodeControllerServer(ctx context.Context, nodeID string, dm pmdmanager.PmemDeviceManager, sm pmemstate.StateManager) *nodeControllerServer {
 	ctx, logger := pmemlog.WithName(ctx, "NewNodeControllerServer")
 
-	serverCaps := []csi.ControllerServiceCapability_RPC_Type{
-		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
-		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
-	}
-
+	// Optional features get enabled later, see enableFeatures.
+	var caps capabilities
 	ncs := &nodeControllerServer{
-		DefaultControllerServer: NewDefaultControllerServer(serverCaps),
+		DefaultControllerServer: NewDefaultControllerServer(caps.controller()),
+		caps:                    caps,
 		nodeID:                  nodeID,
 		dm:                      dm,
 		sm:                      sm,
+		capacity:                newAdaptiveCapacity(dm, 0, 0),
 		pmemVolumes:             map[string]*nodeVolume{},
+		volumeIDs:               map[string]string{},
 	}
 
 	// Restore provisioned volumes from state.
@@ -77,6 +94,10 @@ func NewNodeControllerServer(ctx context.Context, nodeID string, dm pmdmanager.P
 		if err != nil {
 			logger.Error(err, "Failed to get volumes")
 		}
+		deviceIDs := make(map[string]bool, len(devices))
+		for _, devInfo := range devices {
+			deviceIDs[devInfo.VolumeId] = true
+		}
 		cleanupList := []string{}
 		ids, err := sm.GetAll()
 		if err != nil {
@@ -113,16 +134,11 @@ func NewNodeControllerServer(ctx context.Context, nodeID string, dm pmdmanager.P
 				}
 			} else {
 				// See if the device data stored at StateManager is still valid
-				for _, devInfo := range devices {
-					if devInfo.VolumeId == id {
-						found = true
-						break
-					}
-				}
+				found = deviceIDs[id]
 			}
 
 			if found {
-				ncs.pmemVolumes[id] = vol
+				ncs.addVolume(vol)
 			} else {
 				// if not found in DeviceManager's list, add to cleanupList
 				cleanupList = append(cleanupList, id)
@@ -143,7 +159,8 @@ func (cs *nodeControllerServer) RegisterService(rpcServer *grpc.Server) {
 	csi.RegisterControllerServer(rpcServer, cs)
 }
 
-func (cs *nodeControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+func (cs *nodeControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (_ *csi.CreateVolumeResponse, finalErr error) {
+	defer observeVolumeOperation(ctx, "CreateVolume", time.Now(), &finalErr)
 	topology := []*csi.Topology{}
 
 	var resp *csi.CreateVolumeResponse
@@ -155,20 +172,70 @@ func (cs *nodeControllerServer) CreateVolume(ctx context.Context, req *csi.Creat
 	if req.GetVolumeCapabilities() == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
 	}
+	// A new volume is empty. Staging it read-only would fail
+	// because it cannot be formatted, so read-only access is
+	// only possible for imported volumes.
+	for _, cap := range req.GetVolumeCapabilities() {
+		if readOnlyAccess(cap) {
+			return nil, status.Errorf(codes.InvalidArgument, "access mode %s is not supported for new volumes, only for imported ones", cap.GetAccessMode().GetMode())
+		}
+	}
 
 	if len(req.GetName()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
 	}
 
+	// Restoring a snapshot or cloning a volume would have to happen
+	// on the node which holds the data, but there are no snapshots
+	// of PMEM-CSI volumes and cloning is not supported. Creating
+	// an empty volume instead would silently lose data.
+	switch source := req.GetVolumeContentSource(); {
+	case source.GetSnapshot() != nil:
+		return nil, status.Errorf(codes.InvalidArgument, "restoring snapshot %q is not supported: PMEM-CSI volumes are local to node %s and cannot be restored from a snapshot", source.GetSnapshot().GetSnapshotId(), cs.nodeID)
+	case source.GetVolume() != nil:
+		return nil, status.Errorf(codes.InvalidArgument, "cloning volume %q is not supported", source.GetVolume().GetVolumeId())
+	}
+
 	p, err := parameters.Parse(parameters.CreateVolumeOrigin, req.GetParameters())
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, "persistent volume: "+err.Error())
 	}
+	if p.GetEncrypted() {
+		// The passphrase is only available in NodeStageVolume,
+		// which does nothing for raw block volumes.
+		for _, cap := range req.GetVolumeCapabilities() {
+			if cap.GetBlock() != nil {
+				return nil, status.Error(codes.InvalidArgument, "encryption is not supported for raw block volumes")
+			}
+		}
+		// Provisioner secrets are optional. When the storage
+		// class has them, a misconfiguration gets reported
+		// already when creating the volume instead of when a
+		// pod tries to use it.
+		if len(req.GetSecrets()) > 0 {
+			if _, err := cryptPassphrase(req.GetSecrets()); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+		}
+	}
 
-	nodeVolumeMutex.LockKey(req.Name)
+	recent, done, err := cs.inFlight.start("CreateVolume", req.Name, req)
+	if err != nil {
+		return nil, err
+	}
 	defer func() {
-		_ = nodeVolumeMutex.UnlockKey(req.Name)
+		if resp == nil {
+			// Not a typed nil, that would be stored as response.
+			done(nil)
+			return
+		}
+		done(resp)
 	}()
+	if recent, ok := recent.(*csi.CreateVolumeResponse); ok && cs.getVolumeByID(recent.Volume.VolumeId) != nil {
+		klog.FromContext(ctx).V(4).Info("Returning result of recent call", "volume-name", req.Name, "volume-id", recent.Volume.VolumeId)
+		resp = recent
+		return resp, nil
+	}
 
 	volumeID, size, err := cs.createVolumeInternal(ctx,
 		p,
@@ -189,6 +256,14 @@ func (cs *nodeControllerServer) CreateVolume(ctx context.Context, req *csi.Creat
 
 	// Prepare the volume context. Including the name is useful for logging.
 	p.Name = &req.Name
+	// The PVC metadata is only stored on the node. Kubernetes
+	// already has it and NodePublishVolume does not accept it.
+	p.PVCName, p.PVCNamespace, p.PVName = nil, nil, nil
+	if vol := cs.getVolumeByID(volumeID); vol != nil {
+		if signature, ok := vol.Params[parameters.Signature]; ok {
+			p.Signature = &signature
+		}
+	}
 	volumeContext := p.ToContext()
 
 	resp = &csi.CreateVolumeResponse{
@@ -216,6 +291,12 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 	logger := klog.FromContext(ctx).WithValues("volume-name", volumeName)
 	ctx = klog.NewContext(ctx, logger)
 
+	// Serialize by the VolumeId that a new volume gets, the same
+	// key that DeleteVolume and the orphan checker use.
+	lockID := generateVolumeID(volumeName)
+	nodeVolumeMutex.LockKey(lockID)
+	defer nodeVolumeMutex.UnlockKey(lockID) //nolint: errcheck
+
 	// Keep volume name as part of volume parameters for use in
 	// getVolumeByName.
 	p.Name = &volumeName
@@ -250,9 +331,38 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 		return
 	}
 
+	ephemeral := p.GetPersistency() == parameters.PersistencyEphemeral
+	if _, limited := cs.quota.limit(p.GetPVCNamespace()); limited || cs.maxVolumes > 0 || ephemeral && cs.ephemeralQuota.enabled() {
+		// The reservation counts as used until the volume
+		// was added, so the device can be created without
+		// blocking other volumes.
+		release, err := cs.reserve(ctx, &reservation{
+			namespace: p.GetPVCNamespace(),
+			podUID:    p.GetPodUID(),
+			ephemeral: ephemeral,
+			size:      asked,
+			newVolume: true,
+		})
+		if err != nil {
+			statusErr = err
+			return
+		}
+		defer release()
+	}
+
 	// Set which device manager was used to create the volume
 	mode := cs.dm.GetMode()
 	p.DeviceMode = &mode
+	if p.NamespaceMode != nil && *p.NamespaceMode != parameters.NamespaceModeFsdax && mode != api.DeviceModeDirect {
+		statusErr = status.Error(codes.InvalidArgument, fmt.Sprintf("namespace mode %q is only supported in %q mode, use usage %q instead", *p.NamespaceMode, api.DeviceModeDirect, parameters.UsageFileIO))
+		return
+	}
+
+	regions, _ := cs.dm.(pmdmanager.PmemDeviceRegions)
+	if _, ok := p.GetRegion(); ok && regions == nil {
+		statusErr = status.Errorf(codes.InvalidArgument, "parameter %q is not supported in %q mode", parameters.Region, mode)
+		return
+	}
 
 	vol := &nodeVolume{
 		ID:     volumeID,
@@ -277,38 +387,89 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 			}
 		}()
 	}
-	actualSize, err := cs.dm.CreateDevice(ctx, volumeID, uint64(asked), p.GetUsage())
-	if err != nil {
-		code := codes.Internal
-		if errors.Is(err, pmemerr.NotEnoughSpace) {
-			code = codes.ResourceExhausted
+	overhead := deviceOverhead(p, asked)
+	actualSize, pooled := cs.pool.take(ctx, volumeID, asked, p, volumeCapabilities)
+	if !pooled {
+		release, err := cs.limiter.acquire(ctx, "create device")
+		if err != nil {
+			statusErr = err
+			return
+		}
+		createDevice := func() (uint64, error) {
+			if region, ok := p.GetRegion(); ok {
+				return regions.CreateDeviceInRegion(ctx, volumeID, uint64(asked+overhead), p.GetUsage(), region)
+			}
+			return cs.dm.CreateDevice(ctx, volumeID, uint64(asked+overhead), p.GetUsage())
+		}
+		actualSize, err = createDevice()
+		if errors.Is(err, pmemerr.NotEnoughSpace) && cs.pool.drain(ctx) {
+			// The space of the pools was reported as
+			// available, so it has to be used now.
+			actualSize, err = createDevice()
+		}
+		release()
+		cs.capacity.invalidate()
+		if err != nil {
+			code := codes.Internal
+			if errors.Is(err, pmemerr.NotEnoughSpace) {
+				code = codes.ResourceExhausted
+			}
+			statusErr = status.Errorf(code, "device creation failed: %v", err)
+			return
+		}
+	}
+	changed := false
+	if signatures, ok := cs.dm.(pmdmanager.PmemDeviceSignatures); ok {
+		// The signature ties the device to this volume, see
+		// checkSignature.
+		signature := uuid.New().String()
+		if err := signatures.SetSignature(ctx, volumeID, signature); err != nil {
+			if err := cs.dm.DeleteDevice(ctx, volumeID, false); err != nil {
+				logger.Error(err, "Removing device without signature failed")
+			}
+			cs.capacity.invalidate()
+			statusErr = status.Errorf(codes.Internal, "set device signature: %v", err)
+			return
+		}
+		vol.Params[parameters.Signature] = signature
+		changed = true
+	}
+	if metadata, ok := cs.dm.(pmdmanager.PmemDeviceMetadata); ok {
+		// Only informational, so failures are not fatal.
+		if m := deviceMetadata(p); len(m) > 0 {
+			if err := metadata.SetMetadata(ctx, volumeID, m); err != nil {
+				logger.Error(err, "Setting device metadata failed")
+			}
 		}
-		statusErr = status.Errorf(code, "device creation failed: %v", err)
-		return
 	}
-	actual = int64(actualSize)
+	actual = int64(actualSize) - overhead
 	if vol.Size != actual {
-		// Update volume size and store that persistently.
 		vol.Size = actual
+		changed = true
+	}
+	if changed && cs.sm != nil {
+		// Update volume size and signature and store that persistently.
 		if err := cs.sm.Create(volumeID, vol); err != nil {
 			// We are in a difficult place now. We have
 			// created the volume, but couldn't update the
 			// metadata about it. The best we can do now
 			// is probably to proceed, hoping that whatever
 			// meta data was written is still valid.
-			logger.Error(err, "Updating state with new volume size failed")
+			logger.Error(err, "Updating volume state failed")
 		}
 	}
 
 	cs.mutex.Lock()
 	defer cs.mutex.Unlock()
-	cs.pmemVolumes[volumeID] = vol
+	cs.addVolume(vol)
 	logger.V(5).Info("Created new volume", "volume", *vol)
+	cs.hook.notify(ctx, volumeHookCreated, vol)
 
 	return
 }
 
-func (cs *nodeControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+func (cs *nodeControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (resp *csi.DeleteVolumeResponse, finalErr error) {
+	defer observeVolumeOperation(ctx, "DeleteVolume", time.Now(), &finalErr)
 	volumeID := req.GetVolumeId()
 	logger := klog.FromContext(ctx).WithValues("volume-id", volumeID)
 	ctx = klog.NewContext(ctx, logger)
@@ -322,11 +483,31 @@ func (cs *nodeControllerServer) DeleteVolume(ctx context.Context, req *csi.Delet
 		return nil, err
 	}
 
+	recent, done, err := cs.inFlight.start("DeleteVolume", volumeID, req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if resp == nil {
+			done(nil)
+			return
+		}
+		done(resp)
+	}()
+	if recent, ok := recent.(*csi.DeleteVolumeResponse); ok && cs.getVolumeByID(volumeID) == nil {
+		logger.V(4).Info("Returning result of recent call")
+		return recent, nil
+	}
+
 	// Serialize by VolumeId
 	nodeVolumeMutex.LockKey(volumeID)
 	defer nodeVolumeMutex.UnlockKey(volumeID) //nolint: errcheck
 
 	logger.V(4).Info("Starting to delete volume")
+	// The device must not get removed while it is being formatted.
+	if err := cs.operations.cancel(ctx, formatOperation(volumeID)); err != nil {
+		return nil, err
+	}
 	vol := cs.getVolumeByID(volumeID)
 	if vol == nil {
 		// Already deleted.
@@ -348,7 +529,27 @@ func (cs *nodeControllerServer) DeleteVolume(ctx context.Context, req *csi.Delet
 		}
 	}
 
-	if err := dm.DeleteDevice(ctx, req.VolumeId, p.GetEraseAfter()); err != nil {
+	if p.GetIntegrity() {
+		if err := closeIntegrity(ctx, volumeID); err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to delete volume: %v", err)
+		}
+	}
+	if p.GetEncrypted() {
+		if err := closeCrypt(ctx, volumeID); err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to delete volume: %v", err)
+		}
+	}
+
+	release, err := cs.limiter.acquire(ctx, "delete device")
+	if err != nil {
+		return nil, err
+	}
+	err = dm.DeleteDevice(ctx, req.VolumeId, p.GetEraseAfter())
+	release()
+	if dm == cs.dm {
+		cs.capacity.invalidate()
+	}
+	if err != nil {
 		if errors.Is(err, pmemerr.DeviceInUse) {
 			return nil, status.Errorf(codes.FailedPrecondition, err.Error())
 		}
@@ -362,12 +563,22 @@ func (cs *nodeControllerServer) DeleteVolume(ctx context.Context, req *csi.Delet
 
 	cs.mutex.Lock()
 	defer cs.mutex.Unlock()
-	delete(cs.pmemVolumes, req.VolumeId)
+	cs.removeVolume(req.VolumeId)
+	cs.hook.notify(ctx, volumeHookDeleted, vol)
 
 	logger.V(4).Info("Volume deleted")
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+// supportedAccessModes lists the access modes of volumes. Volumes
+// are local to one node, but all pods on that node can share them
+// in the read-only modes.
+var supportedAccessModes = map[csi.VolumeCapability_AccessMode_Mode]bool{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:      true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY: true,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:  true,
+}
+
 func (cs *nodeControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
 
 	// Check arguments
@@ -383,7 +594,7 @@ func (cs *nodeControllerServer) ValidateVolumeCapabilities(ctx context.Context,
 		return nil, status.Error(codes.NotFound, "Volume not created by this controller")
 	}
 	for _, cap := range req.VolumeCapabilities {
-		if cap.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
+		if !supportedAccessModes[cap.GetAccessMode().GetMode()] {
 			return &csi.ValidateVolumeCapabilitiesResponse{
 				Confirmed: nil,
 				Message:   "Driver does not support '" + cap.AccessMode.Mode.String() + "' mode",
@@ -478,10 +689,20 @@ func (cs *nodeControllerServer) ListVolumes(ctx context.Context, req *csi.ListVo
 }
 
 func (cs *nodeControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	cap, err := cs.dm.GetCapacity(ctx)
+	cap, err := cs.capacity.GetCapacity(ctx)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, err.Error())
 	}
+	// Pool devices are not in use yet. Their space is available,
+	// see volumePool.drain. How large a volume could become after
+	// draining them depends on where the devices are, so only
+	// the pool device itself is certain to fit.
+	if reserved, largest := cs.pool.reserved(); reserved > 0 {
+		cap.Available += reserved
+		if largest > cap.MaxVolumeSize {
+			cap.MaxVolumeSize = largest
+		}
+	}
 
 	return &csi.GetCapacityResponse{
 		AvailableCapacity: int64(cap.Available),
@@ -502,14 +723,31 @@ func (cs *nodeControllerServer) getVolumeByID(volumeID string) *nodeVolume {
 func (cs *nodeControllerServer) getVolumeByName(volumeName string) *nodeVolume {
 	cs.mutex.Lock()
 	defer cs.mutex.Unlock()
-	for _, pmemVol := range cs.pmemVolumes {
-		if pmemVol.Params[parameters.Name] == volumeName {
-			return pmemVol
-		}
+	if volumeID, ok := cs.volumeIDs[volumeName]; ok {
+		return cs.pmemVolumes[volumeID]
 	}
 	return nil
 }
 
+// addVolume stores a volume and updates the name index. The caller
+// must hold the mutex unless the server is not in use yet.
+func (cs *nodeControllerServer) addVolume(vol *nodeVolume) {
+	cs.pmemVolumes[vol.ID] = vol
+	if name, ok := vol.Params[parameters.Name]; ok {
+		cs.volumeIDs[name] = vol.ID
+	}
+}
+
+// removeVolume is the counterpart of addVolume.
+func (cs *nodeControllerServer) removeVolume(volumeID string) {
+	if vol, ok := cs.pmemVolumes[volumeID]; ok {
+		if name, ok := vol.Params[parameters.Name]; ok && cs.volumeIDs[name] == volumeID {
+			delete(cs.volumeIDs, name)
+		}
+		delete(cs.pmemVolumes, volumeID)
+	}
+}
+
 func (cs *nodeControllerServer) ControllerExpandVolume(context.Context, *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "")
 }
@@ -518,6 +756,21 @@ func (cs *nodeControllerServer) ControllerGetVolume(context.Context, *csi.Contro
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
+// deviceOverhead returns how much larger than the volume the device
+// has to be. With dm-integrity, some of the device is used for
+// checksums and the journal, with dm-crypt for the LUKS header. The
+// volume size is what remains usable.
+func deviceOverhead(p parameters.Volume, size int64) int64 {
+	var overhead int64
+	if p.GetIntegrity() {
+		overhead = integrityOverhead(size)
+	}
+	if p.GetEncrypted() {
+		overhead = cryptOverhead
+	}
+	return overhead
+}
+
 func generateVolumeID(name string) string {
 	// VolumeID is hashed from Volume Name.
 	// Hashing guarantees same ID for repeated requests.
@@ -542,3 +795,17 @@ func generateVolumeID(name string) string {
 	id := name[0:use] + "-" + hash
 	return id
 }
+
+// deviceMetadata returns the Kubernetes objects of the volume, as far
+// as they are known. external-provisioner only passes them with
+// --extra-create-metadata.
+func deviceMetadata(p parameters.Volume) map[string]string {
+	metadata := map[string]string{}
+	if name := p.GetPVCName(); name != "" {
+		metadata[pmdmanager.MetadataPVC] = p.GetPVCNamespace() + "/" + name
+	}
+	if name := p.GetPVName(); name != "" {
+		metadata[pmdmanager.MetadataPV] = name
+	}
+	return metadata
+}
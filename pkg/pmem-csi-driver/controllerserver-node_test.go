@@ -0,0 +1,329 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+const manyVolumes = 5000
+
+func newFakeNodeControllerServer(ctx context.Context, tb testing.TB) *nodeControllerServer {
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100)
+	require.NoError(tb, err, "create fake device manager")
+	return NewNodeControllerServer(ctx, "node", dm, nil)
+}
+
+func createVolumes(ctx context.Context, tb testing.TB, cs *nodeControllerServer, offset, num int) {
+	for i := offset; i < offset+num; i++ {
+		_, _, err := cs.createVolumeInternal(ctx,
+			parameters.Volume{},
+			fmt.Sprintf("pvc-%d", i),
+			nil,
+			&csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+		)
+		require.NoError(tb, err, "create volume #%d", i)
+	}
+}
+
+func TestManyVolumes(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+	createVolumes(ctx, t, cs, 0, manyVolumes)
+	require.Len(t, cs.pmemVolumes, manyVolumes, "volumes")
+	require.Len(t, cs.volumeIDs, manyVolumes, "name index")
+
+	for _, i := range []int{0, manyVolumes / 2, manyVolumes - 1} {
+		name := fmt.Sprintf("pvc-%d", i)
+		vol := cs.getVolumeByName(name)
+		require.NotNil(t, vol, "volume %s", name)
+		require.Equal(t, generateVolumeID(name), vol.ID, "volume ID of %s", name)
+		require.Equal(t, vol, cs.getVolumeByID(vol.ID), "lookup by ID")
+
+		_, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.ID})
+		require.NoError(t, err, "delete %s", name)
+		require.Nil(t, cs.getVolumeByName(name), "deleted volume %s", name)
+	}
+	require.Len(t, cs.pmemVolumes, manyVolumes-3, "volumes after deletion")
+	require.Len(t, cs.volumeIDs, manyVolumes-3, "name index after deletion")
+}
+
+func TestNoAttach(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+
+	caps, err := cs.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+	require.NoError(t, err, "get capabilities")
+	for _, cap := range caps.Capabilities {
+		require.NotEqual(t, csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME, cap.GetRpc().GetType(), "capabilities")
+	}
+
+	_, err = cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: "foo", NodeId: "node"})
+	require.Equal(t, codes.Unimplemented, status.Code(err), "publish")
+	_, err = cs.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: "foo", NodeId: "node"})
+	require.Equal(t, codes.Unimplemented, status.Code(err), "unpublish")
+}
+
+func TestNamespaceMode(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+
+	// The fake device manager cannot create sector namespaces.
+	sector := parameters.NamespaceModeSector
+	_, _, err := cs.createVolumeInternal(ctx,
+		parameters.Volume{NamespaceMode: &sector},
+		"pvc-sector",
+		nil,
+		&csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+	)
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "sector namespace")
+	require.Nil(t, cs.getVolumeByName("pvc-sector"), "volume must not exist")
+
+	fsdax := parameters.NamespaceModeFsdax
+	_, _, err = cs.createVolumeInternal(ctx,
+		parameters.Volume{NamespaceMode: &fsdax},
+		"pvc-fsdax",
+		nil,
+		&csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+	)
+	require.NoError(t, err, "fsdax namespace")
+}
+
+func TestRegion(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+
+	// The fake device manager only has region 0.
+	region := uint(1)
+	_, _, err := cs.createVolumeInternal(ctx,
+		parameters.Volume{Region: &region},
+		"pvc-region-1",
+		nil,
+		&csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+	)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err), "region 1")
+	require.Nil(t, cs.getVolumeByName("pvc-region-1"), "volume must not exist")
+
+	region = 0
+	_, _, err = cs.createVolumeInternal(ctx,
+		parameters.Volume{Region: &region},
+		"pvc-region-0",
+		nil,
+		&csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+	)
+	require.NoError(t, err, "region 0")
+	vol := cs.getVolumeByName("pvc-region-0")
+	require.NotNil(t, vol, "volume")
+	require.Equal(t, "0", vol.Params[parameters.Region], "region parameter")
+}
+
+func TestContentSource(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+
+	for name, source := range map[string]*csi.VolumeContentSource{
+		"snapshot": {Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "snapshot-0"}}},
+		"volume":   {Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "volume-0"}}},
+	} {
+		_, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:                "pvc-" + name,
+			VolumeCapabilities:  []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+			CapacityRange:       &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+			VolumeContentSource: source,
+		})
+		require.Equal(t, codes.InvalidArgument, status.Code(err), "%s: %v", name, err)
+		require.Nil(t, cs.getVolumeByName("pvc-"+name), "%s: volume must not exist", name)
+	}
+}
+
+func TestCreateReadOnly(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+
+	for _, mode := range []csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	} {
+		_, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: "pvc-read-only",
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			}},
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+		})
+		require.Equal(t, codes.InvalidArgument, status.Code(err), "%s: %v", mode, err)
+		require.Nil(t, cs.getVolumeByName("pvc-read-only"), "%s: volume must not exist", mode)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	realDM, err := pmdmanager.New(ctx, api.DeviceModeFake, 100)
+	require.NoError(t, err, "create fake device manager")
+	initial, err := realDM.GetCapacity(ctx)
+	require.NoError(t, err, "initial capacity")
+	dm, err := pmdmanager.NewDryRun(ctx, api.DeviceModeFake, 100)
+	require.NoError(t, err, "create dry-run device manager")
+	require.Equal(t, api.DeviceModeFake, dm.GetMode(), "device mode")
+	simulated, err := dm.GetCapacity(ctx)
+	require.NoError(t, err, "simulated initial capacity")
+	require.Equal(t, initial, simulated, "simulated initial capacity")
+	cs := NewNodeControllerServer(ctx, "node", dm, nil)
+
+	createVolumes(ctx, t, cs, 0, 2)
+	capacity, err := dm.GetCapacity(ctx)
+	require.NoError(t, err, "simulated capacity")
+	require.Equal(t, initial.Available-2*4*1024*1024, capacity.Available, "simulated available capacity")
+
+	vol := cs.getVolumeByName("pvc-0")
+	require.NotNil(t, vol, "volume pvc-0")
+	ns := NewNodeServer(cs, t.TempDir())
+	ns.dryRun = true
+	_, err = ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          vol.ID,
+		StagingTargetPath: "/staging",
+		VolumeCapability:  &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}},
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err), "stage")
+
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.ID})
+	require.NoError(t, err, "delete pvc-0")
+	capacity, err = dm.GetCapacity(ctx)
+	require.NoError(t, err, "simulated capacity after deletion")
+	require.Equal(t, initial.Available-4*1024*1024, capacity.Available, "simulated available capacity after deletion")
+}
+
+func TestSignature(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+	ns := NewNodeServer(cs, t.TempDir())
+	req := &csi.CreateVolumeRequest{
+		Name:               "pvc-signature",
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+	}
+
+	resp, err := cs.CreateVolume(ctx, req)
+	require.NoError(t, err, "create volume")
+	volumeID := resp.Volume.VolumeId
+	signature := resp.Volume.VolumeContext[parameters.Signature]
+	require.NotEmpty(t, signature, "signature in volume context")
+	device, err := cs.dm.GetDevice(ctx, volumeID)
+	require.NoError(t, err, "get device")
+	require.Equal(t, signature, device.Signature, "device signature")
+
+	resp, err = cs.CreateVolume(ctx, req)
+	require.NoError(t, err, "create volume again")
+	require.Equal(t, signature, resp.Volume.VolumeContext[parameters.Signature], "signature of existing volume")
+
+	// The same name leads to the same volume ID, but not the same signature.
+	oldContext := resp.Volume.VolumeContext
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	require.NoError(t, err, "delete volume")
+	resp, err = cs.CreateVolume(ctx, req)
+	require.NoError(t, err, "recreate volume")
+	require.Equal(t, volumeID, resp.Volume.VolumeId, "volume ID")
+	require.NotEqual(t, signature, resp.Volume.VolumeContext[parameters.Signature], "signature of new volume")
+
+	_, err = ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: "/staging",
+		VolumeCapability:  req.VolumeCapabilities[0],
+		VolumeContext:     oldContext,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err), "stage with old volume context: %v", err)
+}
+
+func BenchmarkGetVolumeByName(b *testing.B) {
+	ctx := context.Background()
+	cs := newFakeNodeControllerServer(ctx, b)
+	createVolumes(ctx, b, cs, 0, manyVolumes)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if cs.getVolumeByName(fmt.Sprintf("pvc-%d", i%manyVolumes)) == nil {
+			b.Fatal("volume not found")
+		}
+	}
+}
+
+func BenchmarkCreateVolume(b *testing.B) {
+	ctx := context.Background()
+	cs := newFakeNodeControllerServer(ctx, b)
+	createVolumes(ctx, b, cs, 0, manyVolumes)
+
+	b.ResetTimer()
+	createVolumes(ctx, b, cs, manyVolumes, b.N)
+}
+
+func TestValidateAccessModes(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+	createVolumes(ctx, t, cs, 0, 1)
+	volumeID := generateVolumeID("pvc-0")
+
+	for mode, supported := range map[csi.VolumeCapability_AccessMode_Mode]bool{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:       true,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:  true,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:   true,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER: false,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:  false,
+	} {
+		resp, err := cs.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId: volumeID,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			}},
+		})
+		require.NoError(t, err, "validate %s", mode)
+		require.Equal(t, supported, resp.GetConfirmed() != nil, "%s confirmed", mode)
+	}
+}
+
+func TestDeviceMetadata(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+	resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-metadata",
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+		Parameters: map[string]string{
+			parameters.PVCName:      "data",
+			parameters.PVCNamespace: "default",
+			parameters.PVName:       "pvc-metadata",
+		},
+	})
+	require.NoError(t, err, "create volume")
+
+	device, err := cs.dm.GetDevice(ctx, resp.Volume.VolumeId)
+	require.NoError(t, err, "get device")
+	assert.Equal(t, map[string]string{
+		pmdmanager.MetadataPVC: "default/data",
+		pmdmanager.MetadataPV:  "pvc-metadata",
+	}, device.Metadata, "device metadata")
+	vol := cs.getVolumeByID(resp.Volume.VolumeId)
+	require.NotNil(t, vol, "volume")
+	assert.Equal(t, "data", vol.Params[parameters.PVCName], "PVC name in volume state")
+
+	_, err = parameters.Parse(parameters.PersistentVolumeOrigin, resp.Volume.VolumeContext)
+	require.NoError(t, err, "volume context must be valid for NodePublishVolume")
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"k8s.io/klog/v2"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+)
+
+const (
+	// cryptPrefix is used for the device mapper names of
+	// dm-crypt devices: <prefix><volume ID>.
+	cryptPrefix = "pmem-crypt-"
+
+	// cryptOverhead is reserved for the LUKS2 header, which
+	// cryptsetup puts in front of the encrypted data by default.
+	cryptOverhead = 16 * 1024 * 1024
+
+	// cryptPassphraseKey is the key of the passphrase in the
+	// secrets of CreateVolume, NodeStageVolume and (for
+	// ephemeral volumes) NodePublishVolume.
+	cryptPassphraseKey = "passphrase"
+)
+
+// cryptPassphrase returns the passphrase from the secrets of a CSI
+// request. The secrets come from the Kubernetes secret that is
+// referenced by the storage class or the inline volume of the pod.
+func cryptPassphrase(secrets map[string]string) ([]byte, error) {
+	passphrase := secrets[cryptPassphraseKey]
+	if passphrase == "" {
+		return nil, fmt.Errorf("encrypted volume: secret %q missing", cryptPassphraseKey)
+	}
+	return []byte(passphrase), nil
+}
+
+// cryptDevicePath returns the path of the dm-crypt device for a
+// volume.
+func cryptDevicePath(volumeID string) string {
+	return filepath.Join("/dev/mapper", cryptPrefix+volumeID)
+}
+
+// openCrypt ensures that the dm-crypt device for the volume exists
+// and returns its path. The underlying device gets formatted with
+// the passphrase if it isn't a LUKS device yet. It can be called
+// multiple times for the same device (idempotent).
+func openCrypt(ctx context.Context, volumeID, devicePath string, passphrase []byte) (string, error) {
+	logger := klog.FromContext(ctx).WithName("openCrypt")
+	ctx = klog.NewContext(ctx, logger)
+
+	path := cryptDevicePath(volumeID)
+	if _, err := os.Stat(path); err == nil {
+		logger.V(5).Info("dm-crypt device already open", "device", path)
+		return path, nil
+	}
+
+	luks, err := isLuks(ctx, devicePath)
+	if err != nil {
+		return "", err
+	}
+	if !luks {
+		logger.V(3).Info("Formatting device for dm-crypt", "device", devicePath)
+		cmd := exec.Command("cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2", "--key-file=-", devicePath)
+		cmd.Stdin = bytes.NewReader(passphrase)
+		if _, err := pmemexec.Run(ctx, cmd); err != nil {
+			return "", fmt.Errorf("format %s for dm-crypt: %v", devicePath, err)
+		}
+	}
+	cmd := exec.Command("cryptsetup", "open", "--type", "luks", "--key-file=-", devicePath, cryptPrefix+volumeID)
+	cmd.Stdin = bytes.NewReader(passphrase)
+	if _, err := pmemexec.Run(ctx, cmd); err != nil {
+		return "", fmt.Errorf("open dm-crypt device for %s: %v", devicePath, err)
+	}
+	logger.V(3).Info("Opened dm-crypt device", "device", path)
+	return path, nil
+}
+
+// isLuks checks whether the device has a LUKS header. "cryptsetup
+// isLuks" exits with 1 if it doesn't. All other failures, for example
+// a missing binary, a busy device or an I/O error, must not be
+// mistaken for that because formatting would destroy the data of an
+// existing encrypted volume.
+func isLuks(ctx context.Context, devicePath string) (bool, error) {
+	cmd := exec.Command("cryptsetup", "isLuks", devicePath)
+	_, err := pmemexec.Run(ctx, cmd)
+	switch {
+	case err == nil:
+		return true, nil
+	case cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == 1:
+		return false, nil
+	default:
+		return false, fmt.Errorf("check %s for LUKS header: %v", devicePath, err)
+	}
+}
+
+// closeCrypt removes the dm-crypt device for the volume. Nothing is
+// done if there is no such device.
+func closeCrypt(ctx context.Context, volumeID string) error {
+	logger := klog.FromContext(ctx).WithName("closeCrypt")
+	ctx = klog.NewContext(ctx, logger)
+
+	path := cryptDevicePath(volumeID)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if _, err := pmemexec.RunCommand(ctx, "cryptsetup", "close", cryptPrefix+volumeID); err != nil {
+		return fmt.Errorf("close dm-crypt device %s: %v", path, err)
+	}
+	logger.V(3).Info("Closed dm-crypt device", "device", path)
+	return nil
+}
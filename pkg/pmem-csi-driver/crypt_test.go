@@ -0,0 +1,60 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestIsLuks(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+
+	for name, tc := range map[string]struct {
+		// script replaces cryptsetup, empty if there is none.
+		script      string
+		expected    bool
+		expectedErr bool
+	}{
+		"luks": {
+			script:   "exit 0",
+			expected: true,
+		},
+		"no-luks": {
+			script: "exit 1",
+		},
+		"io-error": {
+			script:      "echo 'Cannot read device' >&2; exit 4",
+			expectedErr: true,
+		},
+		"no-binary": {
+			expectedErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			bin := t.TempDir()
+			if tc.script != "" {
+				err := os.WriteFile(filepath.Join(bin, "cryptsetup"), []byte("#!/bin/sh\n"+tc.script+"\n"), 0755)
+				require.NoError(t, err, "create fake cryptsetup")
+			}
+			t.Setenv("PATH", bin)
+
+			luks, err := isLuks(ctx, "/dev/no-such-device")
+			if tc.expectedErr {
+				assert.Error(t, err, "isLuks")
+				return
+			}
+			require.NoError(t, err, "isLuks")
+			assert.Equal(t, tc.expected, luks, "LUKS header")
+		})
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// volumesPath is the HTTP path under which the node driver reports
+// its volumes and their mounts.
+const volumesPath = "/volumes"
+
+// Mount kinds, derived from the mount path.
+const (
+	mountKindStaging  = "staging"
+	mountKindTarget   = "target"
+	mountKindInternal = "internal"
+	mountKindOther    = "other"
+)
+
+// VolumesReport is the node driver's view of its volumes. It is meant
+// for comparing against /proc/mounts when debugging problems like
+// "volume already mounted" or "device busy".
+type VolumesReport struct {
+	// Volumes contains all volumes known to the driver, sorted by ID.
+	Volumes []VolumeReport `json:"volumes"`
+	// UnknownMounts are mounts which kubelet created for the
+	// driver according to vol_data.json, but for a volume which
+	// the driver does not know.
+	UnknownMounts []VolumeMount `json:"unknownMounts,omitempty"`
+}
+
+// VolumeReport describes one volume.
+type VolumeReport struct {
+	ID         string            `json:"id"`
+	Size       int64             `json:"size"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+	// DevicePath is empty when looking up the device failed,
+	// DeviceError explains why.
+	DevicePath  string `json:"devicePath,omitempty"`
+	DeviceError string `json:"deviceError,omitempty"`
+	// Mounts are all entries in the mount table for the volume.
+	// A volume without staging mount is not staged, one without
+	// target mounts is not published.
+	Mounts []VolumeMount `json:"mounts,omitempty"`
+}
+
+// VolumeMount is one entry in the mount table.
+type VolumeMount struct {
+	// Kind is "staging" or "target" for paths chosen by kubelet,
+	// "internal" for mounts of the driver itself, "other"
+	// otherwise.
+	Kind     string   `json:"kind"`
+	Path     string   `json:"path"`
+	Device   string   `json:"device"`
+	Type     string   `json:"type,omitempty"`
+	Options  []string `json:"options,omitempty"`
+	VolumeID string   `json:"volumeID,omitempty"`
+}
+
+// volumesReport combines the volumes of the driver with the current
+// mount table.
+func (ns *nodeServer) volumesReport(ctx context.Context, driverName string) (VolumesReport, error) {
+	ns.cs.mutex.Lock()
+	volumes := make([]nodeVolume, 0, len(ns.cs.pmemVolumes))
+	for _, vol := range ns.cs.pmemVolumes {
+		volumes = append(volumes, *vol)
+	}
+	ns.cs.mutex.Unlock()
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].ID < volumes[j].ID
+	})
+
+	mounts, err := ns.mounter.List()
+	if err != nil {
+		return VolumesReport{}, fmt.Errorf("list mounts: %v", err)
+	}
+
+	report := VolumesReport{Volumes: make([]VolumeReport, 0, len(volumes))}
+	index := map[string]int{}
+	byDevice := map[string]string{}
+	for i, vol := range volumes {
+		volReport := VolumeReport{
+			ID:         vol.ID,
+			Size:       vol.Size,
+			Parameters: vol.Params,
+		}
+		device, err := ns.cs.dm.GetDevice(ctx, vol.ID)
+		if err != nil {
+			volReport.DeviceError = err.Error()
+		} else {
+			volReport.DevicePath = device.Path
+			byDevice[device.Path] = vol.ID
+		}
+		byDevice[integrityDevicePath(vol.ID)] = vol.ID
+		byDevice[cryptDevicePath(vol.ID)] = vol.ID
+		index[vol.ID] = i
+		report.Volumes = append(report.Volumes, volReport)
+	}
+
+	for _, mp := range mounts {
+		m := VolumeMount{
+			Kind:    ns.mountKind(mp.Path),
+			Path:    mp.Path,
+			Device:  mp.Device,
+			Type:    mp.Type,
+			Options: mp.Opts,
+		}
+		volumeID, ok := byDevice[mp.Device]
+		switch {
+		case ok:
+		case m.Kind == mountKindInternal:
+			volumeID = filepath.Base(mp.Path)
+		case m.Kind == mountKindStaging || m.Kind == mountKindTarget:
+			// Fall back to the volume handle recorded by
+			// kubelet, for example for mounts of a
+			// device which no longer exists.
+			data, err := readVolumeData(mp.Path)
+			if err != nil || data.DriverName != driverName {
+				continue
+			}
+			volumeID = data.VolumeHandle
+		default:
+			continue
+		}
+		if i, ok := index[volumeID]; ok {
+			report.Volumes[i].Mounts = append(report.Volumes[i].Mounts, m)
+		} else {
+			m.VolumeID = volumeID
+			report.UnknownMounts = append(report.UnknownMounts, m)
+		}
+	}
+
+	return report, nil
+}
+
+// mountKind determines whether the path was chosen by kubelet or the
+// driver.
+func (ns *nodeServer) mountKind(path string) string {
+	switch {
+	case stagingPathRE.MatchString(path):
+		return mountKindStaging
+	case targetPathRE.MatchString(path):
+		return mountKindTarget
+	case ns.mountDirectory != "" && strings.HasPrefix(path, filepath.Clean(ns.mountDirectory)+"/"):
+		return mountKindInternal
+	default:
+		return mountKindOther
+	}
+}
+
+// volumesHandler serves the current VolumesReport as JSON.
+type volumesHandler struct {
+	driverName string
+	ns         *nodeServer
+}
+
+func (v volumesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := klog.FromContext(r.Context()).WithName("volumes")
+	report, err := v.ns.volumesReport(r.Context(), v.driverName)
+	if err != nil {
+		logger.Error(err, "Create volumes report")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logger.Error(err, "Encode report")
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+	"k8s.io/utils/mount"
+
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+func TestVolumesReport(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+	createVolumes(ctx, t, cs, 0, 2)
+	ns := NewNodeServer(cs, t.TempDir())
+	kubeletDir := t.TempDir()
+
+	staged, unused := generateVolumeID("pvc-0"), generateVolumeID("pvc-1")
+	stagingPath := filepath.Join(kubeletDir, "plugins/kubernetes.io/csi", driverName, "hash-0", "globalmount")
+	targetPath := filepath.Join(kubeletDir, "pods", "pod-0", "volumes/kubernetes.io~csi", "pv-0", "mount")
+	unknownPath := filepath.Join(kubeletDir, "pods", "pod-1", "volumes/kubernetes.io~csi", "pv-unknown", "mount")
+	require.NoError(t, os.MkdirAll(unknownPath, 0755), "create %s", unknownPath)
+	content, err := json.Marshal(volumeData{DriverName: driverName, VolumeHandle: "unknown-volume"})
+	require.NoError(t, err, "encode vol_data.json")
+	require.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(unknownPath), "vol_data.json"), content, 0644), "write vol_data.json")
+	ns.mounter = mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "/dev/sda1", Path: "/", Type: "ext4"},
+		{Device: pmdmanager.FakeDevicePathPrefix + staged, Path: stagingPath, Type: "ext4", Opts: []string{"dax"}},
+		{Device: pmdmanager.FakeDevicePathPrefix + staged, Path: targetPath, Type: "ext4", Opts: []string{"bind"}},
+		{Device: "/dev/pmem0.9", Path: unknownPath, Type: "xfs"},
+	})
+
+	h := volumesHandler{driverName: driverName, ns: ns}
+	req := httptest.NewRequest(http.MethodGet, volumesPath, nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, "status code")
+	var report VolumesReport
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&report), "decode report")
+
+	require.Len(t, report.Volumes, 2, "volumes")
+	for _, vol := range report.Volumes {
+		assert.Equal(t, pmdmanager.FakeDevicePathPrefix+vol.ID, vol.DevicePath, "device path of %s", vol.ID)
+		switch vol.ID {
+		case staged:
+			assert.Equal(t, []VolumeMount{
+				{Kind: mountKindStaging, Path: stagingPath, Device: pmdmanager.FakeDevicePathPrefix + staged, Type: "ext4", Options: []string{"dax"}},
+				{Kind: mountKindTarget, Path: targetPath, Device: pmdmanager.FakeDevicePathPrefix + staged, Type: "ext4", Options: []string{"bind"}},
+			}, vol.Mounts, "mounts of staged volume")
+		case unused:
+			assert.Empty(t, vol.Mounts, "mounts of unused volume")
+		default:
+			t.Errorf("unexpected volume %s", vol.ID)
+		}
+	}
+	assert.Equal(t, []VolumeMount{
+		{Kind: mountKindTarget, Path: unknownPath, Device: "/dev/pmem0.9", Type: "xfs", VolumeID: "unknown-volume"},
+	}, report.UnknownMounts, "unknown mounts")
+}
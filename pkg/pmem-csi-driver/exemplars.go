@@ -0,0 +1,84 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// traceparentRE matches a W3C Trace Context header
+// (https://www.w3.org/TR/trace-context/#traceparent-header) and
+// extracts trace ID and flags.
+var traceparentRE = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-([0-9a-f]{2})`)
+
+// traceparentKey is the gRPC metadata key used by OpenTelemetry for
+// propagating the trace context.
+const traceparentKey = "traceparent"
+
+// traceIDLabel is the exemplar label name for the trace ID, the same
+// as the one used by OpenTelemetry.
+const traceIDLabel = "trace_id"
+
+var volumeOperationsSeconds = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "pmem_volume_operations_seconds",
+		Help:    "Duration of creating and deleting volumes. Exemplars link to the trace of the call, if the caller provided one.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15, 25, 50, 120, 300, 600},
+	},
+	[]string{"method_name", "grpc_status_code"},
+)
+
+func mustRegisterVolumeOperations(reg prometheus.Registerer, nodeName, driverName string) {
+	labels := prometheus.Labels{
+		pmdmanager.NodeLabel: nodeName,
+		"driver_name":        driverName,
+	}
+	prometheus.WrapRegistererWith(labels, reg).MustRegister(volumeOperationsSeconds)
+}
+
+// traceID returns the ID of the trace that the incoming gRPC call
+// belongs to. It is empty if the caller did not propagate a trace
+// context or the trace is not sampled, because then there is no
+// trace to link to.
+func traceID(ctx context.Context) string {
+	for _, value := range metadata.ValueFromIncomingContext(ctx, traceparentKey) {
+		parts := traceparentRE.FindStringSubmatch(value)
+		if parts == nil || parts[1] == "00000000000000000000000000000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(parts[2], 16, 8)
+		if err != nil || flags&0x01 == 0 {
+			continue
+		}
+		return parts[1]
+	}
+	return ""
+}
+
+// observeVolumeOperation records the duration of a call which was
+// started at the given time. It is meant to be deferred with a
+// pointer to the named error result.
+func observeVolumeOperation(ctx context.Context, method string, start time.Time, err *error) {
+	observer := volumeOperationsSeconds.WithLabelValues(method, status.Code(*err).String())
+	duration := time.Since(start).Seconds()
+	if id := traceID(ctx); id != "" {
+		if eo, ok := observer.(prometheus.ExemplarObserver); ok {
+			eo.ObserveWithExemplar(duration, prometheus.Labels{traceIDLabel: id})
+			return
+		}
+	}
+	observer.Observe(duration)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestTraceID(t *testing.T) {
+	testcases := map[string]struct {
+		traceparent []string
+		expected    string
+	}{
+		"none": {},
+		"sampled": {
+			traceparent: []string{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			expected:    "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		"not-sampled": {
+			traceparent: []string{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+		},
+		"invalid-trace-id": {
+			traceparent: []string{"00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		},
+		"malformed": {
+			traceparent: []string{"4bf92f3577b34da6a3ce929d0e0e4736"},
+		},
+		"second-valid": {
+			traceparent: []string{"foo", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			expected:    "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+	}
+
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			md := metadata.MD{}
+			md.Append(traceparentKey, tc.traceparent...)
+			ctx := metadata.NewIncomingContext(context.Background(), md)
+			assert.Equal(t, tc.expected, traceID(ctx))
+		})
+	}
+}
+
+func TestObserveVolumeOperation(t *testing.T) {
+	id := "0af7651916cd43dd8448eb211c80319c"
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(traceparentKey, "00-"+id+"-b7ad6b7169203331-01"))
+	err := errors.New("fake error")
+	observeVolumeOperation(ctx, "TestObserveVolumeOperation", time.Now(), &err)
+
+	var m dto.Metric
+	observer := volumeOperationsSeconds.WithLabelValues("TestObserveVolumeOperation", "Unknown")
+	require.NoError(t, observer.(prometheus.Metric).Write(&m), "write metric")
+	assert.Equal(t, uint64(1), m.GetHistogram().GetSampleCount(), "sample count")
+	var traceIDs []string
+	for _, bucket := range m.GetHistogram().GetBucket() {
+		if exemplar := bucket.GetExemplar(); exemplar != nil {
+			for _, label := range exemplar.GetLabel() {
+				if label.GetName() == traceIDLabel {
+					traceIDs = append(traceIDs, label.GetValue())
+				}
+			}
+		}
+	}
+	assert.Equal(t, []string{id}, traceIDs, "exemplar trace IDs")
+}
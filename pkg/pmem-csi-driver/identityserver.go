@@ -21,26 +21,13 @@ type identityServer struct {
 
 var _ grpcserver.Service = &identityServer{}
 
-func NewIdentityServer(name, version string) *identityServer {
+// NewIdentityServer creates the identity service. The capabilities
+// must be the same as the ones of the controller and node service.
+func NewIdentityServer(name, version string, caps capabilities) *identityServer {
 	return &identityServer{
-		name:    name,
-		version: version,
-		pluginCaps: []*csi.PluginCapability{
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
-					},
-				},
-			},
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
-					},
-				},
-			},
-		},
+		name:       name,
+		version:    version,
+		pluginCaps: caps.plugin(),
 	}
 }
 
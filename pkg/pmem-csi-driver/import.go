@@ -0,0 +1,270 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// importSocket is the Unix domain socket in the state directory on
+// which the node driver accepts import requests.
+const importSocket = "import.sock"
+
+// importRequest is what "-mode=import-volume" sends to the running
+// node driver.
+type importRequest struct {
+	Device       string `json:"device"`
+	PVName       string `json:"pvName"`
+	StorageClass string `json:"storageClass,omitempty"`
+	ReadOnly     bool   `json:"readOnly,omitempty"`
+}
+
+// importVolume turns a device which was created outside of the
+// driver into a volume of the driver without touching its data. The
+// device gets renamed so that the driver can find it under the
+// volume ID and the volume is added to the persistent state and to
+// the running driver. The result is a PV for the volume which can be
+// used to bind a PVC to it.
+//
+// This must run inside the node driver: device manager operations
+// and the state are only protected against concurrent modifications
+// within one process.
+//
+// The PV has only one access mode because kubelet stages the volume
+// with the first one: ReadOnlyMany if readOnly is set, otherwise
+// ReadWriteOnce.
+func (cs *nodeControllerServer) importVolume(ctx context.Context, driverName string, req importRequest) (*corev1.PersistentVolume, error) {
+	logger := klog.FromContext(ctx)
+	deviceName, pvName := req.Device, req.PVName
+	if deviceName == "" {
+		return nil, errors.New("device name missing")
+	}
+	if pvName == "" {
+		return nil, errors.New("PV name missing")
+	}
+	dm, sm := cs.dm, cs.sm
+	if sm == nil {
+		return nil, errors.New("importing devices is not supported in dry-run mode")
+	}
+	renamer, ok := dm.(pmdmanager.PmemDeviceRenamer)
+	if !ok {
+		return nil, fmt.Errorf("importing devices is not supported in %s mode", dm.GetMode())
+	}
+
+	if cs.getVolumeByID(deviceName) != nil {
+		return nil, fmt.Errorf("device %s already is a volume of the driver", deviceName)
+	}
+	volumeID := generateVolumeID(pvName)
+	nodeVolumeMutex.LockKey(volumeID)
+	defer nodeVolumeMutex.UnlockKey(volumeID) //nolint: errcheck
+
+	if cs.getVolumeByID(volumeID) != nil || cs.getVolumeByName(pvName) != nil {
+		return nil, fmt.Errorf("volume %s for PV %s already exists", volumeID, pvName)
+	}
+	if _, err := dm.GetDevice(ctx, volumeID); err == nil {
+		return nil, fmt.Errorf("device %s for PV %s already exists", volumeID, pvName)
+	}
+
+	mode := dm.GetMode()
+	p := parameters.Volume{
+		Name:       &pvName,
+		DeviceMode: &mode,
+	}
+	vol := &nodeVolume{
+		ID:     volumeID,
+		Params: p.ToContext(),
+	}
+	// Same order as in createVolumeInternal: if the state gets
+	// stored and renaming fails, the stale entry gets removed
+	// when the driver starts.
+	if err := sm.Create(volumeID, vol); err != nil {
+		return nil, fmt.Errorf("store state: %v", err)
+	}
+	if err := renamer.RenameDevice(ctx, deviceName, volumeID); err != nil {
+		if err := sm.Delete(volumeID); err != nil {
+			logger.Error(err, "Removing volume from persistent state failed", "volume-id", volumeID)
+		}
+		if errors.Is(err, pmemerr.DeviceNotFound) {
+			return nil, fmt.Errorf("device %s not found, in LVM mode only logical volumes in the volume groups of the driver can be imported", deviceName)
+		}
+		return nil, fmt.Errorf("rename device %s: %v", deviceName, err)
+	}
+	device, err := dm.GetDevice(ctx, volumeID)
+	if err != nil {
+		return nil, fmt.Errorf("get renamed device %s: %v", volumeID, err)
+	}
+	vol.Size = int64(device.Size)
+	if err := sm.Create(volumeID, vol); err != nil {
+		return nil, fmt.Errorf("update state: %v", err)
+	}
+	fsType, err := determineFilesystemType(ctx, device.Path)
+	if err != nil {
+		// Not fatal, NodeStageVolume will check again.
+		logger.Error(err, "Cannot determine file system", "device", device.Path)
+	}
+	cs.mutex.Lock()
+	cs.addVolume(vol)
+	cs.mutex.Unlock()
+	logger.Info("Imported device", "device", deviceName, "volume-id", volumeID, "size", device.Size, "fs-type", fsType)
+
+	accessMode := corev1.ReadWriteOnce
+	if req.ReadOnly {
+		accessMode = corev1.ReadOnlyMany
+	}
+	return &corev1.PersistentVolume{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "PersistentVolume",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: pvName,
+			Annotations: map[string]string{
+				"pv.kubernetes.io/provisioned-by": driverName,
+			},
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity: corev1.ResourceList{
+				corev1.ResourceStorage: *resource.NewQuantity(int64(device.Size), resource.BinarySI),
+			},
+			AccessModes:                   []corev1.PersistentVolumeAccessMode{accessMode},
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+			StorageClassName:              req.StorageClass,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:           driverName,
+					VolumeHandle:     volumeID,
+					FSType:           fsType,
+					VolumeAttributes: vol.Params,
+				},
+			},
+			NodeAffinity: &corev1.VolumeNodeAffinity{
+				Required: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+						MatchExpressions: []corev1.NodeSelectorRequirement{{
+							Key:      DriverTopologyKey,
+							Operator: corev1.NodeSelectorOpIn,
+							Values:   []string{cs.nodeID},
+						}},
+					}},
+				},
+			},
+		},
+	}, nil
+}
+
+// importHandler serves import requests.
+type importHandler struct {
+	driverName string
+	cs         *nodeControllerServer
+}
+
+func (h importHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := klog.FromContext(r.Context()).WithName("import")
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	var req importRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+	pv, err := h.cs.importVolume(klog.NewContext(r.Context(), logger), h.driverName, req)
+	if err != nil {
+		logger.Error(err, "Import failed", "device", req.Device)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pv); err != nil {
+		logger.Error(err, "Encode PV")
+	}
+}
+
+// serveImport accepts import requests on the Unix domain socket
+// until the context is done.
+func serveImport(ctx context.Context, socketPath string, handler http.Handler) error {
+	logger := klog.FromContext(ctx).WithName("import")
+	// A socket left behind by a previous instance of the driver
+	// would prevent listening.
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove stale socket: %v", err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %v", socketPath, err)
+	}
+	server := http.Server{
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			logger.Error(err, "Serving import requests failed")
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	return nil
+}
+
+// requestImport asks the node driver which listens on the socket to
+// import a device.
+func requestImport(ctx context.Context, socketPath string, req importRequest) (*corev1.PersistentVolume, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("encode request: %v", err)
+	}
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+	// The host name is irrelevant, the transport always
+	// connects to the socket.
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("contact node driver, it must be running with the same -statePath: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("node driver: %s", strings.TrimSpace(string(msg)))
+	}
+	pv := &corev1.PersistentVolume{}
+	if err := json.NewDecoder(resp.Body).Decode(pv); err != nil {
+		return nil, fmt.Errorf("decode PV: %v", err)
+	}
+	return pv, nil
+}
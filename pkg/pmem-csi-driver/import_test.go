@@ -0,0 +1,108 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestImportVolume(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100)
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create state manager")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm)
+	size := uint64(4 * 1024 * 1024)
+	_, err = dm.CreateDevice(ctx, "legacy", size, parameters.UsageAppDirect)
+	require.NoError(t, err, "create device")
+
+	_, err = cs.importVolume(ctx, "pmem-csi.intel.com", importRequest{Device: "no-such-device", PVName: "pv-0"})
+	assert.Error(t, err, "unknown device")
+	ids, err := sm.GetAll()
+	require.NoError(t, err, "get state")
+	assert.Empty(t, ids, "state after failed import")
+
+	pv, err := cs.importVolume(ctx, "pmem-csi.intel.com", importRequest{Device: "legacy", PVName: "pv-0", StorageClass: "pmem-csi-sc"})
+	require.NoError(t, err, "import")
+	volumeID := generateVolumeID("pv-0")
+	assert.Equal(t, "pv-0", pv.Name, "PV name")
+	assert.Equal(t, "pmem-csi-sc", pv.Spec.StorageClassName, "storage class")
+	assert.Equal(t, volumeID, pv.Spec.CSI.VolumeHandle, "volume handle")
+	assert.Equal(t, int64(size), pv.Spec.Capacity.Storage().Value(), "capacity")
+	assert.Equal(t, []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}, pv.Spec.AccessModes, "access modes")
+	assert.Equal(t, []string{"node"}, pv.Spec.NodeAffinity.Required.NodeSelectorTerms[0].MatchExpressions[0].Values, "node affinity")
+
+	_, err = dm.GetDevice(ctx, volumeID)
+	require.NoError(t, err, "renamed device")
+	vol := cs.getVolumeByID(volumeID)
+	require.NotNil(t, vol, "volume without restart")
+	assert.Equal(t, int64(size), vol.Size, "volume size")
+	restarted := NewNodeControllerServer(ctx, "node", dm, sm)
+	vol = restarted.getVolumeByID(volumeID)
+	require.NotNil(t, vol, "volume after restart")
+	assert.Equal(t, int64(size), vol.Size, "volume size after restart")
+
+	_, err = cs.importVolume(ctx, "pmem-csi.intel.com", importRequest{Device: "legacy", PVName: "pv-0"})
+	assert.Error(t, err, "second import")
+	_, err = cs.importVolume(ctx, "pmem-csi.intel.com", importRequest{Device: volumeID, PVName: "pv-other"})
+	assert.Error(t, err, "import of existing volume")
+
+	_, err = dm.CreateDevice(ctx, "model-cache", size, parameters.UsageAppDirect)
+	require.NoError(t, err, "create second device")
+	pv, err = cs.importVolume(ctx, "pmem-csi.intel.com", importRequest{Device: "model-cache", PVName: "pv-1", ReadOnly: true})
+	require.NoError(t, err, "read-only import")
+	assert.Equal(t, []corev1.PersistentVolumeAccessMode{corev1.ReadOnlyMany}, pv.Spec.AccessModes, "read-only access modes")
+
+	dryRun := newFakeNodeControllerServer(ctx, t)
+	_, err = dryRun.importVolume(ctx, "pmem-csi.intel.com", importRequest{Device: "legacy", PVName: "pv-2"})
+	assert.Error(t, err, "import without state")
+}
+
+func TestImportSocket(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100)
+	require.NoError(t, err, "create fake device manager")
+	stateDir := t.TempDir()
+	sm, err := pmemstate.NewFileState(stateDir)
+	require.NoError(t, err, "create state manager")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm)
+	_, err = dm.CreateDevice(ctx, "legacy", 4*1024*1024, parameters.UsageAppDirect)
+	require.NoError(t, err, "create device")
+
+	socketPath := filepath.Join(stateDir, importSocket)
+	_, err = requestImport(ctx, socketPath, importRequest{Device: "legacy", PVName: "pv-0"})
+	assert.Error(t, err, "driver not running")
+
+	err = serveImport(ctx, socketPath, importHandler{driverName: "pmem-csi.intel.com", cs: cs})
+	require.NoError(t, err, "serve import requests")
+	pv, err := requestImport(ctx, socketPath, importRequest{Device: "legacy", PVName: "pv-0"})
+	require.NoError(t, err, "import")
+	assert.Equal(t, generateVolumeID("pv-0"), pv.Spec.CSI.VolumeHandle, "volume handle")
+	assert.NotNil(t, cs.getVolumeByID(generateVolumeID("pv-0")), "imported volume")
+
+	_, err = requestImport(ctx, socketPath, importRequest{Device: "legacy", PVName: "pv-1"})
+	assert.Error(t, err, "second import of the same device")
+
+	ids, err := sm.GetAll()
+	require.NoError(t, err, "get state")
+	assert.Equal(t, []string{generateVolumeID("pv-0")}, ids, "state only contains volumes")
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"crypto/sha256"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/proto" //nolint: staticcheck // The CSI spec types are not APIv2 messages.
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recentResultTTL is how long the response of a completed call is
+// remembered. external-provisioner retries with exponential backoff,
+// so a retry which gets triggered by a timeout of the first call
+// usually comes in soon after.
+const recentResultTTL = time.Minute
+
+// inFlight tracks the CreateVolume and DeleteVolume calls which are
+// currently running or completed recently. external-provisioner
+// retries a call after its timeout although the first one may still
+// be busy creating or erasing the device. Such a retry fails with
+// Aborted, as recommended by the CSI spec, instead of waiting for the
+// first call and then doing the lookups again. The retry after that
+// gets the response of the first call if the request is the same.
+// The zero value is ready for use.
+type inFlight struct {
+	mutex   sync.Mutex
+	keys    map[string]bool
+	results map[string]recentResult
+	now     func() time.Time // time.Now if nil
+}
+
+// recentResult is the response to a successful call. The request
+// is kept without its secrets, only their hash is needed to detect
+// a retry.
+type recentResult struct {
+	req     proto.Message
+	secrets [sha256.Size]byte
+	resp    proto.Message
+	expires time.Time
+}
+
+// start marks the operation as running. It returns a function which
+// must be called when the operation is done, with the response if it
+// succeeded and an untyped nil otherwise, or, if the operation is
+// already running, an Aborted status error.
+//
+// When the same request succeeded recently, its response gets
+// returned, too. The caller must check that it is still valid
+// because the volume may have been modified since then by some other
+// means, for example the orphan checker.
+func (f *inFlight) start(operation, name string, req proto.Message) (recent proto.Message, done func(resp proto.Message), err error) {
+	key := operation + "/" + name
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.keys[key] {
+		return nil, nil, status.Errorf(codes.Aborted, "%s for %q is already in progress", operation, name)
+	}
+	if f.keys == nil {
+		f.keys = map[string]bool{}
+		f.results = map[string]recentResult{}
+	}
+	now := f.getNow()
+	for k, result := range f.results {
+		if !now.Before(result.expires) {
+			delete(f.results, k)
+		}
+	}
+	req, secrets := splitSecrets(req)
+	if result, ok := f.results[key]; ok && result.secrets == secrets && proto.Equal(result.req, req) {
+		recent = result.resp
+	}
+	f.keys[key] = true
+	return recent, func(resp proto.Message) {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		delete(f.keys, key)
+		if resp == nil {
+			delete(f.results, key)
+			return
+		}
+		f.results[key] = recentResult{
+			req:     req,
+			secrets: secrets,
+			resp:    resp,
+			expires: f.getNow().Add(recentResultTTL),
+		}
+	}, nil
+}
+
+// splitSecrets returns a copy of the request without secrets and a
+// hash of those secrets.
+func splitSecrets(req proto.Message) (proto.Message, [sha256.Size]byte) {
+	req = proto.Clone(req)
+	var secrets map[string]string
+	switch req := req.(type) {
+	case *csi.CreateVolumeRequest:
+		secrets, req.Secrets = req.Secrets, nil
+	case *csi.DeleteVolumeRequest:
+		secrets, req.Secrets = req.Secrets, nil
+	}
+	keys := make([]string, 0, len(secrets))
+	for key := range secrets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	hash := sha256.New()
+	for _, key := range keys {
+		// The NUL bytes separate keys and values unambiguously.
+		hash.Write([]byte(key + "\x00" + secrets[key] + "\x00"))
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], hash.Sum(nil))
+	return req, sum
+}
+
+func (f *inFlight) getNow() time.Time {
+	if f.now != nil {
+		return f.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestInFlight(t *testing.T) {
+	var f inFlight
+	req := &csi.DeleteVolumeRequest{VolumeId: "pvc-1"}
+	_, done, err := f.start("CreateVolume", "pvc-1", req)
+	require.NoError(t, err, "first call")
+	_, _, err = f.start("CreateVolume", "pvc-1", req)
+	require.Equal(t, codes.Aborted, status.Code(err), "retry: %v", err)
+	_, doneOther, err := f.start("CreateVolume", "pvc-2", req)
+	require.NoError(t, err, "other volume")
+	doneOther(nil)
+	_, doneDelete, err := f.start("DeleteVolume", "pvc-1", req)
+	require.NoError(t, err, "other operation")
+	doneDelete(nil)
+	done(nil)
+	recent, done, err := f.start("CreateVolume", "pvc-1", req)
+	require.NoError(t, err, "after completion")
+	require.Nil(t, recent, "no result after failure")
+	done(nil)
+}
+
+func TestInFlightRecent(t *testing.T) {
+	now := time.Now()
+	f := inFlight{now: func() time.Time { return now }}
+	req := &csi.CreateVolumeRequest{Name: "pvc-1"}
+	resp := &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "id-1"}}
+
+	_, done, err := f.start("CreateVolume", "pvc-1", req)
+	require.NoError(t, err, "first call")
+	done(resp)
+
+	recent, done, err := f.start("CreateVolume", "pvc-1", &csi.CreateVolumeRequest{Name: "pvc-1"})
+	require.NoError(t, err, "same request")
+	require.Equal(t, resp, recent, "recent response")
+	done(recent)
+
+	recent, done, err = f.start("CreateVolume", "pvc-1", &csi.CreateVolumeRequest{Name: "pvc-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 1}})
+	require.NoError(t, err, "different request")
+	require.Nil(t, recent, "no response for different request")
+	done(nil)
+
+	recent, done, err = f.start("CreateVolume", "pvc-1", req)
+	require.NoError(t, err, "after failure")
+	require.Nil(t, recent, "failure removes the response")
+	done(resp)
+
+	now = now.Add(recentResultTTL)
+	recent, done, err = f.start("CreateVolume", "pvc-1", req)
+	require.NoError(t, err, "after expiration")
+	require.Nil(t, recent, "expired response")
+	done(nil)
+	require.Empty(t, f.results, "no result after failure")
+}
+
+func TestInFlightSecrets(t *testing.T) {
+	var f inFlight
+	req := &csi.CreateVolumeRequest{Name: "pvc-1", Secrets: map[string]string{"key": "secret"}}
+	resp := &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "id-1"}}
+
+	_, done, err := f.start("CreateVolume", "pvc-1", req)
+	require.NoError(t, err, "first call")
+	done(resp)
+	require.Len(t, f.results, 1, "recent results")
+	for _, result := range f.results {
+		require.Empty(t, result.req.(*csi.CreateVolumeRequest).Secrets, "secrets of stored request")
+	}
+	require.Equal(t, "secret", req.Secrets["key"], "original request unmodified")
+
+	recent, done, err := f.start("CreateVolume", "pvc-1", &csi.CreateVolumeRequest{Name: "pvc-1", Secrets: map[string]string{"key": "other"}})
+	require.NoError(t, err, "different secret")
+	require.Nil(t, recent, "no response for different secret")
+	done(resp)
+
+	recent, done, err = f.start("CreateVolume", "pvc-1", &csi.CreateVolumeRequest{Name: "pvc-1", Secrets: map[string]string{"key": "other"}})
+	require.NoError(t, err, "same secret")
+	require.Equal(t, resp, recent, "recent response")
+	done(recent)
+}
+
+func TestCreateVolumeInFlight(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+	req := &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+	}
+
+	// Simulate a first call which is still running.
+	_, done, err := cs.inFlight.start("CreateVolume", req.Name, req)
+	require.NoError(t, err, "start first call")
+	_, err = cs.CreateVolume(ctx, req)
+	require.Equal(t, codes.Aborted, status.Code(err), "retry while first call runs: %v", err)
+	done(nil)
+
+	resp, err := cs.CreateVolume(ctx, req)
+	require.NoError(t, err, "retry after first call")
+	resp2, err := cs.CreateVolume(ctx, req)
+	require.NoError(t, err, "idempotent retry")
+	require.Same(t, resp, resp2, "recent response")
+
+	_, done, err = cs.inFlight.start("DeleteVolume", resp.Volume.VolumeId, &csi.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId})
+	require.NoError(t, err, "start first delete")
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId})
+	require.Equal(t, codes.Aborted, status.Code(err), "retry while first delete runs: %v", err)
+	done(nil)
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId})
+	require.NoError(t, err, "delete")
+
+	// The volume is gone, so the recent response must not be used.
+	resp3, err := cs.CreateVolume(ctx, req)
+	require.NoError(t, err, "create again")
+	require.NotSame(t, resp, resp3, "new response")
+	require.NotNil(t, cs.getVolumeByID(resp3.Volume.VolumeId), "volume exists")
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"k8s.io/klog/v2"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+)
+
+const (
+	// integrityPrefix is used for the device mapper names of
+	// dm-integrity devices: <prefix><volume ID>.
+	integrityPrefix = "pmem-integrity-"
+
+	// integrityJournalOverhead is reserved for the superblock
+	// and the journal that integritysetup creates by default
+	// for a device. It is a rough upper bound.
+	integrityJournalOverhead = 64 * 1024 * 1024
+
+	// integrityTagRatio is the ratio between data and checksum
+	// tags: integritysetup defaults to crc32c with 4 byte tags
+	// per 512 byte sector, i.e. 1/128. We reserve twice that
+	// to be on the safe side.
+	integrityTagRatio = 64
+)
+
+// integrityMagic is at the start of the dm-integrity superblock
+// (SB_MAGIC in the kernel, including the terminating null byte).
+var integrityMagic = []byte("integrt\x00")
+
+// integrityOverhead returns how many bytes must be added to a
+// device such that a dm-integrity device on top of it can provide
+// the requested size.
+func integrityOverhead(size int64) int64 {
+	return (size+integrityTagRatio-1)/integrityTagRatio + integrityJournalOverhead
+}
+
+// integrityDevicePath returns the path of the dm-integrity device
+// for a volume.
+func integrityDevicePath(volumeID string) string {
+	return filepath.Join("/dev/mapper", integrityPrefix+volumeID)
+}
+
+// openIntegrity ensures that the dm-integrity device for the volume
+// exists and returns its path. The underlying device gets formatted
+// if it doesn't have a dm-integrity superblock yet. It can be called
+// multiple times for the same device (idempotent).
+func openIntegrity(ctx context.Context, volumeID, devicePath string) (string, error) {
+	logger := klog.FromContext(ctx).WithName("openIntegrity")
+	ctx = klog.NewContext(ctx, logger)
+
+	path := integrityDevicePath(volumeID)
+	if _, err := os.Stat(path); err == nil {
+		logger.V(5).Info("dm-integrity device already open", "device", path)
+		return path, nil
+	}
+
+	formatted, err := hasIntegritySuperblock(devicePath)
+	if err != nil {
+		return "", err
+	}
+	if !formatted {
+		logger.V(3).Info("Formatting device for dm-integrity", "device", devicePath)
+		if _, err := pmemexec.RunCommand(ctx, "integritysetup", "format", "--batch-mode", devicePath); err != nil {
+			return "", fmt.Errorf("format %s for dm-integrity: %v", devicePath, err)
+		}
+	}
+	if _, err := pmemexec.RunCommand(ctx, "integritysetup", "open", devicePath, integrityPrefix+volumeID); err != nil {
+		return "", fmt.Errorf("open dm-integrity device for %s: %v", devicePath, err)
+	}
+	logger.V(3).Info("Opened dm-integrity device", "device", path)
+	return path, nil
+}
+
+// hasIntegritySuperblock checks whether the device starts with the
+// dm-integrity superblock magic. This is checked directly instead of
+// relying on "integritysetup dump" because that fails the same way
+// for a missing superblock as for a busy device or an I/O error, and
+// formatting would destroy the data of an existing volume.
+func hasIntegritySuperblock(devicePath string) (bool, error) {
+	file, err := os.Open(devicePath)
+	if err != nil {
+		return false, fmt.Errorf("check %s for dm-integrity superblock: %v", devicePath, err)
+	}
+	defer file.Close()
+	magic := make([]byte, len(integrityMagic))
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false, fmt.Errorf("check %s for dm-integrity superblock: %v", devicePath, err)
+	}
+	return bytes.Equal(magic, integrityMagic), nil
+}
+
+// closeIntegrity removes the dm-integrity device for the volume.
+// Nothing is done if there is no such device.
+func closeIntegrity(ctx context.Context, volumeID string) error {
+	logger := klog.FromContext(ctx).WithName("closeIntegrity")
+	ctx = klog.NewContext(ctx, logger)
+
+	path := integrityDevicePath(volumeID)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if _, err := pmemexec.RunCommand(ctx, "integritysetup", "close", integrityPrefix+volumeID); err != nil {
+		return fmt.Errorf("close dm-integrity device %s: %v", path, err)
+	}
+	logger.V(3).Info("Closed dm-integrity device", "device", path)
+	return nil
+}
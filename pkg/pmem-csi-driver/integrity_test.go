@@ -0,0 +1,59 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHasIntegritySuperblock(t *testing.T) {
+	for name, tc := range map[string]struct {
+		// content of the device, none if nil.
+		content     []byte
+		expected    bool
+		expectedErr bool
+	}{
+		"superblock": {
+			content:  append([]byte("integrt\x00"), make([]byte, 4096)...),
+			expected: true,
+		},
+		"empty": {
+			content: make([]byte, 4096),
+		},
+		"filesystem": {
+			content: append([]byte("integrity"), make([]byte, 4096)...),
+		},
+		"too-small": {
+			content:     []byte("int"),
+			expectedErr: true,
+		},
+		"no-device": {
+			expectedErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			devicePath := filepath.Join(t.TempDir(), "device")
+			if tc.content != nil {
+				err := os.WriteFile(devicePath, tc.content, 0600)
+				require.NoError(t, err, "create fake device")
+			}
+
+			formatted, err := hasIntegritySuperblock(devicePath)
+			if tc.expectedErr {
+				assert.Error(t, err, "hasIntegritySuperblock")
+				return
+			}
+			require.NoError(t, err, "hasIntegritySuperblock")
+			assert.Equal(t, tc.expected, formatted, "dm-integrity superblock")
+		})
+	}
+}
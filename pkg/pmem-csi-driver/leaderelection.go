@@ -0,0 +1,91 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+)
+
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// leaseName returns the name of the Lease object that the controller
+// replicas of a driver instance compete for.
+func leaseName(driverName string) string {
+	return strings.ReplaceAll(driverName, ".", "-") + "-controller"
+}
+
+// runAsLeader calls run in the background whenever this process
+// becomes the leader among all controller replicas. The context
+// passed to run is canceled when leadership is lost. The process
+// then competes again until the outer context is done.
+func runAsLeader(ctx context.Context, client kubernetes.Interface, namespace, driverName string, run func(ctx context.Context)) error {
+	ctx, logger := pmemlog.WithName(ctx, "leader-election")
+	if namespace == "" {
+		namespace = os.Getenv("POD_NAMESPACE")
+	}
+	if namespace == "" {
+		return fmt.Errorf("namespace for leader election unknown, set -leaderElectionNamespace or POD_NAMESPACE")
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("determine identity for leader election: %v", err)
+	}
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock,
+		namespace, leaseName(driverName),
+		client.CoreV1(), client.CoordinationV1(),
+		resourcelock.ResourceLockConfig{Identity: identity})
+	if err != nil {
+		return fmt.Errorf("create leader election lock: %v", err)
+	}
+	config := leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		Name:            leaseName(driverName),
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				logger.Info("Became leader", "identity", identity)
+				run(klog.NewContext(ctx, logger))
+			},
+			OnStoppedLeading: func() {
+				logger.Info("Stopped leading", "identity", identity)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					logger.V(3).Info("Other replica is leader", "leader", leader)
+				}
+			},
+		},
+	}
+	elector, err := leaderelection.NewLeaderElector(config)
+	if err != nil {
+		return fmt.Errorf("create leader elector: %v", err)
+	}
+	go func() {
+		for ctx.Err() == nil {
+			elector.Run(ctx)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// deviceLimiter limits how many expensive device operations (creating
+// and deleting devices, mkfs) run in parallel. Without such a limit,
+// a storm of CreateVolume calls can saturate the node until all of
+// them time out. A nil limiter does not limit anything.
+type deviceLimiter chan struct{}
+
+// newDeviceLimiter returns a limiter for at most max concurrent
+// operations, nil if max is zero or negative.
+func newDeviceLimiter(max int) deviceLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return make(deviceLimiter, max)
+}
+
+// acquire blocks until the operation may proceed. The caller must
+// invoke the returned function once the operation is done. The
+// error is a gRPC status error for the context.
+func (l deviceLimiter) acquire(ctx context.Context, operation string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l <- struct{}{}:
+		return l.release, nil
+	default:
+	}
+	logger := klog.FromContext(ctx)
+	logger.V(4).Info("Waiting for other device operations to finish", "operation", operation, "limit", cap(l))
+	select {
+	case l <- struct{}{}:
+		return l.release, nil
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+func (l deviceLimiter) release() {
+	<-l
+}
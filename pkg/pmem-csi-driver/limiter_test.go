@@ -0,0 +1,57 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestDeviceLimiter(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+
+	var unlimited deviceLimiter
+	for i := 0; i < 10; i++ {
+		_, err := unlimited.acquire(ctx, "test")
+		require.NoError(t, err, "unlimited #%d", i)
+	}
+
+	l := newDeviceLimiter(2)
+	release1, err := l.acquire(ctx, "test")
+	require.NoError(t, err, "first")
+	release2, err := l.acquire(ctx, "test")
+	require.NoError(t, err, "second")
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(timeoutCtx, "test")
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err), "third with timeout: %v", err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		release3, err := l.acquire(ctx, "test")
+		if err == nil {
+			release3()
+		}
+	}()
+	select {
+	case <-done:
+		t.Fatal("third operation should have blocked")
+	case <-time.After(10 * time.Millisecond):
+	}
+	release1()
+	<-done
+	release2()
+	require.Empty(t, l, "all operations done")
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+// VolumeLookup describes which Kubernetes objects a volume belongs
+// to. It is the output of the lookup-volume mode.
+type VolumeLookup struct {
+	// VolumeID is also the name of the logical volume (LVM
+	// mode) or namespace (direct mode).
+	VolumeID string `json:"volumeID"`
+	Size     int64  `json:"size"`
+	// PVC is <namespace>/<name>, empty if unknown.
+	PVC string `json:"pvc,omitempty"`
+	// PV is empty for ephemeral inline volumes.
+	PV string `json:"pv,omitempty"`
+	// PodUID is only set for ephemeral inline volumes.
+	PodUID string `json:"podUID,omitempty"`
+}
+
+// lookupVolumes finds the volumes in the persistent state of the node
+// driver which match the key. The key can be a volume ID, a PV name or
+// a PVC as <namespace>/<name>. All volumes match an empty key. The
+// PVC is only known for volumes which were created by
+// external-provisioner with --extra-create-metadata.
+func lookupVolumes(sm pmemstate.StateManager, key string) ([]VolumeLookup, error) {
+	ids, err := sm.GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("load state: %v", err)
+	}
+	sort.Strings(ids)
+	result := []VolumeLookup{}
+	for _, id := range ids {
+		vol := &nodeVolume{}
+		if err := sm.Get(id, vol); err != nil {
+			return nil, fmt.Errorf("load volume %s: %v", id, err)
+		}
+		p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+		if err != nil {
+			return nil, fmt.Errorf("volume %s: %v", id, err)
+		}
+		l := VolumeLookup{
+			VolumeID: vol.ID,
+			Size:     vol.Size,
+			PodUID:   p.GetPodUID(),
+		}
+		if name := p.GetPVCName(); name != "" {
+			l.PVC = p.GetPVCNamespace() + "/" + name
+		}
+		if p.GetPersistency() != parameters.PersistencyEphemeral {
+			// The CreateVolume name is the PV name for
+			// volumes created by external-provisioner.
+			l.PV = p.GetPVName()
+			if l.PV == "" {
+				l.PV = p.GetName()
+			}
+		}
+		if key == "" || key == l.VolumeID || key == l.PV || key == l.PVC {
+			result = append(result, l)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestLookupVolumes(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100)
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create state manager")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm)
+
+	create := func(name string, params map[string]string) string {
+		resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+			Parameters:         params,
+		})
+		require.NoError(t, err, "create volume %s", name)
+		return resp.Volume.VolumeId
+	}
+	withPVC := create("pv-0", map[string]string{
+		parameters.PVCName:      "data",
+		parameters.PVCNamespace: "default",
+		parameters.PVName:       "pv-0",
+	})
+	withoutPVC := create("pv-1", nil)
+
+	all, err := lookupVolumes(sm, "")
+	require.NoError(t, err, "all volumes")
+	assert.Len(t, all, 2, "all volumes")
+
+	expected := []VolumeLookup{{
+		VolumeID: withPVC,
+		Size:     4 * 1024 * 1024,
+		PVC:      "default/data",
+		PV:       "pv-0",
+	}}
+	for _, key := range []string{withPVC, "pv-0", "default/data"} {
+		volumes, err := lookupVolumes(sm, key)
+		require.NoError(t, err, key)
+		assert.Equal(t, expected, volumes, key)
+	}
+
+	volumes, err := lookupVolumes(sm, "pv-1")
+	require.NoError(t, err, "volume without PVC")
+	assert.Equal(t, []VolumeLookup{{VolumeID: withoutPVC, Size: 4 * 1024 * 1024, PV: "pv-1"}}, volumes, "volume without PVC")
+
+	volumes, err = lookupVolumes(sm, "no-such-volume")
+	require.NoError(t, err, "unknown volume")
+	assert.Empty(t, volumes, "unknown volume")
+}
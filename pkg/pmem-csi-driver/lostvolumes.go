@@ -0,0 +1,183 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	pmemcapacity "github.com/intel/pmem-csi/pkg/pmem-capacity"
+
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	corelistersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// annLostVolume is set on PVs whose node was removed from
+	// the cluster. The value explains why.
+	annLostVolume = "pmem-csi.intel.com/lost"
+
+	// provisionerFinalizer gets added by external-provisioner to
+	// PVs which it is meant to delete. It must be removed for
+	// volumes whose node is gone because there is no
+	// external-provisioner anymore which could do that.
+	provisionerFinalizer = "external-provisioner.volume.kubernetes.io/finalizer"
+
+	// lostVolumeCheckInterval determines how often PVs are
+	// checked. All data comes from informers, so this is cheap.
+	lostVolumeCheckInterval = time.Minute
+)
+
+// lostVolumeChecker detects PVs of the driver on nodes which no
+// longer exist. After the grace period, such PVs are marked as lost
+// with an annotation and a warning event for the PV and its PVC. If
+// enabled, PVs that are also released (= no longer bound to a PVC)
+// get deleted because the data is gone together with the node and
+// nothing else would remove them.
+type lostVolumeChecker struct {
+	driverName     string
+	topologyKey    string
+	client         kubernetes.Interface
+	pvLister       corelistersv1.PersistentVolumeLister
+	nodeLister     corelistersv1.NodeLister
+	recorder       record.EventRecorder
+	gracePeriod    time.Duration
+	deleteReleased bool
+	now            func() time.Time
+
+	// missingSince records when a node was first found to be
+	// missing. Only accessed by check, which never runs in
+	// parallel.
+	missingSince map[string]time.Time
+}
+
+func newLostVolumeChecker(driverName, topologyKey string, client kubernetes.Interface,
+	pvLister corelistersv1.PersistentVolumeLister, nodeLister corelistersv1.NodeLister,
+	recorder record.EventRecorder, gracePeriod time.Duration, deleteReleased bool) *lostVolumeChecker {
+	return &lostVolumeChecker{
+		driverName:     driverName,
+		topologyKey:    topologyKey,
+		client:         client,
+		pvLister:       pvLister,
+		nodeLister:     nodeLister,
+		recorder:       recorder,
+		gracePeriod:    gracePeriod,
+		deleteReleased: deleteReleased,
+		now:            time.Now,
+		missingSince:   map[string]time.Time{},
+	}
+}
+
+// run checks periodically until the context is canceled.
+func (lc *lostVolumeChecker) run(ctx context.Context, interval time.Duration) {
+	ctx, _ = pmemlog.WithName(ctx, "lostVolumeChecker")
+	go wait.UntilWithContext(ctx, lc.check, interval)
+}
+
+// check looks at all PVs once.
+func (lc *lostVolumeChecker) check(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	pvs, err := lc.pvLister.List(labels.Everything())
+	if err != nil {
+		logger.Error(err, "Failed to list PVs")
+		return
+	}
+
+	now := lc.now()
+	missing := map[string]time.Time{}
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != lc.driverName {
+			continue
+		}
+		nodeName := pmemcapacity.VolumeNode(pv, lc.topologyKey)
+		if nodeName == "" {
+			continue
+		}
+		if _, ok := missing[nodeName]; !ok {
+			_, err := lc.nodeLister.Get(nodeName)
+			switch {
+			case err == nil:
+				continue
+			case !apierrs.IsNotFound(err):
+				logger.Error(err, "Failed to get node", "node", nodeName)
+				continue
+			}
+			since, ok := lc.missingSince[nodeName]
+			if !ok {
+				logger.V(3).Info("Node with volumes is missing", "node", nodeName)
+				since = now
+			}
+			missing[nodeName] = since
+		}
+		if now.Sub(missing[nodeName]) < lc.gracePeriod {
+			continue
+		}
+		if err := lc.handleLostVolume(ctx, pv, nodeName); err != nil {
+			logger.Error(err, "Failed to handle lost volume", "pv", pmemlog.KObj(pv))
+		}
+	}
+	// Nodes which came back or have no volumes anymore are forgotten.
+	lc.missingSince = missing
+}
+
+// handleLostVolume marks the PV as lost, if not done yet, and
+// deletes it if it is released and that is enabled.
+func (lc *lostVolumeChecker) handleLostVolume(ctx context.Context, pv *v1.PersistentVolume, nodeName string) error {
+	logger := klog.FromContext(ctx).WithValues("pv", pmemlog.KObj(pv), "node", nodeName)
+
+	if _, ok := pv.Annotations[annLostVolume]; !ok {
+		reason := fmt.Sprintf("node %s was removed from the cluster more than %s ago", nodeName, lc.gracePeriod)
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]string{annLostVolume: reason},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("create patch: %v", err)
+		}
+		if _, err := lc.client.CoreV1().PersistentVolumes().Patch(ctx, pv.Name, k8stypes.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			return fmt.Errorf("mark PV as lost: %v", err)
+		}
+		logger.Info("Marked volume as lost")
+		message := fmt.Sprintf("Volume %s is lost because %s.", pv.Name, reason)
+		lc.recorder.Event(pv, v1.EventTypeWarning, "VolumeLost", message)
+		if ref := pv.Spec.ClaimRef; ref != nil && pv.Status.Phase == v1.VolumeBound {
+			lc.recorder.Event(ref, v1.EventTypeWarning, "VolumeLost", message)
+		}
+	}
+
+	if !lc.deleteReleased || pv.Status.Phase != v1.VolumeReleased {
+		return nil
+	}
+	for i, finalizer := range pv.Finalizers {
+		if finalizer != provisionerFinalizer {
+			continue
+		}
+		pv = pv.DeepCopy()
+		pv.Finalizers = append(pv.Finalizers[:i], pv.Finalizers[i+1:]...)
+		if _, err := lc.client.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("remove finalizer: %v", err)
+		}
+		break
+	}
+	if err := lc.client.CoreV1().PersistentVolumes().Delete(ctx, pv.Name, metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
+		return fmt.Errorf("delete PV: %v", err)
+	}
+	logger.Info("Deleted released volume")
+	return nil
+}
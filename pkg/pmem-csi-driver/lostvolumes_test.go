@@ -0,0 +1,107 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestLostVolumes(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	topologyKey := driverName + "/node"
+	newPV := func(name, node string, phase v1.PersistentVolumePhase) *v1.PersistentVolume {
+		pv := &v1.PersistentVolume{}
+		pv.Name = name
+		pv.Finalizers = []string{provisionerFinalizer}
+		pv.Spec.CSI = &v1.CSIPersistentVolumeSource{Driver: driverName}
+		pv.Spec.ClaimRef = &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: "default", Name: "claim-" + name}
+		pv.Spec.NodeAffinity = &v1.VolumeNodeAffinity{
+			Required: &v1.NodeSelector{
+				NodeSelectorTerms: []v1.NodeSelectorTerm{{
+					MatchExpressions: []v1.NodeSelectorRequirement{{
+						Key:      topologyKey,
+						Operator: v1.NodeSelectorOpIn,
+						Values:   []string{node},
+					}},
+				}},
+			},
+		}
+		pv.Status.Phase = phase
+		return pv
+	}
+	node := &v1.Node{}
+	node.Name = nodeName
+	other := newPV("other", "gone", v1.VolumeReleased)
+	other.Spec.CSI.Driver = "other." + driverName
+	objects := []runtime.Object{
+		node,
+		newPV("present", nodeName, v1.VolumeBound),
+		newPV("bound", "gone", v1.VolumeBound),
+		newPV("released", "gone", v1.VolumeReleased),
+		other,
+	}
+
+	client := fake.NewSimpleClientset(objects...)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	pvLister := factory.Core().V1().PersistentVolumes().Lister()
+	nodeLister := factory.Core().V1().Nodes().Lister()
+	factory.Start(ctx.Done())
+	for typ, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		require.True(t, synced, "sync %v", typ)
+	}
+
+	recorder := record.NewFakeRecorder(10)
+	gracePeriod := time.Hour
+	lc := newLostVolumeChecker(driverName, topologyKey, client, pvLister, nodeLister, recorder, gracePeriod, true)
+	now := time.Now()
+	lc.now = func() time.Time { return now }
+
+	getPV := func(name string) *v1.PersistentVolume {
+		pv, err := client.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+		if apierrs.IsNotFound(err) {
+			return nil
+		}
+		require.NoError(t, err, "get PV %s", name)
+		return pv
+	}
+
+	// The node was just found to be missing, nothing happens yet.
+	lc.check(ctx)
+	for _, name := range []string{"present", "bound", "released", "other"} {
+		pv := getPV(name)
+		require.NotNil(t, pv, "PV %s", name)
+		assert.NotContains(t, pv.Annotations, annLostVolume, "PV %s", name)
+	}
+	assert.Empty(t, recorder.Events, "events")
+
+	// After the grace period, the volumes are lost.
+	now = now.Add(gracePeriod)
+	lc.check(ctx)
+	assert.NotContains(t, getPV("present").Annotations, annLostVolume, "present PV")
+	assert.Contains(t, getPV("bound").Annotations, annLostVolume, "bound PV")
+	assert.Nil(t, getPV("released"), "released PV should have been deleted")
+	assert.NotContains(t, getPV("other").Annotations, annLostVolume, "PV of other driver")
+	// Two events for the bound PV and its PVC, one for the released PV.
+	assert.Len(t, recorder.Events, 3, "events")
+}
@@ -11,32 +11,51 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"strings"
+	"time"
 
 	"k8s.io/klog/v2"
 
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/configfile"
+	"github.com/intel/pmem-csi/pkg/driverfeatures"
 	"github.com/intel/pmem-csi/pkg/logger"
-	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	"github.com/intel/pmem-csi/pkg/termination"
 )
 
+// configReloadInterval is how often the -config file is checked for
+// changes. Kubelet updates mounted ConfigMaps with a delay of about a
+// minute, so checking more often is not useful.
+const configReloadInterval = 30 * time.Second
+
 var (
 	config = Config{
 		Mode:          Node,
 		DeviceManager: api.DeviceModeLVM,
 	}
 	showVersion = flag.Bool("version", false, "Show release version and exit")
+	configFile  = flag.String("config", "", "YAML file with settings for any of the other flags (name without leading hyphen as key), flags on the command line take precedence, log verbosity gets updated when the file changes")
 	logFormat   = logger.NewFlag()
+	featureGate = driverfeatures.NewFeatureGate()
 	version     = "unknown" // Set version during build time
 )
 
 func init() {
 	/* generic options */
 	flag.StringVar(&config.DriverName, "drivername", "pmem-csi.intel.com", "name of the driver")
+	flag.Func("drivername-alias", "node: additional driver name for kubelet plugin registration, with <alias>.sock next to the -endpoint socket, may be repeated", func(value string) error {
+		config.DriverNameAliases = append(config.DriverNameAliases, value)
+		return nil
+	})
 	flag.StringVar(&config.NodeID, "nodeid", "nodeid", "node id")
 	flag.StringVar(&config.Endpoint, "endpoint", "unix:///tmp/pmem-csi.sock", "PMEM CSI endpoint")
 	flag.Var(&config.Mode, "mode", "driver run mode")
 	flag.Float64Var(&config.KubeAPIQPS, "kube-api-qps", 5, "QPS to use while communicating with the Kubernetes apiserver. Defaults to 5.0.")
 	flag.IntVar(&config.KubeAPIBurst, "kube-api-burst", 10, "Burst to use while communicating with the Kubernetes apiserver. Defaults to 10.")
+	flag.Func("feature-gates", "A set of key=value pairs that describe driver features for alpha/experimental features. "+
+		"Options are:\n"+strings.Join(featureGate.KnownFeatures(), "\n"), featureGate.Set)
+	flag.DurationVar(&config.ShutdownTimeout, "shutdownTimeout", 20*time.Second, "maximum time that pending gRPC calls may run after receiving SIGTERM, must be shorter than the termination grace period of the pod")
 
 	/* metrics options */
 	flag.StringVar(&config.metricsListen, "metricsListen", "", "listen address (like :8001) for prometheus metrics endpoint, disabled by default")
@@ -44,11 +63,46 @@ func init() {
 
 	/* Controller mode options */
 	flag.Var(&config.nodeSelector, "nodeSelector", "controller: reschedule PVCs with a selected node where PMEM-CSI is not meant to run because the node does not have these labels (represented as JSON map)")
+	flag.DurationVar(&config.LostNodeGracePeriod, "lostNodeGracePeriod", 0, "controller: mark volumes as lost when their node was removed from the cluster for longer than this, zero disables the check")
+	flag.BoolVar(&config.DeleteLostVolumes, "deleteLostVolumes", false, "controller: delete released PVs of lost volumes")
+	flag.BoolVar(&config.LeaderElection, "leaderElection", false, "controller: elect a leader among several controller replicas, only the leader checks for lost volumes")
+	flag.StringVar(&config.LeaderElectionNamespace, "leaderElectionNamespace", "", "controller: namespace of the Lease object for leader election, defaults to the POD_NAMESPACE env variable")
 
 	/* Node mode options */
 	flag.Var(&config.DeviceManager, "deviceManager", "node: device manager to use to manage pmem devices, supported types: 'lvm' or 'direct' (= 'ndctl')")
 	flag.StringVar(&config.StateBasePath, "statePath", "", "node: directory path where to persist the state of the driver, defaults to /var/lib/<drivername>")
 	flag.UintVar(&config.PmemPercentage, "pmemPercentage", 100, "node: percentage of space to be used by the driver in each PMEM region")
+	flag.StringVar(&config.PmemPercentageLabel, "pmemPercentageLabel", "", "node: name of a node label which, if set on the node, overrides -pmemPercentage for that node")
+	flag.DurationVar(&config.CapacityRefreshMin, "capacityRefreshMin", 30*time.Second, "node: minimum time that the result of a capacity query is reused, zero disables caching")
+	flag.DurationVar(&config.CapacityRefreshMax, "capacityRefreshMax", 10*time.Minute, "node: maximum time that the result of a capacity query is reused while no volumes get created or deleted")
+	flag.DurationVar(&config.OrphanCheckInterval, "orphanCheckInterval", 10*time.Minute, "node: how often to check for devices which have no volume, zero disables the check")
+	flag.BoolVar(&config.OrphanDryRun, "orphanDryRun", true, "node: only report orphaned devices instead of deleting them")
+	flag.BoolVar(&config.CleanupOrphanedMounts, "cleanupOrphanedMounts", true, "node: unpublish and unstage volumes of pods which no longer exist during startup")
+	flag.StringVar(&config.VolumeHookURL, "volumeHookURL", "", "node: HTTP(S) URL which receives a POST request with JSON metadata after creating or deleting a volume, disabled by default")
+	flag.IntVar(&config.VolumeHookRetries, "volumeHookRetries", 5, "node: how often to retry a failed volume hook request, with exponential backoff")
+	flag.Var(&config.NamespaceQuota, "namespaceQuota", "node: maximum total size of volumes on the node per PVC namespace (represented as JSON map from namespace to quantity, \"*\" for all other namespaces), needs external-provisioner with --extra-create-metadata")
+	flag.Var(&config.EphemeralQuotaPerPod, "ephemeralQuotaPerPod", "node: maximum total size of the ephemeral inline volumes of a pod on the node (quantity like 10Gi), zero for no limit")
+	flag.Var(&config.EphemeralQuotaPerNode, "ephemeralQuotaPerNode", "node: maximum total size of all ephemeral inline volumes on the node (quantity like 100Gi), zero for no limit")
+	flag.IntVar(&config.MaxDeviceOperations, "maxDeviceOperations", 4, "node: maximum number of concurrent device operations (creating or deleting devices, mkfs), zero for no limit")
+	flag.IntVar(&config.MaxVolumesPerNode, "maxVolumesPerNode", 0, "node: maximum number of volumes on the node, zero for no limit other than the one of the hardware")
+	flag.IntVar(&config.DeviceRetryPolicy.Attempts, "deviceRetries", pmdmanager.DefaultRetryPolicy.Attempts, "node: maximum number of attempts for a device operation (lvcreate, lvremove, creating or destroying a namespace) which fails with a transient error like a locking conflict, 1 disables retrying")
+	flag.DurationVar(&config.DeviceRetryPolicy.Delay, "deviceRetryDelay", pmdmanager.DefaultRetryPolicy.Delay, "node: delay before the first retry of a device operation, doubles for each further retry")
+	flag.DurationVar(&config.DeviceRetryPolicy.MaxDelay, "deviceRetryMaxDelay", pmdmanager.DefaultRetryPolicy.MaxDelay, "node: maximum delay between retries of a device operation")
+	flag.Var(&config.VolumePools, "volumePools", "node: pre-formatted devices to keep ready for new volumes in LVM mode (represented as JSON list of objects with size, count and fsType)")
+	flag.BoolVar(&config.DryRun, "dryRun", false, "node: only simulate creating and deleting volumes in memory without modifying PMEM, volumes cannot be used by pods")
+	flag.StringVar((*string)(&config.UnsupportedFsType), "unsupportedFsType", string(FsTypeFail), "node: how to handle volumes with a filesystem type other than ext4 or xfs, \"fail\" or \"fallback\" (= use ext4 and record a warning event)")
+
+	/* Import mode options */
+	flag.StringVar(&config.ImportDevice, "importDevice", "", "import-volume: logical volume (LVM mode) or namespace name or device (direct mode) which gets imported")
+	flag.StringVar(&config.ImportPVName, "importPVName", "", "import-volume: name of the PV for the imported volume")
+	flag.StringVar(&config.ImportStorageClass, "importStorageClass", "", "import-volume: optional storage class name of the PV for the imported volume")
+	flag.BoolVar(&config.ImportReadOnly, "importReadOnly", false, "import-volume: create a PV with the ReadOnlyMany instead of the ReadWriteOnce access mode, pods then mount the volume read-only")
+
+	/* Lookup mode options */
+	flag.StringVar(&config.LookupKey, "lookup", "", "lookup-volume: volume ID (= logical volume or namespace name), PV name or <namespace>/<PVC name> of the volumes to show, all volumes if empty")
+
+	/* Uninstall mode options */
+	flag.BoolVar(&config.UninstallForce, "uninstallForce", false, "uninstall: erase and delete volumes even if PVs still refer to them")
 
 	// These options no longer have an effect. They don't get removed to
 	// keep old deployments working when upgrading only the image.
@@ -67,6 +121,15 @@ func Main() int {
 		fmt.Println(version)
 		return 0
 	}
+	var cf *configfile.File
+	if *configFile != "" {
+		var err error
+		cf, err = configfile.Load(flag.CommandLine, *configFile)
+		if err != nil {
+			termination.ExitError("failed to load configuration", err)
+			return 1
+		}
+	}
 
 	// This ensures that code which does not use klog as fallback also uses
 	// the klog logger.
@@ -76,16 +139,20 @@ func Main() int {
 
 	logger.Info("PMEM-CSI started.", "version", version)
 	defer logger.Info("PMEM-CSI stopped.")
+	if cf != nil {
+		go cf.Watch(ctx, configReloadInterval)
+	}
 
 	config.Version = version
+	config.FeatureGate = featureGate
 	driver, err := GetCSIDriver(config)
 	if err != nil {
-		pmemcommon.ExitError("failed to initialize driver", err)
+		termination.ExitError("failed to initialize driver", err)
 		return 1
 	}
 
 	if err = driver.Run(ctx); err != nil {
-		pmemcommon.ExitError("failed to run driver", err)
+		termination.ExitError("failed to run driver", err)
 		return 1
 	}
 
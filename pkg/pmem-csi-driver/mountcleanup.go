@@ -0,0 +1,177 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+)
+
+var (
+	// targetPathRE matches the target path of a filesystem volume
+	// as chosen by kubelet. The submatch is the pod UID.
+	targetPathRE = regexp.MustCompile(`/pods/([^/]+)/volumes/kubernetes.io~csi/[^/]+/mount$`)
+	// blockTargetPathRE matches the target path of a raw block
+	// volume as chosen by kubelet. The submatches are the
+	// directory with the per-volume data, the volume spec name
+	// and the pod UID. Block volumes are not staged by
+	// PMEM-CSI.
+	blockTargetPathRE = regexp.MustCompile(`^(.*/plugins/kubernetes.io/csi/volumeDevices)/publish/([^/]+)/([^/]+)$`)
+	// stagingPathRE matches the staging path of a volume as
+	// chosen by kubelet.
+	stagingPathRE = regexp.MustCompile(`/plugins/kubernetes.io/csi/.+/globalmount$`)
+)
+
+// volumeData is the content of the vol_data.json file which kubelet
+// writes next to the target or staging directory.
+type volumeData struct {
+	DriverName   string `json:"driverName"`
+	VolumeHandle string `json:"volumeHandle"`
+}
+
+// targetPodUID returns the pod UID for a filesystem or raw block
+// target path.
+func targetPodUID(path string) (string, bool) {
+	if m := targetPathRE.FindStringSubmatch(path); m != nil {
+		return m[1], true
+	}
+	if m := blockTargetPathRE.FindStringSubmatch(path); m != nil {
+		return m[3], true
+	}
+	return "", false
+}
+
+// readVolumeData reads the vol_data.json file for a target or staging
+// path. For raw block volumes, kubelet stores it in
+// volumeDevices/<spec name>/data.
+func readVolumeData(path string) (*volumeData, error) {
+	file := filepath.Join(filepath.Dir(path), "vol_data.json")
+	if m := blockTargetPathRE.FindStringSubmatch(path); m != nil {
+		file = filepath.Join(m[1], m[2], "data", "vol_data.json")
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	data := &volumeData{}
+	if err := json.Unmarshal(content, data); err != nil {
+		return nil, fmt.Errorf("parse vol_data.json for %s: %v", path, err)
+	}
+	return data, nil
+}
+
+// cleanupOrphanedMounts unpublishes volumes of the driver that are
+// still mounted for pods which no longer exist, then unstages
+// volumes that are not published anymore. This can happen when the
+// driver or kubelet were not running while a pod got deleted. It
+// must be called before the driver starts accepting requests.
+//
+// Only mounts listed in the mount table are considered. After a
+// reboot, there are no such mounts and kubelet cleans up the
+// directories. Must not be called in dry run mode, where the mounts
+// do not belong to simulated volumes.
+func (ns *nodeServer) cleanupOrphanedMounts(ctx context.Context, driverName string, podUIDs map[string]bool) error {
+	ctx, logger := pmemlog.WithName(ctx, "cleanupOrphanedMounts")
+
+	mounts, err := ns.mounter.List()
+	if err != nil {
+		return fmt.Errorf("list mounts: %v", err)
+	}
+	for _, mp := range mounts {
+		podUID, ok := targetPodUID(mp.Path)
+		if !ok || podUIDs[podUID] {
+			continue
+		}
+		data, err := readVolumeData(mp.Path)
+		if err != nil {
+			logger.Error(err, "Skipping target path", "target-path", mp.Path)
+			continue
+		}
+		if data.DriverName != driverName {
+			continue
+		}
+		logger.Info("Unpublishing volume of removed pod", "volume-id", data.VolumeHandle, "target-path", mp.Path, "pod-uid", podUID)
+		if _, err := ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   data.VolumeHandle,
+			TargetPath: mp.Path,
+		}); err != nil {
+			logger.Error(err, "Unpublishing failed", "volume-id", data.VolumeHandle, "target-path", mp.Path)
+		}
+	}
+
+	// The mount table has changed, get it again to find staged
+	// volumes which are no longer in use.
+	mounts, err = ns.mounter.List()
+	if err != nil {
+		return fmt.Errorf("list mounts: %v", err)
+	}
+	// Volumes are identified by their handle, not the mounted
+	// device, because for Kata Containers the target path is
+	// not a bind mount of the staging path.
+	published := map[string]bool{}
+	for _, mp := range mounts {
+		if _, ok := targetPodUID(mp.Path); !ok {
+			continue
+		}
+		data, err := readVolumeData(mp.Path)
+		if err != nil {
+			// Better not unstage anything when it is
+			// unknown what is still in use.
+			return fmt.Errorf("determine published volumes: %v", err)
+		}
+		if data.DriverName == driverName {
+			published[data.VolumeHandle] = true
+		}
+	}
+	for _, mp := range mounts {
+		if !stagingPathRE.MatchString(mp.Path) {
+			continue
+		}
+		data, err := readVolumeData(mp.Path)
+		if err != nil {
+			logger.Error(err, "Skipping staging path", "staging-target-path", mp.Path)
+			continue
+		}
+		if data.DriverName != driverName || published[data.VolumeHandle] {
+			continue
+		}
+		logger.Info("Unstaging unused volume", "volume-id", data.VolumeHandle, "staging-target-path", mp.Path)
+		if _, err := ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+			VolumeId:          data.VolumeHandle,
+			StagingTargetPath: mp.Path,
+		}); err != nil {
+			logger.Error(err, "Unstaging failed", "volume-id", data.VolumeHandle, "staging-target-path", mp.Path)
+		}
+	}
+	return nil
+}
+
+// podUIDsOnNode returns the UIDs of all pods which exist for the node.
+func podUIDsOnNode(ctx context.Context, client kubernetes.Interface, nodeName string) (map[string]bool, error) {
+	pods, err := client.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", nodeName).String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list pods on node %s: %v", nodeName, err)
+	}
+	uids := make(map[string]bool, len(pods.Items))
+	for _, pod := range pods.Items {
+		uids[string(pod.UID)] = true
+	}
+	return uids, nil
+}
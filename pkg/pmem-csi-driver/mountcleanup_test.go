@@ -0,0 +1,80 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+	"k8s.io/utils/mount"
+)
+
+func TestCleanupOrphanedMounts(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+	createVolumes(ctx, t, cs, 0, 4)
+	ns := NewNodeServer(cs, t.TempDir())
+	kubeletDir := t.TempDir()
+
+	const driverName = "pmem-csi.intel.com"
+	var mounts []mount.MountPoint
+	addMount := func(path, driver, volumeID string) string {
+		require.NoError(t, os.MkdirAll(path, 0755), "create %s", path)
+		content, err := json.Marshal(volumeData{DriverName: driver, VolumeHandle: volumeID})
+		require.NoError(t, err, "encode vol_data.json")
+		require.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(path), "vol_data.json"), content, 0644), "write vol_data.json")
+		mounts = append(mounts, mount.MountPoint{Device: "/dev/" + volumeID, Path: path, Type: "ext4"})
+		return path
+	}
+	target := func(podUID, pv string) string {
+		return filepath.Join(kubeletDir, "pods", podUID, "volumes/kubernetes.io~csi", pv, "mount")
+	}
+	addBlockMount := func(podUID, pv, driver, volumeID string) string {
+		dir := filepath.Join(kubeletDir, "plugins/kubernetes.io/csi/volumeDevices")
+		path := filepath.Join(dir, "publish", pv, podUID)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755), "create %s", filepath.Dir(path))
+		require.NoError(t, os.WriteFile(path, nil, 0644), "create %s", path)
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, pv, "data"), 0755), "create data directory")
+		content, err := json.Marshal(volumeData{DriverName: driver, VolumeHandle: volumeID})
+		require.NoError(t, err, "encode vol_data.json")
+		require.NoError(t, os.WriteFile(filepath.Join(dir, pv, "data", "vol_data.json"), content, 0644), "write vol_data.json")
+		mounts = append(mounts, mount.MountPoint{Device: "/dev/" + volumeID, Path: path, Type: "devtmpfs"})
+		return path
+	}
+	staging := func(driver, hash string) string {
+		return filepath.Join(kubeletDir, "plugins/kubernetes.io/csi", driver, hash, "globalmount")
+	}
+
+	orphaned, used := generateVolumeID("pvc-0"), generateVolumeID("pvc-1")
+	orphanedTarget := addMount(target("removed-pod", "pv-0"), driverName, orphaned)
+	orphanedStaging := addMount(staging(driverName, "hash-0"), driverName, orphaned)
+	usedTarget := addMount(target("existing-pod", "pv-1"), driverName, used)
+	usedStaging := addMount(staging(driverName, "hash-1"), driverName, used)
+	otherTarget := addMount(target("removed-pod", "pv-other"), "other-driver", "other-volume")
+	orphanedBlock := addBlockMount("removed-pod", "pv-2", driverName, generateVolumeID("pvc-2"))
+	usedBlock := addBlockMount("existing-pod", "pv-3", driverName, generateVolumeID("pvc-3"))
+	ns.mounter = mount.NewFakeMounter(mounts)
+
+	err := ns.cleanupOrphanedMounts(ctx, driverName, map[string]bool{"existing-pod": true})
+	require.NoError(t, err, "cleanup")
+
+	remaining, err := ns.mounter.List()
+	require.NoError(t, err, "list mounts")
+	var paths []string
+	for _, mp := range remaining {
+		paths = append(paths, mp.Path)
+	}
+	assert.ElementsMatch(t, []string{usedTarget, usedStaging, otherTarget, usedBlock}, paths, "remaining mounts")
+	assert.NoDirExists(t, orphanedTarget, "orphaned target path")
+	assert.NoFileExists(t, orphanedBlock, "orphaned block target path")
+	assert.DirExists(t, orphanedStaging, "staging path is left for kubelet")
+}
@@ -19,6 +19,9 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 	"k8s.io/utils/keymutex"
 	"k8s.io/utils/mount"
@@ -51,8 +54,31 @@ const (
 	// Given that "-o dax" is part of the kernel API, it's unlikely that
 	// support for it really gets removed, therefore we continue to use it.
 	daxMountFlag = "dax"
+
+	// daxInodeMountFlag enables per-file DAX (Linux >= 5.8 for XFS,
+	// >= 5.10 for ext4). Older kernels reject it.
+	daxInodeMountFlag = "dax=inode"
+)
+
+// FsTypePolicy determines how the node driver handles a request for
+// a filesystem type that it does not support.
+type FsTypePolicy string
+
+const (
+	// FsTypeFail rejects such requests.
+	FsTypeFail FsTypePolicy = "fail"
+	// FsTypeFallback uses the default filesystem instead and
+	// records a warning event.
+	FsTypeFallback FsTypePolicy = "fallback"
 )
 
+// supportedFilesystems lists all filesystem types that
+// provisionDevice can create.
+var supportedFilesystems = []string{"ext4", "xfs"}
+
+// errDryRun is returned for operations which need a real device.
+var errDryRun = status.Error(codes.FailedPrecondition, "driver runs in dry-run mode, volumes cannot be used by pods")
+
 type nodeServer struct {
 	nodeCaps []*csi.NodeServiceCapability
 	cs       *nodeControllerServer
@@ -61,6 +87,14 @@ type nodeServer struct {
 
 	// A directory for additional mount points.
 	mountDirectory string
+
+	// fsTypePolicy is the policy for unsupported filesystem types.
+	fsTypePolicy FsTypePolicy
+	// recorder is used for events, may be nil.
+	recorder record.EventRecorder
+	// dryRun rejects staging and publishing because volumes
+	// only exist in memory.
+	dryRun bool
 }
 
 var _ csi.NodeServer = &nodeServer{}
@@ -69,18 +103,11 @@ var volumeMutex = keymutex.NewHashed(-1)
 
 func NewNodeServer(cs *nodeControllerServer, mountDirectory string) *nodeServer {
 	return &nodeServer{
-		nodeCaps: []*csi.NodeServiceCapability{
-			{
-				Type: &csi.NodeServiceCapability_Rpc{
-					Rpc: &csi.NodeServiceCapability_RPC{
-						Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
-					},
-				},
-			},
-		},
+		nodeCaps:       cs.caps.node(),
 		cs:             cs,
 		mounter:        mount.New(""),
 		mountDirectory: mountDirectory,
+		fsTypePolicy:   FsTypeFail,
 	}
 }
 
@@ -88,15 +115,41 @@ func (ns *nodeServer) RegisterService(rpcServer *grpc.Server) {
 	csi.RegisterNodeServer(rpcServer, ns)
 }
 
+// NodeGetInfo gets called each time kubelet registers the driver.
+// Kubelet turns all topology segments into node labels and refuses
+// to register the driver when the value of an existing label
+// changes, therefore only segments with fixed values are reported.
 func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	return &csi.NodeGetInfoResponse{
+	segments := map[string]string{
+		DriverTopologyKey: ns.cs.nodeID,
+	}
+	resp := &csi.NodeGetInfoResponse{
 		NodeId: ns.cs.nodeID,
 		AccessibleTopology: &csi.Topology{
-			Segments: map[string]string{
-				DriverTopologyKey: ns.cs.nodeID,
-			},
+			Segments: segments,
 		},
-	}, nil
+	}
+
+	if layout, ok := ns.cs.dm.(pmdmanager.PmemDeviceLayout); ok {
+		var err error
+		resp.MaxVolumesPerNode, err = layout.MaxVolumes(ctx)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "determine maximum number of volumes: %v", err)
+		}
+	}
+	if max := int64(ns.cs.maxVolumes); max > 0 && (resp.MaxVolumesPerNode == 0 || max < resp.MaxVolumesPerNode) {
+		resp.MaxVolumesPerNode = max
+	}
+	if regions, ok := ns.cs.dm.(pmdmanager.PmemDeviceRegions); ok {
+		ids, err := regions.RegionIDs(ctx)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "determine PMEM region IDs: %v", err)
+		}
+		for _, id := range ids {
+			segments[fmt.Sprintf("%s%d", DriverRegionTopologyKeyPrefix, id)] = "true"
+		}
+	}
+	return resp, nil
 }
 
 func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
@@ -124,6 +177,9 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if len(req.GetTargetPath()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
+	if ns.dryRun {
+		return nil, errDryRun
+	}
 
 	// Serialize by VolumeId
 	volumeMutex.LockKey(volumeID)
@@ -133,14 +189,16 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 
 	var ephemeral bool
 	var device *pmdmanager.PmemDeviceInfo
-	var err error
 
 	srcPath := req.GetStagingTargetPath()
 	targetPath := req.GetTargetPath()
 	mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
-	readOnly := req.GetReadonly()
-	fsType := req.GetVolumeCapability().GetMount().GetFsType()
+	readOnly := req.GetReadonly() || readOnlyAccess(req.GetVolumeCapability())
 	volumeContext := req.GetVolumeContext()
+	fsType, err := ns.checkFsType(ctx, req.GetVolumeCapability().GetMount().GetFsType(), podReference(volumeContext))
+	if err != nil {
+		return nil, err
+	}
 	// volumeContext contains the original volume name for persistent volumes.
 	logger.V(3).Info("Publishing volume",
 		"target-path", targetPath,
@@ -179,15 +237,13 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		}
 		volumeParameters = v
 
-		device, err := ns.createEphemeralDevice(ctx, req, volumeParameters)
+		device, err := ns.createEphemeralDevice(ctx, req, volumeParameters, fsType)
 		if err != nil {
 			// createEphemeralDevice() returns status.Error, so safe to return
 			return nil, err
 		}
 		srcPath = device.Path
-		if v.GetUsage() == parameters.UsageAppDirect {
-			mountFlags = append(mountFlags, daxMountFlag)
-		}
+		mountFlags = append(mountFlags, daxMountOptions(v)...)
 	} else {
 		// Validate parameters.
 		v, err := parameters.Parse(parameters.PersistentVolumeOrigin, req.GetVolumeContext())
@@ -207,7 +263,10 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			}
 			return nil, status.Errorf(codes.Internal, "failed to get device details for volume id %q: %v", volumeID, err)
 		}
-		mountFlags = append(mountFlags, "bind")
+		if err := checkSignature(dm, device, v); err != nil {
+			return nil, err
+		}
+		mountFlags = append(bindMountFlags(ctx, mountFlags), "bind")
 	}
 
 	if readOnly {
@@ -220,10 +279,25 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		rawBlock = true
 		// For block volumes, source path is the actual Device path
 		srcPath = device.Path
+		if !ephemeral && volumeParameters.GetIntegrity() {
+			// Opened by NodeStageVolume, closed by NodeUnstageVolume.
+			srcPath = integrityDevicePath(volumeID)
+			if _, err := os.Stat(srcPath); err != nil {
+				return nil, status.Errorf(codes.FailedPrecondition, "dm-integrity device of volume not staged: %v", err)
+			}
+		}
+		if err := tuneDevice(ctx, srcPath, volumeParameters, true); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
 	case *csi.VolumeCapability_Mount:
 		if !ephemeral && len(srcPath) == 0 {
 			return nil, status.Error(codes.FailedPrecondition, "Staging target path missing in request")
 		}
+		if !ephemeral {
+			if err := ns.checkStaged(srcPath, fsType); err != nil {
+				return nil, err
+			}
+		}
 
 		notMnt, err := mount.IsNotMountPoint(ns.mounter, targetPath)
 		if err != nil && !os.IsNotExist(err) {
@@ -292,6 +366,12 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		}
 	}
 
+	if ephemeral && !rawBlock {
+		if err := configureDAX(hostMount, volumeParameters); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
 	if !volumeParameters.GetKataContainers() {
 		// A normal volume, return early.
 		return &csi.NodePublishVolumeResponse{}, nil
@@ -398,7 +478,10 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	// Check if the target path is really a mount point. If it's not a mount point *and* we don't
 	// have such a volume, then we are done.
 	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
-	if (notMnt || err != nil && !os.IsNotExist(err)) && vol == nil {
+	// A corrupted mount, for example of a device that is gone,
+	// still needs to be unmounted.
+	mounted := err == nil && !notMnt || err != nil && mount.IsCorruptedMnt(err)
+	if !mounted && vol == nil {
 		logger.V(3).Info("Target path is not a mount point, no such volume -> done")
 		return &csi.NodeUnpublishVolumeResponse{}, nil
 	}
@@ -429,7 +512,7 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 
 	// Unmounting the image if still mounted. It might have been unmounted before if
 	// a previous NodeUnpublishVolume call was interrupted.
-	if err == nil && !notMnt {
+	if mounted {
 		logger.V(3).Info("Unmounting at target path")
 		if err := ns.mounter.Unmount(targetPath); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
@@ -443,11 +526,10 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		}
 	}
 
-	err = os.Remove(targetPath)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
+	if err := removeTarget(targetPath); err != nil {
 		return nil, status.Error(codes.Internal, "unexpected error while removing target path: "+err.Error())
 	}
-	logger.V(5).Info("Target path removed with harmless error or no error", "error", err)
+	logger.V(5).Info("Target path removed")
 
 	if p.GetPersistency() == parameters.PersistencyEphemeral {
 		if _, err := ns.cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.ID}); err != nil {
@@ -513,23 +595,38 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	if req.GetVolumeCapability() == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
 	}
+	if ns.dryRun {
+		return nil, errDryRun
+	}
 
-	// We should do nothing for block device usage
 	switch req.VolumeCapability.GetAccessType().(type) {
 	case *csi.VolumeCapability_Block:
-		return &csi.NodeStageVolumeResponse{}, nil
-	}
-
-	requestedFsType := req.GetVolumeCapability().GetMount().GetFsType()
-	if requestedFsType == "" {
-		// Default to ext4 filesystem
-		requestedFsType = defaultFilesystem
+		return ns.nodeStageBlockVolume(ctx, req)
 	}
 
 	v, err := parameters.Parse(parameters.PersistentVolumeOrigin, req.GetVolumeContext())
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, "persistent volume context: "+err.Error())
 	}
+	var passphrase []byte
+	if v.GetEncrypted() {
+		if passphrase, err = cryptPassphrase(req.GetSecrets()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	var pvReference *corev1.ObjectReference
+	if name := v.GetName(); name != "" {
+		pvReference = &corev1.ObjectReference{Kind: "PersistentVolume", APIVersion: "v1", Name: name}
+	}
+	requestedFsType, err := ns.checkFsType(ctx, req.GetVolumeCapability().GetMount().GetFsType(), pvReference)
+	if err != nil {
+		return nil, err
+	}
+	if requestedFsType == "" {
+		// Default to ext4 filesystem
+		requestedFsType = defaultFilesystem
+	}
 
 	// Serialize by VolumeId
 	volumeMutex.LockKey(req.GetVolumeId())
@@ -538,9 +635,11 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	}()
 
 	mountOptions := req.GetVolumeCapability().GetMount().GetMountFlags()
+	readOnly := readOnlyAccess(req.GetVolumeCapability())
 	logger.V(3).Info("Staging volume",
 		"fs-type", requestedFsType,
 		"mount-options", mountOptions,
+		"read-only", readOnly,
 	)
 
 	dm, err := ns.getDeviceManagerForVolume(ctx, volumeID)
@@ -555,41 +654,129 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		}
 		return nil, status.Errorf(codes.Internal, "failed to get device details for volume id %q: %v", volumeID, err)
 	}
-
-	// Check does devicepath already contain a filesystem?
-	existingFsType, err := determineFilesystemType(ctx, device.Path)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	if err := checkSignature(dm, device, v); err != nil {
+		return nil, err
 	}
 
-	// what to do if existing file system is detected;
-	if existingFsType != "" {
-		// Is existing filesystem type same as requested?
-		if existingFsType == requestedFsType {
-			logger.V(4).Info("Skipping mkfs as file system already exists on device", "device", device.Path)
-		} else {
-			return nil, status.Error(codes.AlreadyExists, "File system with different type exists")
+	if v.GetIntegrity() {
+		// Everything below operates on the dm-integrity device.
+		if device.Path, err = openIntegrity(ctx, volumeID, device.Path); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
 		}
-	} else {
-		if err = ns.provisionDevice(ctx, device, requestedFsType); err != nil {
+	}
+	if v.GetEncrypted() {
+		// Everything below operates on the dm-crypt device.
+		if device.Path, err = openCrypt(ctx, volumeID, device.Path, passphrase); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
 
-	if v.GetUsage() == parameters.UsageAppDirect {
-		mountOptions = append(mountOptions, daxMountFlag)
+	// Creating the filesystem on a large volume may take longer
+	// than kubelet waits. It then continues in the background and
+	// the retry waits for it instead of checking the device while
+	// mkfs is still writing to it.
+	err = ns.cs.operations.run(ctx, formatOperation(volumeID), func(ctx context.Context) error {
+		if err := ctx.Err(); err != nil {
+			// Canceled by NodeUnstageVolume or DeleteVolume.
+			return status.FromContextError(err).Err()
+		}
+		// Check does devicepath already contain a filesystem?
+		existingFsType, err := determineFilesystemType(ctx, device.Path)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		// what to do if existing file system is detected;
+		if existingFsType != "" {
+			// Is existing filesystem type same as requested?
+			if existingFsType == requestedFsType {
+				logger.V(4).Info("Skipping mkfs as file system already exists on device", "device", device.Path)
+				return nil
+			}
+			return status.Error(codes.AlreadyExists, "File system with different type exists")
+		}
+		if readOnly {
+			// A read-only volume must have been populated
+			// before, an empty filesystem would be useless.
+			return status.Error(codes.FailedPrecondition, "read-only volume has no file system")
+		}
+		if err := ns.provisionDevice(ctx, device, requestedFsType, v.GetZeroFill()); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tuneDevice(ctx, device.Path, v, false); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	mountOptions = append(mountOptions, daxMountOptions(v)...)
+	if readOnly {
+		mountOptions = append(mountOptions, "ro")
 	}
 
 	if err = ns.mount(ctx, device.Path, stagingtargetPath, mountOptions, false /* raw block */); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	if readOnly {
+		// The filesystem was prepared when the volume was
+		// populated, nothing can be changed anymore.
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
 	if requestedFsType == "xfs" {
 		if err := xfs.ConfigureFS(stagingtargetPath); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
 
+	if err := configureDAX(stagingtargetPath, v); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// nodeStageBlockVolume does nothing for raw block volumes unless they
+// have integrity protection. Then the dm-integrity device gets opened
+// here, once per node, and stays open until NodeUnstageVolume.
+func (ns *nodeServer) nodeStageBlockVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	v, err := parameters.Parse(parameters.PersistentVolumeOrigin, req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "persistent volume context: "+err.Error())
+	}
+	if !v.GetIntegrity() {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	// Serialize by VolumeId
+	volumeMutex.LockKey(volumeID)
+	defer func() {
+		_ = volumeMutex.UnlockKey(volumeID)
+	}()
+
+	dm, err := ns.getDeviceManagerForVolume(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	device, err := dm.GetDevice(ctx, volumeID)
+	if err != nil {
+		if errors.Is(err, pmemerr.DeviceNotFound) {
+			return nil, status.Errorf(codes.NotFound, "no device found with volume id %q: %v", volumeID, err)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get device details for volume id %q: %v", volumeID, err)
+	}
+	if err := checkSignature(dm, device, v); err != nil {
+		return nil, err
+	}
+	if _, err := openIntegrity(ctx, volumeID, device.Path); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
@@ -614,6 +801,11 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	}()
 
 	logger.V(3).Info("Unstage volume")
+	// Formatting may still be going on after a NodeStageVolume
+	// call which gave up.
+	if err := ns.cs.operations.cancel(ctx, formatOperation(volumeID)); err != nil {
+		return nil, err
+	}
 	dm, err := ns.getDeviceManagerForVolume(ctx, volumeID)
 	if err != nil {
 		return nil, err
@@ -635,23 +827,156 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	}
 	if mountedDev == "" {
 		logger.Info("No device name found for staging target path, skipping unmount")
+		// Raw block volumes are not mounted, but may have a
+		// dm-integrity device from nodeStageBlockVolume.
+		if err := closeIntegrity(ctx, volumeID); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
 		return &csi.NodeUnstageVolumeResponse{}, nil
 	}
 	logger.V(3).Info("Unmounting", "device", mountedDev)
 	if err := ns.mounter.Unmount(stagingtargetPath); err != nil {
 		return nil, err
 	}
+	switch mountedDev {
+	case integrityDevicePath(volumeID):
+		if err := closeIntegrity(ctx, volumeID); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	case cryptDevicePath(volumeID):
+		if err := closeCrypt(ctx, volumeID); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) NodeExpandVolume(context.Context, *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// NodeExpandVolume grows the device and then the filesystem on it
+// while the volume is in use. Both happen on the node because the
+// device is local to it.
+func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	ctx, logger := pmemlog.WithName(ctx, "NodeExpandVolume")
+
+	if !ns.cs.caps.expansion {
+		return nil, status.Error(codes.Unimplemented, "volume expansion is not enabled")
+	}
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if req.GetVolumePath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+	required := req.GetCapacityRange().GetRequiredBytes()
+	if limit := req.GetCapacityRange().GetLimitBytes(); limit > 0 && required > limit {
+		return nil, status.Errorf(codes.OutOfRange, "required size %d is larger than limit %d", required, limit)
+	}
+
+	volumeMutex.LockKey(volumeID)
+	defer func() {
+		_ = volumeMutex.UnlockKey(volumeID)
+	}()
+
+	vol := ns.cs.getVolumeByID(volumeID)
+	if vol == nil {
+		return nil, status.Errorf(codes.NotFound, "unknown volume: %s", volumeID)
+	}
+	p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "previously stored volume parameters for volume with ID %q: %v", volumeID, err)
+	}
+	switch {
+	case p.GetPersistency() == parameters.PersistencyEphemeral:
+		return nil, status.Error(codes.InvalidArgument, "ephemeral inline volumes cannot be expanded")
+	case p.GetIntegrity() || p.GetEncrypted():
+		// The dm-integrity journal and the LUKS header are
+		// sized for the original device.
+		return nil, status.Error(codes.InvalidArgument, "volumes with integrity protection or encryption cannot be expanded")
+	case p.GetKataContainers():
+		return nil, status.Error(codes.InvalidArgument, "volumes for Kata Containers cannot be expanded")
+	}
+	resizer, ok := ns.cs.dm.(pmdmanager.PmemDeviceResizer)
+	if !ok || p.GetDeviceMode() != ns.cs.dm.GetMode() {
+		return nil, status.Errorf(codes.InvalidArgument, "volumes in %q mode cannot be expanded", p.GetDeviceMode())
+	}
+
+	if required > vol.Size {
+		if _, limited := ns.cs.quota.limit(p.GetPVCNamespace()); limited {
+			release, err := ns.cs.reserve(ctx, &reservation{
+				namespace: p.GetPVCNamespace(),
+				size:      required - vol.Size,
+			})
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+		}
+		release, err := ns.cs.limiter.acquire(ctx, "resize device")
+		if err != nil {
+			return nil, err
+		}
+		// Same accounting as in createVolumeInternal.
+		overhead := deviceOverhead(p, required)
+		actual, err := resizer.ResizeDevice(ctx, volumeID, uint64(required+overhead))
+		release()
+		ns.cs.capacity.invalidate()
+		if err != nil {
+			code := codes.Internal
+			if errors.Is(err, pmemerr.NotEnoughSpace) {
+				code = codes.ResourceExhausted
+			}
+			return nil, status.Errorf(code, "device resizing failed: %v", err)
+		}
+		ns.cs.mutex.Lock()
+		vol.Size = int64(actual) - overhead
+		ns.cs.mutex.Unlock()
+		if ns.cs.sm != nil {
+			if err := ns.cs.sm.Create(volumeID, vol); err != nil {
+				// The device is larger than recorded,
+				// which only means that quota checks
+				// are too lenient until the next
+				// expansion.
+				logger.Error(err, "Updating volume state failed")
+			}
+		}
+		logger.V(3).Info("Resized device", "volume-id", volumeID, "size", pmemlog.CapacityRef(vol.Size))
+	}
+
+	if req.GetVolumeCapability().GetBlock() == nil {
+		device, err := ns.cs.dm.GetDevice(ctx, volumeID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "get device for volume %q: %v", volumeID, err)
+		}
+		if err := resizeFilesystem(ctx, device.Path, req.GetVolumePath()); err != nil {
+			return nil, status.Errorf(codes.Internal, "resize filesystem: %v", err)
+		}
+	}
+
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: vol.Size}, nil
+}
+
+// resizeFilesystem grows the mounted filesystem on the device to the
+// size of the device.
+func resizeFilesystem(ctx context.Context, devicePath, mountPath string) error {
+	fsType, err := determineFilesystemType(ctx, devicePath)
+	if err != nil {
+		return err
+	}
+	switch fsType {
+	case "ext4":
+		_, err = pmemexec.RunCommand(ctx, "resize2fs", devicePath)
+	case "xfs":
+		_, err = pmemexec.RunCommand(ctx, "xfs_growfs", mountPath)
+	default:
+		err = fmt.Errorf("filesystem type %q on %s cannot be resized", fsType, devicePath)
+	}
+	return err
 }
 
 // createEphemeralDevice creates new pmem device for given req.
 // On failure it returns one of status errors.
-func (ns *nodeServer) createEphemeralDevice(ctx context.Context, req *csi.NodePublishVolumeRequest, p parameters.Volume) (*pmdmanager.PmemDeviceInfo, error) {
+func (ns *nodeServer) createEphemeralDevice(ctx context.Context, req *csi.NodePublishVolumeRequest, p parameters.Volume, fsType string) (*pmdmanager.PmemDeviceInfo, error) {
 	ctx, _ = pmemlog.WithName(ctx, "createEphemeralDevice")
 
 	// If the caller has use the heuristic for detecting ephemeral volumes, the flag won't
@@ -659,6 +984,16 @@ func (ns *nodeServer) createEphemeralDevice(ctx context.Context, req *csi.NodePu
 	ephemeral := parameters.PersistencyEphemeral
 	p.Persistency = &ephemeral
 
+	// Check before creating a device that would only have to be
+	// removed again.
+	var passphrase []byte
+	if p.GetEncrypted() {
+		var err error
+		if passphrase, err = cryptPassphrase(req.GetSecrets()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "ephemeral inline volume: "+err.Error())
+		}
+	}
+
 	// Create new device, using the same code that the normal CreateVolume also uses,
 	// so internally this volume will be tracked like persistent volumes.
 	volumeID, _, err := ns.cs.createVolumeInternal(ctx, p, req.GetVolumeId(),
@@ -675,17 +1010,34 @@ func (ns *nodeServer) createEphemeralDevice(ctx context.Context, req *csi.NodePu
 		return nil, status.Error(codes.Internal, fmt.Sprintf("ephemeral inline volume: device not found after creating volume %q: %v", volumeID, err))
 	}
 
+	if p.GetIntegrity() {
+		if device.Path, err = openIntegrity(ctx, volumeID, device.Path); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("ephemeral inline volume: %v", err))
+		}
+	}
+	if p.GetEncrypted() {
+		if device.Path, err = openCrypt(ctx, volumeID, device.Path, passphrase); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("ephemeral inline volume: %v", err))
+		}
+	}
+
 	// Create filesystem
-	if err := ns.provisionDevice(ctx, device, req.GetVolumeCapability().GetMount().GetFsType()); err != nil {
+	if err := ns.provisionDevice(ctx, device, fsType, p.GetZeroFill()); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("ephemeral inline volume: failed to create filesystem: %v", err))
 	}
 
+	if err := tuneDevice(ctx, device.Path, p, false); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("ephemeral inline volume: %v", err))
+	}
+
 	return device, nil
 }
 
 // provisionDevice initializes the device with requested filesystem.
 // It can be called multiple times for the same device (idempotent).
-func (ns *nodeServer) provisionDevice(ctx context.Context, device *pmdmanager.PmemDeviceInfo, fsType string) error {
+// With zeroFill, the entire device gets overwritten with zeros
+// before creating the filesystem.
+func (ns *nodeServer) provisionDevice(ctx context.Context, device *pmdmanager.PmemDeviceInfo, fsType string, zeroFill bool) error {
 	ctx, logger := pmemlog.WithName(ctx, "provisionDevice")
 
 	if fsType == "" {
@@ -706,19 +1058,63 @@ func (ns *nodeServer) provisionDevice(ctx context.Context, device *pmdmanager.Pm
 		}
 		return status.Error(codes.AlreadyExists, "File system with different type exists")
 	}
+	release, err := ns.cs.limiter.acquire(ctx, "mkfs")
+	if err != nil {
+		return err
+	}
+	defer release()
+	if zeroFill {
+		logger.V(3).Info("Zeroing device before creating the file system", "device", device.Path)
+		output, err := pmemexec.RunCommand(ctx, "shred", "-n", "0", "-z", device.Path)
+		if err != nil {
+			return fmt.Errorf("zeroing device failed: output:[%s] err:[%v]", output, err)
+		}
+	}
+	return makeFilesystem(ctx, device.Path, fsType)
+}
+
+// daxMountOptions returns the mount options which enable DAX
+// for the volume, none for usage FileIO.
+func daxMountOptions(v parameters.Volume) []string {
+	if v.GetUsage() != parameters.UsageAppDirect {
+		return nil
+	}
+	if v.GetDAXMode() == parameters.DAXModeInode {
+		return []string{daxInodeMountFlag}
+	}
+	return []string{daxMountFlag}
+}
+
+// configureDAX marks the root directory of a filesystem that was
+// mounted with per-file DAX so that all files created in the volume
+// inherit DAX. Applications can still turn it off for individual
+// files or directories.
+func configureDAX(path string, v parameters.Volume) error {
+	if v.GetUsage() != parameters.UsageAppDirect ||
+		v.GetDAXMode() != parameters.DAXModeInode {
+		return nil
+	}
+	if err := xfs.EnableDAX(path); err != nil {
+		return fmt.Errorf("per-file DAX: %v", err)
+	}
+	return nil
+}
+
+// makeFilesystem creates a new file system of the given type on the device.
+func makeFilesystem(ctx context.Context, devicePath, fsType string) error {
 	cmd := ""
 	var args []string
 	// hard-code block size to 4k to avoid smaller values and trouble to dax mount option
 	switch fsType {
 	case "ext4":
 		cmd = "mkfs.ext4"
-		args = []string{"-b", "4096", "-E", "stride=512,stripe_width=512", "-F", device.Path}
+		args = []string{"-b", "4096", "-E", "stride=512,stripe_width=512", "-F", devicePath}
 	case "xfs":
 		cmd = "mkfs.xfs"
 		// reflink=0: reflink and DAX are mutually exclusive
 		// (http://man7.org/linux/man-pages/man8/mkfs.xfs.8.html).
 		// su=2m,sw=1: use 2MB-aligned and -sized block allocations
-		args = []string{"-b", "size=4096", "-m", "reflink=0", "-d", "su=2m,sw=1", "-f", device.Path}
+		args = []string{"-b", "size=4096", "-m", "reflink=0", "-d", "su=2m,sw=1", "-f", devicePath}
 	default:
 		return fmt.Errorf("Unsupported filesystem '%s'. Supported filesystems types: 'xfs', 'ext4'", fsType)
 	}
@@ -731,6 +1127,49 @@ func (ns *nodeServer) provisionDevice(ctx context.Context, device *pmdmanager.Pm
 	return nil
 }
 
+// checkFsType returns the filesystem type that is to be used instead
+// of the requested one. An empty string is returned unchanged and
+// means "default filesystem". Unsupported types are handled
+// according to the fsTypePolicy. The object, if not nil, is the
+// one for which a warning event gets recorded.
+func (ns *nodeServer) checkFsType(ctx context.Context, fsType string, object *corev1.ObjectReference) (string, error) {
+	if fsType == "" {
+		return fsType, nil
+	}
+	for _, supported := range supportedFilesystems {
+		if fsType == supported {
+			return fsType, nil
+		}
+	}
+	if ns.fsTypePolicy != FsTypeFallback {
+		return "", status.Errorf(codes.InvalidArgument, "unsupported filesystem %q, supported filesystem types: %s", fsType, strings.Join(supportedFilesystems, ", "))
+	}
+
+	klog.FromContext(ctx).Info("Using default filesystem instead of unsupported filesystem", "fs-type", fsType, "default-fs-type", defaultFilesystem)
+	if ns.recorder != nil && object != nil {
+		ns.recorder.Eventf(object, corev1.EventTypeWarning, "UnsupportedFsType",
+			"filesystem %q is not supported by PMEM-CSI on node %s, using %q instead", fsType, ns.cs.nodeID, defaultFilesystem)
+	}
+	return defaultFilesystem, nil
+}
+
+// podReference returns a reference to the pod for which a volume
+// gets published, if known.
+func podReference(volumeContext map[string]string) *corev1.ObjectReference {
+	name := volumeContext[parameters.PodInfoPrefix+"pod.name"]
+	namespace := volumeContext[parameters.PodInfoPrefix+"pod.namespace"]
+	if name == "" || namespace == "" {
+		return nil
+	}
+	return &corev1.ObjectReference{
+		Kind:       "Pod",
+		APIVersion: "v1",
+		Name:       name,
+		Namespace:  namespace,
+		UID:        types.UID(volumeContext[parameters.PodInfoPrefix+"pod.uid"]),
+	}
+}
+
 // mount creates the target path (parent must exist) and mounts the source there. It is idempotent.
 func (ns *nodeServer) mount(ctx context.Context, sourcePath, targetPath string, mountOptions []string, rawBlock bool) error {
 	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
@@ -773,6 +1212,115 @@ func (ns *nodeServer) mount(ctx context.Context, sourcePath, targetPath string,
 	return nil
 }
 
+// readOnlyAccess checks whether the access mode of the volume only
+// allows reading. Such volumes get mounted read-only, which makes it
+// safe to publish them for several pods at once.
+func readOnlyAccess(capability *csi.VolumeCapability) bool {
+	switch capability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
+
+// checkStaged ensures that a filesystem of the requested type, if
+// any, is mounted at the staging path. Bind-mounting a staging path
+// without a filesystem would silently publish an empty directory of
+// the host.
+func (ns *nodeServer) checkStaged(stagingPath, fsType string) error {
+	mpList, err := ns.mounter.List()
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to fetch existing mount details while checking %q: %v", stagingPath, err)
+	}
+	for i := len(mpList) - 1; i >= 0; i-- {
+		if mpList[i].Path == stagingPath {
+			if fsType != "" && mpList[i].Type != fsType {
+				return status.Errorf(codes.InvalidArgument, "volume is staged with filesystem type %q, cannot publish it as %q", mpList[i].Type, fsType)
+			}
+			return nil
+		}
+	}
+	return status.Errorf(codes.FailedPrecondition, "volume is not staged at %q", stagingPath)
+}
+
+// bindMountFlags returns those mount flags which can be set
+// separately for a bind mount. All other flags configure the
+// filesystem. NodeStageVolume already used them when mounting at the
+// staging path and they are not listed for the bind mount, which
+// would break the check for an existing mount.
+func bindMountFlags(ctx context.Context, flags []string) []string {
+	var bindFlags []string
+	for _, flag := range flags {
+		if perMountFlags[flag] {
+			bindFlags = append(bindFlags, flag)
+			continue
+		}
+		klog.FromContext(ctx).V(3).Info("Filesystem mount flag was applied during staging", "mount-flag", flag)
+	}
+	return bindFlags
+}
+
+// perMountFlags are the mount flags which are stored per mount point
+// instead of per filesystem. Their negated forms are the defaults
+// and not included because they do not show up in the mount options
+// of the existing mount.
+var perMountFlags = map[string]bool{
+	"ro":          true,
+	"rw":          true,
+	"noatime":     true,
+	"relatime":    true,
+	"strictatime": true,
+	"nodiratime":  true,
+	"nosuid":      true,
+	"nodev":       true,
+	"noexec":      true,
+}
+
+// removeTarget removes what mount created for NodePublishVolume once
+// it is no longer mounted: a file for raw block volumes, an empty
+// directory for filesystems. A directory with content is not removed
+// because that content would be data of a volume which is still
+// mounted somehow. A target which is already gone is not an error.
+func removeTarget(targetPath string) error {
+	info, err := os.Lstat(targetPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		// os.Remove fails for non-empty directories.
+	case mode.IsRegular(), mode&os.ModeDevice != 0:
+		// Bind mount target of a raw block volume.
+	default:
+		return fmt.Errorf("%s: unexpected file type %s", targetPath, mode.Type())
+	}
+	if err := os.Remove(targetPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// checkSignature ensures that the device was created for the volume
+// described by the volume context. Volume IDs are derived from volume
+// names, so after losing the node state a different volume with the
+// same name can end up using a device with the same ID. Volumes
+// created by older releases have no signature and are not checked.
+func checkSignature(dm pmdmanager.PmemDeviceManager, device *pmdmanager.PmemDeviceInfo, v parameters.Volume) error {
+	expected := v.GetSignature()
+	if _, ok := dm.(pmdmanager.PmemDeviceSignatures); !ok || expected == "" {
+		return nil
+	}
+	if device.Signature != expected {
+		return status.Errorf(codes.FailedPrecondition, "device %s for volume %q has signature %q instead of %q, it belongs to a different volume",
+			device.Path, device.VolumeId, device.Signature, expected)
+	}
+	return nil
+}
+
 // getDeviceManagerForVolume checks the stored volume parametes for the
 // given id and returns the device manager which creates that volume.
 // NOT_FOUND is returned when the volume does not exist.
@@ -850,6 +1398,10 @@ func findMountFlags(flags []string, findIn []string) bool {
 		if f == "bind" {
 			continue
 		}
+		// dax=inode is the default and thus not always listed.
+		if f == daxInodeMountFlag && !hasDAXFlag(findIn) {
+			continue
+		}
 		found := false
 		for _, fIn := range findIn {
 			if f == "dax=always" && fIn == "dax" ||
@@ -866,3 +1418,13 @@ func findMountFlags(flags []string, findIn []string) bool {
 
 	return true
 }
+
+// hasDAXFlag checks whether any of the mount options configures DAX.
+func hasDAXFlag(opts []string) bool {
+	for _, opt := range opts {
+		if opt == "dax" || strings.HasPrefix(opt, "dax=") {
+			return true
+		}
+	}
+	return false
+}
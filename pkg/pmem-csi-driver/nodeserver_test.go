@@ -0,0 +1,404 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2/ktesting"
+	"k8s.io/utils/mount"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestCheckFsType(t *testing.T) {
+	pod := podReference(map[string]string{
+		"csi.storage.k8s.io/pod.name":      "my-pod",
+		"csi.storage.k8s.io/pod.namespace": "default",
+	})
+	require.NotNil(t, pod, "pod reference")
+
+	testcases := map[string]struct {
+		policy         FsTypePolicy
+		fsType         string
+		expectedFsType string
+		expectedCode   codes.Code
+		expectEvent    bool
+	}{
+		"default": {
+			policy: FsTypeFail,
+		},
+		"xfs": {
+			policy:         FsTypeFail,
+			fsType:         "xfs",
+			expectedFsType: "xfs",
+		},
+		"fail": {
+			policy:       FsTypeFail,
+			fsType:       "btrfs",
+			expectedCode: codes.InvalidArgument,
+		},
+		"fallback": {
+			policy:         FsTypeFallback,
+			fsType:         "btrfs",
+			expectedFsType: defaultFilesystem,
+			expectEvent:    true,
+		},
+		"fallback-supported": {
+			policy:         FsTypeFallback,
+			fsType:         "ext4",
+			expectedFsType: "ext4",
+		},
+	}
+
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+			recorder := record.NewFakeRecorder(10)
+			ns := NewNodeServer(newFakeNodeControllerServer(ctx, t), t.TempDir())
+			ns.fsTypePolicy = tc.policy
+			ns.recorder = recorder
+
+			fsType, err := ns.checkFsType(ctx, tc.fsType, pod)
+			if tc.expectedCode != codes.OK {
+				require.Error(t, err, "check fsType")
+				assert.Equal(t, tc.expectedCode, status.Code(err), "status code")
+				return
+			}
+			require.NoError(t, err, "check fsType")
+			assert.Equal(t, tc.expectedFsType, fsType, "fsType")
+			if tc.expectEvent {
+				require.Len(t, recorder.Events, 1, "events")
+				assert.Contains(t, <-recorder.Events, corev1.EventTypeWarning+" UnsupportedFsType", "event")
+			} else {
+				assert.Len(t, recorder.Events, 0, "events")
+			}
+		})
+	}
+}
+
+func TestNodeGetInfo(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ns := NewNodeServer(newFakeNodeControllerServer(ctx, t), t.TempDir())
+	oldKeys := []string{DriverTopologyKey, DriverRegionTopologyKeyPrefix}
+	defer func() {
+		DriverTopologyKey, DriverRegionTopologyKeyPrefix = oldKeys[0], oldKeys[1]
+	}()
+	DriverTopologyKey, DriverRegionTopologyKeyPrefix = "test/node", "test/region-"
+
+	resp, err := ns.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	require.NoError(t, err, "NodeGetInfo")
+	assert.Equal(t, map[string]string{
+		DriverTopologyKey: "node",
+		"test/region-0":   "true",
+	}, resp.GetAccessibleTopology().GetSegments(), "topology")
+	assert.Equal(t, int64(0), resp.GetMaxVolumesPerNode(), "no volume limit")
+
+	ns.cs.maxVolumes = 10
+	resp, err = ns.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	require.NoError(t, err, "NodeGetInfo")
+	assert.Equal(t, int64(10), resp.GetMaxVolumesPerNode(), "configured volume limit")
+}
+
+func TestNodeUnpublishVolume(t *testing.T) {
+	testcases := map[string]struct {
+		// prepare creates the target and returns true if it is mounted.
+		prepare      func(t *testing.T, targetPath string) bool
+		corrupted    bool
+		expectedCode codes.Code
+		expectTarget bool
+	}{
+		"block": {
+			prepare: func(t *testing.T, targetPath string) bool {
+				require.NoError(t, os.WriteFile(targetPath, nil, 0644), "create target file")
+				return true
+			},
+		},
+		"filesystem": {
+			prepare: func(t *testing.T, targetPath string) bool {
+				require.NoError(t, os.Mkdir(targetPath, 0755), "create target directory")
+				return true
+			},
+		},
+		"corrupted": {
+			prepare: func(t *testing.T, targetPath string) bool {
+				require.NoError(t, os.WriteFile(targetPath, nil, 0644), "create target file")
+				return true
+			},
+			corrupted: true,
+		},
+		"unmounted": {
+			prepare: func(t *testing.T, targetPath string) bool {
+				require.NoError(t, os.WriteFile(targetPath, nil, 0644), "create target file")
+				return false
+			},
+		},
+		"removed": {
+			prepare: func(t *testing.T, targetPath string) bool {
+				return false
+			},
+		},
+		"not-empty": {
+			prepare: func(t *testing.T, targetPath string) bool {
+				require.NoError(t, os.Mkdir(targetPath, 0755), "create target directory")
+				require.NoError(t, os.WriteFile(filepath.Join(targetPath, "data"), nil, 0644), "create data file")
+				return false
+			},
+			expectedCode: codes.Internal,
+			expectTarget: true,
+		},
+		"symlink": {
+			prepare: func(t *testing.T, targetPath string) bool {
+				require.NoError(t, os.Symlink("/dev/null", targetPath), "create symlink")
+				return false
+			},
+			expectedCode: codes.Internal,
+			expectTarget: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+			cs := newFakeNodeControllerServer(ctx, t)
+			ns := NewNodeServer(cs, t.TempDir())
+			resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Name:               "pvc-unpublish",
+				VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}},
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+			})
+			require.NoError(t, err, "create volume")
+
+			targetPath := filepath.Join(t.TempDir(), "target")
+			mounter := mount.NewFakeMounter(nil)
+			if tc.prepare(t, targetPath) {
+				mounter.MountPoints = append(mounter.MountPoints, mount.MountPoint{Device: "/dev/pmem0", Path: targetPath})
+			}
+			if tc.corrupted {
+				// Checking a real mount point fails in stat.
+				mounter.MountCheckErrors = map[string]error{targetPath: &os.PathError{Op: "stat", Path: targetPath, Err: syscall.ENOTCONN}}
+			}
+			ns.mounter = mounter
+
+			_, err = ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+				VolumeId:   resp.Volume.VolumeId,
+				TargetPath: targetPath,
+			})
+			require.Equal(t, tc.expectedCode, status.Code(err), "unpublish: %v", err)
+			_, err = os.Lstat(targetPath)
+			if tc.expectTarget {
+				require.NoError(t, err, "target kept")
+			} else {
+				require.True(t, os.IsNotExist(err), "target removed, got: %v", err)
+			}
+			for _, mp := range mounter.MountPoints {
+				require.NotEqual(t, targetPath, mp.Path, "target unmounted")
+			}
+		})
+	}
+}
+
+func TestBindMountFlags(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	assert.Empty(t, bindMountFlags(ctx, nil), "no flags")
+	assert.Equal(t, []string{"ro", "noatime", "nosuid"}, bindMountFlags(ctx, []string{"ro", "nodiscard", "noatime", "dax", "nosuid", "data=ordered"}), "filesystem flags removed")
+}
+
+func TestCheckStaged(t *testing.T) {
+	const stagingPath = "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount"
+	testcases := map[string]struct {
+		mountPoints  []mount.MountPoint
+		fsType       string
+		expectedCode codes.Code
+	}{
+		"staged": {
+			mountPoints: []mount.MountPoint{{Device: "/dev/pmem0", Path: stagingPath, Type: "ext4"}},
+		},
+		"same-type": {
+			mountPoints: []mount.MountPoint{{Device: "/dev/pmem0", Path: stagingPath, Type: "xfs"}},
+			fsType:      "xfs",
+		},
+		"other-type": {
+			mountPoints:  []mount.MountPoint{{Device: "/dev/pmem0", Path: stagingPath, Type: "ext4"}},
+			fsType:       "xfs",
+			expectedCode: codes.InvalidArgument,
+		},
+		"not-staged": {
+			mountPoints:  []mount.MountPoint{{Device: "/dev/pmem0", Path: "/mnt", Type: "ext4"}},
+			expectedCode: codes.FailedPrecondition,
+		},
+	}
+
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+			ns := NewNodeServer(newFakeNodeControllerServer(ctx, t), t.TempDir())
+			ns.mounter = mount.NewFakeMounter(tc.mountPoints)
+			err := ns.checkStaged(stagingPath, tc.fsType)
+			assert.Equal(t, tc.expectedCode, status.Code(err), "check staged volume: %v", err)
+		})
+	}
+}
+
+func TestEncryptedVolume(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+	ns := NewNodeServer(cs, t.TempDir())
+	mountCapability := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}
+	blockCapability := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+	params := map[string]string{
+		"encrypted": "true",
+		"usage":     "FileIO",
+	}
+
+	_, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-encrypted-block",
+		Parameters:         params,
+		VolumeCapabilities: []*csi.VolumeCapability{blockCapability},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "raw block volume: %v", err)
+
+	_, err = cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-encrypted-secret",
+		Parameters:         params,
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+		Secrets:            map[string]string{"password": "foo"},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "provisioner secret without passphrase: %v", err)
+
+	resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-encrypted",
+		Parameters:         params,
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+	})
+	require.NoError(t, err, "create volume")
+	assert.Equal(t, "true", resp.Volume.VolumeContext["encrypted"], "volume context")
+
+	_, err = ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          resp.Volume.VolumeId,
+		StagingTargetPath: filepath.Join(t.TempDir(), "staging"),
+		VolumeCapability:  mountCapability,
+		VolumeContext:     resp.Volume.VolumeContext,
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "stage without passphrase: %v", err)
+
+	_, err = ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:         "ephemeral-encrypted",
+		TargetPath:       filepath.Join(t.TempDir(), "target"),
+		VolumeCapability: mountCapability,
+		VolumeContext: map[string]string{
+			parameters.Ephemeral: "true",
+			"encrypted":          "true",
+			"usage":              "FileIO",
+			"size":               "4Mi",
+		},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "ephemeral volume without passphrase: %v", err)
+	assert.Nil(t, cs.getVolumeByName("ephemeral-encrypted"), "no ephemeral volume")
+}
+
+func TestIntegrityBlockVolume(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+	ns := NewNodeServer(cs, t.TempDir())
+	blockCapability := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+
+	resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "pvc-integrity-block",
+		Parameters: map[string]string{
+			"integrity": "true",
+			"usage":     "FileIO",
+		},
+		VolumeCapabilities: []*csi.VolumeCapability{blockCapability},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+	})
+	require.NoError(t, err, "create volume")
+
+	// The dm-integrity device only gets opened by NodeStageVolume,
+	// publishing must not open another one which nothing closes.
+	_, err = ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:         resp.Volume.VolumeId,
+		TargetPath:       filepath.Join(t.TempDir(), "target"),
+		VolumeCapability: blockCapability,
+		VolumeContext:    resp.Volume.VolumeContext,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err), "publish without staging: %v", err)
+}
+
+func TestNodeExpandVolume(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+	blockCapability := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+	resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-expand",
+		VolumeCapabilities: []*csi.VolumeCapability{blockCapability},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+	})
+	require.NoError(t, err, "create volume")
+	volumeID := resp.Volume.VolumeId
+	req := &csi.NodeExpandVolumeRequest{
+		VolumeId:         volumeID,
+		VolumePath:       filepath.Join(t.TempDir(), "target"),
+		VolumeCapability: blockCapability,
+		CapacityRange:    &csi.CapacityRange{RequiredBytes: 8 * 1024 * 1024},
+	}
+
+	ns := NewNodeServer(cs, t.TempDir())
+	_, err = ns.NodeExpandVolume(ctx, req)
+	require.Equal(t, codes.Unimplemented, status.Code(err), "expansion disabled: %v", err)
+
+	cs.caps.expansion = true
+	expanded, err := ns.NodeExpandVolume(ctx, req)
+	require.NoError(t, err, "expand volume")
+	assert.Equal(t, int64(8*1024*1024), expanded.CapacityBytes, "expanded size")
+	device, err := cs.dm.GetDevice(ctx, volumeID)
+	require.NoError(t, err, "get device")
+	assert.Equal(t, uint64(8*1024*1024), device.Size, "device size")
+	assert.Equal(t, int64(8*1024*1024), cs.getVolumeByID(volumeID).Size, "volume size")
+
+	// Shrinking is not possible, the volume keeps its size.
+	req.CapacityRange.RequiredBytes = 4 * 1024 * 1024
+	expanded, err = ns.NodeExpandVolume(ctx, req)
+	require.NoError(t, err, "smaller size")
+	assert.Equal(t, int64(8*1024*1024), expanded.CapacityBytes, "size after shrinking")
+
+	req.VolumeId = "no-such-volume"
+	_, err = ns.NodeExpandVolume(ctx, req)
+	require.Equal(t, codes.NotFound, status.Code(err), "unknown volume: %v", err)
+
+	resp, err = cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "pvc-expand-integrity",
+		Parameters: map[string]string{
+			"integrity": "true",
+			"usage":     "FileIO",
+		},
+		VolumeCapabilities: []*csi.VolumeCapability{blockCapability},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+	})
+	require.NoError(t, err, "create volume with integrity")
+	req.VolumeId = resp.Volume.VolumeId
+	req.CapacityRange.RequiredBytes = 8 * 1024 * 1024
+	_, err = ns.NodeExpandVolume(ctx, req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "volume with integrity: %v", err)
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+var (
+	// volumeIDRE matches the IDs created by generateVolumeID. Only
+	// devices with such a name are considered by the orphan check,
+	// everything else was not created by PMEM-CSI.
+	volumeIDRE = regexp.MustCompile(`^.{0,6}-[0-9a-f]{56}$`)
+
+	orphanedDevices = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pmem_orphaned_devices",
+		Help: "Number of PMEM devices without a volume which remained after the last check for orphans.",
+	})
+	orphanedDevicesDeleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pmem_orphaned_devices_deleted_total",
+		Help: "Number of orphaned PMEM devices that were deleted.",
+	})
+)
+
+// orphanChecker periodically compares the devices of the device
+// manager against the volumes of the node controller server. A
+// device is orphaned when there is no volume for it, for example
+// because the volume state was lost or because creating the volume
+// was interrupted.
+//
+// To avoid races with CreateVolume, which creates the device before
+// it records the volume, a device must be seen as orphaned in two
+// consecutive checks before it gets deleted.
+type orphanChecker struct {
+	cs     *nodeControllerServer
+	dryRun bool
+
+	// candidates are the orphans found by the previous check.
+	candidates map[string]bool
+}
+
+func newOrphanChecker(cs *nodeControllerServer, dryRun bool) *orphanChecker {
+	return &orphanChecker{
+		cs:         cs,
+		dryRun:     dryRun,
+		candidates: map[string]bool{},
+	}
+}
+
+// MustRegister adds the metrics to the registry, using labels to tag each sample with node and driver name.
+func (oc *orphanChecker) MustRegister(reg prometheus.Registerer, nodeName, driverName string) {
+	labels := prometheus.Labels{
+		pmdmanager.NodeLabel: nodeName,
+		"driver_name":        driverName,
+	}
+	prometheus.WrapRegistererWith(labels, reg).MustRegister(orphanedDevices, orphanedDevicesDeleted)
+}
+
+// run checks for orphans until the context is canceled.
+func (oc *orphanChecker) run(ctx context.Context, interval time.Duration) {
+	ctx, _ = pmemlog.WithName(ctx, "orphanChecker")
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		oc.check(ctx)
+	}, interval)
+}
+
+// check lists devices once and deletes those which were also found
+// by the previous check, unless in dry-run mode. It returns the IDs
+// of the orphaned devices.
+func (oc *orphanChecker) check(ctx context.Context) []string {
+	logger := klog.FromContext(ctx)
+	devices, err := oc.cs.dm.ListDevices(ctx)
+	if err != nil {
+		logger.Error(err, "Failed to list devices")
+		return nil
+	}
+
+	var orphans []string
+	candidates := map[string]bool{}
+	for _, device := range devices {
+		id := device.VolumeId
+		if !volumeIDRE.MatchString(id) || oc.cs.getVolumeByID(id) != nil {
+			continue
+		}
+		orphans = append(orphans, id)
+		if !oc.candidates[id] {
+			logger.V(3).Info("Found potentially orphaned device", "volume-id", id, "device", device.Path)
+			candidates[id] = true
+			continue
+		}
+		if oc.dryRun {
+			logger.Info("Found orphaned device, not deleting it in dry-run mode", "volume-id", id, "device", device.Path, "size", device.Size)
+			candidates[id] = true
+			continue
+		}
+		if oc.deleteOrphan(ctx, id) {
+			logger.Info("Deleted orphaned device", "volume-id", id, "device", device.Path, "size", device.Size)
+			orphanedDevicesDeleted.Inc()
+		} else {
+			candidates[id] = true
+		}
+	}
+	oc.candidates = candidates
+	orphanedDevices.Set(float64(len(candidates)))
+	return orphans
+}
+
+// deleteOrphan deletes the device if there still is no volume for it.
+func (oc *orphanChecker) deleteOrphan(ctx context.Context, volumeID string) bool {
+	logger := klog.FromContext(ctx).WithValues("volume-id", volumeID)
+
+	// Same key as in createVolumeInternal and DeleteVolume.
+	nodeVolumeMutex.LockKey(volumeID)
+	defer nodeVolumeMutex.UnlockKey(volumeID) //nolint: errcheck
+
+	if oc.cs.getVolumeByID(volumeID) != nil {
+		// Created in the meantime.
+		return false
+	}
+	if err := closeIntegrity(ctx, volumeID); err != nil {
+		logger.Error(err, "Failed to close dm-integrity device of orphaned device")
+		return false
+	}
+	if err := closeCrypt(ctx, volumeID); err != nil {
+		logger.Error(err, "Failed to close dm-crypt device of orphaned device")
+		return false
+	}
+	// The parameters of the volume are unknown, so erasing the
+	// data cannot depend on the "eraseafter" parameter. Always
+	// erase it to be on the safe side.
+	err := oc.cs.dm.DeleteDevice(ctx, volumeID, true)
+	oc.cs.capacity.invalidate()
+	if err != nil {
+		logger.Error(err, "Failed to delete orphaned device")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestOrphanChecker(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+	createVolumes(ctx, t, cs, 0, 2)
+
+	// A device without a volume...
+	orphan := generateVolumeID("orphan")
+	_, err := cs.dm.CreateDevice(ctx, orphan, 4*1024*1024, parameters.UsageFileIO)
+	require.NoError(t, err, "create orphan")
+	// ... and one not created by PMEM-CSI.
+	_, err = cs.dm.CreateDevice(ctx, "something-else", 4*1024*1024, parameters.UsageFileIO)
+	require.NoError(t, err, "create other device")
+
+	for _, dryRun := range []bool{true, false} {
+		oc := newOrphanChecker(cs, dryRun)
+		assert.Equal(t, []string{orphan}, oc.check(ctx), "first check, dry run %v", dryRun)
+		assert.Equal(t, []string{orphan}, oc.check(ctx), "second check, dry run %v", dryRun)
+		_, err = cs.dm.GetDevice(ctx, orphan)
+		if dryRun {
+			require.NoError(t, err, "orphan not deleted in dry run")
+		} else {
+			require.Error(t, err, "orphan deleted")
+		}
+	}
+
+	devices, err := cs.dm.ListDevices(ctx)
+	require.NoError(t, err, "list devices")
+	assert.Len(t, devices, 3, "remaining devices")
+}
@@ -18,6 +18,9 @@ import (
 type Persistency string
 type Origin int
 type Usage string
+type NamespaceMode string
+type AccessPattern string
+type DAXMode string
 
 // Beware of API and backwards-compatibility breaking when changing these string constants!
 const (
@@ -33,6 +36,61 @@ const (
 	UsageAppDirect Usage = "AppDirect"
 	UsageFileIO    Usage = "FileIO"
 
+	// NamespaceModel selects the kind of PMEM namespace. It is an
+	// alternative to UsageModel: "fsdax" corresponds to AppDirect,
+	// "sector" to FileIO. The mode is only guaranteed in direct
+	// mode, LVM volumes are always carved out of fsdax namespaces.
+	NamespaceModel                    = "nsmode"
+	NamespaceModeFsdax  NamespaceMode = "fsdax"
+	NamespaceModeSector NamespaceMode = "sector"
+
+	// Integrity enables dm-integrity between the PMEM device and
+	// the filesystem. Only supported for usage FileIO because
+	// device mapper targets cannot provide DAX.
+	Integrity = "integrity"
+
+	// Encrypted enables dm-crypt between the PMEM device and the
+	// filesystem. The passphrase comes from the secrets of
+	// NodeStageVolume or, for ephemeral volumes, of
+	// NodePublishVolume. Only supported for usage FileIO because
+	// device mapper targets cannot provide DAX.
+	Encrypted = "encrypted"
+
+	// ZeroFill overwrites the entire device with zeros before
+	// creating the filesystem. This does not preallocate
+	// filesystem blocks, it only ensures that no data from
+	// earlier volumes is left on the device.
+	ZeroFill = "zeroFill"
+
+	// Region restricts volume creation to the PMEM region with
+	// this ID (= N in regionN), for example to get storage that is
+	// local to a certain NUMA node.
+	Region = "region"
+
+	// AccessPatternModel is a hint how the application is going
+	// to read the volume. The node driver tunes read-ahead of the
+	// block device accordingly.
+	AccessPatternModel                    = "accessPattern"
+	AccessPatternSequential AccessPattern = "sequential"
+	AccessPatternRandom     AccessPattern = "random"
+
+	// DAXModel selects how DAX gets enabled for AppDirect
+	// filesystems. "always" mounts with "-o dax" and thus uses
+	// DAX for all files. "inode" mounts with "-o dax=inode" and
+	// sets FS_XFLAG_DAX on the volume root, so new files inherit
+	// DAX while applications may turn it off for individual
+	// files. Needs Linux >= 5.8 for XFS and >= 5.10 for ext4.
+	DAXModel              = "daxMode"
+	DAXModeAlways DAXMode = "always"
+	DAXModeInode  DAXMode = "inode"
+
+	// Signature is a random identifier that the node driver
+	// stores with the device when creating a volume and returns
+	// in the volume context. Volume IDs are derived from volume
+	// names, so this detects when a device with the expected ID
+	// belongs to some other volume.
+	Signature = "signature"
+
 	// Kubernetes v1.16+ adds this key to NodePublishRequest.VolumeContext
 	// while provisioning ephemeral volume.
 	Ephemeral = "csi.storage.k8s.io/ephemeral"
@@ -40,11 +98,24 @@ const (
 	// Additional, unknown parameters that are okay.
 	PodInfoPrefix = "csi.storage.k8s.io/"
 
+	// PodUID is added by kubelet to the volume context of
+	// ephemeral volumes when the CSIDriver has podInfoOnMount. It
+	// gets stored for the per-pod ephemeral volume quota.
+	PodUID = PodInfoPrefix + "pod.uid"
+
+	// Added by external-provisioner to CreateVolume parameters
+	// when started with --extra-create-metadata. The namespace
+	// is used for per-namespace quota.
+	PVCName      = "csi.storage.k8s.io/pvc/name"
+	PVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+	PVName       = "csi.storage.k8s.io/pv/name"
+
 	// Added by https://github.com/kubernetes-csi/external-provisioner/blob/feb67766f5e6af7db5c03ac0f0b16255f696c350/pkg/controller/controller.go#L584
 	ProvisionerID = "storage.kubernetes.io/csiProvisionerIdentity"
 
 	PersistencyNormal    Persistency = "normal"    // In releases <= 0.6.x this was called "none", but not documented.
 	PersistencyEphemeral Persistency = "ephemeral" // only used internally
+	PersistencyCache     Persistency = "cache"     // removed in PMEM-CSI 0.9, rejected with an explanation
 
 	//CreateVolumeOrigin is for parameters from the storage class in controller CreateVolume.
 	CreateVolumeOrigin Origin = iota
@@ -63,16 +134,34 @@ var valid = map[Origin][]string{
 	// Parameters from Kubernetes and users for a persistent volume.
 	CreateVolumeOrigin: []string{
 		EraseAfter,
+		Encrypted,
+		Integrity,
 		KataContainers,
+		ZeroFill,
+		Region,
+		AccessPatternModel,
+		DAXModel,
 		UsageModel,
+		NamespaceModel,
 		PersistencyModel,
+
+		PVCName,
+		PVCNamespace,
+		PVName,
 	},
 
 	// Parameters from Kubernetes and users.
 	EphemeralVolumeOrigin: []string{
 		EraseAfter,
+		Encrypted,
+		Integrity,
 		KataContainers,
+		ZeroFill,
+		Region,
+		AccessPatternModel,
+		DAXModel,
 		UsageModel,
+		NamespaceModel,
 		PodInfoPrefix,
 		Size,
 	},
@@ -84,11 +173,19 @@ var valid = map[Origin][]string{
 	// Kubernetes adds pod info and provisioner ID.
 	PersistentVolumeOrigin: []string{
 		EraseAfter,
+		Encrypted,
+		Integrity,
 		KataContainers,
+		ZeroFill,
+		Region,
+		AccessPatternModel,
+		DAXModel,
 		PersistencyModel,
 		UsageModel,
+		NamespaceModel,
 
 		Name,
+		Signature,
 		PodInfoPrefix,
 		ProvisionerID,
 	},
@@ -97,12 +194,24 @@ var valid = map[Origin][]string{
 	// which is handled separately.
 	NodeVolumeOrigin: []string{
 		EraseAfter,
+		Encrypted,
+		Integrity,
 		KataContainers,
+		ZeroFill,
+		Region,
+		AccessPatternModel,
+		DAXModel,
 		UsageModel,
+		NamespaceModel,
 		Name,
 		PersistencyModel,
 		Size,
 		DeviceMode,
+		PVCName,
+		PVCNamespace,
+		PVName,
+		PodUID,
+		Signature,
 	},
 }
 
@@ -112,12 +221,24 @@ var valid = map[Origin][]string{
 // the default.
 type Volume struct {
 	EraseAfter     *bool
+	Encrypted      *bool
+	Integrity      *bool
 	KataContainers *bool
+	ZeroFill       *bool
+	Region         *uint
+	AccessPattern  *AccessPattern
+	DAXMode        *DAXMode
 	Name           *string
 	Persistency    *Persistency
 	Size           *int64
 	DeviceMode     *api.DeviceMode
 	Usage          *Usage
+	NamespaceMode  *NamespaceMode
+	PVCName        *string
+	PVCNamespace   *string
+	PVName         *string
+	PodUID         *string
+	Signature      *string
 }
 
 // VolumeContext represents the same settings as a string map.
@@ -141,6 +262,9 @@ func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 			}
 		}
 		if !valid {
+			if suggestion := suggestKey(key, validKeys); suggestion != "" {
+				return result, fmt.Errorf("unknown parameter %q, did you mean %q?", key, suggestion)
+			}
 			return result, fmt.Errorf("parameter %q invalid in this context", key)
 		}
 
@@ -148,6 +272,16 @@ func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 		switch key {
 		case Name:
 			result.Name = &value
+		case PVCName:
+			result.PVCName = &value
+		case PVCNamespace:
+			result.PVCNamespace = &value
+		case PVName:
+			result.PVName = &value
+		case PodUID:
+			result.PodUID = &value
+		case Signature:
+			result.Signature = &value
 		case PersistencyModel:
 			p := Persistency(value)
 			switch p {
@@ -155,15 +289,17 @@ func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 				result.Persistency = &p
 			case PersistencyEphemeral:
 				if origin != NodeVolumeOrigin {
-					return result, fmt.Errorf("parameter %q: value invalid in this context: %q", key, value)
+					return result, fmt.Errorf("parameter %q: value invalid in this context: %q, use CSI ephemeral inline volumes instead", key, value)
 				}
 				result.Persistency = &p
 			case "none":
 				// Legacy alias from PMEM-CSI <= 0.5.0.
 				p := PersistencyNormal
 				result.Persistency = &p
+			case PersistencyCache:
+				return result, fmt.Errorf("parameter %q: value %q is no longer supported, use %q and one PVC per node instead", key, value, PersistencyNormal)
 			default:
-				return result, fmt.Errorf("parameter %q: unknown value: %q", key, value)
+				return result, fmt.Errorf("parameter %q: unknown value %q, must be %q", key, value, PersistencyNormal)
 			}
 		case KataContainers:
 			b, err := strconv.ParseBool(value)
@@ -171,6 +307,47 @@ func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 				return result, fmt.Errorf("parameter %q: failed to parse %q as boolean: %v", key, value, err)
 			}
 			result.KataContainers = &b
+		case Integrity:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as boolean: %v", key, value, err)
+			}
+			result.Integrity = &b
+		case Encrypted:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as boolean: %v", key, value, err)
+			}
+			result.Encrypted = &b
+		case ZeroFill:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as boolean: %v", key, value, err)
+			}
+			result.ZeroFill = &b
+		case Region:
+			id, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as region ID: %v", key, value, err)
+			}
+			region := uint(id)
+			result.Region = &region
+		case AccessPatternModel:
+			a := AccessPattern(value)
+			switch a {
+			case AccessPatternSequential, AccessPatternRandom:
+				result.AccessPattern = &a
+			default:
+				return result, fmt.Errorf("parameter %q: unknown value %q, must be %q or %q", key, value, AccessPatternSequential, AccessPatternRandom)
+			}
+		case DAXModel:
+			m := DAXMode(value)
+			switch m {
+			case DAXModeAlways, DAXModeInode:
+				result.DAXMode = &m
+			default:
+				return result, fmt.Errorf("parameter %q: unknown value %q, must be %q or %q", key, value, DAXModeAlways, DAXModeInode)
+			}
 		case UsageModel:
 			u := Usage(value)
 			switch u {
@@ -180,6 +357,14 @@ func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 			default:
 				return result, fmt.Errorf("parameter %q: unknown value: %s", key, value)
 			}
+		case NamespaceModel:
+			m := NamespaceMode(value)
+			switch m {
+			case NamespaceModeFsdax, NamespaceModeSector:
+				result.NamespaceMode = &m
+			default:
+				return result, fmt.Errorf("parameter %q: unknown value %q, must be %q or %q", key, value, NamespaceModeFsdax, NamespaceModeSector)
+			}
 		case Size:
 			quantity, err := resource.ParseQuantity(value)
 			if err != nil {
@@ -221,10 +406,35 @@ func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 		return result, fmt.Errorf("required parameter %q not specified", Size)
 	}
 
+	if result.Usage != nil && result.NamespaceMode != nil &&
+		*result.Usage != result.NamespaceMode.usage() {
+		return result, fmt.Errorf("namespace mode %q and usage %q are mutually exclusive, use usage %q", *result.NamespaceMode, *result.Usage, result.NamespaceMode.usage())
+	}
+
 	if result.GetKataContainers() && result.GetUsage() != UsageAppDirect {
 		return result, fmt.Errorf("Kata Container support and usage %q are mutually exclusive", result.GetUsage())
 	}
 
+	if result.DAXMode != nil && result.GetUsage() != UsageAppDirect {
+		return result, fmt.Errorf("DAX mode and usage %q are mutually exclusive", result.GetUsage())
+	}
+
+	if result.GetKataContainers() && result.GetDAXMode() != DAXModeAlways {
+		return result, fmt.Errorf("Kata Container support and DAX mode %q are mutually exclusive", result.GetDAXMode())
+	}
+
+	if result.GetIntegrity() && result.GetUsage() != UsageFileIO {
+		return result, fmt.Errorf("integrity checking and usage %q are mutually exclusive, use %q", result.GetUsage(), UsageFileIO)
+	}
+
+	if result.GetEncrypted() && result.GetUsage() != UsageFileIO {
+		return result, fmt.Errorf("encryption and usage %q are mutually exclusive, use %q", result.GetUsage(), UsageFileIO)
+	}
+
+	if result.GetEncrypted() && result.GetIntegrity() {
+		return result, fmt.Errorf("encryption and integrity checking are mutually exclusive")
+	}
+
 	return result, nil
 }
 
@@ -244,6 +454,12 @@ func (v Volume) ToContext() VolumeContext {
 	if v.EraseAfter != nil {
 		result[EraseAfter] = fmt.Sprintf("%v", *v.EraseAfter)
 	}
+	if v.Encrypted != nil {
+		result[Encrypted] = fmt.Sprintf("%v", *v.Encrypted)
+	}
+	if v.Integrity != nil {
+		result[Integrity] = fmt.Sprintf("%v", *v.Integrity)
+	}
 	if v.Name != nil {
 		result[Name] = *v.Name
 	}
@@ -256,12 +472,42 @@ func (v Volume) ToContext() VolumeContext {
 	if v.KataContainers != nil {
 		result[KataContainers] = fmt.Sprintf("%v", *v.KataContainers)
 	}
+	if v.ZeroFill != nil {
+		result[ZeroFill] = fmt.Sprintf("%v", *v.ZeroFill)
+	}
+	if v.Region != nil {
+		result[Region] = fmt.Sprintf("%d", *v.Region)
+	}
+	if v.AccessPattern != nil {
+		result[AccessPatternModel] = string(*v.AccessPattern)
+	}
+	if v.DAXMode != nil {
+		result[DAXModel] = string(*v.DAXMode)
+	}
 	if v.DeviceMode != nil {
 		result[DeviceMode] = string(*v.DeviceMode)
 	}
 	if v.Usage != nil {
 		result[UsageModel] = string(*v.Usage)
 	}
+	if v.NamespaceMode != nil {
+		result[NamespaceModel] = string(*v.NamespaceMode)
+	}
+	if v.PVCName != nil {
+		result[PVCName] = *v.PVCName
+	}
+	if v.PVCNamespace != nil {
+		result[PVCNamespace] = *v.PVCNamespace
+	}
+	if v.PVName != nil {
+		result[PVName] = *v.PVName
+	}
+	if v.PodUID != nil {
+		result[PodUID] = *v.PodUID
+	}
+	if v.Signature != nil {
+		result[Signature] = *v.Signature
+	}
 
 	return result
 }
@@ -273,6 +519,99 @@ func (v Volume) GetEraseAfter() bool {
 	return true
 }
 
+func (v Volume) GetIntegrity() bool {
+	if v.Integrity != nil {
+		return *v.Integrity
+	}
+	return false
+}
+
+func (v Volume) GetEncrypted() bool {
+	if v.Encrypted != nil {
+		return *v.Encrypted
+	}
+	return false
+}
+
+func (v Volume) GetZeroFill() bool {
+	if v.ZeroFill != nil {
+		return *v.ZeroFill
+	}
+	return false
+}
+
+// GetRegion returns the ID of the region that the volume must be
+// created in and true, false if any region may be used.
+func (v Volume) GetRegion() (uint, bool) {
+	if v.Region != nil {
+		return *v.Region, true
+	}
+	return 0, false
+}
+
+// GetAccessPattern returns the access pattern hint, empty if the
+// application did not provide one.
+func (v Volume) GetAccessPattern() AccessPattern {
+	if v.AccessPattern != nil {
+		return *v.AccessPattern
+	}
+	return ""
+}
+
+// GetDAXMode returns how DAX is to be enabled for the filesystem,
+// DAXModeAlways if not set.
+func (v Volume) GetDAXMode() DAXMode {
+	if v.DAXMode != nil {
+		return *v.DAXMode
+	}
+	return DAXModeAlways
+}
+
+// GetPVCNamespace returns the namespace of the PVC for which the
+// volume was created, empty if unknown.
+func (v Volume) GetPVCNamespace() string {
+	if v.PVCNamespace != nil {
+		return *v.PVCNamespace
+	}
+	return ""
+}
+
+// GetPVCName returns the name of the PVC for which the volume was
+// created, empty if unknown.
+func (v Volume) GetPVCName() string {
+	if v.PVCName != nil {
+		return *v.PVCName
+	}
+	return ""
+}
+
+// GetPVName returns the name of the PV for which the volume was
+// created, empty if unknown.
+func (v Volume) GetPVName() string {
+	if v.PVName != nil {
+		return *v.PVName
+	}
+	return ""
+}
+
+// GetPodUID returns the UID of the pod for which an ephemeral
+// volume was created, empty if unknown.
+func (v Volume) GetPodUID() string {
+	if v.PodUID != nil {
+		return *v.PodUID
+	}
+	return ""
+}
+
+// GetSignature returns the signature of the device, empty if the
+// volume was created without one.
+func (v Volume) GetSignature() string {
+	if v.Signature != nil {
+		return *v.Signature
+	}
+	return ""
+}
+
 func (v Volume) GetPersistency() Persistency {
 	if v.Persistency != nil {
 		return *v.Persistency
@@ -313,5 +652,101 @@ func (v Volume) GetUsage() Usage {
 	if v.Usage != nil {
 		return *v.Usage
 	}
+	if v.NamespaceMode != nil {
+		return v.NamespaceMode.usage()
+	}
 	return UsageAppDirect
 }
+
+func (v Volume) GetNamespaceMode() NamespaceMode {
+	if v.NamespaceMode != nil {
+		return *v.NamespaceMode
+	}
+	if v.GetUsage() == UsageFileIO {
+		return NamespaceModeSector
+	}
+	return NamespaceModeFsdax
+}
+
+// usage returns the usage model that corresponds to the namespace mode.
+func (m NamespaceMode) usage() Usage {
+	if m == NamespaceModeSector {
+		return UsageFileIO
+	}
+	return UsageAppDirect
+}
+
+// allKeys contains all parameters that are valid in at least one
+// context.
+var allKeys = []string{
+	AccessPatternModel,
+	DAXModel,
+	Encrypted,
+	EraseAfter,
+	Integrity,
+	KataContainers,
+	Name,
+	NamespaceModel,
+	PersistencyModel,
+	ZeroFill,
+	Region,
+	Signature,
+	Size,
+	DeviceMode,
+	UsageModel,
+}
+
+// suggestKey returns a valid key that is similar to an unknown key,
+// for example because of a typo or wrong case. Keys which are known
+// but invalid in the current context get no suggestion.
+func suggestKey(key string, validKeys []string) string {
+	for _, known := range allKeys {
+		if known == key {
+			return ""
+		}
+	}
+	best, bestDistance := "", 3
+	for _, validKey := range validKeys {
+		if validKey == PodInfoPrefix {
+			continue
+		}
+		if strings.EqualFold(validKey, key) {
+			return validKey
+		}
+		if d := editDistance(strings.ToLower(key), strings.ToLower(validKey)); d < bestDistance {
+			best, bestDistance = validKey, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -23,6 +23,15 @@ func TestParameters(t *testing.T) {
 	gigNum := int64(1 * 1024 * 1024 * 1024)
 	appDirect := UsageAppDirect
 	fileIO := UsageFileIO
+	sector := NamespaceModeSector
+	pvcName := "pvc"
+	namespace := "default"
+	pvName := "pv"
+	region1 := uint(1)
+	sequential := AccessPatternSequential
+	daxInode := DAXModeInode
+	signature := "0b1c3a4e-5f6d-4a8b-9c0d-1e2f3a4b5c6d"
+	podUID := "5e2f4b1a-0c3d-4e5f-8a9b-7c6d5e4f3a2b"
 
 	tests := []struct {
 		name       string
@@ -45,6 +54,20 @@ func TestParameters(t *testing.T) {
 			},
 		},
 
+		{
+			name:   "ephemeral-pod",
+			origin: EphemeralVolumeOrigin,
+			stringmap: VolumeContext{
+				Size:                          gig,
+				PodUID:                        podUID,
+				"csi.storage.k8s.io/pod.name": "my-pod",
+			},
+			parameters: Volume{
+				Size:   &gigNum,
+				PodUID: &podUID,
+			},
+		},
+
 		// Various parameters which are not allowed in this context.
 		{
 			name:   "invalid-parameter-create",
@@ -110,6 +133,316 @@ func TestParameters(t *testing.T) {
 			},
 		},
 
+		// Namespace mode.
+		{
+			name:   "valid-nsmode-sector",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				NamespaceModel: "sector",
+			},
+			parameters: Volume{
+				NamespaceMode: &sector,
+			},
+		},
+		{
+			name:   "valid-nsmode-usage",
+			origin: NodeVolumeOrigin,
+			stringmap: VolumeContext{
+				NamespaceModel: "sector",
+				UsageModel:     "FileIO",
+			},
+			parameters: Volume{
+				NamespaceMode: &sector,
+				Usage:         &fileIO,
+			},
+		},
+		{
+			name:   "invalid-nsmode",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				NamespaceModel: "devdax",
+			},
+			err: "parameter \"nsmode\": unknown value \"devdax\", must be \"fsdax\" or \"sector\"",
+		},
+		{
+			name:   "invalid-nsmode-usage",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				NamespaceModel: "sector",
+				UsageModel:     "AppDirect",
+			},
+			err: "namespace mode \"sector\" and usage \"AppDirect\" are mutually exclusive, use usage \"FileIO\"",
+		},
+
+		// Persistency model.
+		{
+			name:   "invalid-persistency-cache",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				PersistencyModel: "cache",
+			},
+			err: "parameter \"persistencyModel\": value \"cache\" is no longer supported, use \"normal\" and one PVC per node instead",
+		},
+		{
+			name:   "invalid-persistency-ephemeral",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				PersistencyModel: "ephemeral",
+			},
+			err: "parameter \"persistencyModel\": value invalid in this context: \"ephemeral\", use CSI ephemeral inline volumes instead",
+		},
+		{
+			name:   "invalid-persistency",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				PersistencyModel: "foo",
+			},
+			err: "parameter \"persistencyModel\": unknown value \"foo\", must be \"normal\"",
+		},
+
+		// Typos.
+		{
+			name:   "typo-case",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				"eraseAfter": "false",
+			},
+			err: "unknown parameter \"eraseAfter\", did you mean \"eraseafter\"?",
+		},
+		{
+			name:   "typo-letters",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				"persistenceModel": "normal",
+			},
+			err: "unknown parameter \"persistenceModel\", did you mean \"persistencyModel\"?",
+		},
+
+		// Integrity checking.
+		{
+			name:   "invalid-integrity-app-direct",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Integrity: "true",
+			},
+			err: "integrity checking and usage \"AppDirect\" are mutually exclusive, use \"FileIO\"",
+		},
+		{
+			name:   "invalid-integrity-value",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Integrity: "foo",
+			},
+			err: "parameter \"integrity\": failed to parse \"foo\" as boolean: strconv.ParseBool: parsing \"foo\": invalid syntax",
+		},
+		{
+			name:   "valid-integrity",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Integrity:  "true",
+				UsageModel: "FileIO",
+			},
+			parameters: Volume{
+				Integrity: &yes,
+				Usage:     &fileIO,
+			},
+		},
+
+		// Encryption.
+		{
+			name:   "invalid-encrypted-app-direct",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Encrypted: "true",
+			},
+			err: "encryption and usage \"AppDirect\" are mutually exclusive, use \"FileIO\"",
+		},
+		{
+			name:   "invalid-encrypted-integrity",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Encrypted:  "true",
+				Integrity:  "true",
+				UsageModel: "FileIO",
+			},
+			err: "encryption and integrity checking are mutually exclusive",
+		},
+		{
+			name:   "valid-encrypted-ephemeral",
+			origin: EphemeralVolumeOrigin,
+			stringmap: VolumeContext{
+				Encrypted:  "true",
+				UsageModel: "FileIO",
+				Size:       gig,
+			},
+			parameters: Volume{
+				Encrypted: &yes,
+				Usage:     &fileIO,
+				Size:      &gigNum,
+			},
+		},
+		{
+			name:   "valid-encrypted",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Encrypted:  "true",
+				UsageModel: "FileIO",
+			},
+			parameters: Volume{
+				Encrypted: &yes,
+				Usage:     &fileIO,
+			},
+		},
+
+		// Metadata from external-provisioner.
+		{
+			name:   "pvc-metadata",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				PVCName:      "pvc",
+				PVCNamespace: "default",
+				PVName:       "pv",
+			},
+			parameters: Volume{
+				PVCName:      &pvcName,
+				PVCNamespace: &namespace,
+				PVName:       &pvName,
+			},
+		},
+		{
+			name:   "node-pvc-metadata",
+			origin: NodeVolumeOrigin,
+			stringmap: VolumeContext{
+				PVCName:      "pvc",
+				PVCNamespace: "default",
+				PVName:       "pv",
+			},
+			parameters: Volume{
+				PVCName:      &pvcName,
+				PVCNamespace: &namespace,
+				PVName:       &pvName,
+			},
+		},
+
+		// Zeroing.
+		{
+			name:   "invalid-zerofill-value",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				ZeroFill: "foo",
+			},
+			err: "parameter \"zeroFill\": failed to parse \"foo\" as boolean: strconv.ParseBool: parsing \"foo\": invalid syntax",
+		},
+		{
+			name:   "valid-zerofill",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				ZeroFill: "true",
+			},
+			parameters: Volume{
+				ZeroFill: &yes,
+			},
+		},
+
+		// Region.
+		{
+			name:   "invalid-region",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Region: "region1",
+			},
+			err: "parameter \"region\": failed to parse \"region1\" as region ID: strconv.ParseUint: parsing \"region1\": invalid syntax",
+		},
+		{
+			name:   "valid-region",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Region: "1",
+			},
+			parameters: Volume{
+				Region: &region1,
+			},
+		},
+
+		// Access pattern.
+		{
+			name:   "invalid-access-pattern",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				AccessPatternModel: "linear",
+			},
+			err: "parameter \"accessPattern\": unknown value \"linear\", must be \"sequential\" or \"random\"",
+		},
+		{
+			name:   "valid-access-pattern",
+			origin: PersistentVolumeOrigin,
+			stringmap: VolumeContext{
+				AccessPatternModel: "sequential",
+			},
+			parameters: Volume{
+				AccessPattern: &sequential,
+			},
+		},
+
+		// DAX mode.
+		{
+			name:   "invalid-dax-mode",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				DAXModel: "never",
+			},
+			err: "parameter \"daxMode\": unknown value \"never\", must be \"always\" or \"inode\"",
+		},
+		{
+			name:   "valid-dax-mode",
+			origin: PersistentVolumeOrigin,
+			stringmap: VolumeContext{
+				DAXModel: "inode",
+			},
+			parameters: Volume{
+				DAXMode: &daxInode,
+			},
+		},
+		{
+			name:   "dax-mode-fileio",
+			origin: EphemeralVolumeOrigin,
+			stringmap: VolumeContext{
+				Size:       gig,
+				DAXModel:   "inode",
+				UsageModel: "FileIO",
+			},
+			err: "DAX mode and usage \"FileIO\" are mutually exclusive",
+		},
+		{
+			name:   "dax-mode-kata",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				DAXModel:       "inode",
+				KataContainers: "true",
+			},
+			err: "Kata Container support and DAX mode \"inode\" are mutually exclusive",
+		},
+
+		// Device signature.
+		{
+			name:   "signature",
+			origin: PersistentVolumeOrigin,
+			stringmap: VolumeContext{
+				Signature: signature,
+			},
+			parameters: Volume{
+				Signature: &signature,
+			},
+		},
+		{
+			name:   "invalid-signature-create",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Signature: signature,
+			},
+			err: "parameter \"signature\" invalid in this context",
+		},
+
 		// Parse errors for size.
 		{
 			name:   "invalid-size-suffix",
@@ -154,9 +487,15 @@ func TestParameters(t *testing.T) {
 						value = "normal"
 					}
 				}
-				if key != ProvisionerID &&
-					!strings.HasPrefix(key, PodInfoPrefix) {
+				switch key {
+				case PVCName, PVCNamespace, PVName, PodUID:
+					// Pod info which ToContext keeps.
 					result[key] = value
+				default:
+					if key != ProvisionerID &&
+						!strings.HasPrefix(key, PodInfoPrefix) {
+						result[key] = value
+					}
 				}
 			}
 			return result
@@ -17,17 +17,31 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/component-base/featuregate"
 	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
 
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/driverfeatures"
 	grpcserver "github.com/intel/pmem-csi/pkg/grpc-server"
 	"github.com/intel/pmem-csi/pkg/k8sutil"
 	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemgrpc "github.com/intel/pmem-csi/pkg/pmem-grpc"
 	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+	"github.com/intel/pmem-csi/pkg/termination"
 	"github.com/intel/pmem-csi/pkg/types"
 	"github.com/kubernetes-csi/csi-lib-utils/metrics"
 
@@ -45,7 +59,7 @@ type DriverMode string
 
 func (mode *DriverMode) Set(value string) error {
 	switch value {
-	case string(Node), string(Controller), string(ForceConvertRawNamespaces):
+	case string(Node), string(Controller), string(ForceConvertRawNamespaces), string(ImportVolume), string(LookupVolume), string(Uninstall):
 		*mode = DriverMode(value)
 	default:
 		// The flag package will add the value to the final output, no need to do it here.
@@ -67,11 +81,21 @@ const (
 	Controller DriverMode = "webhooks"
 	// Convert each raw namespace into fsdax.
 	ForceConvertRawNamespaces = "force-convert-raw-namespaces"
+	// Turn an existing device into a volume, print the PV and exit.
+	ImportVolume DriverMode = "import-volume"
+	// Print which Kubernetes objects the volumes belong to and exit.
+	LookupVolume DriverMode = "lookup-volume"
+	// Remove volumes, the PMEM setup and the state of the node driver.
+	Uninstall DriverMode = "uninstall"
 )
 
 var (
 	//PmemDriverTopologyKey key to use for topology constraint
 	DriverTopologyKey = ""
+	// DriverRegionTopologyKeyPrefix gets combined with the ID of
+	// each PMEM region on a node, for example
+	// pmem-csi.intel.com/region-0=true.
+	DriverRegionTopologyKeyPrefix = ""
 
 	// Mirrored after https://github.com/kubernetes/component-base/blob/dae26a37dccb958eac96bc9dedcecf0eb0690f0f/metrics/version.go#L21-L37
 	// just with less information.
@@ -95,6 +119,10 @@ func init() {
 type Config struct {
 	//DriverName name of the csi driver
 	DriverName string
+	// DriverNameAliases are additional names under which the
+	// node driver registers with kubelet, each with its own
+	// socket next to Endpoint.
+	DriverNameAliases []string
 	//NodeID node id on which this csi driver is running
 	NodeID string
 	//Endpoint exported csi driver endpoint
@@ -109,6 +137,72 @@ type Config struct {
 	Version string
 	// PmemPercentage percentage of space to be used by the driver in each PMEM region
 	PmemPercentage uint
+	// PmemPercentageLabel, if set, is the name of a node label which overrides
+	// PmemPercentage on nodes where it is set.
+	PmemPercentageLabel string
+	// CapacityRefreshMin and CapacityRefreshMax determine how long
+	// the result of GetCapacity may be reused while no volumes get
+	// created or deleted. Zero disables caching.
+	CapacityRefreshMin time.Duration
+	CapacityRefreshMax time.Duration
+	// OrphanCheckInterval determines how often the node driver
+	// looks for devices without a volume. Zero disables the check.
+	OrphanCheckInterval time.Duration
+	// OrphanDryRun, if set, only reports orphaned devices instead
+	// of deleting them.
+	OrphanDryRun bool
+	// CleanupOrphanedMounts enables unpublishing and unstaging
+	// volumes of pods that no longer exist when the node driver
+	// starts.
+	CleanupOrphanedMounts bool
+	// UnsupportedFsType determines how the node driver handles
+	// requests for unsupported filesystem types.
+	UnsupportedFsType FsTypePolicy
+	// VolumeHookURL, if set, receives a POST request with JSON
+	// metadata after a volume was created or deleted.
+	VolumeHookURL string
+	// VolumeHookRetries is the number of retries for failed
+	// volume hook requests.
+	VolumeHookRetries int
+	// DryRun simulates creating and deleting volumes in memory
+	// without modifying PMEM. Volumes cannot be used by pods.
+	DryRun bool
+	// NamespaceQuota, if set, limits the total size of volumes
+	// on the node per PVC namespace.
+	NamespaceQuota NamespaceQuota
+	// EphemeralQuotaPerPod, if set, limits the total size of the
+	// ephemeral inline volumes of a pod.
+	EphemeralQuotaPerPod resource.QuantityValue
+	// EphemeralQuotaPerNode, if set, limits the total size of all
+	// ephemeral inline volumes on the node.
+	EphemeralQuotaPerNode resource.QuantityValue
+	// MaxDeviceOperations limits how many device operations
+	// (create, delete, mkfs) run concurrently. Zero disables the
+	// limit.
+	MaxDeviceOperations int
+	// VolumePools configures pre-formatted devices which are
+	// kept ready for new volumes.
+	VolumePools VolumePools
+	// MaxVolumesPerNode limits the number of volumes on a node.
+	// Zero disables the limit.
+	MaxVolumesPerNode int
+	// DeviceRetryPolicy determines how device operations get
+	// repeated after transient errors.
+	DeviceRetryPolicy pmdmanager.RetryPolicy
+	// ImportDevice is the device which gets turned into a volume
+	// in import mode.
+	ImportDevice string
+	// ImportPVName is the name of the PV for the imported volume.
+	ImportPVName string
+	// ImportStorageClass is the optional storage class of that PV.
+	ImportStorageClass string
+	// ImportReadOnly selects ReadOnlyMany as access mode of that PV.
+	ImportReadOnly bool
+	// LookupKey selects the volumes in lookup mode, all if empty.
+	LookupKey string
+	// UninstallForce enables deleting volumes that still have PVs
+	// in uninstall mode.
+	UninstallForce bool
 
 	// KubeAPIQPS is the average rate of requests to the Kubernetes API server,
 	// enforced locally in client-go.
@@ -117,10 +211,31 @@ type Config struct {
 	// KubeAPIQPS is the number of requests that a client is
 	// allowed to send above the average rate of request.
 	KubeAPIBurst int
+	// ShutdownTimeout is how long pending gRPC calls may run
+	// after receiving SIGTERM before they get aborted. It must be
+	// shorter than the termination grace period of the pod.
+	ShutdownTimeout time.Duration
+	// FeatureGate holds the experimental features which are
+	// enabled, driverfeatures.NewFeatureGate() with the defaults if nil.
+	FeatureGate featuregate.FeatureGate
 
 	// parameters for rescheduler and raw namespace conversion
 	nodeSelector types.NodeSelector
 
+	// LostNodeGracePeriod is the time that a node must be absent
+	// from the cluster before its volumes are considered lost.
+	// Zero disables the check.
+	LostNodeGracePeriod time.Duration
+	// DeleteLostVolumes enables deleting released PVs of lost
+	// volumes.
+	DeleteLostVolumes bool
+	// LeaderElection enables leader election between controller
+	// replicas for tasks that only one of them may perform.
+	LeaderElection bool
+	// LeaderElectionNamespace is the namespace of the Lease object,
+	// POD_NAMESPACE if empty.
+	LeaderElectionNamespace string
+
 	// parameters for Prometheus metrics
 	metricsListen string
 	metricsPath   string
@@ -129,6 +244,11 @@ type Config struct {
 type csiDriver struct {
 	cfg       Config
 	gatherers prometheus.Gatherers
+
+	// balance is set in controller mode and served by the metrics server.
+	balance http.Handler
+	// volumes is set in node mode and served by the metrics server.
+	volumes http.Handler
 }
 
 func GetCSIDriver(cfg Config) (*csiDriver, error) {
@@ -138,14 +258,48 @@ func GetCSIDriver(cfg Config) (*csiDriver, error) {
 	if cfg.Endpoint == "" {
 		return nil, errors.New("CSI endpoint configuration option missing")
 	}
-	if cfg.Mode == Node && cfg.NodeID == "" {
+	if (cfg.Mode == Node || cfg.Mode == Uninstall) && cfg.NodeID == "" {
 		return nil, errors.New("node ID configuration option missing")
 	}
-	if cfg.Mode == Node && cfg.StateBasePath == "" {
+	if (cfg.Mode == Node || cfg.Mode == ImportVolume || cfg.Mode == LookupVolume || cfg.Mode == Uninstall) && cfg.StateBasePath == "" {
 		cfg.StateBasePath = "/var/lib/" + cfg.DriverName
 	}
+	switch cfg.UnsupportedFsType {
+	case "":
+		cfg.UnsupportedFsType = FsTypeFail
+	case FsTypeFail, FsTypeFallback:
+	default:
+		return nil, fmt.Errorf("invalid policy for unsupported filesystem types %q, must be %q or %q", cfg.UnsupportedFsType, FsTypeFail, FsTypeFallback)
+	}
+
+	if cfg.VolumeHookURL != "" {
+		if err := validateVolumeHookURL(cfg.VolumeHookURL); err != nil {
+			return nil, fmt.Errorf("invalid volume hook URL: %v", err)
+		}
+	}
+	if err := checkAliases(cfg.DriverName, cfg.DriverNameAliases); err != nil {
+		return nil, fmt.Errorf("-drivername-alias: %v", err)
+	}
+	if cfg.ShutdownTimeout < 0 {
+		return nil, fmt.Errorf("invalid shutdown timeout %s, must not be negative", cfg.ShutdownTimeout)
+	}
+	if cfg.VolumeHookRetries < 0 {
+		return nil, fmt.Errorf("invalid number of volume hook retries %d, must not be negative", cfg.VolumeHookRetries)
+	}
+	if cfg.EphemeralQuotaPerPod.Sign() < 0 || cfg.EphemeralQuotaPerNode.Sign() < 0 {
+		return nil, errors.New("ephemeral volume quota must not be negative")
+	}
+	if cfg.FeatureGate == nil {
+		cfg.FeatureGate = driverfeatures.NewFeatureGate()
+	}
+	if cfg.Mode == Node {
+		if err := checkFeatures(cfg.FeatureGate, cfg.DeviceManager); err != nil {
+			return nil, fmt.Errorf("-feature-gates: %v", err)
+		}
+	}
 
 	DriverTopologyKey = cfg.DriverName + "/node"
+	DriverRegionTopologyKeyPrefix = cfg.DriverName + "/region-"
 
 	// Should GetCSIDriver get called more than once per process,
 	// all of them will record their version.
@@ -174,6 +328,7 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	logger := klog.FromContext(ctx)
+	pmdmanager.SetRetryPolicy(csid.cfg.DeviceRetryPolicy)
 
 	switch csid.cfg.Mode {
 	case Controller:
@@ -188,6 +343,33 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 		scInformer := globalFactory.Storage().V1().StorageClasses().Informer()
 		pvInformer := globalFactory.Core().V1().PersistentVolumes().Informer()
 		csiNodeLister := globalFactory.Storage().V1().CSINodes().Lister()
+		csid.balance = balanceHandler{
+			driverName:    csid.cfg.DriverName,
+			pvLister:      globalFactory.Core().V1().PersistentVolumes().Lister(),
+			csiNodeLister: csiNodeLister,
+		}
+
+		// CSIStorageCapacity v1 is only available since Kubernetes
+		// 1.24. An informer for it on older clusters would never sync,
+		// so it has its own factory which does not get waited for.
+		hasCapacityV1, err := hasCSIStorageCapacityV1(client)
+		if err != nil {
+			return err
+		}
+		if hasCapacityV1 {
+			capacityFactory := informers.NewSharedInformerFactory(client, resyncPeriod)
+			capacityInformer := capacityFactory.Storage().V1().CSIStorageCapacities()
+			capacityCollector{
+				driverName:     csid.cfg.DriverName,
+				capacityLister: capacityInformer.Lister(),
+				capacitySynced: capacityInformer.Informer().HasSynced,
+				scLister:       globalFactory.Storage().V1().StorageClasses().Lister(),
+				pvLister:       globalFactory.Core().V1().PersistentVolumes().Lister(),
+			}.MustRegister(prometheus.DefaultRegisterer)
+			capacityFactory.Start(ctx.Done())
+		} else {
+			logger.Info("CSIStorageCapacity v1 is not supported by the apiserver, capacity per topology segment is not available")
+		}
 
 		var pcp *pmemCSIProvisioner
 		if csid.cfg.nodeSelector != nil {
@@ -209,12 +391,24 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 			// One of them will succeed, the others will get a conflict error and then
 			// notice that nothing is left to do on their retry.
 			pcp = newRescheduler(ctx,
-				csid.cfg.DriverName,
+				csid.cfg.DriverName, DriverTopologyKey,
 				client, pvcInformer, scInformer, pvInformer, csiNodeLister,
 				csid.cfg.nodeSelector,
 				serverVersion.GitVersion)
 		}
 
+		var lc *lostVolumeChecker
+		if csid.cfg.LostNodeGracePeriod > 0 {
+			eventBroadcaster := record.NewBroadcaster()
+			eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+			defer eventBroadcaster.Shutdown()
+			lc = newLostVolumeChecker(csid.cfg.DriverName, DriverTopologyKey, client,
+				globalFactory.Core().V1().PersistentVolumes().Lister(),
+				globalFactory.Core().V1().Nodes().Lister(),
+				eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: csid.cfg.DriverName}),
+				csid.cfg.LostNodeGracePeriod, csid.cfg.DeleteLostVolumes)
+		}
+
 		// Now that all informers and indices are created we can run the factory.
 		globalFactory.Start(ctx.Done())
 		cacheSyncResult := globalFactory.WaitForCacheSync(ctx.Done())
@@ -228,15 +422,87 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 		if pcp != nil {
 			pcp.startRescheduler(ctx, cancel)
 		}
+		if lc != nil {
+			// With more than one replica, only one of them
+			// must mark and delete PVs.
+			if csid.cfg.LeaderElection {
+				if err := runAsLeader(ctx, client, csid.cfg.LeaderElectionNamespace, csid.cfg.DriverName, func(ctx context.Context) {
+					lc.run(ctx, lostVolumeCheckInterval)
+				}); err != nil {
+					return err
+				}
+			} else {
+				lc.run(ctx, lostVolumeCheckInterval)
+			}
+		}
 	case Node:
-		dm, err := pmdmanager.New(ctx, csid.cfg.DeviceManager, csid.cfg.PmemPercentage)
-		if err != nil {
-			return err
+		// Fail early instead of after setting up PMEM.
+		if _, _, err := pmemgrpc.ParseEndpoint(csid.cfg.Endpoint); err != nil {
+			return fmt.Errorf("-endpoint: %v", err)
+		}
+		aliasEndpoints := map[string]string{}
+		for _, alias := range csid.cfg.DriverNameAliases {
+			endpoint, err := aliasEndpoint(csid.cfg.Endpoint, alias)
+			if err != nil {
+				return fmt.Errorf("-drivername-alias: %v", err)
+			}
+			aliasEndpoints[alias] = endpoint
+		}
+		// Several optional features need the apiserver. They
+		// share one client and one event recorder.
+		apiserver := &nodeAPIServer{
+			source: corev1.EventSource{Component: csid.cfg.DriverName, Host: csid.cfg.NodeID},
+		}
+		defer apiserver.shutdown()
+		if csid.cfg.PmemPercentageLabel != "" {
+			client, err := apiserver.client()
+			if err != nil {
+				return err
+			}
+			percentage, err := pmemPercentageForNode(ctx, client, csid.cfg.NodeID, csid.cfg.PmemPercentageLabel, csid.cfg.PmemPercentage)
+			if err != nil {
+				return err
+			}
+			csid.cfg.PmemPercentage = percentage
+		}
+		var dm pmdmanager.PmemDeviceManager
+		var err error
+		if csid.cfg.DryRun {
+			// PMEM must not get modified, not even by the
+			// initial setup of a real device manager.
+			logger.Info("Dry-run mode, volumes only get created in memory.")
+			dm, err = pmdmanager.NewDryRun(ctx, csid.cfg.DeviceManager, csid.cfg.PmemPercentage)
+		} else {
+			dm, err = pmdmanager.New(ctx, csid.cfg.DeviceManager, csid.cfg.PmemPercentage)
 		}
-		sm, err := pmemstate.NewFileState(csid.cfg.StateBasePath)
 		if err != nil {
 			return err
 		}
+		if dp, ok := dm.(pmdmanager.PmemDeviceProblems); ok && len(dp.Problems()) > 0 {
+			// The driver can still work, but an admin needs
+			// to know. Errors were already logged.
+			recorder, err := apiserver.recorder()
+			if err != nil {
+				return err
+			}
+			node := &corev1.ObjectReference{Kind: "Node", Name: csid.cfg.NodeID, UID: k8stypes.UID(csid.cfg.NodeID)}
+			for _, problem := range dp.Problems() {
+				recorder.Event(node, corev1.EventTypeWarning, "ManualInterventionRequired", problem)
+			}
+		}
+		var sm pmemstate.StateManager
+		// Simulated volumes must not be mixed with
+		// the persistent state of real volumes.
+		if !csid.cfg.DryRun {
+			sm, err = pmemstate.NewFileState(csid.cfg.StateBasePath)
+			if err != nil {
+				return &termination.Error{
+					Reason:     termination.ReasonStateDirectory,
+					Suggestion: "check that " + csid.cfg.StateBasePath + " is a writable directory on the host",
+					Err:        err,
+				}
+			}
+		}
 
 		// On the csi.sock endpoint we gather statistics for incoming
 		// CSI method calls like any other CSI driver.
@@ -247,17 +513,111 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 		csid.gatherers = append(csid.gatherers, cmm.GetRegistry())
 
 		// Create GRPC servers
-		ids := NewIdentityServer(csid.cfg.DriverName, csid.cfg.Version)
 		cs := NewNodeControllerServer(ctx, csid.cfg.NodeID, dm, sm)
+		cs.caps.enableFeatures(csid.cfg.FeatureGate)
+		ids := NewIdentityServer(csid.cfg.DriverName, csid.cfg.Version, cs.caps)
+		cs.capacity = newAdaptiveCapacity(dm, csid.cfg.CapacityRefreshMin, csid.cfg.CapacityRefreshMax)
+		cs.quota = csid.cfg.NamespaceQuota
+		cs.ephemeralQuota = EphemeralQuota{
+			PerPod:  csid.cfg.EphemeralQuotaPerPod.Value(),
+			PerNode: csid.cfg.EphemeralQuotaPerNode.Value(),
+		}
+		cs.limiter = newDeviceLimiter(csid.cfg.MaxDeviceOperations)
+		cs.maxVolumes = csid.cfg.MaxVolumesPerNode
+		if cs.maxVolumes > 0 {
+			cs.recorder, err = apiserver.recorder()
+			if err != nil {
+				return err
+			}
+		}
+		if csid.cfg.VolumeHookURL != "" {
+			cs.hook = newVolumeHook(csid.cfg.VolumeHookURL, csid.cfg.DriverName, csid.cfg.NodeID, csid.cfg.VolumeHookRetries)
+			cs.hook.run(ctx)
+		}
+		if csid.cfg.DryRun {
+			// Simulated devices cannot be formatted.
+			if len(csid.cfg.VolumePools) > 0 {
+				logger.Info("Volume pools are not supported in dry-run mode, ignoring them")
+			}
+		} else {
+			cs.pool = newVolumePool(ctx, cs, csid.cfg.VolumePools)
+			if cs.pool != nil {
+				cs.pool.run(ctx)
+			}
+		}
 		ns := NewNodeServer(cs, filepath.Clean(csid.cfg.StateBasePath)+"/mount")
+		ns.fsTypePolicy = csid.cfg.UnsupportedFsType
+		ns.dryRun = csid.cfg.DryRun
+		csid.volumes = volumesHandler{
+			driverName: csid.cfg.DriverName,
+			ns:         ns,
+		}
+		if ns.fsTypePolicy == FsTypeFallback {
+			ns.recorder, err = apiserver.recorder()
+			if err != nil {
+				return err
+			}
+		}
+
+		// Simulated volumes are never mounted, so any
+		// mounts belong to some other instance of the driver.
+		if csid.cfg.CleanupOrphanedMounts && csid.cfg.DryRun {
+			logger.Info("Orphaned mounts are not cleaned up in dry run mode")
+		} else if csid.cfg.CleanupOrphanedMounts {
+			client, err := apiserver.client()
+			if err != nil {
+				return err
+			}
+			// Errors are not fatal, the driver can still work.
+			// Listing pods fails when the driver is deployed
+			// without the necessary RBAC rule.
+			if podUIDs, err := podUIDsOnNode(ctx, client, csid.cfg.NodeID); err != nil {
+				logger.Error(err, "Cannot check for orphaned mounts")
+			} else if err := ns.cleanupOrphanedMounts(ctx, csid.cfg.DriverName, podUIDs); err != nil {
+				logger.Error(err, "Cleaning up orphaned mounts failed")
+			}
+		}
+
+		// Simulated volumes cannot be imported.
+		if !csid.cfg.DryRun {
+			if err := serveImport(ctx, filepath.Join(csid.cfg.StateBasePath, importSocket), importHandler{
+				driverName: csid.cfg.DriverName,
+				cs:         cs,
+			}); err != nil {
+				return err
+			}
+		}
 
 		services := []grpcserver.Service{ids, ns, cs}
 		if err := s.Start(ctx, csid.cfg.Endpoint, csid.cfg.NodeID, nil, cmm, services...); err != nil {
 			return err
 		}
+		// Existing volumes of a previous driver name remain
+		// usable through the same services. Only the driver
+		// name and the topology keys differ.
+		for alias, endpoint := range aliasEndpoints {
+			services := []grpcserver.Service{
+				NewIdentityServer(alias, csid.cfg.Version, cs.caps),
+				&aliasNodeServer{nodeServer: ns, driverName: csid.cfg.DriverName, alias: alias},
+				cs,
+			}
+			if err := s.Start(ctx, endpoint, csid.cfg.NodeID, nil, cmm, services...); err != nil {
+				return err
+			}
+			logger.Info("Serving driver name alias", "alias", alias, "endpoint", endpoint)
+		}
 
 		// Also collect metrics data via the device manager.
 		pmdmanager.CapacityCollector{PmemDeviceCapacity: dm}.MustRegister(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+		quotaCollector{cs: cs}.MustRegister(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+		mustRegisterVolumeOperations(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+		pmdmanager.MustRegisterRetries(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+
+		if csid.cfg.OrphanCheckInterval > 0 {
+			oc := newOrphanChecker(cs, csid.cfg.OrphanDryRun)
+			oc.MustRegister(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+			oc.run(ctx, csid.cfg.OrphanCheckInterval)
+		}
 
 		capacity, err := dm.GetCapacity(ctx)
 		if err != nil {
@@ -285,6 +645,54 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 		// isn't supported for DaemonSets
 		// (https://github.com/kubernetes/kubernetes/issues/24725).
 		logger.Info("Raw namespace conversion is done, waiting for termination signal.")
+	case ImportVolume:
+		// The running node driver does the actual work, only it
+		// can modify devices and state safely.
+		pv, err := requestImport(ctx, filepath.Join(csid.cfg.StateBasePath, importSocket), importRequest{
+			Device:       csid.cfg.ImportDevice,
+			PVName:       csid.cfg.ImportPVName,
+			StorageClass: csid.cfg.ImportStorageClass,
+			ReadOnly:     csid.cfg.ImportReadOnly,
+		})
+		if err != nil {
+			return err
+		}
+		data, err := yaml.Marshal(pv)
+		if err != nil {
+			return fmt.Errorf("encode PV: %v", err)
+		}
+		fmt.Print(string(data))
+		return nil
+	case LookupVolume:
+		sm, err := pmemstate.NewFileState(csid.cfg.StateBasePath)
+		if err != nil {
+			return err
+		}
+		volumes, err := lookupVolumes(sm, csid.cfg.LookupKey)
+		if err != nil {
+			return err
+		}
+		if csid.cfg.LookupKey != "" && len(volumes) == 0 {
+			return fmt.Errorf("no volume found for %q", csid.cfg.LookupKey)
+		}
+		data, err := yaml.Marshal(volumes)
+		if err != nil {
+			return fmt.Errorf("encode volumes: %v", err)
+		}
+		fmt.Print(string(data))
+		return nil
+	case Uninstall:
+		client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
+		if err != nil {
+			return fmt.Errorf("connect to apiserver: %v", err)
+		}
+		if err := uninstall(ctx, client, csid.cfg.DriverName, csid.cfg.NodeID,
+			csid.cfg.StateBasePath, csid.cfg.UninstallForce); err != nil {
+			return err
+		}
+		// Same as for raw namespace conversion: the operator runs
+		// this in a DaemonSet, so the pod has to stay around.
+		logger.Info("Uninstall is done, waiting for termination signal.")
 	default:
 		return fmt.Errorf("Unsupported device mode '%v", csid.cfg.Mode)
 	}
@@ -314,13 +722,79 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 	}
 
 	// Here (in contrast to the s.ForceStop() above) we let the gRPC server finish
-	// its work on any pending call.
-	s.Stop()
+	// its work on any pending call, for example a NodeStageVolume which is
+	// in the middle of mkfs and mount. Kubelet kills the container when
+	// the termination grace period is over, so we must give up before that
+	// and still return normally.
+	if !s.Shutdown(csid.cfg.ShutdownTimeout) {
+		logger.Info("Pending gRPC calls did not complete in time, aborted them.", "timeout", csid.cfg.ShutdownTimeout)
+	}
 	s.Wait()
 
 	return nil
 }
 
+// pmemPercentageForNode returns the percentage stored in the node label
+// or, if the label is not set, the default.
+// nodeAPIServer connects to the apiserver and creates the event
+// recorder only when needed.
+type nodeAPIServer struct {
+	source corev1.EventSource
+
+	c           kubernetes.Interface
+	broadcaster record.EventBroadcaster
+	r           record.EventRecorder
+}
+
+func (a *nodeAPIServer) client() (kubernetes.Interface, error) {
+	if a.c == nil {
+		client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
+		if err != nil {
+			return nil, fmt.Errorf("connect to apiserver: %v", err)
+		}
+		a.c = client
+	}
+	return a.c, nil
+}
+
+func (a *nodeAPIServer) recorder() (record.EventRecorder, error) {
+	if a.r == nil {
+		client, err := a.client()
+		if err != nil {
+			return nil, err
+		}
+		a.broadcaster = record.NewBroadcaster()
+		a.broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+		a.r = a.broadcaster.NewRecorder(scheme.Scheme, a.source)
+	}
+	return a.r, nil
+}
+
+// shutdown flushes pending events.
+func (a *nodeAPIServer) shutdown() {
+	if a.broadcaster != nil {
+		a.broadcaster.Shutdown()
+	}
+}
+
+func pmemPercentageForNode(ctx context.Context, client kubernetes.Interface, nodeName, label string, defaultPercentage uint) (uint, error) {
+	logger := klog.FromContext(ctx)
+	node, err := client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("get node %s: %v", nodeName, err)
+	}
+	value, ok := node.Labels[label]
+	if !ok {
+		return defaultPercentage, nil
+	}
+	percentage, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || percentage > 100 {
+		return 0, fmt.Errorf("node label %s=%q: must be an integer between 0 and 100", label, value)
+	}
+	logger.Info("Using PMEM percentage from node label", "label", label, "percentage", percentage)
+	return uint(percentage), nil
+}
+
 // startMetrics starts the HTTPS server for the Prometheus endpoint, if one is configured.
 // Error handling is the same as for startScheduler.
 func (csid *csiDriver) startMetrics(ctx context.Context, cancel func()) (string, error) {
@@ -328,10 +802,17 @@ func (csid *csiDriver) startMetrics(ctx context.Context, cancel func()) (string,
 	mux.Handle(csid.cfg.metricsPath,
 		promhttp.InstrumentMetricHandler(
 			prometheus.DefaultRegisterer,
-			promhttp.HandlerFor(csid.gatherers, promhttp.HandlerOpts{}),
+			// OpenMetrics is needed for exemplars.
+			promhttp.HandlerFor(csid.gatherers, promhttp.HandlerOpts{EnableOpenMetrics: true}),
 		),
 	)
 	mux.Handle(csid.cfg.metricsPath+"/simple", promhttp.HandlerFor(simpleMetrics, promhttp.HandlerOpts{}))
+	if csid.balance != nil {
+		mux.Handle(balancePath, csid.balance)
+	}
+	if csid.volumes != nil {
+		mux.Handle(volumesPath, csid.volumes)
+	}
 	return csid.startHTTPSServer(ctx, cancel, csid.cfg.metricsListen, mux)
 }
 
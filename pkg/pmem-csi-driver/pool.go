@@ -0,0 +1,421 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+const (
+	// poolDevicePrefix is used for the names of all pool devices.
+	// Formatted devices are called
+	// <prefix><fs type>-<size in bytes>-<random suffix>, devices
+	// which are still being prepared <prefix>new-<random suffix>.
+	poolDevicePrefix = "pmem-csi-pool-"
+	poolDeviceNew    = "new"
+
+	// poolRefillInterval determines how often the pool gets
+	// checked even when no pool device was used.
+	poolRefillInterval = time.Minute
+)
+
+// VolumePool describes pre-formatted devices of one kind that the
+// node driver keeps ready for CreateVolume.
+type VolumePool struct {
+	// Size must be the exact size requested for a volume.
+	Size resource.Quantity `json:"size"`
+	// Count is the number of devices which are kept ready.
+	Count int `json:"count"`
+	// FsType is "ext4" (the default) or "xfs".
+	FsType string `json:"fsType,omitempty"`
+}
+
+// VolumePools is the configuration for all pools.
+type VolumePools []VolumePool
+
+// Set converts a JSON representation into VolumePools.
+func (v *VolumePools) Set(value string) error {
+	var pools VolumePools
+	if err := json.NewDecoder(bytes.NewBufferString(value)).Decode(&pools); err != nil {
+		return err
+	}
+	seen := map[poolKey]bool{}
+	for i, pool := range pools {
+		if pool.Size.Sign() <= 0 {
+			return fmt.Errorf("pool #%d: size must be positive", i)
+		}
+		if pool.Count < 0 {
+			return fmt.Errorf("pool #%d: negative count %d", i, pool.Count)
+		}
+		switch pool.FsType {
+		case "":
+			pools[i].FsType = defaultFilesystem
+		case "ext4", "xfs":
+		default:
+			return fmt.Errorf("pool #%d: unsupported filesystem %q", i, pool.FsType)
+		}
+		key := pools[i].key()
+		if seen[key] {
+			return fmt.Errorf("pool #%d: more than one pool for size %s and filesystem %s", i, pool.Size.String(), pools[i].FsType)
+		}
+		seen[key] = true
+	}
+	*v = pools
+	return nil
+}
+
+// String converts into the JSON representation expected by Set.
+func (v *VolumePools) String() string {
+	var value bytes.Buffer
+	if err := json.NewEncoder(&value).Encode(v); err != nil {
+		panic(err)
+	}
+	return strings.TrimSpace(value.String())
+}
+
+func (pool VolumePool) key() poolKey {
+	return poolKey{size: pool.Size.Value(), fsType: pool.FsType}
+}
+
+// poolKey identifies the devices of one pool.
+type poolKey struct {
+	size   int64
+	fsType string
+}
+
+func (key poolKey) deviceName() string {
+	return fmt.Sprintf("%s%s-%d-%s", poolDevicePrefix, key.fsType, key.size, randomSuffix())
+}
+
+// parsePoolDevice determines whether the device belongs to a pool.
+// Devices which were not formatted completely are reported with
+// an empty key.
+func parsePoolDevice(name string) (key poolKey, isPool bool) {
+	if !strings.HasPrefix(name, poolDevicePrefix) {
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(name, poolDevicePrefix), "-")
+	if len(parts) == 2 && parts[0] == poolDeviceNew {
+		return poolKey{}, true
+	}
+	if len(parts) != 3 {
+		return
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return
+	}
+	return poolKey{size: size, fsType: parts[0]}, true
+}
+
+func randomSuffix() string {
+	var buffer [4]byte
+	if _, err := rand.Read(buffer[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buffer[:])
+}
+
+// volumePool keeps pre-formatted devices ready. CreateVolume then
+// only needs to rename one of them instead of creating a device and
+// NodeStageVolume finds the file system already in place, which
+// avoids the expensive mkfs. Only device managers which can rename
+// devices support this. A nil pool is empty.
+type volumePool struct {
+	cs      *nodeControllerServer
+	renamer pmdmanager.PmemDeviceRenamer
+	pools   VolumePools
+	refill  chan struct{}
+
+	// format is makeFilesystem, replaced in tests.
+	format func(ctx context.Context, devicePath, fsType string) error
+
+	mutex     sync.Mutex
+	available map[poolKey][]string
+}
+
+// newVolumePool returns nil if no pool is configured or the device
+// manager does not support pools.
+func newVolumePool(ctx context.Context, cs *nodeControllerServer, pools VolumePools) *volumePool {
+	if len(pools) == 0 {
+		return nil
+	}
+	renamer, ok := cs.dm.(pmdmanager.PmemDeviceRenamer)
+	if !ok {
+		klog.FromContext(ctx).Info("Volume pools are not supported by the device manager, ignoring them", "device-mode", cs.dm.GetMode())
+		return nil
+	}
+	return &volumePool{
+		cs:        cs,
+		renamer:   renamer,
+		pools:     pools,
+		refill:    make(chan struct{}, 1),
+		format:    makeFilesystem,
+		available: map[poolKey][]string{},
+	}
+}
+
+// run fills the pools in the background until the context is done.
+func (vp *volumePool) run(ctx context.Context) {
+	ctx, logger := pmemlog.WithName(ctx, "volume-pool")
+	if err := vp.init(ctx); err != nil {
+		logger.Error(err, "Initializing volume pools failed, using them anyway")
+	}
+	go func() {
+		ticker := time.NewTicker(poolRefillInterval)
+		defer ticker.Stop()
+		for {
+			vp.fill(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-vp.refill:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// init finds pool devices from a previous run. Devices which were
+// not prepared completely or belong to pools which are not
+// configured anymore get deleted.
+func (vp *volumePool) init(ctx context.Context) error {
+	logger := klog.FromContext(ctx)
+	devices, err := vp.cs.dm.ListDevices(ctx)
+	if err != nil {
+		return fmt.Errorf("list devices: %v", err)
+	}
+	configured := map[poolKey]bool{}
+	for _, pool := range vp.pools {
+		configured[pool.key()] = true
+	}
+
+	vp.mutex.Lock()
+	defer vp.mutex.Unlock()
+	for _, device := range devices {
+		key, isPool := parsePoolDevice(device.VolumeId)
+		if !isPool {
+			continue
+		}
+		if configured[key] {
+			vp.available[key] = append(vp.available[key], device.VolumeId)
+			continue
+		}
+		logger.V(3).Info("Deleting unused pool device", "device", device.VolumeId)
+		if err := vp.cs.dm.DeleteDevice(ctx, device.VolumeId, false); err != nil {
+			logger.Error(err, "Deleting pool device failed", "device", device.VolumeId)
+		}
+		vp.cs.capacity.invalidate()
+	}
+	return nil
+}
+
+// fill creates devices until all pools have the configured number
+// of devices or space runs out.
+func (vp *volumePool) fill(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	for _, pool := range vp.pools {
+		key := pool.key()
+		for {
+			vp.mutex.Lock()
+			missing := pool.Count - len(vp.available[key])
+			vp.mutex.Unlock()
+			if missing <= 0 || ctx.Err() != nil {
+				break
+			}
+			name, err := vp.create(ctx, key)
+			if err != nil {
+				// Try again later, space may have become
+				// available by then.
+				logger.V(3).Info("Cannot add device to volume pool", "size", pmemlog.CapacityRef(key.size), "fs-type", key.fsType, "missing", missing, "reason", err.Error())
+				break
+			}
+			vp.mutex.Lock()
+			vp.available[key] = append(vp.available[key], name)
+			vp.mutex.Unlock()
+			logger.V(4).Info("Added device to volume pool", "device", name, "size", pmemlog.CapacityRef(key.size), "fs-type", key.fsType)
+		}
+	}
+}
+
+// create allocates and formats a new pool device under a temporary
+// name, then gives it the final name. A device that still has the
+// temporary name after a crash is known to be incomplete.
+func (vp *volumePool) create(ctx context.Context, key poolKey) (finalName string, finalErr error) {
+	name := poolDevicePrefix + poolDeviceNew + "-" + randomSuffix()
+	release, err := vp.cs.limiter.acquire(ctx, "create pool device")
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	_, err = vp.cs.dm.CreateDevice(ctx, name, uint64(key.size), parameters.UsageAppDirect)
+	vp.cs.capacity.invalidate()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if finalErr != nil {
+			if err := vp.cs.dm.DeleteDevice(ctx, name, false); err != nil {
+				klog.FromContext(ctx).Error(err, "Deleting incomplete pool device failed", "device", name)
+			}
+			vp.cs.capacity.invalidate()
+		}
+	}()
+	device, err := vp.cs.dm.GetDevice(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if err := vp.format(ctx, device.Path, key.fsType); err != nil {
+		return "", err
+	}
+	finalName = key.deviceName()
+	if err := vp.renamer.RenameDevice(ctx, name, finalName); err != nil {
+		return "", err
+	}
+	return finalName, nil
+}
+
+// take turns a pool device into the device for the volume if the
+// volume can use it. It returns the size of the device and true if
+// it did that.
+func (vp *volumePool) take(ctx context.Context, volumeID string, size int64, p parameters.Volume, volumeCapabilities []*csi.VolumeCapability) (uint64, bool) {
+	if vp == nil {
+		return 0, false
+	}
+	key, ok := poolKeyForVolume(size, p, volumeCapabilities)
+	if !ok {
+		return 0, false
+	}
+	logger := klog.FromContext(ctx)
+
+	vp.mutex.Lock()
+	names := vp.available[key]
+	if len(names) == 0 {
+		vp.mutex.Unlock()
+		return 0, false
+	}
+	name := names[len(names)-1]
+	vp.available[key] = names[:len(names)-1]
+	vp.mutex.Unlock()
+
+	// Refill asynchronously.
+	select {
+	case vp.refill <- struct{}{}:
+	default:
+	}
+
+	if err := vp.renamer.RenameDevice(ctx, name, volumeID); err != nil {
+		logger.Error(err, "Using pool device failed, creating a new device", "device", name)
+		if err := vp.cs.dm.DeleteDevice(ctx, name, false); err != nil {
+			logger.Error(err, "Deleting pool device failed", "device", name)
+		}
+		vp.cs.capacity.invalidate()
+		return 0, false
+	}
+	logger.V(3).Info("Using pool device for volume", "device", name)
+	if device, err := vp.cs.dm.GetDevice(ctx, volumeID); err == nil {
+		return device.Size, true
+	}
+	return uint64(key.size), true
+}
+
+// reserved returns the total size of all devices in the pools and
+// the size of the largest one. That space counts as available
+// because a volume gets either a pool device or, if it cannot use
+// one, the pools get drained.
+func (vp *volumePool) reserved() (total, largest uint64) {
+	if vp == nil {
+		return 0, 0
+	}
+	vp.mutex.Lock()
+	defer vp.mutex.Unlock()
+	for key, names := range vp.available {
+		size := uint64(key.size)
+		total += size * uint64(len(names))
+		if len(names) > 0 && size > largest {
+			largest = size
+		}
+	}
+	return total, largest
+}
+
+// drain deletes all devices in the pools. It returns true if that
+// freed some space.
+func (vp *volumePool) drain(ctx context.Context) bool {
+	if vp == nil {
+		return false
+	}
+	logger := klog.FromContext(ctx)
+	vp.mutex.Lock()
+	available := vp.available
+	vp.available = map[poolKey][]string{}
+	vp.mutex.Unlock()
+
+	freed := false
+	for _, names := range available {
+		for _, name := range names {
+			logger.V(3).Info("Deleting pool device to make space for a volume", "device", name)
+			if err := vp.cs.dm.DeleteDevice(ctx, name, false); err != nil {
+				logger.Error(err, "Deleting pool device failed", "device", name)
+				continue
+			}
+			freed = true
+		}
+	}
+	if freed {
+		vp.cs.capacity.invalidate()
+	}
+	return freed
+}
+
+// poolKeyForVolume determines which pool can provide a device for
+// the volume. Pooled devices are only suitable for plain file system
+// volumes with the default usage.
+func poolKeyForVolume(size int64, p parameters.Volume, volumeCapabilities []*csi.VolumeCapability) (poolKey, bool) {
+	if p.GetUsage() != parameters.UsageAppDirect ||
+		p.GetIntegrity() ||
+		p.GetEncrypted() ||
+		p.GetZeroFill() ||
+		p.GetKataContainers() ||
+		p.GetNamespaceMode() != parameters.NamespaceModeFsdax ||
+		p.Region != nil ||
+		len(volumeCapabilities) == 0 {
+		return poolKey{}, false
+	}
+	fsType := ""
+	for i, capability := range volumeCapabilities {
+		mount := capability.GetMount()
+		if mount == nil {
+			return poolKey{}, false
+		}
+		if i > 0 && mount.GetFsType() != fsType {
+			return poolKey{}, false
+		}
+		fsType = mount.GetFsType()
+	}
+	if fsType == "" {
+		fsType = defaultFilesystem
+	}
+	return poolKey{size: size, fsType: fsType}, true
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+func TestVolumePoolsFlag(t *testing.T) {
+	var v VolumePools
+	require.NoError(t, v.Set(`[{"size": "4Mi", "count": 2}, {"size": "4Mi", "count": 1, "fsType": "xfs"}]`), "parse pools")
+	require.Len(t, v, 2, "pools")
+	assert.Equal(t, poolKey{size: 4 * 1024 * 1024, fsType: "ext4"}, v[0].key(), "default file system")
+
+	assert.Error(t, v.Set(`[{"size": "0", "count": 1}]`), "zero size")
+	assert.Error(t, v.Set(`[{"size": "4Mi", "count": -1}]`), "negative count")
+	assert.Error(t, v.Set(`[{"size": "4Mi", "count": 1, "fsType": "btrfs"}]`), "unsupported file system")
+	assert.Error(t, v.Set(`[{"size": "4Mi", "count": 1}, {"size": "4Mi", "count": 1, "fsType": "ext4"}]`), "duplicate pool")
+}
+
+func TestParsePoolDevice(t *testing.T) {
+	key := poolKey{size: 4 * 1024 * 1024, fsType: "xfs"}
+	parsed, isPool := parsePoolDevice(key.deviceName())
+	assert.True(t, isPool, "pool device")
+	assert.Equal(t, key, parsed, "key")
+
+	parsed, isPool = parsePoolDevice(poolDevicePrefix + poolDeviceNew + "-" + randomSuffix())
+	assert.True(t, isPool, "incomplete pool device")
+	assert.Equal(t, poolKey{}, parsed, "key of incomplete device")
+
+	_, isPool = parsePoolDevice(generateVolumeID("pvc-0"))
+	assert.False(t, isPool, "volume")
+}
+
+func TestVolumePool(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+	var pools VolumePools
+	require.NoError(t, pools.Set(`[{"size": "4Mi", "count": 2}]`), "parse pools")
+	cs.pool = newVolumePool(ctx, cs, pools)
+	require.NotNil(t, cs.pool, "pool")
+	var formatted []string
+	cs.pool.format = func(ctx context.Context, devicePath, fsType string) error {
+		formatted = append(formatted, devicePath)
+		return nil
+	}
+
+	// Left over from a previous run.
+	_, err := cs.dm.CreateDevice(ctx, poolDevicePrefix+poolDeviceNew+"-"+randomSuffix(), 4*1024*1024, parameters.UsageAppDirect)
+	require.NoError(t, err, "create incomplete device")
+	require.NoError(t, cs.pool.init(ctx), "init")
+	devices, err := cs.dm.ListDevices(ctx)
+	require.NoError(t, err, "list devices")
+	assert.Empty(t, devices, "incomplete device removed")
+
+	cs.pool.fill(ctx)
+	assert.Len(t, formatted, 2, "formatted devices")
+	assert.Len(t, cs.pool.available[pools[0].key()], 2, "available devices")
+
+	create := func(name string, size int64, fsType string) {
+		_, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}}}},
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: size},
+		})
+		require.NoError(t, err, "create volume %s", name)
+		_, err = cs.dm.GetDevice(ctx, generateVolumeID(name))
+		require.NoError(t, err, "device for volume %s", name)
+	}
+
+	// Other sizes and file systems are created normally.
+	create("pvc-0", 8*1024*1024, "")
+	create("pvc-1", 4*1024*1024, "xfs")
+	assert.Len(t, cs.pool.available[pools[0].key()], 2, "available devices after creating other volumes")
+
+	// Matching volumes use the pool.
+	create("pvc-2", 4*1024*1024, "ext4")
+	create("pvc-3", 4*1024*1024, "")
+	assert.Empty(t, cs.pool.available[pools[0].key()], "available devices after creating matching volumes")
+	select {
+	case <-cs.pool.refill:
+	default:
+		t.Fatal("refill not triggered")
+	}
+
+	// Failed formatting does not leave devices behind.
+	cs.pool.format = func(ctx context.Context, devicePath, fsType string) error {
+		return errors.New("fake mkfs failure")
+	}
+	cs.pool.fill(ctx)
+	assert.Empty(t, cs.pool.available[pools[0].key()], "available devices after failed refill")
+	devices, err = cs.dm.ListDevices(ctx)
+	require.NoError(t, err, "list devices")
+	assert.Len(t, devices, 4, "devices")
+}
+
+func TestVolumePoolCapacity(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	// 1% of the fake 1TiB, enough for two pool devices and some
+	// free space.
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 1)
+	require.NoError(t, err, "create fake device manager")
+	cs := NewNodeControllerServer(ctx, "node", dm, nil)
+	var pools VolumePools
+	require.NoError(t, pools.Set(`[{"size": "4Gi", "count": 2}]`), "parse pools")
+	cs.pool = newVolumePool(ctx, cs, pools)
+	require.NotNil(t, cs.pool, "pool")
+	cs.pool.format = func(ctx context.Context, devicePath, fsType string) error {
+		return nil
+	}
+
+	before, err := cs.GetCapacity(ctx, &csi.GetCapacityRequest{})
+	require.NoError(t, err, "get capacity before filling the pool")
+	cs.pool.fill(ctx)
+	require.Len(t, cs.pool.available[pools[0].key()], 2, "available devices")
+	free, err := dm.GetCapacity(ctx)
+	require.NoError(t, err, "get free space")
+	require.Less(t, free.MaxVolumeSize, uint64(6*1024*1024*1024), "free space after filling the pool")
+
+	// The pool does not reduce the capacity.
+	after, err := cs.GetCapacity(ctx, &csi.GetCapacityRequest{})
+	require.NoError(t, err, "get capacity after filling the pool")
+	assert.Equal(t, before.AvailableCapacity, after.AvailableCapacity, "available capacity")
+	assert.Equal(t, int64(4*1024*1024*1024), after.MaximumVolumeSize.GetValue(), "maximum volume size")
+
+	// A volume which does not fit into the free space gets it
+	// from the pool.
+	_, err = cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-large",
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 6 * 1024 * 1024 * 1024},
+	})
+	require.NoError(t, err, "create volume larger than the free space")
+	assert.Empty(t, cs.pool.available[pools[0].key()], "available devices after draining")
+}
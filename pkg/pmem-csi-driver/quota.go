@@ -0,0 +1,283 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// anyNamespace is the key in NamespaceQuota for namespaces without
+// an explicit limit.
+const anyNamespace = "*"
+
+var (
+	namespaceUsedDesc = prometheus.NewDesc(
+		"pmem_namespace_used_bytes",
+		"Total size of the PMEM volumes on the node which were provisioned for PVCs in the namespace.",
+		[]string{"namespace"}, nil,
+	)
+	namespaceQuotaDesc = prometheus.NewDesc(
+		"pmem_namespace_quota_bytes",
+		"Maximum total size of the PMEM volumes on the node for PVCs in the namespace.",
+		[]string{"namespace"}, nil,
+	)
+)
+
+// NamespaceQuota limits the total size of the volumes that get
+// provisioned on a node for the PVCs of a Kubernetes namespace. The
+// key is the namespace or "*" for all namespaces without an entry.
+type NamespaceQuota map[string]resource.Quantity
+
+// Set converts a JSON representation into a NamespaceQuota.
+func (q *NamespaceQuota) Set(value string) error {
+	var m map[string]resource.Quantity
+	if err := json.NewDecoder(bytes.NewBufferString(value)).Decode(&m); err != nil {
+		return err
+	}
+	for namespace, limit := range m {
+		if limit.Sign() < 0 {
+			return fmt.Errorf("namespace %q: negative quota %s", namespace, limit.String())
+		}
+	}
+	*q = m
+	return nil
+}
+
+// String converts into the JSON representation expected by Set.
+func (q *NamespaceQuota) String() string {
+	var value bytes.Buffer
+	if err := json.NewEncoder(&value).Encode(q); err != nil {
+		panic(err)
+	}
+	return strings.TrimSpace(value.String())
+}
+
+// limit returns the quota for the namespace in bytes. Volumes without
+// a namespace, for example ephemeral volumes or those which were
+// provisioned by an external-provisioner without
+// --extra-create-metadata, are never limited.
+func (q NamespaceQuota) limit(namespace string) (int64, bool) {
+	if namespace == "" {
+		return 0, false
+	}
+	limit, ok := q[namespace]
+	if !ok {
+		limit, ok = q[anyNamespace]
+	}
+	return limit.Value(), ok
+}
+
+// reservation is space that was granted to a volume which is still
+// being created or grown. It counts as used until the volume has its
+// final size.
+type reservation struct {
+	namespace string
+	podUID    string
+	ephemeral bool
+	size      int64
+	newVolume bool // counts against the volume limit
+}
+
+// reserve checks the volume limit and quotas and, if the request
+// fits, records it as used. Device operations can be slow, so
+// quotaMutex is only held while checking and not until the device
+// is ready. The returned function removes the reservation again and
+// must be called after the volume was added or updated or when
+// creating it failed.
+func (cs *nodeControllerServer) reserve(ctx context.Context, r *reservation) (func(), error) {
+	cs.quotaMutex.Lock()
+	defer cs.quotaMutex.Unlock()
+	if r.newVolume {
+		if err := cs.checkVolumeLimit(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err := cs.checkQuota(r.namespace, r.size); err != nil {
+		return nil, err
+	}
+	if r.ephemeral {
+		if err := cs.checkEphemeralQuota(r.podUID, r.size); err != nil {
+			return nil, err
+		}
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if cs.reservations == nil {
+		cs.reservations = map[*reservation]bool{}
+	}
+	cs.reservations[r] = true
+	return func() {
+		cs.mutex.Lock()
+		defer cs.mutex.Unlock()
+		delete(cs.reservations, r)
+	}, nil
+}
+
+// namespaceUsage returns the total size of all volumes per
+// namespace, including reservations.
+func (cs *nodeControllerServer) namespaceUsage() map[string]int64 {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	usage := map[string]int64{}
+	for _, vol := range cs.pmemVolumes {
+		if namespace := vol.Params[parameters.PVCNamespace]; namespace != "" {
+			usage[namespace] += vol.Size
+		}
+	}
+	for r := range cs.reservations {
+		if r.namespace != "" {
+			usage[r.namespace] += r.size
+		}
+	}
+	return usage
+}
+
+// checkQuota returns a ResourceExhausted error if a new volume of the
+// given size would exceed the quota of its namespace. The caller must
+// hold quotaMutex.
+func (cs *nodeControllerServer) checkQuota(namespace string, size int64) error {
+	limit, ok := cs.quota.limit(namespace)
+	if !ok {
+		return nil
+	}
+	used := cs.namespaceUsage()[namespace]
+	if used+size > limit {
+		return status.Errorf(codes.ResourceExhausted, "quota exceeded for namespace %q on node %s: %s in use, %s requested, limit %s",
+			namespace, cs.nodeID,
+			resource.NewQuantity(used, resource.BinarySI),
+			resource.NewQuantity(size, resource.BinarySI),
+			resource.NewQuantity(limit, resource.BinarySI),
+		)
+	}
+	return nil
+}
+
+// EphemeralQuota limits the total size of the ephemeral inline
+// volumes on a node. Zero disables a limit.
+type EphemeralQuota struct {
+	// PerPod is the limit for the volumes of a single pod. Only
+	// enforced for pods with known UID, which depends on
+	// podInfoOnMount in the CSIDriver object.
+	PerPod int64
+	// PerNode is the limit for the volumes of all pods.
+	PerNode int64
+}
+
+// enabled checks whether some limit is set.
+func (q EphemeralQuota) enabled() bool {
+	return q.PerPod > 0 || q.PerNode > 0
+}
+
+// ephemeralUsage returns the total size of all ephemeral volumes
+// and of those which belong to the pod.
+func (cs *nodeControllerServer) ephemeralUsage(podUID string) (node, pod int64) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	for _, vol := range cs.pmemVolumes {
+		if vol.Params[parameters.PersistencyModel] != string(parameters.PersistencyEphemeral) {
+			continue
+		}
+		node += vol.Size
+		if podUID != "" && vol.Params[parameters.PodUID] == podUID {
+			pod += vol.Size
+		}
+	}
+	for r := range cs.reservations {
+		if !r.ephemeral {
+			continue
+		}
+		node += r.size
+		if podUID != "" && r.podUID == podUID {
+			pod += r.size
+		}
+	}
+	return
+}
+
+// checkEphemeralQuota returns a ResourceExhausted error if a new
+// ephemeral volume of the given size would exceed the quota for the
+// pod or the node. The caller must hold quotaMutex.
+func (cs *nodeControllerServer) checkEphemeralQuota(podUID string, size int64) error {
+	node, pod := cs.ephemeralUsage(podUID)
+	if limit := cs.ephemeralQuota.PerPod; limit > 0 && podUID != "" && pod+size > limit {
+		return status.Errorf(codes.ResourceExhausted, "ephemeral volume quota exceeded for pod %s on node %s: %s in use, %s requested, limit %s",
+			podUID, cs.nodeID,
+			resource.NewQuantity(pod, resource.BinarySI),
+			resource.NewQuantity(size, resource.BinarySI),
+			resource.NewQuantity(limit, resource.BinarySI),
+		)
+	}
+	if limit := cs.ephemeralQuota.PerNode; limit > 0 && node+size > limit {
+		return status.Errorf(codes.ResourceExhausted, "ephemeral volume quota exceeded on node %s: %s in use, %s requested, limit %s",
+			cs.nodeID,
+			resource.NewQuantity(node, resource.BinarySI),
+			resource.NewQuantity(size, resource.BinarySI),
+			resource.NewQuantity(limit, resource.BinarySI),
+		)
+	}
+	return nil
+}
+
+// quotaCollector reports usage and quota per namespace.
+type quotaCollector struct {
+	cs *nodeControllerServer
+}
+
+// MustRegister adds the collector to the registry, using labels to tag each sample with node and driver name.
+func (qc quotaCollector) MustRegister(reg prometheus.Registerer, nodeName, driverName string) {
+	labels := prometheus.Labels{
+		pmdmanager.NodeLabel: nodeName,
+		"driver_name":        driverName,
+	}
+	prometheus.WrapRegistererWith(labels, reg).MustRegister(qc)
+}
+
+// Describe implements prometheus.Collector.Describe.
+func (qc quotaCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- namespaceUsedDesc
+	ch <- namespaceQuotaDesc
+}
+
+// Collect implements prometheus.Collector.Collect.
+func (qc quotaCollector) Collect(ch chan<- prometheus.Metric) {
+	usage := qc.cs.namespaceUsage()
+	namespaces := make([]string, 0, len(usage))
+	for namespace := range usage {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	for _, namespace := range namespaces {
+		ch <- prometheus.MustNewConstMetric(
+			namespaceUsedDesc,
+			prometheus.GaugeValue,
+			float64(usage[namespace]),
+			namespace,
+		)
+	}
+	for namespace, limit := range qc.cs.quota {
+		ch <- prometheus.MustNewConstMetric(
+			namespaceQuotaDesc,
+			prometheus.GaugeValue,
+			float64(limit.Value()),
+			namespace,
+		)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestNamespaceQuotaFlag(t *testing.T) {
+	var q NamespaceQuota
+	require.NoError(t, q.Set(`{"team-a": "8Mi", "*": "4Mi"}`), "parse quota")
+	limit, ok := q.limit("team-a")
+	assert.True(t, ok, "team-a limited")
+	assert.Equal(t, int64(8*1024*1024), limit, "team-a limit")
+	limit, ok = q.limit("team-b")
+	assert.True(t, ok, "team-b limited")
+	assert.Equal(t, int64(4*1024*1024), limit, "default limit")
+	_, ok = q.limit("")
+	assert.False(t, ok, "volumes without namespace are not limited")
+
+	assert.Error(t, q.Set(`{"team-a": "-1Mi"}`), "negative quota")
+	assert.Error(t, q.Set(`{"team-a": "foo"}`), "invalid quantity")
+}
+
+func TestNamespaceQuota(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+	require.NoError(t, cs.quota.Set(`{"team-a": "8Mi"}`), "parse quota")
+
+	create := func(name, namespace string) error {
+		_, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+			Parameters: map[string]string{
+				parameters.PVCName:      name,
+				parameters.PVCNamespace: namespace,
+				parameters.PVName:       name,
+			},
+		})
+		return err
+	}
+
+	require.NoError(t, create("pvc-0", "team-a"), "first volume")
+	require.NoError(t, create("pvc-1", "team-a"), "second volume")
+	require.NoError(t, create("pvc-1", "team-a"), "idempotent call for existing volume")
+	err := create("pvc-2", "team-a")
+	require.Equal(t, codes.ResourceExhausted, status.Code(err), "third volume: %v", err)
+	require.NoError(t, create("pvc-3", "team-b"), "other namespace")
+	assert.Equal(t, map[string]int64{"team-a": 8 * 1024 * 1024, "team-b": 4 * 1024 * 1024}, cs.namespaceUsage(), "usage")
+
+	vol := cs.getVolumeByName("pvc-0")
+	require.NotNil(t, vol, "volume pvc-0")
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.ID})
+	require.NoError(t, err, "delete pvc-0")
+	require.NoError(t, create("pvc-2", "team-a"), "third volume after deleting the first one")
+}
+
+func TestEphemeralQuota(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+	cs.ephemeralQuota = EphemeralQuota{PerPod: 8 * 1024 * 1024, PerNode: 12 * 1024 * 1024}
+
+	create := func(name, podUID string) error {
+		ephemeral := parameters.PersistencyEphemeral
+		p := parameters.Volume{Persistency: &ephemeral}
+		if podUID != "" {
+			p.PodUID = &podUID
+		}
+		_, _, err := cs.createVolumeInternal(ctx, p, name,
+			[]*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+			&csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+		)
+		return err
+	}
+
+	require.NoError(t, create("vol-0", "pod-a"), "first volume")
+	require.NoError(t, create("vol-1", "pod-a"), "second volume")
+	err := create("vol-2", "pod-a")
+	require.Equal(t, codes.ResourceExhausted, status.Code(err), "per-pod limit: %v", err)
+	require.NoError(t, create("vol-3", "pod-b"), "other pod")
+	err = create("vol-4", "pod-c")
+	require.Equal(t, codes.ResourceExhausted, status.Code(err), "per-node limit: %v", err)
+	err = create("vol-5", "")
+	require.Equal(t, codes.ResourceExhausted, status.Code(err), "per-node limit without pod UID: %v", err)
+	_, _, err = cs.createVolumeInternal(ctx, parameters.Volume{}, "vol-6",
+		[]*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+		&csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+	)
+	require.NoError(t, err, "persistent volumes are not limited")
+}
+
+func TestQuotaReservation(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+	require.NoError(t, cs.quota.Set(`{"team-a": "8Mi"}`), "parse quota")
+	cs.ephemeralQuota = EphemeralQuota{PerNode: 8 * 1024 * 1024}
+	cs.maxVolumes = 2
+
+	// Reservations count until they are released, without
+	// holding quotaMutex while the device gets created.
+	release, err := cs.reserve(ctx, &reservation{namespace: "team-a", size: 6 * 1024 * 1024, newVolume: true})
+	require.NoError(t, err, "first reservation")
+	assert.True(t, cs.quotaMutex.TryLock(), "quotaMutex released")
+	cs.quotaMutex.Unlock()
+	assert.Equal(t, map[string]int64{"team-a": 6 * 1024 * 1024}, cs.namespaceUsage(), "usage")
+	_, err = cs.reserve(ctx, &reservation{namespace: "team-a", size: 4 * 1024 * 1024, newVolume: true})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err), "namespace quota: %v", err)
+
+	releaseEphemeral, err := cs.reserve(ctx, &reservation{ephemeral: true, size: 6 * 1024 * 1024, newVolume: true})
+	require.NoError(t, err, "ephemeral reservation")
+	_, err = cs.reserve(ctx, &reservation{namespace: "team-b", size: 1024 * 1024, newVolume: true})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err), "volume limit: %v", err)
+	releaseGrowth, err := cs.reserve(ctx, &reservation{namespace: "team-b", size: 1024 * 1024})
+	require.NoError(t, err, "growing a volume is not limited by the number of volumes")
+	releaseGrowth()
+
+	releaseEphemeral()
+	release()
+	assert.Empty(t, cs.namespaceUsage(), "usage after release")
+	_, err = cs.reserve(ctx, &reservation{namespace: "team-a", size: 8 * 1024 * 1024, newVolume: true})
+	require.NoError(t, err, "reservation after release")
+}
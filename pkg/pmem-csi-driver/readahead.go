@@ -0,0 +1,63 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"k8s.io/klog/v2"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+// readAheadSectors maps access pattern hints to the read-ahead of the
+// block device in 512 byte sectors. Large sequential reads benefit
+// from reading 4MiB ahead, random reads only pollute the page cache
+// with data that nobody asked for.
+var readAheadSectors = map[parameters.AccessPattern]int{
+	parameters.AccessPatternSequential: 8192,
+	parameters.AccessPatternRandom:     0,
+}
+
+// readAhead determines the read-ahead for a volume in 512 byte
+// sectors. Without a hint, the kernel default is used. The setting
+// only matters for I/O that goes through the page cache, so it is
+// also left alone for filesystems that are always mounted with DAX.
+// With per-file DAX, files may still use the page cache.
+func readAhead(v parameters.Volume, rawBlock bool) (sectors int, set bool, err error) {
+	pattern := v.GetAccessPattern()
+	if pattern == "" {
+		return 0, false, nil
+	}
+	sectors, ok := readAheadSectors[pattern]
+	if !ok {
+		return 0, false, fmt.Errorf("unsupported access pattern %q", pattern)
+	}
+	if !rawBlock && v.GetUsage() == parameters.UsageAppDirect && v.GetDAXMode() != parameters.DAXModeInode {
+		return 0, false, nil
+	}
+	return sectors, true, nil
+}
+
+// tuneDevice applies the access pattern hint of the volume to the
+// device, see readAhead. The setting is not persistent and thus
+// gets applied each time that a volume is staged or published.
+func tuneDevice(ctx context.Context, devicePath string, v parameters.Volume, rawBlock bool) error {
+	sectors, set, err := readAhead(v, rawBlock)
+	if err != nil || !set {
+		return err
+	}
+	pattern := v.GetAccessPattern()
+	klog.FromContext(ctx).V(3).Info("Setting read-ahead", "device", devicePath, "access-pattern", pattern, "sectors", sectors)
+	if output, err := pmemexec.RunCommand(ctx, "blockdev", "--setra", strconv.Itoa(sectors), devicePath); err != nil {
+		return fmt.Errorf("set read-ahead for access pattern %q: output:[%s] err:[%v]", pattern, output, err)
+	}
+	return nil
+}
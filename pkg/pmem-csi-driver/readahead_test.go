@@ -0,0 +1,90 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestReadAhead(t *testing.T) {
+	sequential := parameters.AccessPatternSequential
+	random := parameters.AccessPatternRandom
+	invalid := parameters.AccessPattern("linear")
+	appDirect := parameters.UsageAppDirect
+	fileIO := parameters.UsageFileIO
+	inode := parameters.DAXModeInode
+
+	testcases := map[string]struct {
+		v             parameters.Volume
+		rawBlock      bool
+		expectSectors int
+		expectSet     bool
+		expectError   bool
+	}{
+		"no hint": {
+			v: parameters.Volume{Usage: &fileIO},
+		},
+		"sequential": {
+			v:             parameters.Volume{Usage: &fileIO, AccessPattern: &sequential},
+			expectSectors: 8192,
+			expectSet:     true,
+		},
+		"random": {
+			v:         parameters.Volume{Usage: &fileIO, AccessPattern: &random},
+			expectSet: true,
+		},
+		"invalid": {
+			v:           parameters.Volume{Usage: &fileIO, AccessPattern: &invalid},
+			expectError: true,
+		},
+		"DAX": {
+			v: parameters.Volume{Usage: &appDirect, AccessPattern: &sequential},
+		},
+		"DAX by default": {
+			v: parameters.Volume{AccessPattern: &sequential},
+		},
+		"per-file DAX": {
+			v:             parameters.Volume{Usage: &appDirect, DAXMode: &inode, AccessPattern: &sequential},
+			expectSectors: 8192,
+			expectSet:     true,
+		},
+		"raw block": {
+			v:             parameters.Volume{Usage: &appDirect, AccessPattern: &sequential},
+			rawBlock:      true,
+			expectSectors: 8192,
+			expectSet:     true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			sectors, set, err := readAhead(tc.v, tc.rawBlock)
+			if tc.expectError {
+				assert.Error(t, err, "read-ahead")
+				return
+			}
+			assert.NoError(t, err, "read-ahead")
+			assert.Equal(t, tc.expectSet, set, "set read-ahead")
+			assert.Equal(t, tc.expectSectors, sectors, "sectors")
+		})
+	}
+}
+
+func TestTuneDeviceSkipped(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	sequential := parameters.AccessPatternSequential
+
+	// The device does not exist, so this only succeeds
+	// when blockdev does not get called.
+	assert.NoError(t, tuneDevice(ctx, "/dev/no-such-device", parameters.Volume{}, false), "no hint")
+	assert.NoError(t, tuneDevice(ctx, "/dev/no-such-device", parameters.Volume{AccessPattern: &sequential}, false), "DAX")
+}
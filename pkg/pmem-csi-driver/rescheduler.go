@@ -33,8 +33,13 @@ const (
 // PMEM-CSI node driver running and triggers re-scheduling of those
 // PVCs by removing the "selected node" annotation. It never
 // provisions volumes. That is handled by the node instances.
+//
+// A node only counts as having a driver when kubelet registered it
+// completely, i.e. the CSINode object lists the driver together with
+// the topology key. Otherwise the volume could be created on the node
+// but kubelet would not know how to stage it.
 func newRescheduler(ctx context.Context,
-	driverName string,
+	driverName, topologyKey string,
 	client kubernetes.Interface,
 	pvcInformer cache.SharedIndexInformer,
 	scInformer cache.SharedIndexInformer,
@@ -51,6 +56,7 @@ func newRescheduler(ctx context.Context,
 
 	pcp := &pmemCSIProvisioner{
 		driverName:    driverName,
+		topologyKey:   topologyKey,
 		nodeSelector:  nodeSelector,
 		csiNodeLister: csiNodeLister,
 	}
@@ -69,6 +75,7 @@ func newRescheduler(ctx context.Context,
 
 type pmemCSIProvisioner struct {
 	driverName          string
+	topologyKey         string
 	nodeSelector        types.NodeSelector
 	csiNodeLister       storagelistersv1.CSINodeLister
 	provisionController *controller.ProvisionController
@@ -98,7 +105,7 @@ func (pcp *pmemCSIProvisioner) startRescheduler(ctx context.Context, cancel func
 func (pcp *pmemCSIProvisioner) ShouldProvision(ctx context.Context, pvc *v1.PersistentVolumeClaim) bool {
 	l := klog.FromContext(ctx)
 
-	reschedule, err := pcp.shouldReschedule(ctx, pvc, nil)
+	reschedule, _, err := pcp.shouldReschedule(ctx, pvc, nil)
 	if err != nil {
 		// Something went wrong. We have to allow the lib to
 		// start working on this PVC, otherwise users will
@@ -113,13 +120,13 @@ func (pcp *pmemCSIProvisioner) ShouldProvision(ctx context.Context, pvc *v1.Pers
 // Despite the name, the only outcome is "no change" (= leave PVC unmodified)
 // or "reschedule" (= remove selected node annotation).
 func (pcp *pmemCSIProvisioner) Provision(ctx context.Context, opts controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
-	reschedule, err := pcp.shouldReschedule(ctx, opts.PVC, opts.SelectedNode)
+	reschedule, problem, err := pcp.shouldReschedule(ctx, opts.PVC, opts.SelectedNode)
 	if err != nil {
 		return nil, controller.ProvisioningNoChange, fmt.Errorf("deprovision check failed: %v", err)
 	}
 	if reschedule {
-		return nil, controller.ProvisioningReschedule, fmt.Errorf("reschedule PVC %s/%s because it is assigned to node %s which has no PMEM-CSI driver",
-			opts.PVC.Namespace, opts.PVC.Name, opts.SelectedNode.Name)
+		return nil, controller.ProvisioningReschedule, fmt.Errorf("reschedule PVC %s/%s because it is assigned to node %s which has no usable PMEM-CSI driver: %s",
+			opts.PVC.Namespace, opts.PVC.Name, opts.SelectedNode.Name, problem)
 	}
 	if opts.SelectedNode != nil {
 		err = &controller.IgnoredError{
@@ -149,7 +156,10 @@ func (pcp *pmemCSIProvisioner) SupportsBlock(context.Context) bool {
 	return true
 }
 
-func (pcp *pmemCSIProvisioner) shouldReschedule(ctx context.Context, pvc *v1.PersistentVolumeClaim, node *v1.Node) (bool, error) {
+// shouldReschedule returns true if the PVC must be moved away from
+// its selected node. In that case the string explains what is wrong
+// with the node.
+func (pcp *pmemCSIProvisioner) shouldReschedule(ctx context.Context, pvc *v1.PersistentVolumeClaim, node *v1.Node) (bool, string, error) {
 	l := klog.FromContext(ctx).WithName("ShouldReschedulePVC").WithValues("pvc", pmemlog.KObj(pvc))
 	if node != nil {
 		l = l.WithValues("node", pmemlog.KObj(node))
@@ -163,7 +173,7 @@ func (pcp *pmemCSIProvisioner) shouldReschedule(ctx context.Context, pvc *v1.Per
 	if selectedNode == "" {
 		// No need to reschedule.
 		l.V(5).Info("no need to reschedule, no selected node")
-		return false, nil
+		return false, "", nil
 	}
 
 	// We have to be absolutely certain that the PVC is not going
@@ -189,35 +199,45 @@ func (pcp *pmemCSIProvisioner) shouldReschedule(ctx context.Context, pvc *v1.Per
 	// Only when the extensions are off, then Provision() may get
 	// called more often. Such a cluster setup should better be
 	// avoided.
-	driverIsRunning := false
+	var problem string
 	csiNode, err := pcp.csiNodeLister.Get(selectedNode)
 	switch {
 	case err == nil:
-		driverIsRunning = hasDriver(csiNode, pcp.driverName)
+		problem = registrationProblem(csiNode, pcp.driverName, pcp.topologyKey)
 	case apierrs.IsNotFound(err):
-		driverIsRunning = false
+		problem = "no CSINode object"
 	default:
-		return false, fmt.Errorf("retrieve CSINode %s: %v", selectedNode, err)
+		return false, "", fmt.Errorf("retrieve CSINode %s: %v", selectedNode, err)
 	}
+	driverIsRunning := problem == ""
 	if node == nil {
 		// Decide only based on CSINode.
 		reschedule := !driverIsRunning
-		l.V(3).Info("result", "reschedule", reschedule, "driverIsRunning", driverIsRunning)
-		return reschedule, nil
+		l.V(3).Info("result", "reschedule", reschedule, "driverIsRunning", driverIsRunning, "problem", problem)
+		return reschedule, problem, nil
 	}
 
 	driverMightRun := pcp.nodeSelector.MatchesLabels(node.Labels)
 
 	reschedule := !driverMightRun && !driverIsRunning
-	l.V(3).Info("result", "reschedule", reschedule, "driverMightRun", driverMightRun, "driverIsRunning", driverIsRunning)
-	return reschedule, nil
+	l.V(3).Info("result", "reschedule", reschedule, "driverMightRun", driverMightRun, "driverIsRunning", driverIsRunning, "problem", problem)
+	return reschedule, problem, nil
 }
 
-func hasDriver(csiNode *storagev1.CSINode, driverName string) bool {
+// registrationProblem checks whether kubelet has registered the
+// driver on the node with the expected topology key. It returns an
+// empty string if it has, otherwise a description of what is missing.
+func registrationProblem(csiNode *storagev1.CSINode, driverName, topologyKey string) string {
 	for _, driver := range csiNode.Spec.Drivers {
-		if driver.Name == driverName {
-			return true
+		if driver.Name != driverName {
+			continue
 		}
+		for _, key := range driver.TopologyKeys {
+			if key == topologyKey {
+				return ""
+			}
+		}
+		return fmt.Sprintf("driver %s registered without topology key %s", driverName, topologyKey)
 	}
-	return false
+	return fmt.Sprintf("driver %s not registered in CSINode", driverName)
 }
@@ -25,9 +25,11 @@ type testcase struct {
 	driverName    string
 	haveCSIDriver bool
 	haveCSINode   bool
-	selectedNode  string
-	nodeLabels    map[string]string
-	nodeSelector  types.NodeSelector
+	// missingTopologyKey simulates an incomplete registration.
+	missingTopologyKey bool
+	selectedNode       string
+	nodeLabels         map[string]string
+	nodeSelector       types.NodeSelector
 
 	expectError                bool
 	expectReschedulePreCheck   bool
@@ -39,6 +41,7 @@ const (
 	nodeLabelName  = "storage"
 	nodeLabelValue = "pmem"
 	nodeName       = "pmem-worker"
+	topologyKey    = driverName + "/node"
 )
 
 func TestRescheduler(t *testing.T) {
@@ -100,6 +103,36 @@ func TestRescheduler(t *testing.T) {
 			expectReschedulePreCheck:   true,
 			expectRescheduleFinalCheck: false,
 		},
+		"missing-topology-key": {
+			driverName:         driverName,
+			haveCSIDriver:      true,
+			haveCSINode:        true,
+			missingTopologyKey: true,
+			selectedNode:       nodeName,
+			nodeSelector: types.NodeSelector{
+				nodeLabelName: nodeLabelValue,
+			},
+			nodeLabels: map[string]string{
+				nodeLabelName: nodeLabelValue,
+			},
+
+			expectReschedulePreCheck:   true,
+			expectRescheduleFinalCheck: false,
+		},
+		"reschedule-missing-topology-key": {
+			driverName:         driverName,
+			haveCSIDriver:      true,
+			haveCSINode:        true,
+			missingTopologyKey: true,
+			selectedNode:       nodeName,
+			nodeSelector: types.NodeSelector{
+				nodeLabelName: nodeLabelValue,
+			},
+			nodeLabels: map[string]string{},
+
+			expectReschedulePreCheck:   true,
+			expectRescheduleFinalCheck: true,
+		},
 		"missing-node-labels": {
 			driverName:    driverName,
 			haveCSIDriver: true,
@@ -133,11 +166,13 @@ func TestRescheduler(t *testing.T) {
 			_, ctx := ktesting.NewTestContext(t)
 			pcp := pmemCSIProvisioner{
 				driverName:   driverName,
+				topologyKey:  topologyKey,
 				nodeSelector: tc.nodeSelector,
 				csiNodeLister: fakeCSINodeLister{
-					driverName:    tc.driverName,
-					haveCSIDriver: tc.haveCSIDriver,
-					haveCSINode:   tc.haveCSINode,
+					driverName:         tc.driverName,
+					haveCSIDriver:      tc.haveCSIDriver,
+					haveCSINode:        tc.haveCSINode,
+					missingTopologyKey: tc.missingTopologyKey,
 				},
 			}
 
@@ -205,9 +240,10 @@ func TestRescheduler(t *testing.T) {
 }
 
 type fakeCSINodeLister struct {
-	driverName    string
-	haveCSIDriver bool
-	haveCSINode   bool
+	driverName         string
+	haveCSIDriver      bool
+	haveCSINode        bool
+	missingTopologyKey bool
 }
 
 func (f fakeCSINodeLister) Get(nodeName string) (*storagev1.CSINode, error) {
@@ -217,9 +253,11 @@ func (f fakeCSINodeLister) Get(nodeName string) (*storagev1.CSINode, error) {
 	csiNode := &storagev1.CSINode{}
 	csiNode.Name = nodeName
 	if f.haveCSIDriver {
-		csiNode.Spec.Drivers = []storagev1.CSINodeDriver{
-			{Name: f.driverName},
+		driver := storagev1.CSINodeDriver{Name: f.driverName}
+		if !f.missingTopologyKey {
+			driver.TopologyKeys = []string{topologyKey}
 		}
+		csiNode.Spec.Drivers = []storagev1.CSINodeDriver{driver}
 	}
 	return csiNode, nil
 }
@@ -0,0 +1,67 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/kubernetes-csi/csi-test/v5/pkg/sanity"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	grpcserver "github.com/intel/pmem-csi/pkg/grpc-server"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// sanitySkip lists csi-sanity tests which need a real device: volumes
+// of the fake device manager cannot be formatted and mounted. The
+// e2e sanity tests cover those on a real cluster.
+var sanitySkip = []string{
+	`Node Service should work`,
+	`Node Service should be idempotent`,
+}
+
+// TestSanity runs the csi-sanity suite against the identity, node
+// and node controller services, with the fake device manager and a
+// local unix socket. It catches CSI spec violations without a
+// cluster.
+func TestSanity(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tmp := t.TempDir()
+	endpoint := "unix://" + filepath.Join(tmp, "csi.sock")
+
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100)
+	require.NoError(t, err, "create fake device manager")
+	cs := NewNodeControllerServer(ctx, nodeName, dm, nil)
+	ns := NewNodeServer(cs, filepath.Join(tmp, "mount"))
+	ids := NewIdentityServer(driverName, "sanity", cs.caps)
+
+	s := grpcserver.NewNonBlockingGRPCServer()
+	require.NoError(t, s.Start(ctx, endpoint, "", nil, nil, ids, ns, cs), "start gRPC server")
+	defer func() {
+		s.ForceStop()
+		s.Wait()
+	}()
+
+	config := sanity.NewTestConfig()
+	config.Address = endpoint
+	config.TargetPath = filepath.Join(tmp, "target")
+	config.StagingPath = filepath.Join(tmp, "staging")
+	sanity.GinkgoTest(&config)
+
+	suiteConfig, reporterConfig := ginkgo.GinkgoConfiguration()
+	suiteConfig.SkipStrings = append(suiteConfig.SkipStrings, sanitySkip...)
+	gomega.RegisterFailHandler(ginkgo.Fail)
+	ginkgo.RunSpecs(t, "CSI sanity with fake device manager", suiteConfig, reporterConfig)
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemcapacity "github.com/intel/pmem-csi/pkg/pmem-capacity"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+// pvsOnNode returns the names of the PVs of the driver which are
+// located on the node.
+func pvsOnNode(ctx context.Context, client kubernetes.Interface, driverName, nodeName string) ([]string, error) {
+	pvs, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list PVs: %v", err)
+	}
+	var names []string
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			continue
+		}
+		if pmemcapacity.VolumeNode(pv, DriverTopologyKey) == nodeName {
+			names = append(names, pv.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// uninstall removes everything that the node driver created on the
+// node: volumes, the LVM setup and the state directory. It refuses
+// to do that while PVs still refer to volumes on the node unless
+// force is set, in which case those volumes get erased and deleted
+// anyway. Calling it again after a failure or a successful run is
+// safe.
+//
+// The device mode is not needed because volumes are found through
+// the state, which records the mode of each volume, and LVM volume
+// groups only exist when LVM mode was used.
+func uninstall(ctx context.Context, client kubernetes.Interface, driverName, nodeName, statePath string, force bool) error {
+	logger := klog.FromContext(ctx).WithName("uninstall")
+
+	pvs, err := pvsOnNode(ctx, client, driverName, nodeName)
+	if err != nil {
+		return err
+	}
+	if len(pvs) > 0 {
+		if !force {
+			return fmt.Errorf("%d PV(s) still use volumes on node %s, delete them first or force the removal: %s",
+				len(pvs), nodeName, strings.Join(pvs, ", "))
+		}
+		logger.Info("Forced removal, deleting volumes of existing PVs", "pvs", pvs)
+	}
+
+	// Percentage zero: only use the existing PMEM setup.
+	dms := map[api.DeviceMode]pmdmanager.PmemDeviceManager{}
+	getDM := func(mode api.DeviceMode) (pmdmanager.PmemDeviceManager, error) {
+		if dm, ok := dms[mode]; ok {
+			return dm, nil
+		}
+		dm, err := pmdmanager.New(ctx, mode, 0)
+		if err != nil {
+			return nil, err
+		}
+		dms[mode] = dm
+		return dm, nil
+	}
+
+	// Volumes recorded in the state. In direct mode, those are the
+	// only namespaces which belong to the driver.
+	numVolumes := 0
+	if _, err := os.Stat(statePath); err == nil {
+		sm, err := pmemstate.NewFileState(statePath)
+		if err != nil {
+			return err
+		}
+		ids, err := sm.GetAll()
+		if err != nil {
+			return fmt.Errorf("load state: %v", err)
+		}
+		for _, id := range ids {
+			vol := &nodeVolume{}
+			if err := sm.Get(id, vol); err != nil {
+				return fmt.Errorf("retrieve volume %s from state: %v", id, err)
+			}
+			v, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+			if err != nil {
+				return fmt.Errorf("parse parameters of volume %s: %v", id, err)
+			}
+			dm, err := getDM(v.GetDeviceMode())
+			if err != nil {
+				return err
+			}
+			logger.Info("Erasing and deleting volume", "volume-id", id, "device-mode", v.GetDeviceMode())
+			if err := dm.DeleteDevice(ctx, id, true); err != nil {
+				return fmt.Errorf("delete volume %s: %v", id, err)
+			}
+			numVolumes++
+		}
+	}
+
+	// Everything in the volume groups of the driver belongs to
+	// it, including devices which are not in the state anymore.
+	dm, err := getDM(api.DeviceModeLVM)
+	if err != nil {
+		return err
+	}
+	devices, err := dm.ListDevices(ctx)
+	if err != nil {
+		return fmt.Errorf("list logical volumes: %v", err)
+	}
+	for _, device := range devices {
+		logger.Info("Erasing and deleting logical volume", "volume-id", device.VolumeId)
+		if err := dm.DeleteDevice(ctx, device.VolumeId, true); err != nil {
+			return fmt.Errorf("delete logical volume %s: %v", device.VolumeId, err)
+		}
+		numVolumes++
+	}
+	if err := pmdmanager.RemoveLVMSetup(ctx); err != nil {
+		return err
+	}
+
+	logger.Info("Removing state directory", "path", statePath)
+	if err := os.RemoveAll(statePath); err != nil {
+		return fmt.Errorf("remove state directory: %v", err)
+	}
+
+	if err := os.WriteFile(api.UninstallDoneFile, nil, 0644); err != nil {
+		return fmt.Errorf("create %s: %v", api.UninstallDoneFile, err)
+	}
+	logger.Info("PMEM-CSI removed from node", "deleted-volumes", numVolumes)
+	return nil
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestUninstall(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	oldKey := DriverTopologyKey
+	defer func() {
+		DriverTopologyKey = oldKey
+	}()
+	DriverTopologyKey = driverName + "/node"
+
+	newPV := func(name, driver, node string) *v1.PersistentVolume {
+		pv := &v1.PersistentVolume{}
+		pv.Name = name
+		pv.Spec.CSI = &v1.CSIPersistentVolumeSource{Driver: driver}
+		pv.Spec.NodeAffinity = &v1.VolumeNodeAffinity{
+			Required: &v1.NodeSelector{
+				NodeSelectorTerms: []v1.NodeSelectorTerm{{
+					MatchExpressions: []v1.NodeSelectorRequirement{{
+						Key:      DriverTopologyKey,
+						Operator: v1.NodeSelectorOpIn,
+						Values:   []string{node},
+					}},
+				}},
+			},
+		}
+		return pv
+	}
+	client := fake.NewSimpleClientset(
+		newPV("pv-b", driverName, nodeName),
+		newPV("pv-a", driverName, nodeName),
+		newPV("other-node", driverName, "other"),
+		newPV("other-driver", "other."+driverName, nodeName),
+	)
+
+	pvs, err := pvsOnNode(ctx, client, driverName, nodeName)
+	require.NoError(t, err, "list PVs")
+	assert.Equal(t, []string{"pv-a", "pv-b"}, pvs, "PVs on node")
+
+	err = uninstall(ctx, client, driverName, nodeName, t.TempDir(), false)
+	require.Error(t, err, "uninstall with PVs")
+	assert.Contains(t, err.Error(), "pv-a, pv-b", "error message")
+}
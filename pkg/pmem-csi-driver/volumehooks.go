@@ -0,0 +1,182 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	volumeHookCreated = "created"
+	volumeHookDeleted = "deleted"
+
+	// volumeHookQueueLength limits how many notifications may be
+	// pending. When the receiver is down for a long time,
+	// additional notifications get dropped instead of blocking
+	// volume operations.
+	volumeHookQueueLength = 1000
+
+	// volumeHookTimeout is the timeout for a single POST request.
+	volumeHookTimeout = 30 * time.Second
+
+	// volumeHookRetryDelay is the initial delay before the first
+	// retry. It doubles for each further retry.
+	volumeHookRetryDelay = time.Second
+)
+
+// volumeHookEvent is the JSON payload of a volume hook POST request.
+type volumeHookEvent struct {
+	// Event is "created" or "deleted".
+	Event      string            `json:"event"`
+	Time       time.Time         `json:"time"`
+	Driver     string            `json:"driver"`
+	Node       string            `json:"node"`
+	VolumeID   string            `json:"volumeID"`
+	Size       int64             `json:"size,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+// volumeHook notifies an external system, for example an inventory
+// database, about volumes that were created or deleted. Delivery is
+// asynchronous and best-effort: failed requests are retried a
+// limited number of times, notifications are lost when the driver
+// restarts before delivering them.
+//
+// All methods may be called for a nil pointer, they do nothing in
+// that case.
+type volumeHook struct {
+	url        string
+	driverName string
+	nodeID     string
+	retries    int
+	retryDelay time.Duration
+	client     *http.Client
+	now        func() time.Time
+	events     chan volumeHookEvent
+}
+
+// validateVolumeHookURL ensures that the URL can be used for POST requests.
+func validateVolumeHookURL(hookURL string) error {
+	u, err := url.Parse(hookURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q, must be http or https", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("host missing in %q", hookURL)
+	}
+	return nil
+}
+
+func newVolumeHook(hookURL, driverName, nodeID string, retries int) *volumeHook {
+	return &volumeHook{
+		url:        hookURL,
+		driverName: driverName,
+		nodeID:     nodeID,
+		retries:    retries,
+		retryDelay: volumeHookRetryDelay,
+		client:     &http.Client{Timeout: volumeHookTimeout},
+		now:        time.Now,
+		events:     make(chan volumeHookEvent, volumeHookQueueLength),
+	}
+}
+
+// run delivers notifications until the context is canceled.
+func (vh *volumeHook) run(ctx context.Context) {
+	if vh == nil {
+		return
+	}
+	ctx, _ = pmemlog.WithName(ctx, "volumeHook")
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-vh.events:
+				vh.deliver(ctx, event)
+			}
+		}
+	}()
+}
+
+// notify queues a notification about the volume.
+func (vh *volumeHook) notify(ctx context.Context, eventType string, vol *nodeVolume) {
+	if vh == nil {
+		return
+	}
+	event := volumeHookEvent{
+		Event:      eventType,
+		Time:       vh.now(),
+		Driver:     vh.driverName,
+		Node:       vh.nodeID,
+		VolumeID:   vol.ID,
+		Size:       vol.Size,
+		Parameters: vol.Params,
+	}
+	select {
+	case vh.events <- event:
+	default:
+		klog.FromContext(ctx).Error(nil, "Too many pending volume hook notifications, dropping one", "event", eventType, "volume-id", vol.ID)
+	}
+}
+
+// deliver sends one notification, with retries.
+func (vh *volumeHook) deliver(ctx context.Context, event volumeHookEvent) {
+	logger := klog.FromContext(ctx).WithValues("event", event.Event, "volume-id", event.VolumeID)
+	delay := vh.retryDelay
+	for attempt := 0; ; attempt++ {
+		err := vh.post(ctx, event)
+		if err == nil {
+			logger.V(5).Info("Delivered volume hook notification")
+			return
+		}
+		if attempt >= vh.retries {
+			logger.Error(err, "Volume hook notification failed, giving up", "attempts", attempt+1)
+			return
+		}
+		logger.V(3).Info("Volume hook notification failed, retrying", "reason", err.Error(), "delay", delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (vh *volumeHook) post(ctx context.Context, event volumeHookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("encode event: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, vh.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := vh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response status %q", resp.Status)
+	}
+	return nil
+}
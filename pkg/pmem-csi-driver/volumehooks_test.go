@@ -0,0 +1,80 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestVolumeHook(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The first request fails, which must trigger a retry.
+	var failures int32 = 1
+	received := make(chan volumeHookEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event volumeHookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- event
+	}))
+	defer server.Close()
+
+	cs := newFakeNodeControllerServer(ctx, t)
+	cs.hook = newVolumeHook(server.URL, driverName, nodeName, 1)
+	cs.hook.retryDelay = time.Millisecond
+	cs.hook.run(ctx)
+
+	createVolumes(ctx, t, cs, 0, 1)
+	vol := cs.getVolumeByName("pvc-0")
+	require.NotNil(t, vol, "created volume")
+	_, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.ID})
+	require.NoError(t, err, "delete volume")
+
+	for _, expected := range []string{volumeHookCreated, volumeHookDeleted} {
+		select {
+		case event := <-received:
+			assert.Equal(t, expected, event.Event, "event type")
+			assert.Equal(t, vol.ID, event.VolumeID, "volume ID")
+			assert.Equal(t, vol.Size, event.Size, "size")
+			assert.Equal(t, driverName, event.Driver, "driver name")
+			assert.Equal(t, nodeName, event.Node, "node name")
+		case <-time.After(10 * time.Second):
+			require.FailNow(t, "timed out waiting for event", expected)
+		}
+	}
+}
+
+func TestValidateVolumeHookURL(t *testing.T) {
+	assert.NoError(t, validateVolumeHookURL("https://inventory.example.com/pmem"), "https")
+	assert.NoError(t, validateVolumeHookURL("http://10.0.0.1:8080"), "http")
+	assert.Error(t, validateVolumeHookURL("ftp://inventory.example.com"), "ftp")
+	assert.Error(t, validateVolumeHookURL("/pmem"), "no host")
+}
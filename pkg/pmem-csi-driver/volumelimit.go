@@ -0,0 +1,48 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// checkVolumeLimit returns a ResourceExhausted error if the node
+// already has the maximum number of volumes. Without such a limit,
+// CreateVolume fails later inside the device manager, for example
+// when LVM runs out of metadata space or a region has no free
+// namespace labels, with an error that is harder to understand.
+// Reserved volumes are included. The caller must hold quotaMutex.
+func (cs *nodeControllerServer) checkVolumeLimit(ctx context.Context) error {
+	if cs.maxVolumes <= 0 {
+		return nil
+	}
+	cs.mutex.Lock()
+	volumes := len(cs.pmemVolumes)
+	for r := range cs.reservations {
+		if r.newVolume {
+			volumes++
+		}
+	}
+	cs.mutex.Unlock()
+	if volumes < cs.maxVolumes {
+		return nil
+	}
+
+	klog.FromContext(ctx).V(3).Info("Volume limit reached", "volumes", volumes, "max-volumes", cs.maxVolumes)
+	if cs.recorder != nil {
+		node := &corev1.ObjectReference{Kind: "Node", Name: cs.nodeID, UID: k8stypes.UID(cs.nodeID)}
+		cs.recorder.Eventf(node, corev1.EventTypeWarning, "VolumeLimitReached",
+			"node has %d PMEM-CSI volumes, no more volumes can be created (-maxVolumesPerNode=%d)", volumes, cs.maxVolumes)
+	}
+	return status.Errorf(codes.ResourceExhausted, "node %s already has the maximum number of %d volumes", cs.nodeID, cs.maxVolumes)
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestVolumeLimit(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeNodeControllerServer(ctx, t)
+	cs.maxVolumes = 2
+	recorder := record.NewFakeRecorder(10)
+	cs.recorder = recorder
+
+	create := func(name string) error {
+		_, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 4 * 1024 * 1024},
+		})
+		return err
+	}
+
+	require.NoError(t, create("pvc-0"), "first volume")
+	require.NoError(t, create("pvc-1"), "second volume")
+	require.NoError(t, create("pvc-1"), "idempotent call for existing volume")
+	err := create("pvc-2")
+	require.Error(t, err, "third volume")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "status code")
+	assert.Nil(t, cs.getVolumeByName("pvc-2"), "volume must not exist")
+	select {
+	case event := <-recorder.Events:
+		assert.Contains(t, event, "VolumeLimitReached", "event")
+	default:
+		t.Error("no event")
+	}
+
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: generateVolumeID("pvc-0")})
+	require.NoError(t, err, "delete volume")
+	require.NoError(t, create("pvc-2"), "volume after deleting another one")
+}
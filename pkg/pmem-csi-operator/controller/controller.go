@@ -9,9 +9,12 @@ package controller
 import (
 	"context"
 
+	"github.com/intel/pmem-csi/pkg/hostpaths"
 	"github.com/intel/pmem-csi/pkg/version"
 	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/component-base/featuregate"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
 
@@ -23,10 +26,22 @@ type ControllerOptions struct {
 	Namespace string
 	// DriverImage to use as default image for driver deployment
 	DriverImage string
+	// OpenShift is true if the cluster was detected as OpenShift
+	OpenShift bool
+	// HostLayout is the directory layout of the nodes, used for
+	// deployments which do not specify one.
+	HostLayout hostpaths.Layout
 	// Config kubernetes config used
 	Config *rest.Config
+	// APIReader reads directly from the apiserver, bypassing the
+	// cache of the manager. The controller client is used if nil.
+	APIReader client.Reader
 	// EventClient events client to use for recording events
 	EventsClient v1.EventInterface
+	// FeatureGate holds the operator features enabled for the
+	// cluster, NewFeatureGate() with the defaults if nil.
+	// Deployments can override it with the feature gates annotation.
+	FeatureGate featuregate.MutableFeatureGate
 }
 
 // AddToManagerFuncs is a list of functions to add all Controllers to the Manager
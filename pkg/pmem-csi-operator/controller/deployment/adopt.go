@@ -0,0 +1,146 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+)
+
+const (
+	// AdoptLabel marks objects of an existing installation, for
+	// example one created with the YAML files, which the
+	// PmemCSIDeployment whose name is the label value may take
+	// over instead of creating its own objects. That avoids
+	// downtime while migrating to the operator.
+	AdoptLabel = "pmem-csi.intel.com/adopt"
+
+	// AdoptAsAnnotation is needed for objects whose name is not
+	// the one that the operator would use. The value is the name
+	// used by the operator.
+	AdoptAsAnnotation = "pmem-csi.intel.com/adopt-as"
+)
+
+// mayAdopt returns true if the object is meant to be taken over by
+// the deployment.
+func (d *pmemCSIDeployment) mayAdopt(obj client.Object) bool {
+	return obj.GetLabels()[AdoptLabel] == d.Name
+}
+
+// findAdopted looks up the objects which are marked for adoption as
+// replacement for sub-objects with a different name, with one list
+// call per kind. The result is kept until the next reconcile.
+func (d *pmemCSIDeployment) findAdopted(ctx context.Context, r *ReconcileDeployment) error {
+	if d.adopted != nil {
+		return nil
+	}
+	adopted := map[string]map[string]string{}
+	for _, obj := range currentObjects {
+		gvk := obj.GetObjectKind().GroupVersionKind()
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+		opts := []client.ListOption{client.MatchingLabels{AdoptLabel: d.Name}}
+		if isNamespaced(gvk.Kind) {
+			opts = append(opts, client.InNamespace(d.namespace))
+		}
+		if err := r.client.List(ctx, list, opts...); err != nil {
+			return fmt.Errorf("list %s objects for adoption: %v", gvk.Kind, err)
+		}
+		names := map[string]string{}
+		for _, item := range list.Items {
+			as := item.GetAnnotations()[AdoptAsAnnotation]
+			if as == "" || as == item.GetName() {
+				continue
+			}
+			if other, ok := names[as]; ok {
+				return fmt.Errorf("%s objects %s and %s are both marked for adoption as %s, only one is allowed", gvk.Kind, other, item.GetName(), as)
+			}
+			names[as] = item.GetName()
+		}
+		adopted[gvk.Kind] = names
+	}
+	d.adopted = adopted
+	return nil
+}
+
+// adoptedName returns the name of the existing object which replaces
+// the sub-object of the given kind and name or, if there is none, the
+// original name. findAdopted must have been called before.
+func (d *pmemCSIDeployment) adoptedName(kind, name string) string {
+	if adopted, ok := d.adopted[kind][name]; ok {
+		return adopted
+	}
+	return name
+}
+
+// useAdoptedName renames a sub-object that is replaced by an existing
+// object.
+func (d *pmemCSIDeployment) useAdoptedName(ctx context.Context, obj client.Object) {
+	name := d.adoptedName(obj.GetObjectKind().GroupVersionKind().Kind, obj.GetName())
+	if name != obj.GetName() {
+		klog.FromContext(ctx).V(3).Info("using existing object", "object", pmemlog.KObj(obj), "adopted", name)
+		obj.SetName(name)
+	}
+}
+
+// rewriteReferences replaces references to sub-objects in the object
+// with the names of the existing objects that replace them. Otherwise
+// the generated objects would refer to objects which do not exist.
+func (d *pmemCSIDeployment) rewriteReferences(obj client.Object) {
+	if template := podTemplate(obj); template != nil {
+		d.rewritePodReferences(&template.Spec)
+	}
+	switch obj := obj.(type) {
+	case *rbacv1.RoleBinding:
+		d.rewriteRBACReferences(&obj.RoleRef, obj.Subjects)
+	case *rbacv1.ClusterRoleBinding:
+		d.rewriteRBACReferences(&obj.RoleRef, obj.Subjects)
+	}
+}
+
+func (d *pmemCSIDeployment) rewritePodReferences(spec *corev1.PodSpec) {
+	if spec.ServiceAccountName != "" {
+		spec.ServiceAccountName = d.adoptedName("ServiceAccount", spec.ServiceAccountName)
+	}
+	for i := range spec.Volumes {
+		volume := &spec.Volumes[i]
+		if volume.Secret != nil {
+			volume.Secret.SecretName = d.adoptedName("Secret", volume.Secret.SecretName)
+		}
+		if volume.ConfigMap != nil {
+			volume.ConfigMap.Name = d.adoptedName("ConfigMap", volume.ConfigMap.Name)
+		}
+	}
+}
+
+func (d *pmemCSIDeployment) rewriteRBACReferences(roleRef *rbacv1.RoleRef, subjects []rbacv1.Subject) {
+	roleRef.Name = d.adoptedName(roleRef.Kind, roleRef.Name)
+	for i := range subjects {
+		subject := &subjects[i]
+		if subject.Kind == rbacv1.ServiceAccountKind && subject.Namespace == d.namespace {
+			subject.Name = d.adoptedName("ServiceAccount", subject.Name)
+		}
+	}
+}
+
+// adopt ensures that the deployment is an owner of the object.
+func (d *pmemCSIDeployment) adopt(ctx context.Context, obj client.Object) {
+	ownerRef := d.GetOwnerReference()
+	if isOwnedBy(obj, &ownerRef) {
+		return
+	}
+	klog.FromContext(ctx).Info("adopting existing object", "object", pmemlog.KObj(obj))
+	obj.SetOwnerReferences(append(obj.GetOwnerReferences(), ownerRef))
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemcapacity "github.com/intel/pmem-csi/pkg/pmem-capacity"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// capacityRefreshInterval is how often RefreshCapacity updates the
+// capacity in the status of the known deployments.
+const capacityRefreshInterval = 5 * time.Minute
+
+// driverNameLabel is set by external-provisioner on the
+// CSIStorageCapacity objects that it maintains for the driver.
+const driverNameLabel = "csi.storage.k8s.io/drivername"
+
+// RefreshCapacity updates the capacity in the status of all known
+// deployments. Unlike Reconcile, it neither touches sub-objects nor
+// emits events and the status only gets patched when the capacity
+// has changed.
+func (r *ReconcileDeployment) RefreshCapacity(ctx context.Context) {
+	r.reconcileMutex.Lock()
+	defer r.reconcileMutex.Unlock()
+	l := klog.FromContext(ctx).WithName("capacity")
+
+	r.deploymentsMutex.Lock()
+	deployments := make([]*api.PmemCSIDeployment, 0, len(r.deployments))
+	for _, d := range r.deployments {
+		deployments = append(deployments, d.DeepCopy())
+	}
+	r.deploymentsMutex.Unlock()
+
+	for _, dep := range deployments {
+		capacity, err := r.getCapacity(ctx, dep)
+		if err != nil {
+			l.Error(err, "get capacity", "deployment", dep.Name)
+			continue
+		}
+		if equality.Semantic.DeepEqual(capacity, dep.Status.Capacity) {
+			continue
+		}
+		patched := dep.DeepCopy()
+		patched.Status.Capacity = capacity
+		if err := r.patchDeploymentStatus(patched, client.MergeFrom(dep)); err != nil {
+			l.Error(err, "update capacity", "deployment", dep.Name)
+		}
+	}
+}
+
+// getCapacity sums up the capacity that the node drivers publish in
+// CSIStorageCapacity objects. The total capacity of a node also
+// includes the existing volumes. The objects are read directly from
+// the apiserver because they are only needed occasionally, caching
+// all PVs of the cluster would not be worth it.
+func (r *ReconcileDeployment) getCapacity(ctx context.Context, dep *api.PmemCSIDeployment) (*api.CapacityStatus, error) {
+	driverName := dep.CSIDriverName()
+	capacityList := &storagev1.CSIStorageCapacityList{}
+	if err := r.apiReader.List(ctx, capacityList,
+		client.InNamespace(r.namespace),
+		client.MatchingLabels{driverNameLabel: driverName}); err != nil {
+		return nil, fmt.Errorf("list CSIStorageCapacity objects: %v", err)
+	}
+	if len(capacityList.Items) == 0 {
+		return nil, nil
+	}
+	// The label identifies the storage classes of the driver,
+	// so they don't need to be retrieved.
+	capacities := make([]*storagev1.CSIStorageCapacity, 0, len(capacityList.Items))
+	provisioners := map[string]string{}
+	for i := range capacityList.Items {
+		capacity := &capacityList.Items[i]
+		capacities = append(capacities, capacity)
+		provisioners[capacity.StorageClassName] = driverName
+	}
+
+	pvList := &corev1.PersistentVolumeList{}
+	if err := r.apiReader.List(ctx, pvList); err != nil {
+		return nil, fmt.Errorf("list PVs: %v", err)
+	}
+	pvs := make([]*corev1.PersistentVolume, 0, len(pvList.Items))
+	for i := range pvList.Items {
+		pvs = append(pvs, &pvList.Items[i])
+	}
+
+	status := &api.CapacityStatus{}
+	var totalSum, freeSum int64
+	for _, s := range pmemcapacity.BySegment(capacities, provisioners, pvs, driverName, driverName+"/node") {
+		// Segments which are not specific to a node are
+		// not part of the per-node status.
+		if s.Node == "" {
+			continue
+		}
+		status.Nodes = append(status.Nodes, api.NodeCapacity{
+			Node:  s.Node,
+			Total: *resource.NewQuantity(s.Total, resource.BinarySI),
+			Free:  *resource.NewQuantity(s.Free, resource.BinarySI),
+		})
+		totalSum += s.Total
+		freeSum += s.Free
+	}
+	if len(status.Nodes) == 0 {
+		return nil, nil
+	}
+	sort.Slice(status.Nodes, func(i, j int) bool {
+		return status.Nodes[i].Node < status.Nodes[j].Node
+	})
+	status.Total = *resource.NewQuantity(totalSum, resource.BinarySI)
+	status.Free = *resource.NewQuantity(freeSum, resource.BinarySI)
+	return status, nil
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+)
+
+// driverNameRE matches names that the CSI spec allows for drivers:
+// at most 63 characters, alphanumeric at the start and end, with
+// dashes, dots and underscores in between.
+var driverNameRE = regexp.MustCompile(`^[a-zA-Z0-9]([-a-zA-Z0-9_.]{0,61}[a-zA-Z0-9])?$`)
+
+// checkDriverName rejects deployment names which cannot be used as
+// CSI driver name. The Kubernetes object name rules alone are not
+// strict enough, they allow names with up to 253 characters.
+func checkDriverName(name string) error {
+	if !driverNameRE.MatchString(name) {
+		return fmt.Errorf("%q is not a valid CSI driver name: it must have at most 63 characters, begin and end with an alphanumeric character and contain only alphanumeric characters, dashes, dots and underscores", name)
+	}
+	return nil
+}
+
+// findNameConflict looks for another installation of a CSI driver
+// with the same name as the deployment. Only one PmemCSIDeployment
+// can have that name, but the driver might also have been installed
+// from YAML files in some other namespace or be a completely
+// different driver. Deploying a second driver would make kubelet
+// switch between them for the node service. The result is a
+// description of the conflict, empty if there is none.
+func (d *pmemCSIDeployment) findNameConflict(ctx context.Context, r *ReconcileDeployment) (string, error) {
+	ownerRef := d.GetOwnerReference()
+
+	csiDriver := &storagev1.CSIDriver{}
+	err := r.client.Get(ctx, client.ObjectKey{Name: d.CSIDriverName()}, csiDriver)
+	switch {
+	case errors.IsNotFound(err):
+	case err != nil:
+		return "", fmt.Errorf("get CSIDriver: %v", err)
+	case !isOwnedBy(csiDriver, &ownerRef) && !d.mayAdopt(csiDriver):
+		return fmt.Sprintf("CSIDriver %s already exists and was not created by this PmemCSIDeployment%s.",
+			csiDriver.Name, describeOwner(csiDriver)), nil
+	}
+
+	// The cache only has objects from the operator namespace, pods
+	// in other namespaces must come from the apiserver.
+	pods := &corev1.PodList{}
+	if err := r.apiReader.List(ctx, pods, client.MatchingLabels{
+		"app.kubernetes.io/name":     "pmem-csi-node",
+		"app.kubernetes.io/instance": d.GetName(),
+	}); err != nil {
+		return "", fmt.Errorf("list node driver pods: %v", err)
+	}
+	ourNodes := map[string]bool{}
+	otherNamespaces := map[string]bool{}
+	for _, pod := range pods.Items {
+		if pod.Namespace == d.namespace {
+			ourNodes[pod.Spec.NodeName] = true
+		} else {
+			otherNamespaces[pod.Namespace] = true
+		}
+	}
+	if len(otherNamespaces) > 0 {
+		return fmt.Sprintf("PMEM-CSI node driver pods for %s are already running in namespace(s) %s.",
+			d.GetName(), strings.Join(sortedNames(otherNamespaces), ", ")), nil
+	}
+
+	// Kubelet registrations are only unexpected before the node
+	// driver was deployed. Afterwards, they may come from
+	// restarting or terminating pods of this deployment.
+	ds := &appsv1.DaemonSet{}
+	err = r.client.Get(ctx, client.ObjectKey{Name: d.NodeDriverName(), Namespace: d.namespace}, ds)
+	switch {
+	case errors.IsNotFound(err):
+	case err != nil:
+		return "", fmt.Errorf("get node DaemonSet: %v", err)
+	default:
+		return "", nil
+	}
+	csiNodes := &storagev1.CSINodeList{}
+	if err := r.client.List(ctx, csiNodes); err != nil {
+		return "", fmt.Errorf("list CSINodes: %v", err)
+	}
+	registered := map[string]bool{}
+	for _, csiNode := range csiNodes.Items {
+		for _, driver := range csiNode.Spec.Drivers {
+			if driver.Name == d.GetName() && !ourNodes[csiNode.Name] {
+				registered[csiNode.Name] = true
+			}
+		}
+	}
+	if len(registered) > 0 {
+		return fmt.Sprintf("A CSI driver called %s is already registered by kubelet on node(s) %s.",
+			d.GetName(), strings.Join(sortedNames(registered), ", ")), nil
+	}
+	return "", nil
+}
+
+// setNameConflict updates the NameConflict condition. Like the
+// Degraded condition, it only gets added when needed.
+func (d *pmemCSIDeployment) setNameConflict(conflict string) {
+	if conflict != "" {
+		d.SetCondition(api.NameConflict, corev1.ConditionTrue, conflict)
+		return
+	}
+	for _, c := range d.Status.Conditions {
+		if c.Type == api.NameConflict {
+			d.SetCondition(api.NameConflict, corev1.ConditionFalse, "No other driver with the same name.")
+			return
+		}
+	}
+}
+
+// describeOwner helps users find the other installation.
+func describeOwner(o client.Object) string {
+	if owners := o.GetOwnerReferences(); len(owners) > 0 {
+		return fmt.Sprintf(" (owned by %s %s)", owners[0].Kind, owners[0].Name)
+	}
+	if instance := o.GetLabels()["app.kubernetes.io/instance"]; instance != "" {
+		return fmt.Sprintf(" (installed as %s)", instance)
+	}
+	return ""
+}
+
+func sortedNames(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -10,9 +10,13 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
+	"time"
 
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/driverfeatures"
+	"github.com/intel/pmem-csi/pkg/k8sutil"
 	pmemlog "github.com/intel/pmem-csi/pkg/logger"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-operator/metrics"
 	"github.com/intel/pmem-csi/pkg/types"
@@ -23,6 +27,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -30,6 +35,7 @@ import (
 	apiruntime "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/component-base/featuregate"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -65,6 +71,7 @@ var currentObjects = []client.Object{
 	&corev1.ServiceAccount{TypeMeta: typeMeta(corev1.SchemeGroupVersion, "ServiceAccount")},
 	&appsv1.Deployment{TypeMeta: typeMeta(appsv1.SchemeGroupVersion, "Deployment")},
 	&admissionregistrationv1.MutatingWebhookConfiguration{TypeMeta: typeMeta(admissionregistrationv1.SchemeGroupVersion, "MutatingWebhookConfiguration")},
+	&corev1.ConfigMap{TypeMeta: typeMeta(corev1.SchemeGroupVersion, "ConfigMap")},
 }
 
 func cloneObject(from client.Object) (client.Object, error) {
@@ -93,6 +100,8 @@ func cloneObject(from client.Object) (client.Object, error) {
 		return t.DeepCopyObject().(*appsv1.StatefulSet), nil
 	case *admissionregistrationv1.MutatingWebhookConfiguration:
 		return t.DeepCopyObject().(*admissionregistrationv1.MutatingWebhookConfiguration), nil
+	case *corev1.ConfigMap:
+		return t.DeepCopyObject().(*corev1.ConfigMap), nil
 	default:
 		return nil, fmt.Errorf("cannot clone client.Object of type %T", from)
 	}
@@ -121,7 +130,6 @@ func CurrentObjects() []client.Object {
 // The RBAC rules in deploy/kustomize/operator/operator.yaml must
 // allow listing and removing of these objects.
 var obsoleteObjects = []client.Object{
-	&corev1.ConfigMap{TypeMeta: typeMeta(corev1.SchemeGroupVersion, "ConfigMap")}, // included only for testing purposes
 	&appsv1.StatefulSet{TypeMeta: typeMeta(appsv1.SchemeGroupVersion, "StatefulSet")},
 }
 
@@ -151,6 +159,25 @@ type pmemCSIDeployment struct {
 	// operator's namespace used for creating sub-resources
 	namespace  string
 	k8sVersion version.Version
+	// openShift is the result of the cluster auto-detection.
+	openShift bool
+	// adopted maps kind and name of sub-objects to the names of
+	// existing objects which replace them, see findAdopted.
+	adopted map[string]map[string]string
+	// changedObjects contains the names of objects whose manually
+	// modified pod template was preserved.
+	changedObjects map[string]bool
+	// requeueAfter, if non-zero, asks for another reconcile
+	// after that time, for example while upgrading nodes.
+	requeueAfter time.Duration
+	// features are the operator features enabled for the deployment.
+	features featuregate.FeatureGate
+}
+
+// onOpenShift determines whether OpenShift specific objects and
+// settings are needed, the same way as deployments.LoadAndCustomizeObjects.
+func (d *pmemCSIDeployment) onOpenShift() bool {
+	return d.OnOpenShift(d.openShift)
 }
 
 func (d *pmemCSIDeployment) withStorageCapacity() bool {
@@ -168,9 +195,26 @@ func (d *pmemCSIDeployment) withStorageCapacity() bool {
 func (d *pmemCSIDeployment) reconcile(ctx context.Context, r *ReconcileDeployment) error {
 	l := klog.FromContext(ctx).WithName("reconcile")
 	l.V(3).Info("start", "deployment", d.Name, "phase", d.Status.Phase)
+	if err := d.checkVersion(); err != nil {
+		d.SetCondition(api.VersionSkew, corev1.ConditionTrue, err.Error())
+		return permanent(err)
+	}
+	if err := checkDriverName(d.Name); err != nil {
+		return permanent(err)
+	}
+	conflict, err := d.findNameConflict(ctx, r)
+	if err != nil {
+		return fmt.Errorf("check for driver name conflicts: %v", err)
+	}
+	d.setNameConflict(conflict)
+	if conflict != "" {
+		// Not permanent, the other driver might get removed.
+		d.SetCondition(api.DriverDeployed, corev1.ConditionFalse, "Not deployed because of a driver name conflict.")
+		return fmt.Errorf("driver name conflict: %s", conflict)
+	}
 	var allObjects []apiruntime.Object
 	redeployAll := func() error {
-		for name, handler := range subObjectHandlers {
+		for name, handler := range d.allSubObjectHandlers() {
 			if handler.enabled != nil && !handler.enabled(d) {
 				continue
 			}
@@ -189,6 +233,23 @@ func (d *pmemCSIDeployment) reconcile(ctx context.Context, r *ReconcileDeploymen
 	}
 
 	d.SetCondition(api.DriverDeployed, corev1.ConditionTrue, "Driver deployed successfully.")
+	d.setDegraded()
+	// Like capacity below, this is only informational.
+	if err := d.setDriverCrashed(ctx, r); err != nil {
+		l.Error(err, "check for driver crashes")
+	}
+	if err := d.upgradeNodes(ctx, r); err != nil {
+		return fmt.Errorf("upgrade node driver: %v", err)
+	}
+
+	// Capacity is purely informational, so failing to get it
+	// is not a reason to fail the reconcile. RefreshCapacity
+	// keeps it up-to-date in between.
+	if capacity, err := r.getCapacity(ctx, d.PmemCSIDeployment); err != nil {
+		l.Error(err, "update capacity")
+	} else {
+		d.Status.Capacity = capacity
+	}
 
 	l.V(3).Info("deployed", "numObjects", len(allObjects))
 	// FIXME(avalluri): Limit the obsolete object deletion either only on version upgrades
@@ -210,7 +271,12 @@ func (d *pmemCSIDeployment) getSubObject(ctx context.Context, r *ReconcileDeploy
 	l := klog.FromContext(ctx).WithName("getSubObject")
 
 	l.V(3).Info("get", "object", pmemlog.KObjWithType(objMeta))
-	if err := r.Get(obj); err != nil {
+	// Get may clear the GVK, which is needed later to identify
+	// the object, so restore it manually.
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	err = r.Get(obj)
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+	if err != nil {
 		if errors.IsNotFound(err) {
 			l.V(3).Info("not found", pmemlog.KObjWithType(objMeta))
 			return nil
@@ -218,7 +284,7 @@ func (d *pmemCSIDeployment) getSubObject(ctx context.Context, r *ReconcileDeploy
 		return err
 	}
 	ownerRef := d.GetOwnerReference()
-	if !isOwnedBy(objMeta, &ownerRef) {
+	if !isOwnedBy(objMeta, &ownerRef) && !d.mayAdopt(obj) {
 		return fmt.Errorf("'%s' of type %T is not owned by '%s'", objMeta.GetName(), obj, ownerRef.Name)
 	}
 
@@ -226,8 +292,13 @@ func (d *pmemCSIDeployment) getSubObject(ctx context.Context, r *ReconcileDeploy
 }
 
 type redeployObject struct {
-	objType    reflect.Type
-	immutable  bool
+	objType   reflect.Type
+	immutable bool
+	// recreate, if set, checks whether the changes between the
+	// existing and the desired object can only be made by
+	// deleting and re-creating the object, like for immutable
+	// objects.
+	recreate   func(existing, desired client.Object) bool
 	enabled    func(*pmemCSIDeployment) bool
 	object     func(*pmemCSIDeployment) client.Object
 	modify     func(*pmemCSIDeployment, client.Object) error
@@ -239,7 +310,8 @@ type redeployObject struct {
 //
 //  1. Retrieve the latest data saved at APIServer for that object.
 //  2. Create an objectPatch for that object to record the changes from this point.
-//  3. Call ro.modify() to modify the object's data.
+//  3. Call ro.modify() to modify the object's data, take ownership of
+//     adopted objects and apply Spec.Patches.
 //  4. Call objectPatch.Apply() to submit the chanages to the APIServer.
 //  5. If the update in step 4 was success, then call the ro.postUpdate() callback
 //     to run any post update steps.
@@ -251,6 +323,11 @@ func (d *pmemCSIDeployment) redeploy(ctx context.Context, r *ReconcileDeployment
 	if o == nil {
 		return nil, fmt.Errorf("nil object")
 	}
+	if err := d.findAdopted(ctx, r); err != nil {
+		return nil, err
+	}
+	d.useAdoptedName(ctx, o)
+	name := o.GetName()
 	l = l.WithValues("object", pmemlog.KObj(o))
 	ctx = klog.NewContext(ctx, l)
 
@@ -275,6 +352,7 @@ func (d *pmemCSIDeployment) redeploy(ctx context.Context, r *ReconcileDeployment
 	if err := ro.modify(d, o); err != nil {
 		return nil, err
 	}
+	d.rewriteReferences(o)
 
 	// ... and also the labels.
 	labels := o.GetLabels()
@@ -286,19 +364,56 @@ func (d *pmemCSIDeployment) redeploy(ctx context.Context, r *ReconcileDeployment
 	}
 	o.SetLabels(labels)
 
+	// Objects from an existing installation become ours.
+	d.adopt(ctx, o)
+
+	// Finally apply the user-provided patches.
+	if err := k8sutil.PatchObject(o, ro.objType.Elem().Name(), d.Spec.Patches, o); err != nil {
+		return nil, err
+	}
+
+	desired, err := d.desiredPodTemplate(ro, name)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := podTemplateHash(desired)
+	if err != nil {
+		return nil, err
+	}
+
 	// Now create or patch the object. If we have a resource
 	// version, then the object was retrieved from the apiserver
 	// and can be patched.
 	doPatch := o.GetResourceVersion() != ""
+	preserve := false
 	if doPatch {
+		changed, err := d.isManuallyChanged(clientObject, desired, hash)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			msg := fmt.Sprintf("pod template of %s %q was modified outside of the operator", ro.objType.Elem().Name(), name)
+			if d.Spec.PreserveManualChanges {
+				l.Info("preserving manual change of pod template")
+				r.evRecorder.Event(d.PmemCSIDeployment, corev1.EventTypeWarning, api.EventReasonManualChange, msg+", preserving it")
+				if d.changedObjects == nil {
+					d.changedObjects = map[string]bool{}
+				}
+				d.changedObjects[name] = true
+				preserve = true
+			} else {
+				l.Info("reverting manual change of pod template")
+				r.evRecorder.Event(d.PmemCSIDeployment, corev1.EventTypeWarning, api.EventReasonManualChange, msg+", reverting it")
+			}
+		}
 		data, err := patch.Data(o)
 		if err != nil {
 			return nil, fmt.Errorf("generate patch: %v", err)
 		}
 		// Check whether we really need to patch.
-		if string(data) != "{}" && len(data) >= 0 {
+		if string(data) != "{}" && !preserve {
 			l.V(5).Info("patch", "diff", string(data))
-			if ro.immutable {
+			if ro.immutable || ro.recreate != nil && ro.recreate(clientObject, o) {
 				// Delete and re-create below.
 				doPatch = false
 				o.SetResourceVersion("")
@@ -339,6 +454,7 @@ func (d *pmemCSIDeployment) redeploy(ctx context.Context, r *ReconcileDeployment
 			l.V(3).Error(err, "failed to set sub-resource metrics", "object", o)
 		}
 	}
+	d.rememberPodTemplateHash(name, hash)
 
 	// Final per-object changes, like emitting events or setting status.
 	if ro.postUpdate != nil {
@@ -362,6 +478,7 @@ var subObjectHandlers = map[string]redeployObject{
 			d.getNodeDaemonSet(o.(*appsv1.DaemonSet))
 			return nil
 		},
+		recreate: selectorChanged,
 		postUpdate: func(d *pmemCSIDeployment, o client.Object) error {
 			ds := o.(*appsv1.DaemonSet)
 			// Update node driver status is status object
@@ -553,8 +670,43 @@ var subObjectHandlers = map[string]redeployObject{
 			return nil
 		},
 	},
+	"resizer cluster role": {
+		objType: reflect.TypeOf(&rbacv1.ClusterRole{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.expansionEnabled()
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &rbacv1.ClusterRole{
+				TypeMeta:   metav1.TypeMeta{Kind: "ClusterRole", APIVersion: "rbac.authorization.k8s.io/v1"},
+				ObjectMeta: d.getObjectMeta(d.ResizerClusterRoleName(), true),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			d.getResizerClusterRole(o.(*rbacv1.ClusterRole))
+			return nil
+		},
+	},
+	"resizer cluster role binding": {
+		objType: reflect.TypeOf(&rbacv1.ClusterRoleBinding{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.expansionEnabled()
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &rbacv1.ClusterRoleBinding{
+				TypeMeta:   metav1.TypeMeta{Kind: "ClusterRoleBinding", APIVersion: "rbac.authorization.k8s.io/v1"},
+				ObjectMeta: d.getObjectMeta(d.ResizerClusterRoleBindingName(), true),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			d.getResizerClusterRoleBinding(o.(*rbacv1.ClusterRoleBinding))
+			return nil
+		},
+	},
 	"node OpenShift role binding": {
 		objType: reflect.TypeOf(&rbacv1.RoleBinding{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.onOpenShift()
+		},
 		object: func(d *pmemCSIDeployment) client.Object {
 			return &rbacv1.RoleBinding{
 				TypeMeta:   metav1.TypeMeta{Kind: "RoleBinding", APIVersion: "rbac.authorization.k8s.io/v1"},
@@ -566,6 +718,84 @@ var subObjectHandlers = map[string]redeployObject{
 			return nil
 		},
 	},
+	"viewer cluster role": {
+		objType: reflect.TypeOf(&rbacv1.ClusterRole{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.Spec.ViewerRole
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &rbacv1.ClusterRole{
+				TypeMeta:   metav1.TypeMeta{Kind: "ClusterRole", APIVersion: "rbac.authorization.k8s.io/v1"},
+				ObjectMeta: d.getObjectMeta(d.ViewerClusterRoleName(), true),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			d.getViewerClusterRole(o.(*rbacv1.ClusterRole))
+			return nil
+		},
+	},
+	"viewer role": {
+		objType: reflect.TypeOf(&rbacv1.Role{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.Spec.ViewerRole
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &rbacv1.Role{
+				TypeMeta:   metav1.TypeMeta{Kind: "Role", APIVersion: "rbac.authorization.k8s.io/v1"},
+				ObjectMeta: d.getObjectMeta(d.ViewerRoleName(), false),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			d.getViewerRole(o.(*rbacv1.Role))
+			return nil
+		},
+	},
+	"driver config": {
+		objType: reflect.TypeOf(&corev1.ConfigMap{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return len(d.Spec.DriverConfig) > 0
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &corev1.ConfigMap{
+				TypeMeta:   metav1.TypeMeta{Kind: "ConfigMap", APIVersion: "v1"},
+				ObjectMeta: d.getObjectMeta(d.DriverConfigName(), false),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			return d.getDriverConfig(o.(*corev1.ConfigMap))
+		},
+	},
+	"grafana dashboards": {
+		objType: reflect.TypeOf(&corev1.ConfigMap{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.Spec.GrafanaDashboards
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &corev1.ConfigMap{
+				TypeMeta:   metav1.TypeMeta{Kind: "ConfigMap", APIVersion: "v1"},
+				ObjectMeta: d.getObjectMeta(d.GrafanaDashboardsName(), false),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			return d.getGrafanaDashboards(o.(*corev1.ConfigMap))
+		},
+	},
+	"node setup OpenShift role binding": {
+		objType: reflect.TypeOf(&rbacv1.RoleBinding{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.onOpenShift()
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &rbacv1.RoleBinding{
+				TypeMeta:   metav1.TypeMeta{Kind: "RoleBinding", APIVersion: "rbac.authorization.k8s.io/v1"},
+				ObjectMeta: d.getObjectMeta(d.NodeSetupOpenShiftRoleBindingName(), false),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			d.getNodeSetupOpenShiftRoleBinding(o.(*rbacv1.RoleBinding))
+			return nil
+		},
+	},
 
 	"node setup cluster role": {
 		objType: reflect.TypeOf(&rbacv1.ClusterRole{}),
@@ -621,6 +851,35 @@ var subObjectHandlers = map[string]redeployObject{
 	},
 }
 
+// allSubObjectHandlers returns the static subObjectHandlers plus one
+// handler for each node configuration.
+func (d *pmemCSIDeployment) allSubObjectHandlers() map[string]redeployObject {
+	if len(d.Spec.NodeConfig) == 0 {
+		return subObjectHandlers
+	}
+	handlers := make(map[string]redeployObject, len(subObjectHandlers)+len(d.Spec.NodeConfig))
+	for name, handler := range subObjectHandlers {
+		handlers[name] = handler
+	}
+	for i := range d.Spec.NodeConfig {
+		nc := d.Spec.NodeConfig[i]
+		handlers["node driver "+nc.Name] = redeployObject{
+			objType: reflect.TypeOf(&appsv1.DaemonSet{}),
+			object: func(d *pmemCSIDeployment) client.Object {
+				return &appsv1.DaemonSet{
+					TypeMeta:   metav1.TypeMeta{Kind: "DaemonSet", APIVersion: "apps/v1"},
+					ObjectMeta: d.getObjectMeta(d.NodeConfigDriverName(nc.Name), false),
+				}
+			},
+			modify: func(d *pmemCSIDeployment, o client.Object) error {
+				d.getNodeDaemonSetFor(o.(*appsv1.DaemonSet), &nc)
+				return nil
+			},
+		}
+	}
+	return handlers
+}
+
 // HandleEvent handles the delete/update events received on sub-objects. It ensures that any undesirable change
 // is reverted.
 func (d *pmemCSIDeployment) handleEvent(ctx context.Context, metaData metav1.Object, obj apiruntime.Object, r *ReconcileDeployment) error {
@@ -628,8 +887,18 @@ func (d *pmemCSIDeployment) handleEvent(ctx context.Context, metaData metav1.Obj
 	l := klog.FromContext(ctx).WithName("deployment/event")
 	l.V(5).Info("start", "object", pmemlog.KObjWithType(metaData), "type", objType)
 
+	if err := d.checkVersion(); err != nil {
+		// Reconcile reports that, don't apply the spec.
+		l.V(3).Info("not redeploying", "reason", err)
+		return nil
+	}
+	if d.Spec.Paused {
+		l.V(3).Info("not redeploying", "reason", "paused")
+		return nil
+	}
+
 	objName := metaData.GetName()
-	for name, handler := range subObjectHandlers {
+	for name, handler := range d.allSubObjectHandlers() {
 		if handler.enabled != nil && !handler.enabled(d) {
 			continue
 		}
@@ -637,7 +906,8 @@ func (d *pmemCSIDeployment) handleEvent(ctx context.Context, metaData metav1.Obj
 			continue
 		}
 		metaObj, _ := meta.Accessor(handler.object(d))
-		if objName != metaObj.GetName() {
+		if objName != metaObj.GetName() &&
+			metaData.GetAnnotations()[AdoptAsAnnotation] != metaObj.GetName() {
 			continue
 		}
 		l.V(3).Info("redeploying", "name", name, "object", pmemlog.KObjWithType(metaData))
@@ -645,6 +915,14 @@ func (d *pmemCSIDeployment) handleEvent(ctx context.Context, metaData metav1.Obj
 		if _, err := d.redeploy(ctx, r, handler); err != nil {
 			return fmt.Errorf("failed to redeploy %s: %v", name, err)
 		}
+		if len(d.changedObjects) > 0 {
+			d.setDegraded()
+		}
+		// A crashing driver shows up as a change of the
+		// ready pods in the DaemonSet or Deployment status.
+		if err := d.setDriverCrashed(ctx, r); err != nil {
+			l.Error(err, "check for driver crashes")
+		}
 		if err := r.patchDeploymentStatus(d.PmemCSIDeployment, client.MergeFrom(org)); err != nil {
 			return fmt.Errorf("failed to update deployment CR status: %v", err)
 		}
@@ -766,6 +1044,14 @@ func (d *pmemCSIDeployment) getWebhooksRole(role *rbacv1.Role) {
 				"get", "watch", "list",
 			},
 		},
+		{
+			// For leader election between controller replicas.
+			APIGroups: []string{"coordination.k8s.io"},
+			Resources: []string{"leases"},
+			Verbs: []string{
+				"get", "watch", "list", "delete", "update", "create",
+			},
+		},
 	}
 }
 
@@ -809,12 +1095,25 @@ func (d *pmemCSIDeployment) getWebhooksClusterRole(cr *rbacv1.ClusterRole) {
 		},
 		{
 			APIGroups: []string{"storage.k8s.io"},
-			Resources: []string{"storageclasses", "csinodes"},
+			Resources: []string{"storageclasses", "csinodes", "csistoragecapacities"},
 			Verbs: []string{
 				"get", "list", "watch",
 			},
 		},
 	}
+	if d.Spec.LostNodeGracePeriod != nil {
+		// For marking and deleting PVs of removed nodes,
+		// see lostVolumeChecker.
+		verbs := []string{"patch", "update"}
+		if d.Spec.DeleteLostVolumes {
+			verbs = append(verbs, "delete")
+		}
+		cr.Rules = append(cr.Rules, rbacv1.PolicyRule{
+			APIGroups: []string{""},
+			Resources: []string{"persistentvolumes"},
+			Verbs:     verbs,
+		})
+	}
 }
 
 func (d *pmemCSIDeployment) getWebhooksClusterRoleBinding(crb *rbacv1.ClusterRoleBinding) {
@@ -883,6 +1182,97 @@ func (d *pmemCSIDeployment) getNodeOpenShiftRoleBinding(rb *rbacv1.RoleBinding)
 	}
 }
 
+// getViewerClusterRole grants read access to the cluster-scoped
+// objects that support staff needs for diagnosing problems. Everything
+// else is in the namespace of the driver, see getViewerRole.
+func (d *pmemCSIDeployment) getViewerClusterRole(cr *rbacv1.ClusterRole) {
+	readOnly := []string{"get", "list", "watch"}
+	cr.Rules = []rbacv1.PolicyRule{
+		{
+			APIGroups: []string{api.SchemeGroupVersion.Group},
+			Resources: []string{"pmemcsideployments", "pmemcsideployments/status"},
+			Verbs:     readOnly,
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"persistentvolumes", "nodes"},
+			Verbs:     readOnly,
+		},
+		{
+			APIGroups: []string{"storage.k8s.io"},
+			Resources: []string{"csidrivers", "csinodes", "storageclasses"},
+			Verbs:     readOnly,
+		},
+		{
+			APIGroups: []string{"admissionregistration.k8s.io"},
+			Resources: []string{"mutatingwebhookconfigurations"},
+			Verbs:     readOnly,
+		},
+	}
+}
+
+// getViewerRole grants read access to the objects in the namespace
+// of the driver, including pod logs and the metrics. Secrets are
+// intentionally not included.
+func (d *pmemCSIDeployment) getViewerRole(r *rbacv1.Role) {
+	readOnly := []string{"get", "list", "watch"}
+	r.Rules = []rbacv1.PolicyRule{
+		{
+			APIGroups: []string{""},
+			Resources: []string{
+				"pods", "pods/log", "services", "endpoints", "serviceaccounts", "events", "configmaps",
+			},
+			Verbs: readOnly,
+		},
+		{
+			APIGroups: []string{"apps"},
+			Resources: []string{"daemonsets", "deployments", "statefulsets"},
+			Verbs:     readOnly,
+		},
+		{
+			APIGroups: []string{"storage.k8s.io"},
+			Resources: []string{"csistoragecapacities"},
+			Verbs:     readOnly,
+		},
+		{
+			APIGroups: []string{"rbac.authorization.k8s.io"},
+			Resources: []string{"roles", "rolebindings"},
+			Verbs:     readOnly,
+		},
+		{
+			// Controller metrics.
+			APIGroups:     []string{""},
+			Resources:     []string{"services/proxy"},
+			ResourceNames: []string{d.MetricsServiceName()},
+			Verbs:         []string{"get"},
+		},
+		{
+			// Node metrics, there is no service for those.
+			APIGroups: []string{""},
+			Resources: []string{"pods/proxy"},
+			Verbs:     []string{"get"},
+		},
+	}
+}
+
+// getNodeSetupOpenShiftRoleBinding grants the privileged SCC to the
+// node setup pods, like getNodeOpenShiftRoleBinding does for the node
+// driver.
+func (d *pmemCSIDeployment) getNodeSetupOpenShiftRoleBinding(rb *rbacv1.RoleBinding) {
+	rb.Subjects = []rbacv1.Subject{
+		{
+			Kind:      "ServiceAccount",
+			Name:      d.NodeSetupServiceAccountName(),
+			Namespace: d.namespace,
+		},
+	}
+	rb.RoleRef = rbacv1.RoleRef{
+		APIGroup: "rbac.authorization.k8s.io",
+		Kind:     "ClusterRole",
+		Name:     "system:openshift:scc:privileged",
+	}
+}
+
 func (d *pmemCSIDeployment) getControllerProvisionerRoleBinding(rb *rbacv1.RoleBinding) {
 	rb.Subjects = []rbacv1.Subject{
 		{
@@ -956,6 +1346,14 @@ func (d *pmemCSIDeployment) getControllerProvisionerClusterRole(cr *rbacv1.Clust
 				"get", "list", "watch",
 			},
 		},
+		{
+			// For the node driver, see cleanupOrphanedMounts.
+			APIGroups: []string{""},
+			Resources: []string{"pods"},
+			Verbs: []string{
+				"list",
+			},
+		},
 	}
 }
 
@@ -974,6 +1372,58 @@ func (d *pmemCSIDeployment) getControllerProvisionerClusterRoleBinding(crb *rbac
 	}
 }
 
+// getResizerClusterRole has the permissions of the upstream
+// external-resizer rbac.yaml, minus access to pods because the
+// sidecar runs with --handle-volume-inuse-error=false. Leases are
+// covered by the provisioner role.
+func (d *pmemCSIDeployment) getResizerClusterRole(cr *rbacv1.ClusterRole) {
+	cr.Rules = []rbacv1.PolicyRule{
+		{
+			APIGroups: []string{""},
+			Resources: []string{"persistentvolumes"},
+			Verbs: []string{
+				"get", "list", "watch", "patch",
+			},
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"persistentvolumeclaims"},
+			Verbs: []string{
+				"get", "list", "watch",
+			},
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"persistentvolumeclaims/status"},
+			Verbs: []string{
+				"patch",
+			},
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"events"},
+			Verbs: []string{
+				"list", "watch", "create", "update", "patch",
+			},
+		},
+	}
+}
+
+func (d *pmemCSIDeployment) getResizerClusterRoleBinding(crb *rbacv1.ClusterRoleBinding) {
+	crb.Subjects = []rbacv1.Subject{
+		{
+			Kind:      "ServiceAccount",
+			Name:      d.ProvisionerServiceAccountName(),
+			Namespace: d.namespace,
+		},
+	}
+	crb.RoleRef = rbacv1.RoleRef{
+		APIGroup: "rbac.authorization.k8s.io",
+		Kind:     "ClusterRole",
+		Name:     d.ResizerClusterRoleName(),
+	}
+}
+
 func (d *pmemCSIDeployment) getControllerDeployment(ss *appsv1.Deployment) {
 	replicas := int32(d.Spec.ControllerReplicas)
 	if replicas <= 0 {
@@ -1020,16 +1470,31 @@ func (d *pmemCSIDeployment) getControllerDeployment(ss *appsv1.Deployment) {
 	}
 	ss.Spec.Template.Spec.PriorityClassName = "system-cluster-critical"
 	ss.Spec.Template.Spec.ServiceAccountName = d.GetHyphenedName() + "-webhooks"
+	ss.Spec.Template.Spec.ImagePullSecrets = d.Spec.ImagePullSecrets
 	ss.Spec.Template.Spec.Containers = []corev1.Container{
 		d.getControllerContainer(),
 	}
 	// Allow this pod to run on all nodes.
 	setTolerations(&ss.Spec.Template.Spec)
 	ss.Spec.Template.Spec.Volumes = []corev1.Volume{}
+	d.setPodSecurity(&ss.Spec.Template)
+	d.setTerminationLog(&ss.Spec.Template)
+	d.setPodMetadata(&ss.Spec.Template)
+	d.setDriverConfig(&ss.Spec.Template)
 }
 
 func (d *pmemCSIDeployment) getNodeDaemonSet(ds *appsv1.DaemonSet) {
+	d.getNodeDaemonSetFor(ds, nil)
+}
+
+// getNodeDaemonSetFor generates the DaemonSet for the nodes that are
+// selected by the node configuration or, if nil, for all nodes that
+// are not selected by any node configuration.
+func (d *pmemCSIDeployment) getNodeDaemonSetFor(ds *appsv1.DaemonSet, nc *api.NodeConfig) {
 	directoryOrCreate := corev1.HostPathDirectoryOrCreate
+	if nc != nil {
+		d = d.withNodeConfig(nc)
+	}
 
 	// To make sure that the default values set by the API server
 	// are not unset by the operator we choose to update only specific
@@ -1056,18 +1521,33 @@ func (d *pmemCSIDeployment) getNodeDaemonSet(ds *appsv1.DaemonSet) {
 			"app.kubernetes.io/instance": d.Name,
 		},
 	}
-	ds.Spec.UpdateStrategy.Type = appsv1.RollingUpdateDaemonSetStrategyType
-	if ds.Spec.UpdateStrategy.RollingUpdate == nil {
-		ds.Spec.UpdateStrategy.RollingUpdate = &appsv1.RollingUpdateDaemonSet{}
-	}
-	maxUnavailable := d.Spec.MaxUnavailable
-	if maxUnavailable == nil {
-		// nil is not the default in the DaemonSet, we have to set "1" explicitly
-		// to avoid redundant patching.
-		one := intstr.FromInt(1)
-		maxUnavailable = &one
+	if nc == nil {
+		// The pods of the other DaemonSets also have the
+		// labels above. The selector is immutable, so this
+		// is set also when there are no node configurations.
+		ds.Spec.Selector.MatchExpressions = []metav1.LabelSelectorRequirement{{
+			Key:      api.NodeConfigLabel,
+			Operator: metav1.LabelSelectorOpDoesNotExist,
+		}}
+	}
+	if d.upgrading() {
+		// upgradeNodes replaces the pods one at a time.
+		ds.Spec.UpdateStrategy.Type = appsv1.OnDeleteDaemonSetStrategyType
+		ds.Spec.UpdateStrategy.RollingUpdate = nil
+	} else {
+		ds.Spec.UpdateStrategy.Type = appsv1.RollingUpdateDaemonSetStrategyType
+		if ds.Spec.UpdateStrategy.RollingUpdate == nil {
+			ds.Spec.UpdateStrategy.RollingUpdate = &appsv1.RollingUpdateDaemonSet{}
+		}
+		maxUnavailable := d.Spec.MaxUnavailable
+		if maxUnavailable == nil {
+			// nil is not the default in the DaemonSet, we have to set "1" explicitly
+			// to avoid redundant patching.
+			one := intstr.FromInt(1)
+			maxUnavailable = &one
+		}
+		ds.Spec.UpdateStrategy.RollingUpdate.MaxUnavailable = maxUnavailable
 	}
-	ds.Spec.UpdateStrategy.RollingUpdate.MaxUnavailable = maxUnavailable
 	ds.Spec.Template.ObjectMeta.Labels = joinMaps(
 		d.Spec.Labels,
 		map[string]string{
@@ -1082,14 +1562,30 @@ func (d *pmemCSIDeployment) getNodeDaemonSet(ds *appsv1.DaemonSet) {
 	}
 	ds.Spec.Template.Spec.PriorityClassName = "system-node-critical"
 	ds.Spec.Template.Spec.ServiceAccountName = d.ProvisionerServiceAccountName()
-	ds.Spec.Template.Spec.NodeSelector = d.Spec.NodeSelector
+	ds.Spec.Template.Spec.ImagePullSecrets = d.Spec.ImagePullSecrets
+	if nc != nil {
+		ds.Spec.Selector.MatchLabels[api.NodeConfigLabel] = nc.Name
+		ds.Spec.Template.ObjectMeta.Labels[api.NodeConfigLabel] = nc.Name
+		ds.Spec.Template.Spec.NodeSelector = joinMaps(d.Spec.NodeSelector, nc.NodeSelector)
+		ds.Spec.Template.Spec.Affinity = nil
+	} else {
+		ds.Spec.Template.Spec.NodeSelector = d.Spec.NodeSelector
+		ds.Spec.Template.Spec.Affinity = d.excludeNodeConfigs()
+	}
 	ds.Spec.Template.Spec.Containers = []corev1.Container{
 		d.getNodeDriverContainer(),
 		d.getNodeRegistrarContainer(),
 		d.getProvisionerContainer(),
 	}
-	// Allow this pod to run on all master nodes.
+	if d.expansionEnabled() {
+		ds.Spec.Template.Spec.Containers = append(ds.Spec.Template.Spec.Containers, d.getResizerContainer())
+	}
+	// Allow this pod to run on all nodes selected by the node
+	// selector, including tainted control-plane nodes.
 	setTolerations(&ds.Spec.Template.Spec)
+	d.setPodSecurity(&ds.Spec.Template)
+	d.setTerminationLog(&ds.Spec.Template)
+	d.setPodMetadata(&ds.Spec.Template)
 	ds.Spec.Template.Spec.Volumes = []corev1.Volume{
 		{
 			Name: "socket-dir",
@@ -1155,6 +1651,95 @@ func (d *pmemCSIDeployment) getNodeDaemonSet(ds *appsv1.DaemonSet) {
 			},
 		},
 	}
+	ds.Spec.Template.Spec.Volumes = append(ds.Spec.Template.Spec.Volumes, d.getScratchVolumes()...)
+	d.setDriverConfig(&ds.Spec.Template)
+}
+
+// withNodeConfig returns a copy of the deployment where the
+// settings from the node configuration replace those of the spec.
+func (d *pmemCSIDeployment) withNodeConfig(nc *api.NodeConfig) *pmemCSIDeployment {
+	copy := *d
+	copy.PmemCSIDeployment = d.PmemCSIDeployment.DeepCopy()
+	if nc.DeviceMode != "" {
+		copy.Spec.DeviceMode = nc.DeviceMode
+	}
+	if nc.PMEMPercentage != 0 {
+		copy.Spec.PMEMPercentage = nc.PMEMPercentage
+	}
+	if nc.NodeDriverResources != nil {
+		copy.Spec.NodeDriverResources = nc.NodeDriverResources
+	}
+	return &copy
+}
+
+// excludeNodeConfigs returns a node affinity which keeps the default
+// node DaemonSet away from nodes that are handled by one of the node
+// configurations, nil if there are none.
+func (d *pmemCSIDeployment) excludeNodeConfigs() *corev1.Affinity {
+	if len(d.Spec.NodeConfig) == 0 {
+		return nil
+	}
+
+	// All node configurations select nodes by the same label
+	// with different values (checked by EnsureDefaults). A node
+	// does not belong to any of them if it has none of those
+	// values or if, for the configuration with its value, one of
+	// the other labels does not match. Terms are ORed,
+	// expressions inside a term are ANDed.
+	key := d.NodeConfigKey()
+	values := make([]string, 0, len(d.Spec.NodeConfig))
+	for _, nc := range d.Spec.NodeConfig {
+		values = append(values, nc.NodeSelector[key])
+	}
+	sort.Strings(values)
+	terms := []corev1.NodeSelectorTerm{{
+		MatchExpressions: []corev1.NodeSelectorRequirement{{
+			Key:      key,
+			Operator: corev1.NodeSelectorOpNotIn,
+			Values:   values,
+		}},
+	}}
+	for _, nc := range d.Spec.NodeConfig {
+		keys := make([]string, 0, len(nc.NodeSelector))
+		for other := range nc.NodeSelector {
+			if other != key {
+				keys = append(keys, other)
+			}
+		}
+		sort.Strings(keys)
+		for _, other := range keys {
+			terms = append(terms, corev1.NodeSelectorTerm{
+				MatchExpressions: []corev1.NodeSelectorRequirement{
+					{
+						Key:      key,
+						Operator: corev1.NodeSelectorOpIn,
+						Values:   []string{nc.NodeSelector[key]},
+					},
+					{
+						Key:      other,
+						Operator: corev1.NodeSelectorOpNotIn,
+						Values:   []string{nc.NodeSelector[other]},
+					},
+				},
+			})
+		}
+	}
+
+	return &corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+				NodeSelectorTerms: terms,
+			},
+		},
+	}
+}
+
+// selectorChanged checks whether the immutable selector of a
+// DaemonSet is different. This is the case for a default node
+// DaemonSet created by an operator which did not exclude the pods
+// of node configurations yet.
+func selectorChanged(existing, desired client.Object) bool {
+	return !equality.Semantic.DeepEqual(existing.(*appsv1.DaemonSet).Spec.Selector, desired.(*appsv1.DaemonSet).Spec.Selector)
 }
 
 func (d *pmemCSIDeployment) getControllerCommand() []string {
@@ -1164,17 +1749,24 @@ func (d *pmemCSIDeployment) getControllerCommand() []string {
 		fmt.Sprintf("-v=%d", d.Spec.LogLevel),
 		"-logging-format=" + string(d.Spec.LogFormat),
 		"-mode=webhooks",
+		"-leaderElection",
 		"-drivername=$(PMEM_CSI_DRIVER_NAME)",
 		"-nodeSelector=" + nodeSelector.String(),
 	}
 
 	args = append(args, fmt.Sprintf("-metricsListen=:%d", controllerMetricsPort))
+	if d.Spec.LostNodeGracePeriod != nil {
+		args = append(args, "-lostNodeGracePeriod="+d.Spec.LostNodeGracePeriod.Duration.String())
+	}
+	if d.Spec.DeleteLostVolumes {
+		args = append(args, "-deleteLostVolumes")
+	}
 
 	return args
 }
 
 func (d *pmemCSIDeployment) getNodeDriverCommand() []string {
-	return []string{
+	args := []string{
 		"/usr/local/bin/pmem-csi-driver",
 		fmt.Sprintf("-deviceManager=%s", d.Spec.DeviceMode),
 		fmt.Sprintf("-v=%d", d.Spec.LogLevel),
@@ -1187,6 +1779,24 @@ func (d *pmemCSIDeployment) getNodeDriverCommand() []string {
 		fmt.Sprintf("-pmemPercentage=%d", d.Spec.PMEMPercentage),
 		fmt.Sprintf("-metricsListen=:%d", nodeMetricsPort),
 	}
+
+	if d.Spec.PMEMPercentageNodeLabel != "" {
+		args = append(args, "-pmemPercentageLabel="+d.Spec.PMEMPercentageNodeLabel)
+	}
+	if d.Spec.DryRun {
+		args = append(args, "-dryRun")
+	}
+	if d.Spec.EphemeralQuotaPerPod != nil {
+		args = append(args, "-ephemeralQuotaPerPod="+d.Spec.EphemeralQuotaPerPod.String())
+	}
+	if d.Spec.EphemeralQuotaPerNode != nil {
+		args = append(args, "-ephemeralQuotaPerNode="+d.Spec.EphemeralQuotaPerNode.String())
+	}
+	if len(d.Spec.DriverFeatureGates) > 0 {
+		args = append(args, "-feature-gates="+driverfeatures.Format(d.Spec.DriverFeatureGates))
+	}
+
+	return args
 }
 
 func (d *pmemCSIDeployment) getControllerContainer() corev1.Container {
@@ -1194,7 +1804,7 @@ func (d *pmemCSIDeployment) getControllerContainer() corev1.Container {
 
 	c := corev1.Container{
 		Name:            "pmem-driver",
-		Image:           d.Spec.Image,
+		Image:           d.ImageReference(d.Spec.Image),
 		ImagePullPolicy: d.Spec.PullPolicy,
 		Command:         d.getControllerCommand(),
 		Env: []corev1.EnvVar{
@@ -1235,7 +1845,7 @@ func (d *pmemCSIDeployment) getNodeDriverContainer() corev1.Container {
 	root := int64(0)
 	c := corev1.Container{
 		Name:            "pmem-driver",
-		Image:           d.Spec.Image,
+		Image:           d.ImageReference(d.Spec.Image),
 		ImagePullPolicy: d.Spec.PullPolicy,
 		Command:         d.getNodeDriverCommand(),
 		Env: []corev1.EnvVar{
@@ -1264,6 +1874,8 @@ func (d *pmemCSIDeployment) getNodeDriverContainer() corev1.Container {
 				MountPropagation: &bidirectional,
 			},
 			{
+				// Kubelet chooses target paths for NodePublishVolume
+				// inside the pod directories.
 				Name:             "pods-dir",
 				MountPath:        d.Spec.KubeletDir + "/pods",
 				MountPropagation: &bidirectional,
@@ -1303,6 +1915,8 @@ func (d *pmemCSIDeployment) getNodeDriverContainer() corev1.Container {
 		StartupProbe:             getMetricsProbe(300, 1, "/simple"),
 	}
 
+	d.setScratchMounts(&c)
+
 	return c
 }
 
@@ -1310,20 +1924,20 @@ func (d *pmemCSIDeployment) getProvisionerContainer() corev1.Container {
 	true := true
 	container := corev1.Container{
 		Name:            "external-provisioner",
-		Image:           d.Spec.ProvisionerImage,
+		Image:           d.ImageReference(d.Spec.ProvisionerImage),
 		ImagePullPolicy: d.Spec.PullPolicy,
-		Args: []string{
-			fmt.Sprintf("-v=%d", d.Spec.LogLevel),
+		Args: append(d.getSidecarLogArgs(),
 			"--csi-address=/csi/csi.sock",
 			"--feature-gates=Topology=true",
 			"--node-deployment=true",
 			"--strict-topology=true",
 			"--immediate-topology=false",
+			"--extra-create-metadata=true",
 			// TODO (?): make this configurable?
 			"--timeout=5m",
 			"--default-fstype=ext4",
 			"--worker-threads=5",
-		},
+		),
 		Env: []corev1.EnvVar{
 			{
 				Name: "NODE_NAME",
@@ -1386,14 +2000,13 @@ func (d *pmemCSIDeployment) getNodeRegistrarContainer() corev1.Container {
 	true := true
 	return corev1.Container{
 		Name:            "driver-registrar",
-		Image:           d.Spec.NodeRegistrarImage,
+		Image:           d.ImageReference(d.Spec.NodeRegistrarImage),
 		ImagePullPolicy: d.Spec.PullPolicy,
-		Args: []string{
-			fmt.Sprintf("-v=%d", d.Spec.LogLevel),
-			"--kubelet-registration-path=" + d.Spec.KubeletDir + "/plugins/$(PMEM_CSI_DRIVER_NAME)/csi.sock",
+		Args: append(d.getSidecarLogArgs(),
+			"--kubelet-registration-path="+d.Spec.KubeletDir+"/plugins/$(PMEM_CSI_DRIVER_NAME)/csi.sock",
 			"--csi-address=/csi/csi.sock",
 			"--timeout=10s",
-		},
+		),
 		SecurityContext: &corev1.SecurityContext{
 			ReadOnlyRootFilesystem: &true,
 		},
@@ -1419,6 +2032,65 @@ func (d *pmemCSIDeployment) getNodeRegistrarContainer() corev1.Container {
 	}
 }
 
+// expansionEnabled checks whether the node driver runs with the
+// Expansion feature and thus needs the external resizer.
+func (d *pmemCSIDeployment) expansionEnabled() bool {
+	return d.Spec.DriverFeatureGates[string(driverfeatures.Expansion)]
+}
+
+// getResizerContainer returns the external resizer sidecar. The
+// driver only supports NodeExpandVolume, so the resizer just updates
+// the PV size without calling the driver and then kubelet grows the
+// volume on its node. That must happen only once per PVC, therefore
+// the sidecars on all nodes use leader election.
+func (d *pmemCSIDeployment) getResizerContainer() corev1.Container {
+	true := true
+	return corev1.Container{
+		Name:            "external-resizer",
+		Image:           d.ImageReference(d.Spec.ResizerImage),
+		ImagePullPolicy: d.Spec.PullPolicy,
+		Args: append(d.getSidecarLogArgs(),
+			"--csi-address=/csi/csi.sock",
+			"--leader-election=true",
+			"--handle-volume-inuse-error=false",
+			"--timeout=5m",
+		),
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      "socket-dir",
+				MountPath: "/csi",
+			},
+		},
+		SecurityContext: &corev1.SecurityContext{
+			ReadOnlyRootFilesystem: &true,
+		},
+		TerminationMessagePath:   corev1.TerminationMessagePathDefault,
+		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+	}
+}
+
+// getSidecarLogArgs returns the klog command line flags for the
+// sidecars. Without SidecarLogging, they use the same log level as
+// the driver.
+func (d *pmemCSIDeployment) getSidecarLogArgs() []string {
+	logLevel := d.Spec.LogLevel
+	sl := d.Spec.SidecarLogging
+	if sl != nil && sl.LogLevel != nil {
+		logLevel = *sl.LogLevel
+	}
+	args := []string{fmt.Sprintf("-v=%d", logLevel)}
+	if sl == nil {
+		return args
+	}
+	if sl.LogToStderr != nil {
+		args = append(args, fmt.Sprintf("--logtostderr=%t", *sl.LogToStderr))
+	}
+	if sl.StderrThreshold != "" {
+		args = append(args, "--stderrthreshold="+sl.StderrThreshold)
+	}
+	return args
+}
+
 func (d *pmemCSIDeployment) getNodeSetupClusterRole(cr *rbacv1.ClusterRole) {
 	cr.Rules = []rbacv1.PolicyRule{
 		{
@@ -1475,6 +2147,7 @@ func (d *pmemCSIDeployment) getNodeSetupDaemonSet(ds *appsv1.DaemonSet) {
 		})
 	podSpec := &ds.Spec.Template.Spec
 	podSpec.ServiceAccountName = d.NodeSetupServiceAccountName()
+	podSpec.ImagePullSecrets = d.Spec.ImagePullSecrets
 	// Allow this pod to run on all nodes.
 	setTolerations(podSpec)
 	podSpec.NodeSelector = map[string]string{
@@ -1483,6 +2156,9 @@ func (d *pmemCSIDeployment) getNodeSetupDaemonSet(ds *appsv1.DaemonSet) {
 	podSpec.Containers = []corev1.Container{
 		d.getNodeSetupContainer(),
 	}
+	d.setPodSecurity(&ds.Spec.Template)
+	d.setTerminationLog(&ds.Spec.Template)
+	d.setPodMetadata(&ds.Spec.Template)
 	podSpec.Volumes = []corev1.Volume{
 		{
 			Name: "dev-dir",
@@ -1503,6 +2179,119 @@ func (d *pmemCSIDeployment) getNodeSetupDaemonSet(ds *appsv1.DaemonSet) {
 			},
 		},
 	}
+	podSpec.Volumes = append(podSpec.Volumes, d.getScratchVolumes()...)
+}
+
+// scratchDirs are the directories which are writable in the node
+// containers when the root filesystem is read-only: the termination
+// log, lock and run files of LVM and cryptsetup, LVM metadata backups.
+var scratchDirs = []struct {
+	name, path string
+}{
+	{"tmp-dir", "/tmp"},
+	{"run-dir", "/run"},
+	{"lvm-archive-dir", "/etc/lvm/archive"},
+	{"lvm-backup-dir", "/etc/lvm/backup"},
+}
+
+// getScratchVolumes returns emptyDir volumes for scratchDirs if
+// Spec.NodeReadOnlyRootFilesystem is set.
+func (d *pmemCSIDeployment) getScratchVolumes() []corev1.Volume {
+	if !d.Spec.NodeReadOnlyRootFilesystem {
+		return nil
+	}
+	var volumes []corev1.Volume
+	for _, dir := range scratchDirs {
+		volumes = append(volumes, corev1.Volume{
+			Name: dir.name,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		})
+	}
+	return volumes
+}
+
+// setScratchMounts makes the root filesystem of a node container
+// read-only and mounts the scratch volumes if
+// Spec.NodeReadOnlyRootFilesystem is set. The container remains
+// privileged because that is required for bidirectional mount
+// propagation.
+func (d *pmemCSIDeployment) setScratchMounts(c *corev1.Container) {
+	if !d.Spec.NodeReadOnlyRootFilesystem {
+		return
+	}
+	readOnly := true
+	c.SecurityContext.ReadOnlyRootFilesystem = &readOnly
+	for _, dir := range scratchDirs {
+		c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+			Name:      dir.name,
+			MountPath: dir.path,
+		})
+	}
+}
+
+// appArmorAnnotationPrefix is the prefix of the per-container AppArmor
+// annotation. It is used instead of the AppArmorProfile field because
+// that only exists in Kubernetes >= 1.30.
+const appArmorAnnotationPrefix = "container.apparmor.security.beta.kubernetes.io/"
+
+// setPodSecurity applies SeccompProfile and AppArmorProfile to a pod
+// template. The containers must have been set already.
+func (d *pmemCSIDeployment) setPodSecurity(template *corev1.PodTemplateSpec) {
+	if d.Spec.SeccompProfile != nil {
+		if template.Spec.SecurityContext == nil {
+			template.Spec.SecurityContext = &corev1.PodSecurityContext{}
+		}
+		template.Spec.SecurityContext.SeccompProfile = d.Spec.SeccompProfile.DeepCopy()
+	}
+	// The kubelet refuses to start pods with AppArmor annotations
+	// on nodes without AppArmor, which is the case on OpenShift.
+	if d.Spec.AppArmorProfile != "" && !d.onOpenShift() {
+		if template.Annotations == nil {
+			template.Annotations = map[string]string{}
+		}
+		for _, c := range template.Spec.Containers {
+			template.Annotations[appArmorAnnotationPrefix+c.Name] = d.Spec.AppArmorProfile
+		}
+	}
+}
+
+// setTerminationLog applies Spec.TerminationLog to all containers of
+// a pod template. The path only changes in containers which get told
+// about it through TERMINATION_LOG_PATH, i.e. the driver containers.
+func (d *pmemCSIDeployment) setTerminationLog(template *corev1.PodTemplateSpec) {
+	tl := d.Spec.TerminationLog
+	if tl == nil {
+		return
+	}
+	for i := range template.Spec.Containers {
+		c := &template.Spec.Containers[i]
+		if tl.Policy != "" {
+			c.TerminationMessagePolicy = tl.Policy
+		}
+		if tl.Path == "" {
+			continue
+		}
+		for e := range c.Env {
+			if c.Env[e].Name == "TERMINATION_LOG_PATH" {
+				c.Env[e].Value = tl.Path
+				c.TerminationMessagePath = tl.Path
+			}
+		}
+	}
+}
+
+// setPodMetadata adds Spec.Annotations to a pod template and
+// replaces the default priority class with Spec.PriorityClassName.
+// Annotations set by the operator itself take precedence.
+func (d *pmemCSIDeployment) setPodMetadata(template *corev1.PodTemplateSpec) {
+	if len(d.Spec.Annotations) > 0 {
+		template.Annotations = joinMaps(d.Spec.Annotations, template.Annotations)
+	}
+	if d.Spec.PriorityClassName != "" {
+		template.Spec.PriorityClassName = d.Spec.PriorityClassName
+	}
 }
 
 func (d *pmemCSIDeployment) getNodeSetupContainer() corev1.Container {
@@ -1510,7 +2299,7 @@ func (d *pmemCSIDeployment) getNodeSetupContainer() corev1.Container {
 	root := int64(0)
 	c := corev1.Container{
 		Name:            "pmem-driver",
-		Image:           d.Spec.Image,
+		Image:           d.ImageReference(d.Spec.Image),
 		ImagePullPolicy: d.Spec.PullPolicy,
 		Command:         d.getNodeSetupCommand(),
 		Env: []corev1.EnvVar{
@@ -1550,6 +2339,13 @@ func (d *pmemCSIDeployment) getNodeSetupContainer() corev1.Container {
 		TerminationMessagePath:   "/tmp/termination-log",
 		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
 	}
+	// Normally set by EnsureDefaults. Without them, the container
+	// gets no resource settings.
+	if d.Spec.NodeSetupResources != nil {
+		c.Resources = *d.Spec.NodeSetupResources
+	}
+
+	d.setScratchMounts(&c)
 
 	return c
 }
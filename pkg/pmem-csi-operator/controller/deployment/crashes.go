@@ -0,0 +1,88 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/termination"
+)
+
+// setDriverCrashed updates the DriverCrashed condition with the most
+// recent termination of a PMEM-CSI driver container that failed. The
+// driver writes the reason in a structured format (see
+// pkg/termination) to its termination log, which Kubernetes stores
+// in the container status. Like the Degraded condition, it only gets
+// added when needed.
+func (d *pmemCSIDeployment) setDriverCrashed(ctx context.Context, r *ReconcileDeployment) error {
+	pods := &corev1.PodList{}
+	if err := r.client.List(ctx, pods, client.InNamespace(d.namespace), client.MatchingLabels{
+		"app.kubernetes.io/instance": d.Name,
+	}); err != nil {
+		return fmt.Errorf("list driver pods: %v", err)
+	}
+
+	var lastPod *corev1.Pod
+	var last *corev1.ContainerStateTerminated
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != "pmem-driver" {
+				continue
+			}
+			terminated := failedTermination(status)
+			if terminated == nil {
+				continue
+			}
+			if last == nil || terminated.FinishedAt.After(last.FinishedAt.Time) {
+				lastPod, last = pod, terminated
+			}
+		}
+	}
+
+	if last == nil {
+		for _, c := range d.Status.Conditions {
+			if c.Type == api.DriverCrashed {
+				d.SetCondition(api.DriverCrashed, corev1.ConditionFalse, "No driver crashes.")
+				return nil
+			}
+		}
+		return nil
+	}
+	msg := fmt.Sprintf("Driver in pod %s on node %s exited with code %d at %s",
+		lastPod.Name, lastPod.Spec.NodeName, last.ExitCode, last.FinishedAt.UTC().Format(time.RFC3339))
+	if last.Message != "" {
+		msg += ": " + termination.ParseMessage(last.Message).String()
+	}
+	d.SetCondition(api.DriverCrashed, corev1.ConditionTrue, msg+".")
+	return nil
+}
+
+// failedTermination returns the termination of the container with a
+// non-zero exit code which still matters. The previous termination
+// is kept in the status after a restart, but is no longer relevant
+// once the restarted container is ready.
+func failedTermination(status corev1.ContainerStatus) *corev1.ContainerStateTerminated {
+	if terminated := status.State.Terminated; terminated != nil && terminated.ExitCode != 0 {
+		return terminated
+	}
+	terminated := status.LastTerminationState.Terminated
+	if terminated == nil || terminated.ExitCode == 0 {
+		return nil
+	}
+	if running := status.State.Running; running != nil && status.Ready &&
+		!terminated.FinishedAt.After(running.StartedAt.Time) {
+		return nil
+	}
+	return terminated
+}
@@ -15,6 +15,7 @@ import (
 	"time"
 
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/hostpaths"
 	"github.com/intel/pmem-csi/pkg/k8sutil"
 	"github.com/intel/pmem-csi/pkg/logger"
 	pmemcontroller "github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller"
@@ -22,12 +23,14 @@ import (
 	"github.com/intel/pmem-csi/pkg/version"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/component-base/featuregate"
 	"k8s.io/klog/v2"
-	"k8s.io/kubectl/pkg/scheme"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/event"
@@ -70,10 +73,12 @@ func add(ctx context.Context, mgr manager.Manager, r *ReconcileDeployment) error
 			defer r.reconcileMutex.Unlock()
 			l.V(3).Info("UPDATED", "object", logger.KObjWithType(e.ObjectOld), "generation", e.ObjectNew.GetGeneration())
 			if e.ObjectNew.GetDeletionTimestamp() != nil {
-				// Deployment CR deleted, remove it's reference from cache.
-				// Objects owned by it are automatically garbage collected.
+				// Deployment CR deleted, remove it's reference from cache
+				// so that changes of sub-objects are no longer reverted.
+				// Reconcile deletes them in the right order,
+				// also after a change of the force annotation.
 				r.deleteDeployment(e.ObjectOld.GetName())
-				return false
+				return true
 			}
 			if e.ObjectOld.GetGeneration() == e.ObjectNew.GetGeneration() {
 				// No changes registered
@@ -120,30 +125,9 @@ func add(ctx context.Context, mgr manager.Manager, r *ReconcileDeployment) error
 	// sub-object changes, instead we provide a dedicated handler.
 	// So all these event handlers returns 'false' so that the event
 	// is not propagated further.
-	// One exception is: If we fail to handle here, then we pass this
-	// event to reconcile loop, where it should recognize these requests
-	// and just requeue. Expecting that the failure is retried.
+	// The exceptions are described in HandleSubObjectEvent.
 	eventFunc := func(what string, obj client.Object) bool {
-		// TODO:
-		// - check that this output is okay
-		// - check why "go test" does not cover this code
-		l.V(3).Info(what, "object", logger.KObjWithType(obj))
-		// Get the owned deployment
-		d, err := r.getDeploymentFor(ctx, obj)
-		if err != nil {
-			l.V(3).Info("not owned by any deployment", "object", logger.KObjWithType(obj))
-			// The owner might have deleted already
-			// we can safely ignore this event
-			return false
-		}
-		r.reconcileMutex.Lock()
-		defer r.reconcileMutex.Unlock()
-		// TODO (?): single parameter
-		if err := d.handleEvent(ctx, obj, obj, r); err != nil {
-			l.Error(err, "while handling the event, requeuing the event")
-			return true
-		}
-		return false
+		return r.HandleSubObjectEvent(ctx, what, obj)
 	}
 	sop := predicate.Funcs{
 		DeleteFunc: func(e event.DeleteEvent) bool {
@@ -174,6 +158,17 @@ func add(ctx context.Context, mgr manager.Manager, r *ReconcileDeployment) error
 		}
 	}
 
+	// Capacity changes whenever volumes get created or deleted.
+	// Polling avoids watching those and, unlike a periodic
+	// Reconcile, only updates the status. The manager runs
+	// this only in the leader.
+	if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		wait.UntilWithContext(ctx, r.RefreshCapacity, capacityRefreshInterval)
+		return nil
+	})); err != nil {
+		return fmt.Errorf("add capacity refresh: %v", err)
+	}
+
 	return nil
 }
 
@@ -189,14 +184,22 @@ type ReconcileDeployment struct {
 	// operations.
 	ctx context.Context
 
-	client        client.Client
+	client client.Client
+	// apiReader reads directly from the apiserver, for objects
+	// which are not cached by client.
+	apiReader     client.Reader
 	evBroadcaster record.EventBroadcaster
 	evRecorder    record.EventRecorder
 	namespace     string
 	k8sVersion    version.Version
+	openShift     bool
+	hostLayout    hostpaths.Layout
 	// container image used for deploying the operator
 	containerImage string
-	// known deployments
+	// operator features enabled for the cluster
+	featureGate featuregate.MutableFeatureGate
+	// known deployments, a cache of the PmemCSIDeployment objects
+	// which hold the actual state in their spec and status
 	deployments map[string]*api.PmemCSIDeployment
 	// deploymentsMutex protects concurrent access to deployments
 	deploymentsMutex sync.Mutex
@@ -236,16 +239,27 @@ func NewReconcileDeployment(ctx context.Context, client client.Client, opts pmem
 
 	evBroadcaster := record.NewBroadcaster()
 	evBroadcaster.StartRecordingToSink(&v1.EventSinkImpl{Interface: opts.EventsClient})
-	evRecorder := evBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "pmem-csi-operator"})
+	// The scheme of the client is the one which knows about
+	// PmemCSIDeployment.
+	evRecorder := evBroadcaster.NewRecorder(client.Scheme(), corev1.EventSource{Component: "pmem-csi-operator"})
+
+	apiReader := opts.APIReader
+	if apiReader == nil {
+		apiReader = client
+	}
 
 	return &ReconcileDeployment{
 		ctx:            ctx,
 		client:         client,
+		apiReader:      apiReader,
 		evBroadcaster:  evBroadcaster,
 		evRecorder:     evRecorder,
 		k8sVersion:     opts.K8sVersion,
+		openShift:      opts.OpenShift,
+		hostLayout:     opts.HostLayout,
 		namespace:      opts.Namespace,
 		containerImage: opts.DriverImage,
+		featureGate:    opts.FeatureGate,
 		deployments:    map[string]*api.PmemCSIDeployment{},
 		reconcileHooks: map[ReconcileHook]struct{}{},
 	}, nil
@@ -270,6 +284,12 @@ func (r *ReconcileDeployment) Reconcile(ctx context.Context, request reconcile.R
 	// Fetch the Deployment instance
 	deployment := &api.PmemCSIDeployment{}
 	err = r.client.Get(ctx, request.NamespacedName, deployment)
+	if errors.IsNotFound(err) {
+		// Sub-object events get passed on for owners which
+		// might have been removed in the meantime.
+		l.V(3).Info("deployment not found, nothing to do")
+		return reconcile.Result{}, nil
+	}
 	if err != nil {
 		l.Error(err, "failed to retrieve CR to reconcile", "deployment", request.Name)
 		// One reason for this could be a failed predicate event handler of
@@ -281,11 +301,16 @@ func (r *ReconcileDeployment) Reconcile(ctx context.Context, request reconcile.R
 	l.V(3).Info("reconcile starting", "deployment", deployment.GetName())
 
 	// If the deployment has already been marked for deletion,
-	// then we don't need to do anything for it because the
-	// apiserver is in the process of garbage-collecting all
-	// sub-objects and then will remove it.
+	// then the only thing left to do is to remove the sub-objects
+	// in the right order. The apiserver garbage-collects the rest
+	// once the finalizer is gone.
 	if deployment.DeletionTimestamp != nil {
-		return reconcile.Result{Requeue: false}, nil
+		return r.finalize(ctx, deployment)
+	}
+
+	if err := r.addFinalizer(ctx, deployment); err != nil {
+		l.Error(err, "failed to add finalizer", "deployment", request.Name)
+		return reconcile.Result{Requeue: true, RequeueAfter: requeueDelayOnError}, err
 	}
 
 	for f := range r.reconcileHooks {
@@ -323,24 +348,40 @@ func (r *ReconcileDeployment) Reconcile(ctx context.Context, request reconcile.R
 		}
 	}()
 
+	// A spec change deserves a new set of attempts.
+	if dep.Status.ObservedGeneration != dep.Generation {
+		dep.Status.Retries = 0
+	}
+	dep.Status.ObservedGeneration = dep.Generation
+
+	// Only the status gets updated while paused. The spec change
+	// which resumes reconciliation triggers a new Reconcile call.
+	setPaused(dep)
+	if dep.Spec.Paused {
+		l.V(3).Info("paused, not changing anything")
+		return reconcile.Result{}, nil
+	}
+
 	d, err := r.newDeployment(ctx, dep)
-	if err == nil {
+	if err != nil {
+		err = permanent(err)
+	} else {
 		err = d.reconcile(ctx, r)
 	}
 	if err != nil {
-		l.Error(err, "reconcile failed")
-		dep.Status.Phase = api.DeploymentPhaseFailed
-		dep.Status.Reason = err.Error()
-		r.evRecorder.Event(dep, corev1.EventTypeWarning, api.EventReasonFailed, err.Error())
-
-		return reconcile.Result{Requeue: true, RequeueAfter: requeueDelayOnError}, err
+		// The result determines when to try again, returning
+		// the error would trigger the rate limiter of the
+		// work queue instead.
+		return r.failed(ctx, dep, err), nil
 	}
 
+	dep.Status.Retries = 0
 	dep.Status.Phase = api.DeploymentPhaseRunning
 	dep.Status.Reason = "All driver components are deployed successfully"
 	r.evRecorder.Event(dep, corev1.EventTypeNormal, api.EventReasonRunning, "Driver deployment successful")
+	recordAppliedSpec(ctx, &deployment.Spec, &dep.Status)
 
-	return reconcile.Result{}, nil
+	return reconcile.Result{RequeueAfter: d.requeueAfter}, nil
 }
 
 func (r *ReconcileDeployment) Namespace() string {
@@ -410,6 +451,41 @@ func (r *ReconcileDeployment) cacheDeploymentStatus(name string, status api.Depl
 	}
 }
 
+// HandleSubObjectEvent reverts a change of a sub-object. It returns
+// true if the event must be passed on to the reconcile loop instead,
+// which then reconciles the owner of the object. That is the case
+// when reverting failed and when the owner is not known yet.
+//
+// The known deployments are only a cache of the PmemCSIDeployment
+// objects. After an operator restart, it is empty until those get
+// reconciled again. Only Reconcile checks for version skew, pending
+// upgrades and conflicting deployments, so sub-objects must not be
+// touched before that.
+func (r *ReconcileDeployment) HandleSubObjectEvent(ctx context.Context, what string, obj client.Object) bool {
+	l := klog.FromContext(ctx)
+	l.V(3).Info(what, "object", logger.KObjWithType(obj))
+	// Get the owned deployment
+	d, err := r.getDeploymentFor(ctx, obj)
+	if err != nil {
+		if owner := metav1.GetControllerOf(obj); owner != nil && owner.Kind == "PmemCSIDeployment" {
+			l.V(3).Info("owner not reconciled yet, reconciling it", "object", logger.KObjWithType(obj), "deployment", owner.Name)
+			return true
+		}
+		l.V(3).Info("not owned by any deployment", "object", logger.KObjWithType(obj))
+		return false
+	}
+	r.reconcileMutex.Lock()
+	defer r.reconcileMutex.Unlock()
+	// TODO (?): single parameter
+	if err := d.handleEvent(ctx, obj, obj, r); err != nil {
+		l.Error(err, "while handling the event, requeuing the event")
+		return true
+	}
+	return false
+}
+
+// getDeploymentFor returns the deployment which owns the object,
+// if it is known.
 func (r *ReconcileDeployment) getDeploymentFor(ctx context.Context, obj metav1.Object) (*pmemCSIDeployment, error) {
 	r.deploymentsMutex.Lock()
 	defer r.deploymentsMutex.Unlock()
@@ -428,15 +504,25 @@ func (r *ReconcileDeployment) getDeploymentFor(ctx context.Context, obj metav1.O
 // newDeployment prepares for object creation and will modify the PmemCSIDeployment.
 // Callers who don't want that need to clone it first.
 func (r *ReconcileDeployment) newDeployment(ctx context.Context, deployment *api.PmemCSIDeployment) (*pmemCSIDeployment, error) {
+	if deployment.Spec.HostLayout == "" {
+		deployment.Spec.HostLayout = r.hostLayout
+	}
 	if err := deployment.EnsureDefaults(r.containerImage); err != nil {
 		return nil, err
 	}
+	features, err := deploymentFeatures(r.featureGate, deployment)
+	if err != nil {
+		return nil, err
+	}
 
 	d := &pmemCSIDeployment{
 		PmemCSIDeployment: deployment,
 		namespace:         r.namespace,
 		k8sVersion:        r.k8sVersion,
+		openShift:         r.openShift,
+		features:          features,
 	}
+	d.Status.FeatureGates = d.featureStatus()
 
 	return d, nil
 }
@@ -7,6 +7,7 @@ package deployment_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"sort"
 	"strings"
@@ -20,13 +21,17 @@ import (
 	"github.com/intel/pmem-csi/deploy"
 	"github.com/intel/pmem-csi/pkg/apis"
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/hostpaths"
 	pmemcontroller "github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller/deployment"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller/deployment/testcases"
 	"github.com/intel/pmem-csi/pkg/version"
 	"github.com/intel/pmem-csi/test/e2e/operator/validate"
 
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -57,6 +62,7 @@ type pmemDeployment struct {
 	provisionerCPU, provisionerMemory                   string
 	nodeRegistarCPU, nodeRegistrarMemory                string
 	kubeletDir                                          string
+	hostLayout                                          string
 
 	objects []runtime.Object
 
@@ -125,6 +131,7 @@ func getDeployment(d *pmemDeployment) *api.PmemCSIDeployment {
 	if d.kubeletDir != "" {
 		spec.KubeletDir = d.kubeletDir
 	}
+	spec.HostLayout = hostpaths.Layout(d.hostLayout)
 
 	return dep
 }
@@ -333,6 +340,15 @@ func TestDeploymentController(t *testing.T) {
 				nodeMemory:         "500Mi",
 				kubeletDir:         "/some/directory",
 			},
+			"microk8s host layout": {
+				name:       "test-deployment",
+				hostLayout: "microk8s",
+			},
+			"invalid host layout": {
+				name:          "test-deployment",
+				hostLayout:    "foobar",
+				expectFailure: true,
+			},
 			"invalid device mode": {
 				name:          "test-driver-modes",
 				deviceMode:    "foobar",
@@ -359,7 +375,7 @@ func TestDeploymentController(t *testing.T) {
 				require.NoError(t, err, "failed to create deployment")
 
 				if d.expectFailure {
-					tc.testReconcilePhase(d.name, true, true, api.DeploymentPhaseFailed)
+					tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseFailed)
 					validateEvents(tc, dep, []string{api.EventReasonNew, api.EventReasonFailed})
 					validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{})
 				} else {
@@ -504,6 +520,38 @@ func TestDeploymentController(t *testing.T) {
 			}
 		})
 
+		t.Run("sub-object events after restart", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-sub-object-events",
+			}
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node DaemonSet")
+			cm := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "unrelated-cm",
+					Namespace: testNamespace,
+				},
+			}
+
+			// Unknown owners must be reconciled before their
+			// sub-objects get touched.
+			tc.ResetReconciler()
+			r := tc.rc.(*deployment.ReconcileDeployment)
+			require.True(t, r.HandleSubObjectEvent(tc.ctx, "UPDATED", ds), "event for sub-object of unknown deployment must be passed on")
+			require.False(t, r.HandleSubObjectEvent(tc.ctx, "UPDATED", cm), "event for unrelated object")
+
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			require.False(t, r.HandleSubObjectEvent(tc.ctx, "UPDATED", ds), "event for sub-object of known deployment")
+		})
+
 		t.Run("delete obsolete objects", func(t *testing.T) {
 			tc := setup(t)
 			defer teardown(tc)
@@ -576,79 +624,1592 @@ func TestDeploymentController(t *testing.T) {
 			require.NoErrorf(t, err, "get '%s' config map after reconcile", cm2.Name)
 		})
 
-		t.Run("recover from unexpected shutdown", func(t *testing.T) {
+		t.Run("adopt existing objects", func(t *testing.T) {
+			d := &pmemDeployment{
+				name: "test-driver-adopt",
+			}
+			dep := getDeployment(d)
+
+			// Same name as the one used by the operator.
+			role := &rbacv1.Role{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      dep.WebhooksRoleName(),
+					Namespace: testNamespace,
+					Labels:    map[string]string{deployment.AdoptLabel: d.name},
+				},
+			}
+			// Different name.
+			sa := &corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "legacy-webhooks",
+					Namespace:   testNamespace,
+					Labels:      map[string]string{deployment.AdoptLabel: d.name},
+					Annotations: map[string]string{deployment.AdoptAsAnnotation: dep.WebhooksServiceAccountName()},
+				},
+			}
+			tc := setup(t, role, sa)
+			defer teardown(tc)
+
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			ownedBy := func(obj metav1.Object) bool {
+				for _, ref := range obj.GetOwnerReferences() {
+					if ref.UID == dep.GetUID() {
+						return true
+					}
+				}
+				return false
+			}
+
+			err = tc.c.Get(tc.ctx, client.ObjectKeyFromObject(role), role)
+			require.NoError(t, err, "get role")
+			require.True(t, ownedBy(role), "role should have been adopted")
+			require.NotEmpty(t, role.Rules, "role should have been reconciled")
+
+			err = tc.c.Get(tc.ctx, client.ObjectKeyFromObject(sa), sa)
+			require.NoError(t, err, "get legacy service account")
+			require.True(t, ownedBy(sa), "service account should have been adopted")
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.WebhooksServiceAccountName(), Namespace: testNamespace}, &corev1.ServiceAccount{})
+			require.True(t, errors.IsNotFound(err), "no additional service account should have been created, got error: %v", err)
+
+			// References must point to the adopted object.
+			rb := &rbacv1.RoleBinding{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.WebhooksRoleBindingName(), Namespace: testNamespace}, rb)
+			require.NoError(t, err, "get webhooks role binding")
+			require.Len(t, rb.Subjects, 1, "role binding subjects")
+			require.Equal(t, sa.Name, rb.Subjects[0].Name, "role binding subject")
+			require.Equal(t, role.Name, rb.RoleRef.Name, "role binding role")
+			crb := &rbacv1.ClusterRoleBinding{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.WebhooksClusterRoleBindingName()}, crb)
+			require.NoError(t, err, "get webhooks cluster role binding")
+			require.Equal(t, sa.Name, crb.Subjects[0].Name, "cluster role binding subject")
+			controller := &appsv1.Deployment{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.ControllerDriverName(), Namespace: testNamespace}, controller)
+			require.NoError(t, err, "get controller")
+			require.Equal(t, sa.Name, controller.Spec.Template.Spec.ServiceAccountName, "controller service account")
+		})
+
+		t.Run("node configurations", func(t *testing.T) {
 			tc := setup(t)
 			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-node-config",
+			}
 
-			for _, obj := range deployment.CurrentObjects() {
-				gvk := obj.GetObjectKind().GroupVersionKind()
-				tc.c.(*testClient).InjectPanicOn(&gvk)
+			dep := getDeployment(d)
+			dep.Spec.NodeConfig = []api.NodeConfig{
+				{
+					Name:           "direct",
+					NodeSelector:   map[string]string{"pmem-mode": "direct"},
+					DeviceMode:     api.DeviceModeDirect,
+					PMEMPercentage: 50,
+				},
+			}
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
 
-				d := &pmemDeployment{
-					name: "test-panic-" + strings.ToLower(gvk.Kind),
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeConfigDriverName("direct"), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node configuration DaemonSet")
+			require.Equal(t, "direct", ds.Spec.Template.Spec.NodeSelector["pmem-mode"], "node selector")
+			require.Equal(t, "pmem", ds.Spec.Template.Spec.NodeSelector["storage"], "node selector")
+			command := ds.Spec.Template.Spec.Containers[0].Command
+			require.Contains(t, command, "-deviceManager=direct", "device mode")
+			require.Contains(t, command, "-pmemPercentage=50", "PMEM percentage")
+
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get default node DaemonSet")
+			require.NotNil(t, ds.Spec.Template.Spec.Affinity, "default node DaemonSet must exclude configured nodes")
+			require.Len(t, ds.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms, 1, "node selector terms")
+			require.Equal(t, []metav1.LabelSelectorRequirement{{
+				Key:      "pmem-csi.intel.com/node-config",
+				Operator: metav1.LabelSelectorOpDoesNotExist,
+			}}, ds.Spec.Selector.MatchExpressions, "default node DaemonSet must not select pods of other DaemonSets")
+			require.Contains(t, ds.Spec.Template.Spec.Containers[0].Command, "-deviceManager=lvm", "device mode")
+			uid := ds.UID
+
+			// Removing the node configuration removes the DaemonSet.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.NodeConfig = nil
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeConfigDriverName("direct"), Namespace: testNamespace}, ds)
+			require.True(t, errors.IsNotFound(err), "node configuration DaemonSet removed, got error: %v", err)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get default node DaemonSet")
+			require.Equal(t, uid, ds.UID, "default node DaemonSet must not be re-created")
+			require.Nil(t, ds.Spec.Template.Spec.Affinity, "default node DaemonSet without node configurations")
+			validateDriver(tc, dep, []string{api.EventReasonNew, api.EventReasonRunning}, true)
+		})
+
+		t.Run("OpenShift", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-openshift",
+			}
+
+			dep := getDeployment(d)
+			dep.Spec.Platform = api.PlatformOpenShift
+			dep.Spec.AppArmorProfile = "runtime/default"
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			rb := &rbacv1.RoleBinding{}
+			for _, name := range []string{dep.NodeOpenShiftRoleBindingName(), dep.NodeSetupOpenShiftRoleBindingName()} {
+				err = tc.c.Get(tc.ctx, client.ObjectKey{Name: name, Namespace: testNamespace}, rb)
+				require.NoError(t, err, "get OpenShift role binding %s", name)
+				require.Equal(t, "system:openshift:scc:privileged", rb.RoleRef.Name, "role")
+			}
+
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node DaemonSet")
+			require.NotContains(t, ds.Spec.Template.Annotations, "container.apparmor.security.beta.kubernetes.io/pmem-driver", "no AppArmor on OpenShift")
+
+			// Switching back to Kubernetes removes the role bindings.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.Platform = api.PlatformKubernetes
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			for _, name := range []string{dep.NodeOpenShiftRoleBindingName(), dep.NodeSetupOpenShiftRoleBindingName()} {
+				err = tc.c.Get(tc.ctx, client.ObjectKey{Name: name, Namespace: testNamespace}, rb)
+				require.True(t, errors.IsNotFound(err), "OpenShift role binding %s removed, got error: %v", name, err)
+			}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node DaemonSet")
+			require.Equal(t, "runtime/default", ds.Spec.Template.Annotations["container.apparmor.security.beta.kubernetes.io/pmem-driver"], "AppArmor annotation")
+		})
+
+		t.Run("read-only root filesystem", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-read-only",
+			}
+
+			dep := getDeployment(d)
+			dep.Spec.NodeReadOnlyRootFilesystem = true
+			dep.Spec.DriverFeatureGates = map[string]bool{"Expansion": true}
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			// All node containers, including the sidecars, must
+			// have a read-only root filesystem.
+			for _, name := range []string{dep.NodeDriverName(), dep.NodeSetupName()} {
+				ds := &appsv1.DaemonSet{}
+				err = tc.c.Get(tc.ctx, client.ObjectKey{Name: name, Namespace: testNamespace}, ds)
+				require.NoError(t, err, "get DaemonSet %s", name)
+				for _, c := range ds.Spec.Template.Spec.Containers {
+					require.NotNil(t, c.SecurityContext, "security context of container %s in %s", c.Name, name)
+					require.NotNil(t, c.SecurityContext.ReadOnlyRootFilesystem, "read-only root filesystem of container %s in %s", c.Name, name)
+					require.True(t, *c.SecurityContext.ReadOnlyRootFilesystem, "read-only root filesystem of container %s in %s", c.Name, name)
+					if c.Name == "pmem-driver" {
+						require.Contains(t, c.VolumeMounts, corev1.VolumeMount{Name: "tmp-dir", MountPath: "/tmp"}, "writable /tmp in %s", name)
+					}
 				}
-				dep := getDeployment(d)
-				err := tc.c.Create(tc.ctx, dep)
-				require.NoError(t, err, "create deployment")
+			}
+		})
 
-				req := reconcile.Request{
-					NamespacedName: types.NamespacedName{
-						Name: d.name,
-					},
+		t.Run("termination log", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-termination-log",
+			}
+
+			dep := getDeployment(d)
+			dep.Spec.TerminationLog = &api.TerminationLog{
+				Path:   "/tmp/pmem-csi-termination-log",
+				Policy: corev1.TerminationMessageFallbackToLogsOnError,
+			}
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node DaemonSet")
+			for _, c := range ds.Spec.Template.Spec.Containers {
+				require.Equal(t, corev1.TerminationMessageFallbackToLogsOnError, c.TerminationMessagePolicy, "termination message policy of %s", c.Name)
+				if c.Name != "pmem-driver" {
+					require.Equal(t, corev1.TerminationMessagePathDefault, c.TerminationMessagePath, "termination message path of %s", c.Name)
+					continue
 				}
+				require.Equal(t, "/tmp/pmem-csi-termination-log", c.TerminationMessagePath, "termination message path of %s", c.Name)
+				require.Contains(t, c.Env, corev1.EnvVar{Name: "TERMINATION_LOG_PATH", Value: "/tmp/pmem-csi-termination-log"}, "env of %s", c.Name)
+			}
+		})
 
-				defer func() {
-					r := recover()
-					require.NotNil(t, r, "expected to recover from panic")
+		t.Run("pod annotations and priority", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-pod-metadata",
+			}
 
-					tc.c.(*testClient).InjectPanicOn(nil)
-					// mimic operator restart
-					tc.ResetReconciler()
-					tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
-					validateDriver(tc, dep, []string{api.EventReasonNew, api.EventReasonRunning}, false)
-				}()
+			dep := getDeployment(d)
+			dep.Spec.Annotations = map[string]string{
+				"sidecar.istio.io/inject":   "false",
+				"pmem-csi.intel.com/scrape": "none",
+			}
+			dep.Spec.PriorityClassName = "pmem-csi-critical"
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
 
-				if _, err := tc.rc.Reconcile(tc.ctx, req); err != nil {
-					t.Fatalf("unexpected error from Reconcile: %v", err)
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node DaemonSet")
+			controller := &appsv1.Deployment{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.ControllerDriverName(), Namespace: testNamespace}, controller)
+			require.NoError(t, err, "get controller Deployment")
+			for name, template := range map[string]corev1.PodTemplateSpec{
+				"node":       ds.Spec.Template,
+				"controller": controller.Spec.Template,
+			} {
+				require.Equal(t, "false", template.Annotations["sidecar.istio.io/inject"], "additional annotation of %s", name)
+				require.Equal(t, "containers", template.Annotations["pmem-csi.intel.com/scrape"], "operator annotation of %s", name)
+				require.Equal(t, "pmem-csi-critical", template.Spec.PriorityClassName, "priority class of %s", name)
+			}
+		})
+
+		t.Run("dry run", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-dry-run",
+			}
+
+			dep := getDeployment(d)
+			dep.Spec.DryRun = true
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node DaemonSet")
+			require.Contains(t, ds.Spec.Template.Spec.Containers[0].Command, "-dryRun", "node driver command")
+		})
+
+		t.Run("ephemeral quota", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-ephemeral-quota",
+			}
+
+			dep := getDeployment(d)
+			perPod := resource.MustParse("10Gi")
+			perNode := resource.MustParse("100Gi")
+			dep.Spec.EphemeralQuotaPerPod = &perPod
+			dep.Spec.EphemeralQuotaPerNode = &perNode
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node DaemonSet")
+			cmd := ds.Spec.Template.Spec.Containers[0].Command
+			require.Contains(t, cmd, "-ephemeralQuotaPerPod=10Gi", "node driver command")
+			require.Contains(t, cmd, "-ephemeralQuotaPerNode=100Gi", "node driver command")
+		})
+
+		t.Run("driver crashed", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-driver-crashed",
+			}
+
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: testNamespace,
+					Name:      "crashed-pod",
+					Labels: map[string]string{
+						"app.kubernetes.io/name":     "pmem-csi-node",
+						"app.kubernetes.io/instance": d.name,
+					},
+				},
+				Spec: corev1.PodSpec{
+					NodeName:   "worker",
+					Containers: []corev1.Container{{Name: "pmem-driver", Image: testDriverImage}},
+				},
+				Status: corev1.PodStatus{
+					ContainerStatuses: []corev1.ContainerStatus{{
+						Name: "pmem-driver",
+						LastTerminationState: corev1.ContainerState{
+							Terminated: &corev1.ContainerStateTerminated{
+								ExitCode: 1,
+								Message:  `{"reason":"VolumeGroupSetupFailed","message":"failed to run driver: vgcreate failed","device":"bus0region0fsdax","suggestion":"check the volume group"}`,
+							},
+						},
+					}},
+				},
+			}
+			require.NoError(t, tc.c.Create(tc.ctx, pod), "create pod")
+			tc.testReconcile(d.name, false, false)
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed: corev1.ConditionTrue,
+				api.DriverCrashed:  corev1.ConditionTrue,
+			})
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			for _, c := range dep.Status.Conditions {
+				if c.Type == api.DriverCrashed {
+					require.Contains(t, c.Reason, "crashed-pod", "pod name")
+					require.Contains(t, c.Reason, "VolumeGroupSetupFailed: failed to run driver: vgcreate failed (device bus0region0fsdax). check the volume group", "termination message")
 				}
 			}
+
+			// A restarted container which is ready resets the
+			// condition, even though the previous termination
+			// is still in its status.
+			require.NoError(t, tc.c.Delete(tc.ctx, pod), "delete pod")
+			finished := metav1.Now()
+			pod.ResourceVersion = ""
+			pod.Status.ContainerStatuses[0].LastTerminationState.Terminated.FinishedAt = finished
+			pod.Status.ContainerStatuses[0].State.Running = &corev1.ContainerStateRunning{StartedAt: metav1.NewTime(finished.Add(time.Second))}
+			pod.Status.ContainerStatuses[0].RestartCount = 1
+			require.NoError(t, tc.c.Create(tc.ctx, pod), "create restarted pod")
+			tc.testReconcile(d.name, false, false)
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed: corev1.ConditionTrue,
+				api.DriverCrashed:  corev1.ConditionTrue,
+			})
+			require.NoError(t, tc.c.Delete(tc.ctx, pod), "delete pod")
+			pod.ResourceVersion = ""
+			pod.Status.ContainerStatuses[0].Ready = true
+			require.NoError(t, tc.c.Create(tc.ctx, pod), "create ready pod")
+			tc.testReconcile(d.name, false, false)
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed: corev1.ConditionTrue,
+				api.DriverCrashed:  corev1.ConditionFalse,
+			})
+
+			// Once the pod is gone, the condition remains reset.
+			require.NoError(t, tc.c.Delete(tc.ctx, pod), "delete pod")
+			tc.testReconcile(d.name, false, false)
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed: corev1.ConditionTrue,
+				api.DriverCrashed:  corev1.ConditionFalse,
+			})
 		})
-	}
 
-	t.Parallel()
+		t.Run("driver feature gates", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-driver-feature-gates",
+			}
 
-	// Validate for all supported Kubernetes versions.
-	versions := map[version.Version]bool{}
-	for _, yaml := range deploy.ListAll() {
-		versions[yaml.Kubernetes] = true
-	}
-	for version := range versions {
-		version := version
-		t.Run(fmt.Sprintf("Kubernetes %v", version), func(t *testing.T) {
-			testIt(t, version)
+			dep := getDeployment(d)
+			dep.Spec.DriverFeatureGates = map[string]bool{"Expansion": true}
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node DaemonSet")
+			require.Contains(t, ds.Spec.Template.Spec.Containers[0].Command, "-feature-gates=Expansion=true", "node driver command")
+			containers := ds.Spec.Template.Spec.Containers
+			require.Equal(t, "external-resizer", containers[len(containers)-1].Name, "resizer sidecar")
+			require.Equal(t, api.DefaultResizerImage, containers[len(containers)-1].Image, "resizer image")
+			cr := &rbacv1.ClusterRole{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.ResizerClusterRoleName()}, cr)
+			require.NoError(t, err, "get resizer cluster role")
+
+			// Disabling expansion removes sidecar and RBAC.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.DriverFeatureGates = map[string]bool{"Expansion": false}
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node DaemonSet")
+			for _, c := range ds.Spec.Template.Spec.Containers {
+				require.NotEqual(t, "external-resizer", c.Name, "resizer sidecar removed")
+			}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.ResizerClusterRoleName()}, cr)
+			require.True(t, errors.IsNotFound(err), "resizer cluster role removed, got error: %v", err)
 		})
-	}
-}
 
-type testClient struct {
-	client.Client
-	assertOn *schema.GroupVersionKind
-}
+		t.Run("lost volumes", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-lost-volumes",
+			}
 
-func newTestClient(initObjs ...runtime.Object) client.Client {
-	return &testClient{Client: fake.NewClientBuilder().WithRuntimeObjects(initObjs...).Build()}
-}
+			hasPVRule := func(cr *rbacv1.ClusterRole, verb string) bool {
+				for _, rule := range cr.Rules {
+					for _, resource := range rule.Resources {
+						if resource != "persistentvolumes" {
+							continue
+						}
+						for _, v := range rule.Verbs {
+							if v == verb {
+								return true
+							}
+						}
+					}
+				}
+				return false
+			}
 
-func (t *testClient) InjectPanicOn(gvk *schema.GroupVersionKind) {
-	t.assertOn = gvk
-}
+			// Disabled by default.
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			cr := &rbacv1.ClusterRole{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.WebhooksClusterRoleName()}, cr)
+			require.NoError(t, err, "get webhooks cluster role")
+			require.False(t, hasPVRule(cr, "patch"), "PV patch permission without lostNodeGracePeriod")
+			require.False(t, hasPVRule(cr, "delete"), "PV delete permission without lostNodeGracePeriod")
 
-// Create adds given obj to its object tracking list.
-// It panics if the object type matches with the type of 'assertOn'
-// that was previously set using InjectPanicOn()
-func (t *testClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
-	if t.assertOn != nil && obj.GetObjectKind().GroupVersionKind() == *t.assertOn {
-		panic(fmt.Sprintf("assert: %v", obj.GetObjectKind()))
+			// Marking needs patch, deleting also delete.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.LostNodeGracePeriod = &metav1.Duration{Duration: 24 * time.Hour}
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.WebhooksClusterRoleName()}, cr)
+			require.NoError(t, err, "get webhooks cluster role")
+			require.True(t, hasPVRule(cr, "patch"), "PV patch permission with lostNodeGracePeriod")
+			require.False(t, hasPVRule(cr, "delete"), "PV delete permission without deleteLostVolumes")
+			controller := &appsv1.Deployment{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.ControllerDriverName(), Namespace: testNamespace}, controller)
+			require.NoError(t, err, "get controller")
+			require.Contains(t, controller.Spec.Template.Spec.Containers[0].Command, "-lostNodeGracePeriod=24h0m0s", "controller command")
+
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.DeleteLostVolumes = true
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.WebhooksClusterRoleName()}, cr)
+			require.NoError(t, err, "get webhooks cluster role")
+			require.True(t, hasPVRule(cr, "delete"), "PV delete permission with deleteLostVolumes")
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.ControllerDriverName(), Namespace: testNamespace}, controller)
+			require.NoError(t, err, "get controller")
+			require.Contains(t, controller.Spec.Template.Spec.Containers[0].Command, "-deleteLostVolumes", "controller command")
+		})
+
+		t.Run("manual changes", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-manual-changes",
+			}
+
+			dep := getDeployment(d)
+			dep.Spec.PreserveManualChanges = true
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed: corev1.ConditionTrue,
+			})
+
+			getDS := func() *appsv1.DaemonSet {
+				ds := &appsv1.DaemonSet{}
+				err := tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+				require.NoError(t, err, "get node DaemonSet")
+				return ds
+			}
+			// The fake client doesn't add defaults like the apiserver
+			// does, so simulate that. Such fields are not manual changes.
+			ds := getDS()
+			gracePeriod := int64(30)
+			ds.Spec.Template.Spec.SchedulerName = "default-scheduler"
+			ds.Spec.Template.Spec.DNSPolicy = corev1.DNSClusterFirst
+			ds.Spec.Template.Spec.TerminationGracePeriodSeconds = &gracePeriod
+			for i := range ds.Spec.Template.Spec.Containers {
+				c := &ds.Spec.Template.Spec.Containers[i]
+				for j := range c.Ports {
+					c.Ports[j].Protocol = corev1.ProtocolTCP
+				}
+			}
+			err = tc.c.Update(tc.ctx, ds)
+			require.NoError(t, err, "add defaults to node DaemonSet")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed: corev1.ConditionTrue,
+			})
+
+			ds = getDS()
+			image := ds.Spec.Template.Spec.Containers[0].Image
+			ds.Spec.Template.Spec.Containers[0].Image = "manually-changed:latest"
+			err = tc.c.Update(tc.ctx, ds)
+			require.NoError(t, err, "update node DaemonSet")
+
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			require.Equal(t, "manually-changed:latest", getDS().Spec.Template.Spec.Containers[0].Image, "preserved image")
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed: corev1.ConditionTrue,
+				api.Degraded:       corev1.ConditionTrue,
+			})
+
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.PreserveManualChanges = false
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			require.Equal(t, image, getDS().Spec.Template.Spec.Containers[0].Image, "reverted image")
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed: corev1.ConditionTrue,
+				api.Degraded:       corev1.ConditionFalse,
+			})
+		})
+
+		t.Run("viewer role", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-viewer-role",
+			}
+
+			dep := getDeployment(d)
+			dep.Spec.ViewerRole = true
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			cr := &rbacv1.ClusterRole{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.ViewerClusterRoleName()}, cr)
+			require.NoError(t, err, "get viewer cluster role")
+			role := &rbacv1.Role{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.ViewerRoleName(), Namespace: testNamespace}, role)
+			require.NoError(t, err, "get viewer role")
+			for _, rule := range append(cr.Rules, role.Rules...) {
+				for _, verb := range rule.Verbs {
+					require.Contains(t, []string{"get", "list", "watch"}, verb, "read-only verbs in rule %+v", rule)
+				}
+				require.NotContains(t, rule.Resources, "secrets", "no access to secrets")
+			}
+			// Pods, their logs and proxy access are only
+			// granted in the driver namespace.
+			for _, rule := range cr.Rules {
+				for _, resource := range []string{"pods", "pods/log", "pods/proxy", "persistentvolumeclaims", "roles", "clusterroles"} {
+					require.NotContains(t, rule.Resources, resource, "cluster-wide rule %+v", rule)
+				}
+			}
+
+			// Disabling the option removes the role.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.ViewerRole = false
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.ViewerClusterRoleName()}, cr)
+			require.True(t, errors.IsNotFound(err), "viewer cluster role removed, got error: %v", err)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.ViewerRoleName(), Namespace: testNamespace}, role)
+			require.True(t, errors.IsNotFound(err), "viewer role removed, got error: %v", err)
+		})
+
+		t.Run("paused", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-paused",
+			}
+
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			getImage := func() string {
+				ds := &appsv1.DaemonSet{}
+				err := tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+				require.NoError(t, err, "get node DaemonSet")
+				return ds.Spec.Template.Spec.Containers[0].Image
+			}
+			image := getImage()
+
+			// Changes are not applied while paused.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.Paused = true
+			dep.Spec.Image = "new-driver-image:latest"
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			require.Equal(t, image, getImage(), "image while paused")
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed: corev1.ConditionTrue,
+				api.Paused:         corev1.ConditionTrue,
+			})
+
+			// Resuming applies them.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.Paused = false
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			require.Equal(t, "new-driver-image:latest", getImage(), "image after resume")
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed: corev1.ConditionTrue,
+				api.Paused:         corev1.ConditionFalse,
+			})
+		})
+
+		t.Run("driver name conflict", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-name-conflict",
+			}
+
+			// Some other installation, for example from YAML files.
+			other := &storagev1.CSIDriver{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   d.name,
+					Labels: map[string]string{"app.kubernetes.io/instance": "other"},
+				},
+			}
+			err := tc.c.Create(tc.ctx, other)
+			require.NoError(t, err, "create other CSIDriver")
+			dep := getDeployment(d)
+			err = tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseFailed)
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.NameConflict:   corev1.ConditionTrue,
+				api.DriverDeployed: corev1.ConditionFalse,
+			})
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.True(t, errors.IsNotFound(err), "node DaemonSet not created, got error: %v", err)
+
+			err = tc.c.Delete(tc.ctx, other)
+			require.NoError(t, err, "delete other CSIDriver")
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "pmem-csi-node-abc",
+					Namespace: "other-namespace",
+					Labels: map[string]string{
+						"app.kubernetes.io/name":     "pmem-csi-node",
+						"app.kubernetes.io/instance": d.name,
+					},
+				},
+			}
+			err = tc.c.Create(tc.ctx, pod)
+			require.NoError(t, err, "create other node driver pod")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseFailed)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Contains(t, dep.Status.Reason, "other-namespace", "reason")
+
+			err = tc.c.Delete(tc.ctx, pod)
+			require.NoError(t, err, "delete other node driver pod")
+			err = tc.c.Create(tc.ctx, &storagev1.CSINode{
+				ObjectMeta: metav1.ObjectMeta{Name: "worker-1"},
+				Spec: storagev1.CSINodeSpec{
+					Drivers: []storagev1.CSINodeDriver{{Name: d.name, NodeID: "worker-1"}},
+				},
+			})
+			require.NoError(t, err, "create CSINode")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseFailed)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Contains(t, dep.Status.Reason, "worker-1", "reason")
+
+			err = tc.c.Delete(tc.ctx, &storagev1.CSINode{ObjectMeta: metav1.ObjectMeta{Name: "worker-1"}})
+			require.NoError(t, err, "delete CSINode")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.NameConflict:   corev1.ConditionFalse,
+				api.DriverDeployed: corev1.ConditionTrue,
+			})
+		})
+
+		t.Run("invalid driver name", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: strings.Repeat("a", 64),
+			}
+
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseFailed)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Contains(t, dep.Status.Reason, "not a valid CSI driver name", "reason")
+		})
+
+		t.Run("grafana dashboards", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-grafana-dashboards",
+			}
+
+			dep := getDeployment(d)
+			dep.Spec.GrafanaDashboards = true
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			cm := &corev1.ConfigMap{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.GrafanaDashboardsName(), Namespace: testNamespace}, cm)
+			require.NoError(t, err, "get dashboards config map")
+			require.Equal(t, "1", cm.Labels["grafana_dashboard"], "label for Grafana sidecar")
+			require.Len(t, cm.Data, 3, "dashboards")
+			for name, dashboard := range cm.Data {
+				var content map[string]interface{}
+				require.NoError(t, json.Unmarshal([]byte(dashboard), &content), "parse %s", name)
+				require.Contains(t, dashboard, d.name, "%s uses driver name", name)
+				require.NotContains(t, dashboard, "@DRIVER_NAME@", "%s placeholder replaced", name)
+			}
+
+			// Disabling the option removes the dashboards.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.GrafanaDashboards = false
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.GrafanaDashboardsName(), Namespace: testNamespace}, cm)
+			require.True(t, errors.IsNotFound(err), "dashboards removed, got error: %v", err)
+		})
+
+		t.Run("driver config", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-driver-config",
+			}
+
+			dep := getDeployment(d)
+			dep.Spec.DriverConfig = map[string]string{"v": "5", "maxDeviceOperations": "8"}
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			cm := &corev1.ConfigMap{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.DriverConfigName(), Namespace: testNamespace}, cm)
+			require.NoError(t, err, "get driver config map")
+			require.Equal(t, "maxDeviceOperations: \"8\"\nv: \"5\"\n", cm.Data["config.yaml"], "config file")
+
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node DaemonSet")
+			cmd := ds.Spec.Template.Spec.Containers[0].Command
+			require.Contains(t, cmd, "-config=/etc/pmem-csi/config.yaml", "node driver command")
+			for _, arg := range cmd {
+				require.False(t, strings.HasPrefix(arg, "-v="), "-v replaced by config file, got %q", arg)
+			}
+			hash := ds.Spec.Template.Annotations["pmem-csi.intel.com/config-hash"]
+			require.NotEmpty(t, hash, "config hash")
+
+			// Changing the log level does not replace the pods.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.DriverConfig["v"] = "3"
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node DaemonSet")
+			require.Equal(t, hash, ds.Spec.Template.Annotations["pmem-csi.intel.com/config-hash"], "config hash after changing log level")
+
+			// Removing the settings also removes the ConfigMap.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.DriverConfig = nil
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.DriverConfigName(), Namespace: testNamespace}, cm)
+			require.True(t, errors.IsNotFound(err), "driver config removed, got error: %v", err)
+		})
+
+		t.Run("deletion order", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-deletion-order",
+			}
+
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Contains(t, dep.Finalizers, api.NodeDriverFinalizer, "finalizer")
+
+			// Pods on nodes with the driver get checked.
+			csiNode := &storagev1.CSINode{
+				ObjectMeta: metav1.ObjectMeta{Name: "worker-1"},
+				Spec: storagev1.CSINodeSpec{
+					Drivers: []storagev1.CSINodeDriver{{Name: d.name, NodeID: "worker-1"}},
+				},
+			}
+			require.NoError(t, tc.c.Create(tc.ctx, csiNode), "create CSINode")
+
+			// A pod with a PMEM-CSI volume blocks the removal
+			// of the node driver.
+			pv := &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "pv"},
+				Spec: corev1.PersistentVolumeSpec{
+					PersistentVolumeSource: corev1.PersistentVolumeSource{
+						CSI: &corev1.CSIPersistentVolumeSource{Driver: d.name, VolumeHandle: "volume"},
+					},
+					ClaimRef: &corev1.ObjectReference{Namespace: "default", Name: "pvc"},
+				},
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod"},
+				Spec: corev1.PodSpec{
+					NodeName: "worker-1",
+					Volumes: []corev1.Volume{{
+						Name: "data",
+						VolumeSource: corev1.VolumeSource{
+							PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "pvc"},
+						},
+					}},
+				},
+				Status: corev1.PodStatus{Phase: corev1.PodRunning},
+			}
+			require.NoError(t, tc.c.Create(tc.ctx, pv), "create PV")
+			require.NoError(t, tc.c.Create(tc.ctx, pod), "create pod")
+
+			// The same for a generic ephemeral volume, whose PVC is
+			// named after the pod and the volume.
+			ephemeralPV := &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "ephemeral-pv"},
+				Spec: corev1.PersistentVolumeSpec{
+					PersistentVolumeSource: corev1.PersistentVolumeSource{
+						CSI: &corev1.CSIPersistentVolumeSource{Driver: d.name, VolumeHandle: "ephemeral-volume"},
+					},
+					ClaimRef: &corev1.ObjectReference{Namespace: "default", Name: "ephemeral-pod-scratch"},
+				},
+			}
+			ephemeralPod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ephemeral-pod"},
+				Spec: corev1.PodSpec{
+					NodeName: "worker-1",
+					Volumes: []corev1.Volume{{
+						Name: "scratch",
+						VolumeSource: corev1.VolumeSource{
+							Ephemeral: &corev1.EphemeralVolumeSource{},
+						},
+					}},
+				},
+				Status: corev1.PodStatus{Phase: corev1.PodRunning},
+			}
+			require.NoError(t, tc.c.Create(tc.ctx, ephemeralPV), "create ephemeral PV")
+			require.NoError(t, tc.c.Create(tc.ctx, ephemeralPod), "create ephemeral pod")
+
+			// Pods on other nodes cannot use the driver.
+			otherPod := pod.DeepCopy()
+			otherPod.Name = "other-pod"
+			otherPod.ResourceVersion = ""
+			otherPod.Spec.NodeName = "worker-2"
+			require.NoError(t, tc.c.Create(tc.ctx, otherPod), "create pod on other node")
+
+			require.NoError(t, tc.c.Delete(tc.ctx, dep), "delete deployment")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.ControllerDriverName(), Namespace: testNamespace}, &appsv1.Deployment{})
+			require.True(t, errors.IsNotFound(err), "controller removed, got error: %v", err)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, &appsv1.DaemonSet{})
+			require.NoError(t, err, "node driver kept")
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "deployment kept")
+
+			// Once the pods are gone, the deployment can be removed.
+			require.NoError(t, tc.c.Delete(tc.ctx, pod), "delete pod")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "deployment kept for ephemeral volume")
+			require.NoError(t, tc.c.Delete(tc.ctx, ephemeralPod), "delete ephemeral pod")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.True(t, errors.IsNotFound(err), "deployment removed, got error: %v", err)
+		})
+
+		t.Run("forced deletion", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-forced-deletion",
+			}
+
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			// An ephemeral inline volume also blocks the removal.
+			// The node driver pod tells the operator where to look.
+			driverPod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: testNamespace,
+					Name:      "pmem-csi-node-abc",
+					Labels: map[string]string{
+						"app.kubernetes.io/name":     "pmem-csi-node",
+						"app.kubernetes.io/instance": d.name,
+					},
+				},
+				Spec: corev1.PodSpec{NodeName: "worker-1"},
+			}
+			require.NoError(t, tc.c.Create(tc.ctx, driverPod), "create node driver pod")
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod"},
+				Spec: corev1.PodSpec{
+					NodeName: "worker-1",
+					Volumes: []corev1.Volume{{
+						Name: "data",
+						VolumeSource: corev1.VolumeSource{
+							CSI: &corev1.CSIVolumeSource{Driver: d.name},
+						},
+					}},
+				},
+				Status: corev1.PodStatus{Phase: corev1.PodRunning},
+			}
+			require.NoError(t, tc.c.Create(tc.ctx, pod), "create pod")
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.NoError(t, tc.c.Delete(tc.ctx, dep), "delete deployment")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "deployment kept")
+
+			dep.Annotations = map[string]string{api.ForceDeleteAnnotation: "true"}
+			require.NoError(t, tc.c.Update(tc.ctx, dep), "annotate deployment")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.True(t, errors.IsNotFound(err), "deployment removed, got error: %v", err)
+		})
+
+		t.Run("capacity", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-capacity",
+			}
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Nil(t, dep.Status.Capacity, "capacity without CSIStorageCapacity objects")
+
+			topologyKey := dep.CSIDriverName() + "/node"
+			newCapacity := func(name, class, node, free string) *storagev1.CSIStorageCapacity {
+				quantity := resource.MustParse(free)
+				return &storagev1.CSIStorageCapacity{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: testNamespace,
+						Name:      name,
+						Labels:    map[string]string{"csi.storage.k8s.io/drivername": dep.CSIDriverName()},
+					},
+					StorageClassName: class,
+					NodeTopology:     &metav1.LabelSelector{MatchLabels: map[string]string{topologyKey: node}},
+					Capacity:         &quantity,
+				}
+			}
+			for _, capacity := range []*storagev1.CSIStorageCapacity{
+				newCapacity("a-ext4", "ext4", "worker-a", "10Gi"),
+				newCapacity("a-xfs", "xfs", "worker-a", "8Gi"),
+				newCapacity("b-ext4", "ext4", "worker-b", "6Gi"),
+			} {
+				require.NoError(t, tc.c.Create(tc.ctx, capacity), "create CSIStorageCapacity")
+			}
+			pv := &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "pv"},
+				Spec: corev1.PersistentVolumeSpec{
+					Capacity: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("4Gi")},
+					PersistentVolumeSource: corev1.PersistentVolumeSource{
+						CSI: &corev1.CSIPersistentVolumeSource{Driver: dep.CSIDriverName(), VolumeHandle: "volume"},
+					},
+					NodeAffinity: &corev1.VolumeNodeAffinity{
+						Required: &corev1.NodeSelector{
+							NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+								MatchExpressions: []corev1.NodeSelectorRequirement{{
+									Key:      topologyKey,
+									Operator: corev1.NodeSelectorOpIn,
+									Values:   []string{"worker-b"},
+								}},
+							}},
+						},
+					},
+				},
+			}
+			require.NoError(t, tc.c.Create(tc.ctx, pv), "create PV")
+
+			dep.Spec.LogLevel++
+			require.NoError(t, tc.c.Update(tc.ctx, dep), "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.NotNil(t, dep.Status.Capacity, "capacity")
+			require.Equal(t, "20Gi", dep.Status.Capacity.Total.String(), "total capacity")
+			require.Equal(t, "16Gi", dep.Status.Capacity.Free.String(), "free capacity")
+			require.Len(t, dep.Status.Capacity.Nodes, 2, "nodes")
+			require.Equal(t, "worker-a", dep.Status.Capacity.Nodes[0].Node, "first node")
+			require.Equal(t, "10Gi", dep.Status.Capacity.Nodes[0].Total.String(), "total capacity of worker-a")
+			require.Equal(t, "10Gi", dep.Status.Capacity.Nodes[0].Free.String(), "free capacity of worker-a")
+			require.Equal(t, "worker-b", dep.Status.Capacity.Nodes[1].Node, "second node")
+			require.Equal(t, "10Gi", dep.Status.Capacity.Nodes[1].Total.String(), "total capacity of worker-b")
+			require.Equal(t, "6Gi", dep.Status.Capacity.Nodes[1].Free.String(), "free capacity of worker-b")
+
+			// A new node gets picked up without reconciling.
+			require.NoError(t, tc.c.Create(tc.ctx, newCapacity("c-ext4", "ext4", "worker-c", "2Gi")), "create CSIStorageCapacity")
+			tc.rc.(*deployment.ReconcileDeployment).RefreshCapacity(tc.ctx)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.NotNil(t, dep.Status.Capacity, "refreshed capacity")
+			require.Equal(t, "22Gi", dep.Status.Capacity.Total.String(), "refreshed total capacity")
+			require.Equal(t, "18Gi", dep.Status.Capacity.Free.String(), "refreshed free capacity")
+			require.Len(t, dep.Status.Capacity.Nodes, 3, "refreshed nodes")
+			require.Equal(t, "worker-c", dep.Status.Capacity.Nodes[2].Node, "third node")
+		})
+
+		t.Run("last applied spec", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-last-applied-spec",
+			}
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			var applied api.DeploymentSpec
+			require.NoError(t, json.Unmarshal([]byte(dep.Status.LastAppliedSpec), &applied), "decode last applied spec")
+			require.Equal(t, dep.Spec, applied, "last applied spec after creation")
+
+			// A failed reconcile does not change it.
+			dep.Spec.DeviceMode = "foobar"
+			require.NoError(t, tc.c.Update(tc.ctx, dep), "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseFailed)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.NoError(t, json.Unmarshal([]byte(dep.Status.LastAppliedSpec), &applied), "decode last applied spec")
+			require.NotEqual(t, dep.Spec, applied, "last applied spec after failure")
+
+			dep.Spec.DeviceMode = api.DeviceModeDirect
+			require.NoError(t, tc.c.Update(tc.ctx, dep), "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			applied = api.DeploymentSpec{}
+			require.NoError(t, json.Unmarshal([]byte(dep.Status.LastAppliedSpec), &applied), "decode last applied spec")
+			require.Equal(t, dep.Spec, applied, "last applied spec after update")
+		})
+
+		t.Run("feature gates", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-feature-gates",
+			}
+
+			dep := getDeployment(d)
+			dep.Annotations = map[string]string{
+				api.UninstallAnnotation:    "true",
+				api.FeatureGatesAnnotation: "NoSuchFeature=true",
+			}
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseFailed)
+
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			delete(dep.Annotations, api.FeatureGatesAnnotation)
+			require.NoError(t, tc.c.Update(tc.ctx, dep), "remove feature gates annotation")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Equal(t, map[string]bool{"NodeUpgrades": true, "Uninstall": false}, dep.Status.FeatureGates, "feature gates in status")
+
+			// Without the Uninstall feature, the annotation is ignored.
+			require.NoError(t, tc.c.Delete(tc.ctx, dep), "delete deployment")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeUninstallName(), Namespace: testNamespace}, &appsv1.DaemonSet{})
+			require.True(t, errors.IsNotFound(err), "no uninstall DaemonSet, got error: %v", err)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.True(t, errors.IsNotFound(err), "deployment removed, got error: %v", err)
+		})
+
+		t.Run("uninstall", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-uninstall",
+			}
+
+			dep := getDeployment(d)
+			dep.Annotations = map[string]string{
+				api.UninstallAnnotation:    "force",
+				api.FeatureGatesAnnotation: "Uninstall=true",
+			}
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+
+			// The node driver gets replaced by the uninstall DaemonSet.
+			require.NoError(t, tc.c.Delete(tc.ctx, dep), "delete deployment")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, &appsv1.DaemonSet{})
+			require.True(t, errors.IsNotFound(err), "node driver removed, got error: %v", err)
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeUninstallName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "uninstall DaemonSet created")
+			require.Len(t, ds.Spec.Template.Spec.Containers, 1, "containers")
+			require.Contains(t, ds.Spec.Template.Spec.Containers[0].Command, "-mode=uninstall", "command")
+			require.Contains(t, ds.Spec.Template.Spec.Containers[0].Command, "-uninstallForce", "command")
+
+			// Not done on all nodes yet.
+			ds.Status.DesiredNumberScheduled = 2
+			ds.Status.NumberReady = 1
+			require.NoError(t, tc.c.Status().Update(tc.ctx, ds), "update DaemonSet status")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "deployment kept")
+
+			// Done everywhere.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeUninstallName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get uninstall DaemonSet")
+			ds.Status.NumberReady = 2
+			require.NoError(t, tc.c.Status().Update(tc.ctx, ds), "update DaemonSet status")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeUninstallName(), Namespace: testNamespace}, ds)
+			require.True(t, errors.IsNotFound(err), "uninstall DaemonSet removed, got error: %v", err)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.True(t, errors.IsNotFound(err), "deployment removed, got error: %v", err)
+		})
+
+		t.Run("upgrade", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name:  "test-upgrade",
+				image: "intel/pmem-csi-driver:v1.0.2",
+			}
+
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Equal(t, "1.0", dep.Status.DriverVersion, "initial driver version")
+
+			newPod := func(name, image string) *corev1.Pod {
+				return &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: testNamespace,
+						Name:      name,
+						Labels: map[string]string{
+							"app.kubernetes.io/name":     "pmem-csi-node",
+							"app.kubernetes.io/instance": d.name,
+						},
+					},
+					Spec: corev1.PodSpec{
+						NodeName:   "worker",
+						Containers: []corev1.Container{{Name: "pmem-driver", Image: image}},
+					},
+					Status: corev1.PodStatus{
+						Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+					},
+				}
+			}
+			oldPod := newPod("old-pod", "intel/pmem-csi-driver:v1.0.2")
+			require.NoError(t, tc.c.Create(tc.ctx, oldPod), "create old pod")
+			csiNode := &storagev1.CSINode{
+				ObjectMeta: metav1.ObjectMeta{Name: "worker"},
+				Spec: storagev1.CSINodeSpec{
+					Drivers: []storagev1.CSINodeDriver{{Name: d.name, NodeID: "worker"}},
+				},
+			}
+			require.NoError(t, tc.c.Create(tc.ctx, csiNode), "create CSINode")
+
+			// The old pod gets replaced by the operator.
+			dep.Spec.Image = "intel/pmem-csi-driver:v1.1.0"
+			require.NoError(t, tc.c.Update(tc.ctx, dep), "update image")
+			tc.testReconcile(d.name, false, false)
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node DaemonSet")
+			require.Equal(t, appsv1.OnDeleteDaemonSetStrategyType, ds.Spec.UpdateStrategy.Type, "update strategy during upgrade")
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: oldPod.Name, Namespace: testNamespace}, oldPod)
+			require.True(t, errors.IsNotFound(err), "old pod deleted, got error: %v", err)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Equal(t, "1.0", dep.Status.DriverVersion, "driver version during upgrade")
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed: corev1.ConditionTrue,
+				api.VersionSkew:    corev1.ConditionTrue,
+			})
+
+			// The new pod must be ready and registered.
+			require.NoError(t, tc.c.Create(tc.ctx, newPod("new-pod", "intel/pmem-csi-driver:v1.1.0")), "create new pod")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Equal(t, "1.1", dep.Status.DriverVersion, "driver version after upgrade")
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed: corev1.ConditionTrue,
+				api.VersionSkew:    corev1.ConditionFalse,
+			})
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node DaemonSet")
+			require.Equal(t, appsv1.RollingUpdateDaemonSetStrategyType, ds.Spec.UpdateStrategy.Type, "update strategy after upgrade")
+
+			// Going back is not possible.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.Image = "intel/pmem-csi-driver:v1.0.2"
+			require.NoError(t, tc.c.Update(tc.ctx, dep), "downgrade image")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Equal(t, api.DeploymentPhaseFailed, dep.Status.Phase, "phase after downgrade")
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed: corev1.ConditionTrue,
+				api.VersionSkew:    corev1.ConditionTrue,
+			})
+			for _, c := range dep.Status.Conditions {
+				if c.Type == api.VersionSkew {
+					require.Contains(t, c.Reason, "downgrade", "VersionSkew reason")
+				}
+			}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node DaemonSet")
+			require.Equal(t, "intel/pmem-csi-driver:v1.1.0", ds.Spec.Template.Spec.Containers[0].Image, "driver image kept")
+		})
+
+		t.Run("canary upgrade", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name:  "test-canary-upgrade",
+				image: "intel/pmem-csi-driver:v1.0.2",
+			}
+
+			dep := getDeployment(d)
+			dep.Spec.CanaryNodeLabel = "example.com/canary"
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			newPod := func(name, nodeName, image string) *corev1.Pod {
+				return &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace:         testNamespace,
+						Name:              name,
+						CreationTimestamp: metav1.Now(),
+						Labels: map[string]string{
+							"app.kubernetes.io/name":     "pmem-csi-node",
+							"app.kubernetes.io/instance": d.name,
+						},
+					},
+					Spec: corev1.PodSpec{
+						NodeName:   nodeName,
+						Containers: []corev1.Container{{Name: "pmem-driver", Image: image}},
+					},
+					Status: corev1.PodStatus{
+						Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+					},
+				}
+			}
+			for _, nodeName := range []string{"a-worker", "z-canary"} {
+				node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: nodeName}}
+				if nodeName == "z-canary" {
+					node.Labels = map[string]string{dep.Spec.CanaryNodeLabel: ""}
+				}
+				require.NoError(t, tc.c.Create(tc.ctx, node), "create node %s", nodeName)
+				require.NoError(t, tc.c.Create(tc.ctx, newPod("old-pod-"+nodeName, nodeName, "intel/pmem-csi-driver:v1.0.2")), "create old pod on %s", nodeName)
+				csiNode := &storagev1.CSINode{
+					ObjectMeta: metav1.ObjectMeta{Name: nodeName},
+					Spec: storagev1.CSINodeSpec{
+						Drivers: []storagev1.CSINodeDriver{{Name: dep.CSIDriverName(), NodeID: nodeName}},
+					},
+				}
+				require.NoError(t, tc.c.Create(tc.ctx, csiNode), "create CSINode %s", nodeName)
+			}
+
+			// The canary node goes first although it sorts last.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.Image = "intel/pmem-csi-driver:v1.1.0"
+			require.NoError(t, tc.c.Update(tc.ctx, dep), "update image")
+			tc.testReconcile(d.name, false, false)
+			pod := &corev1.Pod{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: "old-pod-z-canary", Namespace: testNamespace}, pod)
+			require.True(t, errors.IsNotFound(err), "old pod on canary node deleted, got error: %v", err)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: "old-pod-a-worker", Namespace: testNamespace}, pod)
+			require.NoError(t, err, "old pod on other node kept")
+
+			// A crashing driver on the canary node pauses the upgrade.
+			canaryPod := newPod("new-pod-z-canary", "z-canary", "intel/pmem-csi-driver:v1.1.0")
+			canaryPod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "pmem-driver", RestartCount: 1}}
+			require.NoError(t, tc.c.Create(tc.ctx, canaryPod), "create new canary pod")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: "old-pod-a-worker", Namespace: testNamespace}, pod)
+			require.NoError(t, err, "old pod on other node kept while paused")
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Equal(t, "1.0", dep.Status.DriverVersion, "driver version while paused")
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed: corev1.ConditionTrue,
+				api.VersionSkew:    corev1.ConditionTrue,
+			})
+			for _, c := range dep.Status.Conditions {
+				if c.Type == api.VersionSkew {
+					require.Contains(t, c.Reason, "paused", "VersionSkew reason")
+				}
+			}
+
+			// Restarts of a canary pod which happened before the
+			// upgrade started to check it do not count.
+			require.NoError(t, tc.c.Delete(tc.ctx, canaryPod), "delete crashing canary pod")
+			canaryPod = newPod("new-pod-z-canary", "z-canary", "intel/pmem-csi-driver:v1.1.0")
+			canaryPod.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+			canaryPod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "pmem-driver", RestartCount: 3}}
+			require.NoError(t, tc.c.Create(tc.ctx, canaryPod), "create older canary pod")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: "new-pod-z-canary", Namespace: testNamespace}, pod)
+			require.NoError(t, err, "get canary pod")
+			require.Equal(t, "3", pod.Annotations["pmem-csi.intel.com/canary-restarts"], "recorded restart count")
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: "old-pod-a-worker", Namespace: testNamespace}, pod)
+			require.True(t, errors.IsNotFound(err), "old pod on other node deleted, got error: %v", err)
+
+			// Another restart pauses the upgrade again.
+			require.NoError(t, tc.c.Delete(tc.ctx, canaryPod), "delete older canary pod")
+			canaryPod = newPod("new-pod-z-canary", "z-canary", "intel/pmem-csi-driver:v1.1.0")
+			canaryPod.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+			canaryPod.Annotations = map[string]string{"pmem-csi.intel.com/canary-restarts": "3"}
+			canaryPod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "pmem-driver", RestartCount: 4}}
+			require.NoError(t, tc.c.Create(tc.ctx, canaryPod), "create restarted canary pod")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			for _, c := range dep.Status.Conditions {
+				if c.Type == api.VersionSkew {
+					require.Contains(t, c.Reason, "restarted 1 times", "VersionSkew reason")
+				}
+			}
+		})
+
+		t.Run("validate", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-validate",
+			}
+
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			opts := pmemcontroller.ControllerOptions{
+				Namespace:   testNamespace,
+				K8sVersion:  testK8sVersion,
+				DriverImage: testDriverImage,
+			}
+			findings, err := deployment.Validate(tc.ctx, tc.c, opts, d.name)
+			require.NoError(t, err, "validate")
+			for _, finding := range findings {
+				require.NotEqual(t, "missing", finding.Details, "%s", finding.Check)
+			}
+
+			// Remove one object, validate must notice.
+			err = tc.c.Delete(tc.ctx, &storagev1.CSIDriver{ObjectMeta: metav1.ObjectMeta{Name: dep.CSIDriverName()}})
+			require.NoError(t, err, "delete CSIDriver")
+			findings, err = deployment.Validate(tc.ctx, tc.c, opts, d.name)
+			require.NoError(t, err, "validate")
+			require.False(t, findings.OK(), "validation should fail")
+			found := false
+			for _, finding := range findings {
+				if strings.HasPrefix(finding.Check, "CSIDriver ") {
+					require.False(t, finding.OK, "CSIDriver finding")
+					require.Equal(t, "missing", finding.Details, "CSIDriver finding")
+					found = true
+				}
+			}
+			require.True(t, found, "CSIDriver finding in %+v", findings)
+		})
+
+		t.Run("retry with backoff", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-retry",
+			}
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+
+			gvk := appsv1.SchemeGroupVersion.WithKind("DaemonSet")
+			tc.c.(*testClient).InjectErrorOn(&gvk, errors.NewServerTimeout(appsv1.Resource("daemonsets"), "create", 1))
+			req := reconcile.Request{
+				NamespacedName: types.NamespacedName{
+					Name: d.name,
+				},
+			}
+			for i, delay := range []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second} {
+				resp, err := tc.rc.Reconcile(tc.ctx, req)
+				require.NoError(t, err, "reconcile #%d", i)
+				require.Equal(t, delay, resp.RequeueAfter, "requeue delay #%d", i)
+				err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+				require.NoError(t, err, "get deployment")
+				require.Equal(t, api.DeploymentPhaseFailed, dep.Status.Phase, "phase #%d", i)
+				require.Equal(t, int32(i+1), dep.Status.Retries, "retries #%d", i)
+				require.Contains(t, dep.Status.Reason, "retrying in "+delay.String(), "reason #%d", i)
+			}
+
+			patch := client.MergeFrom(dep.DeepCopy())
+			dep.Status.Retries = 10
+			require.NoError(t, tc.c.Status().Patch(tc.ctx, dep, patch), "patch status")
+			resp, err := tc.rc.Reconcile(tc.ctx, req)
+			require.NoError(t, err, "reconcile after last attempt")
+			require.Zero(t, resp.RequeueAfter, "no requeue after last attempt")
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Contains(t, dep.Status.Reason, "giving up after 11 attempts", "reason after last attempt")
+
+			tc.c.(*testClient).InjectErrorOn(nil, nil)
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Zero(t, dep.Status.Retries, "retries after success")
+		})
+
+		t.Run("recover from unexpected shutdown", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+
+			for _, obj := range deployment.CurrentObjects() {
+				gvk := obj.GetObjectKind().GroupVersionKind()
+				tc.c.(*testClient).InjectPanicOn(&gvk)
+
+				d := &pmemDeployment{
+					name: "test-panic-" + strings.ToLower(gvk.Kind),
+				}
+				dep := getDeployment(d)
+				// Enable optional objects, too.
+				dep.Spec.GrafanaDashboards = true
+				err := tc.c.Create(tc.ctx, dep)
+				require.NoError(t, err, "create deployment")
+
+				req := reconcile.Request{
+					NamespacedName: types.NamespacedName{
+						Name: d.name,
+					},
+				}
+
+				defer func() {
+					r := recover()
+					require.NotNil(t, r, "expected to recover from panic")
+
+					tc.c.(*testClient).InjectPanicOn(nil)
+					// mimic operator restart
+					tc.ResetReconciler()
+					tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+					validateDriver(tc, dep, []string{api.EventReasonNew, api.EventReasonRunning}, false)
+				}()
+
+				if _, err := tc.rc.Reconcile(tc.ctx, req); err != nil {
+					t.Fatalf("unexpected error from Reconcile: %v", err)
+				}
+			}
+		})
+	}
+
+	t.Parallel()
+
+	// Validate for all supported Kubernetes versions.
+	versions := map[version.Version]bool{}
+	for _, yaml := range deploy.ListAll() {
+		versions[yaml.Kubernetes] = true
+	}
+	for version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("Kubernetes %v", version), func(t *testing.T) {
+			testIt(t, version)
+		})
+	}
+}
+
+type testClient struct {
+	client.Client
+	assertOn *schema.GroupVersionKind
+	failOn   *schema.GroupVersionKind
+	failErr  error
+}
+
+func newTestClient(initObjs ...runtime.Object) client.Client {
+	// The operator lists pods by node, which needs an index in
+	// the fake client. The status of a PmemCSIDeployment is a
+	// subresource, as in the CRD.
+	c := fake.NewClientBuilder().
+		WithRuntimeObjects(initObjs...).
+		WithStatusSubresource(&api.PmemCSIDeployment{}).
+		WithIndex(&corev1.Pod{}, "spec.nodeName", func(o client.Object) []string {
+			return []string{o.(*corev1.Pod).Spec.NodeName}
+		}).
+		Build()
+	return &testClient{Client: c}
+}
+
+func (t *testClient) InjectPanicOn(gvk *schema.GroupVersionKind) {
+	t.assertOn = gvk
+}
+
+func (t *testClient) InjectErrorOn(gvk *schema.GroupVersionKind, err error) {
+	t.failOn = gvk
+	t.failErr = err
+}
+
+// Create adds given obj to its object tracking list.
+// It panics if the object type matches with the type of 'assertOn'
+// that was previously set using InjectPanicOn() and fails with the
+// error set with InjectErrorOn() for the type of 'failOn'.
+func (t *testClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if t.assertOn != nil && obj.GetObjectKind().GroupVersionKind() == *t.assertOn {
+		panic(fmt.Sprintf("assert: %v", obj.GetObjectKind()))
+	}
+	if t.failOn != nil && obj.GetObjectKind().GroupVersionKind() == *t.failOn {
+		return t.failErr
 	}
 	return t.Client.Create(ctx, obj, opts...)
 }
@@ -0,0 +1,174 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/k8sutil"
+)
+
+// podTemplate returns the pod template of objects which have one,
+// nil for all others.
+func podTemplate(o client.Object) *corev1.PodTemplateSpec {
+	switch o := o.(type) {
+	case *appsv1.DaemonSet:
+		return &o.Spec.Template
+	case *appsv1.Deployment:
+		return &o.Spec.Template
+	}
+	return nil
+}
+
+// podTemplateHash returns a hash of the pod template or the empty
+// string if there is none.
+func podTemplateHash(template *corev1.PodTemplateSpec) (string, error) {
+	if template == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(template)
+	if err != nil {
+		return "", fmt.Errorf("encode pod template: %v", err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+// desiredPodTemplate generates the object from scratch, the same way
+// as when creating it, and returns its pod template. Unlike the
+// object in redeploy, which starts with a copy of the live object,
+// the result only contains the fields set by the operator, not those
+// added by the apiserver. Nil for objects without a pod template.
+func (d *pmemCSIDeployment) desiredPodTemplate(ro redeployObject, name string) (*corev1.PodTemplateSpec, error) {
+	o := ro.object(d)
+	if podTemplate(o) == nil {
+		return nil, nil
+	}
+	o.SetName(name)
+	if err := ro.modify(d, o); err != nil {
+		return nil, err
+	}
+	d.rewriteReferences(o)
+	if err := k8sutil.PatchObject(o, ro.objType.Elem().Name(), d.Spec.Patches, o); err != nil {
+		return nil, err
+	}
+	return podTemplate(o), nil
+}
+
+// isManuallyChanged checks whether the pod template of the object as
+// retrieved from the apiserver still has the values that the operator
+// set. The apiserver adds defaults for fields that the operator leaves
+// unset, so only the fields in the desired template are compared.
+// When the operator wants a different template than last time,
+// the live object gets updated anyway and is not considered changed.
+func (d *pmemCSIDeployment) isManuallyChanged(live client.Object, desired *corev1.PodTemplateSpec, desiredHash string) (bool, error) {
+	if desired == nil || d.Status.PodTemplateHashes[live.GetName()] != desiredHash {
+		return false, nil
+	}
+	liveTemplate := podTemplate(live)
+	if liveTemplate == nil {
+		return false, nil
+	}
+	contained, err := jsonContains(liveTemplate, desired)
+	if err != nil {
+		return false, fmt.Errorf("compare pod templates: %v", err)
+	}
+	return !contained, nil
+}
+
+// jsonContains checks that all values which are set in the JSON
+// encoding of b have the same value in a. Lists must have the same
+// length, their entries get compared one-by-one.
+func jsonContains(a, b interface{}) (bool, error) {
+	var values [2]interface{}
+	for i, obj := range []interface{}{a, b} {
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return false, err
+		}
+		if err := json.Unmarshal(data, &values[i]); err != nil {
+			return false, err
+		}
+	}
+	return valueContains(values[0], values[1]), nil
+}
+
+func valueContains(a, b interface{}) bool {
+	switch b := b.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		a, ok := a.(map[string]interface{})
+		if !ok {
+			return len(b) == 0 && a == nil
+		}
+		for key, value := range b {
+			if !valueContains(a[key], value) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		a, ok := a.([]interface{})
+		if !ok {
+			return len(b) == 0 && a == nil
+		}
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range b {
+			if !valueContains(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+// rememberPodTemplateHash stores the hash of the pod template that
+// was applied to the object.
+func (d *pmemCSIDeployment) rememberPodTemplateHash(name, hash string) {
+	if hash == "" {
+		return
+	}
+	if d.Status.PodTemplateHashes == nil {
+		d.Status.PodTemplateHashes = map[string]string{}
+	}
+	d.Status.PodTemplateHashes[name] = hash
+}
+
+// setDegraded updates the Degraded condition. The condition only
+// gets added when there are manually changed objects, so
+// deployments which never had any don't have it at all.
+func (d *pmemCSIDeployment) setDegraded() {
+	if len(d.changedObjects) == 0 {
+		for _, c := range d.Status.Conditions {
+			if c.Type == api.Degraded {
+				d.SetCondition(api.Degraded, corev1.ConditionFalse, "No manual changes.")
+				return
+			}
+		}
+		return
+	}
+	names := make([]string, 0, len(d.changedObjects))
+	for name := range d.changedObjects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	d.SetCondition(api.Degraded, corev1.ConditionTrue,
+		fmt.Sprintf("Pod template modified outside of the operator: %s.", strings.Join(names, ", ")))
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/intel/pmem-csi/pkg/configfile"
+)
+
+const (
+	// driverConfigDir is where the ConfigMap with Spec.DriverConfig
+	// gets mounted in the driver containers.
+	driverConfigDir = "/etc/pmem-csi"
+	// driverConfigFile is the key in that ConfigMap.
+	driverConfigFile = "config.yaml"
+	// driverConfigHashAnnotation is set in the pod templates. It
+	// changes when a setting changes which the driver only reads
+	// during startup, which then replaces the pods.
+	driverConfigHashAnnotation = "pmem-csi.intel.com/config-hash"
+)
+
+// getDriverConfig stores Spec.DriverConfig in the ConfigMap in the
+// format expected by the -config parameter of the driver.
+func (d *pmemCSIDeployment) getDriverConfig(cm *corev1.ConfigMap) error {
+	data, err := yaml.Marshal(d.Spec.DriverConfig)
+	if err != nil {
+		return fmt.Errorf("encode driver config: %v", err)
+	}
+	cm.Data = map[string]string{
+		driverConfigFile: string(data),
+	}
+	return nil
+}
+
+// setDriverConfig mounts the ConfigMap with Spec.DriverConfig into
+// the driver container of the pod template. Settings in the
+// ConfigMap replace the command line parameters for the same flags
+// because the driver gives the command line precedence.
+func (d *pmemCSIDeployment) setDriverConfig(template *corev1.PodTemplateSpec) {
+	if len(d.Spec.DriverConfig) == 0 {
+		return
+	}
+	for i := range template.Spec.Containers {
+		c := &template.Spec.Containers[i]
+		if c.Name != "pmem-driver" {
+			continue
+		}
+		var command []string
+		for _, arg := range c.Command {
+			name := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+			if _, ok := d.Spec.DriverConfig[name]; ok && strings.HasPrefix(arg, "-") {
+				continue
+			}
+			command = append(command, arg)
+		}
+		c.Command = append(command, "-config="+driverConfigDir+"/"+driverConfigFile)
+		c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+			Name:      "driver-config",
+			MountPath: driverConfigDir,
+			ReadOnly:  true,
+		})
+	}
+	template.Spec.Volumes = append(template.Spec.Volumes, corev1.Volume{
+		Name: "driver-config",
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: d.DriverConfigName(),
+				},
+			},
+		},
+	})
+	template.Annotations = joinMaps(template.Annotations, map[string]string{
+		driverConfigHashAnnotation: d.driverConfigHash(),
+	})
+}
+
+// driverConfigHash covers all settings which are not updated while
+// the driver runs.
+func (d *pmemCSIDeployment) driverConfigHash() string {
+	var settings []string
+	for name, value := range d.Spec.DriverConfig {
+		if !configfile.Dynamic[name] {
+			settings = append(settings, name+"="+value)
+		}
+	}
+	sort.Strings(settings)
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(settings, "\n"))))
+}
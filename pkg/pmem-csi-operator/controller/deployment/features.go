@@ -0,0 +1,52 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"fmt"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemcontroller "github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller"
+
+	"k8s.io/component-base/featuregate"
+)
+
+// deploymentFeatures returns the features for the deployment: the
+// ones enabled for the operator, overridden by the feature gates
+// annotation of the deployment.
+func deploymentFeatures(operatorFeatures featuregate.MutableFeatureGate, deployment *api.PmemCSIDeployment) (featuregate.FeatureGate, error) {
+	if operatorFeatures == nil {
+		operatorFeatures = pmemcontroller.NewFeatureGate()
+	}
+	value, ok := deployment.Annotations[api.FeatureGatesAnnotation]
+	if !ok {
+		return operatorFeatures, nil
+	}
+	features := operatorFeatures.DeepCopy()
+	if err := features.Set(value); err != nil {
+		return nil, fmt.Errorf("%s annotation: %v", api.FeatureGatesAnnotation, err)
+	}
+	return features, nil
+}
+
+// enabled checks a feature for the deployment.
+func (d *pmemCSIDeployment) enabled(feature featuregate.Feature) bool {
+	if d.features == nil {
+		return pmemcontroller.DefaultFeatureGates[feature].Default
+	}
+	return d.features.Enabled(feature)
+}
+
+// featureStatus lists all operator features and whether they are
+// enabled for the deployment.
+func (d *pmemCSIDeployment) featureStatus() map[string]bool {
+	status := make(map[string]bool, len(pmemcontroller.DefaultFeatureGates))
+	for feature := range pmemcontroller.DefaultFeatureGates {
+		status[string(feature)] = d.enabled(feature)
+	}
+	return status
+}
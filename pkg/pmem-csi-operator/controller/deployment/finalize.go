@@ -0,0 +1,245 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	pmemcontroller "github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller"
+)
+
+// finalizeRetryDelay is how long to wait before checking again
+// whether pods still use volumes.
+const finalizeRetryDelay = 30 * time.Second
+
+// maxPodsInEvent limits how many pods get listed in the event about
+// waiting for them.
+const maxPodsInEvent = 5
+
+// addFinalizer ensures that a deployment cannot be removed before
+// finalize is done with it.
+func (r *ReconcileDeployment) addFinalizer(ctx context.Context, deployment *api.PmemCSIDeployment) error {
+	if controllerutil.ContainsFinalizer(deployment, api.NodeDriverFinalizer) {
+		return nil
+	}
+	patch := client.MergeFrom(deployment.DeepCopy())
+	controllerutil.AddFinalizer(deployment, api.NodeDriverFinalizer)
+	if err := r.client.Patch(ctx, deployment, patch); err != nil {
+		return fmt.Errorf("add finalizer: %v", err)
+	}
+	return nil
+}
+
+// finalize deletes a deployment in the right order. The controller
+// gets removed immediately. The node driver must remain until no
+// pod uses a PMEM-CSI volume anymore, otherwise those volumes could
+// not be unmounted. Once that is the case or the user forces the
+// deletion, the finalizer gets removed and garbage collection takes
+// care of the remaining objects. When the deployment is annotated for
+// uninstalling, the PMEM setup gets removed from the nodes first.
+func (r *ReconcileDeployment) finalize(ctx context.Context, deployment *api.PmemCSIDeployment) (reconcile.Result, error) {
+	if !controllerutil.ContainsFinalizer(deployment, api.NodeDriverFinalizer) {
+		return reconcile.Result{}, nil
+	}
+	l := klog.FromContext(ctx).WithName("finalize")
+
+	d, err := r.newDeployment(ctx, deployment.DeepCopy())
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := d.deleteControllerObjects(ctx, r); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if deployment.Annotations[api.ForceDeleteAnnotation] == "true" {
+		l.Info("Forced deletion, not checking for volumes in use")
+	} else {
+		pods, err := d.podsWithVolumes(ctx, r)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if len(pods) > 0 {
+			examples := pods
+			if len(examples) > maxPodsInEvent {
+				examples = append(examples[:maxPodsInEvent:maxPodsInEvent], "...")
+			}
+			msg := fmt.Sprintf("Waiting for %d pod(s) with PMEM-CSI volumes before removing the node driver: %s. Annotate with %s=true to delete anyway.",
+				len(pods), strings.Join(examples, ", "), api.ForceDeleteAnnotation)
+			l.V(3).Info(msg)
+			r.evRecorder.Event(deployment, corev1.EventTypeNormal, api.EventReasonDeleting, msg)
+			return reconcile.Result{RequeueAfter: finalizeRetryDelay}, nil
+		}
+	}
+
+	ok, force := uninstallMode(deployment)
+	if ok && !d.enabled(pmemcontroller.Uninstall) {
+		msg := fmt.Sprintf("Ignoring %s annotation because the %s feature is disabled", api.UninstallAnnotation, pmemcontroller.Uninstall)
+		l.Info(msg)
+		r.evRecorder.Event(deployment, corev1.EventTypeWarning, api.EventReasonDeleting, msg)
+		ok = false
+	}
+	if ok {
+		done, msg, err := d.uninstall(ctx, r, force)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if !done {
+			l.V(3).Info(msg)
+			r.evRecorder.Event(deployment, corev1.EventTypeNormal, api.EventReasonUninstalling, msg)
+			return reconcile.Result{RequeueAfter: finalizeRetryDelay}, nil
+		}
+	}
+
+	patch := client.MergeFrom(deployment.DeepCopy())
+	controllerutil.RemoveFinalizer(deployment, api.NodeDriverFinalizer)
+	if err := r.client.Patch(ctx, deployment, patch); err != nil {
+		return reconcile.Result{}, fmt.Errorf("remove finalizer: %v", err)
+	}
+	l.V(3).Info("Removed finalizer")
+	return reconcile.Result{}, nil
+}
+
+// isControllerObject identifies the sub-object handlers for objects
+// that are not needed by the node driver.
+func isControllerObject(name string) bool {
+	return name == "controller driver" || strings.HasPrefix(name, "webhooks ")
+}
+
+// deleteControllerObjects deletes all objects which belong to the
+// controller part of the driver.
+func (d *pmemCSIDeployment) deleteControllerObjects(ctx context.Context, r *ReconcileDeployment) error {
+	l := klog.FromContext(ctx)
+	if err := d.findAdopted(ctx, r); err != nil {
+		return err
+	}
+	for name, handler := range d.allSubObjectHandlers() {
+		if !isControllerObject(name) {
+			continue
+		}
+		obj := handler.object(d)
+		d.useAdoptedName(ctx, obj)
+		if err := r.client.Delete(ctx, obj); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return fmt.Errorf("delete %s: %v", name, err)
+		}
+		l.V(3).Info("Deleted", "object", pmemlog.KObjWithType(obj))
+	}
+	return nil
+}
+
+// podsWithVolumes returns the names of all pods which have not
+// terminated and use a persistent, generic ephemeral or CSI ephemeral
+// inline volume of the driver. Such pods can only run on nodes with
+// the driver, so only the pods of those nodes get checked. They are
+// read directly from the apiserver because the operator does not
+// cache pods outside of its own namespace.
+func (d *pmemCSIDeployment) podsWithVolumes(ctx context.Context, r *ReconcileDeployment) ([]string, error) {
+	pvs := &corev1.PersistentVolumeList{}
+	if err := r.client.List(ctx, pvs); err != nil {
+		return nil, fmt.Errorf("list PVs: %v", err)
+	}
+	claims := map[string]bool{}
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == d.CSIDriverName() && pv.Spec.ClaimRef != nil {
+			claims[pv.Spec.ClaimRef.Namespace+"/"+pv.Spec.ClaimRef.Name] = true
+		}
+	}
+
+	nodes, err := d.driverNodes(ctx, r.client)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, node := range nodes {
+		pods := &corev1.PodList{}
+		if err := r.apiReader.List(ctx, pods, client.MatchingFields{"spec.nodeName": node}); err != nil {
+			return nil, fmt.Errorf("list pods on node %s: %v", node, err)
+		}
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+				continue
+			}
+			if d.usesVolumes(pod, claims) {
+				names = append(names, pod.Namespace+"/"+pod.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// usesVolumes checks whether the pod has a volume of the driver.
+// claims contains the <namespace>/<name> of all PVCs which are
+// bound to a volume of the driver.
+func (d *pmemCSIDeployment) usesVolumes(pod *corev1.Pod, claims map[string]bool) bool {
+	for _, volume := range pod.Spec.Volumes {
+		switch {
+		case volume.CSI != nil:
+			if volume.CSI.Driver == d.CSIDriverName() {
+				return true
+			}
+		case volume.PersistentVolumeClaim != nil:
+			if claims[pod.Namespace+"/"+volume.PersistentVolumeClaim.ClaimName] {
+				return true
+			}
+		case volume.Ephemeral != nil:
+			// The PVC of a generic ephemeral volume is named
+			// after the pod and the volume.
+			if claims[pod.Namespace+"/"+pod.Name+"-"+volume.Name] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// driverNodes returns the names of all nodes where kubelet has the
+// driver registered or a node driver pod is scheduled, sorted.
+func (d *pmemCSIDeployment) driverNodes(ctx context.Context, c client.Client) ([]string, error) {
+	nodes := map[string]bool{}
+	csiNodes := &storagev1.CSINodeList{}
+	if err := c.List(ctx, csiNodes); err != nil {
+		return nil, fmt.Errorf("list CSINodes: %v", err)
+	}
+	for _, csiNode := range csiNodes.Items {
+		for _, driver := range csiNode.Spec.Drivers {
+			if driver.Name == d.CSIDriverName() {
+				nodes[csiNode.Name] = true
+			}
+		}
+	}
+	pods := &corev1.PodList{}
+	if err := c.List(ctx, pods, client.InNamespace(d.namespace), client.MatchingLabels{
+		"app.kubernetes.io/name":     "pmem-csi-node",
+		"app.kubernetes.io/instance": d.GetName(),
+	}); err != nil {
+		return nil, fmt.Errorf("list node driver pods: %v", err)
+	}
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName != "" {
+			nodes[pod.Spec.NodeName] = true
+		}
+	}
+	return sortedNames(nodes), nil
+}
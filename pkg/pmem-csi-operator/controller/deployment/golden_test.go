@@ -0,0 +1,181 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package deployment_test
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	"github.com/intel/pmem-csi/deploy"
+	"github.com/intel/pmem-csi/pkg/apis"
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller/deployment"
+	"github.com/intel/pmem-csi/pkg/version"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "write the objects created by the operator into testdata/golden instead of comparing against those files")
+
+const goldenDir = "testdata/golden"
+
+// goldenDeployments are the input for TestGolden. The expected
+// objects for each of them are stored in a directory of the same
+// name under testdata/golden, one file per object.
+var goldenDeployments = map[string]pmemDeployment{
+	"lvm": {
+		name:       "pmem-csi.intel.com",
+		deviceMode: "lvm",
+	},
+	"direct": {
+		name:       "pmem-csi.intel.com",
+		deviceMode: "direct",
+	},
+	"explicit-values": {
+		name:                "pmem-csi.example.com",
+		deviceMode:          "lvm",
+		image:               "test-driver:v0.0.0",
+		provisionerImage:    "test-provisioner-image:v0.0.0",
+		registrarImage:      "test-driver-registrar-image:v0.0.0",
+		pullPolicy:          "Never",
+		logLevel:            10,
+		logFormat:           "json",
+		controllerCPU:       "1500m",
+		controllerMemory:    "300Mi",
+		controllerReplicas:  2,
+		nodeCPU:             "1000m",
+		nodeMemory:          "500Mi",
+		provisionerCPU:      "100m",
+		provisionerMemory:   "250Mi",
+		nodeRegistarCPU:     "300m",
+		nodeRegistrarMemory: "350Mi",
+		kubeletDir:          "/some/directory",
+	},
+}
+
+// TestGolden reconciles each of the goldenDeployments with a fake
+// client and compares all objects created for it against the golden
+// files. Intentional changes of the generated objects must be
+// reviewed by updating those files with:
+//
+//	go test ./pkg/pmem-csi-operator/controller/deployment -run TestGolden -update-golden
+func TestGolden(t *testing.T) {
+	err := apis.AddToScheme(scheme.Scheme)
+	require.NoError(t, err, "add api schema")
+
+	// Other Kubernetes versions are covered by TestDeploymentController.
+	var k8sVersion version.Version
+	for _, file := range deploy.ListAll() {
+		if file.Kubernetes.CompareVersion(k8sVersion) > 0 {
+			k8sVersion = file.Kubernetes
+		}
+	}
+
+	for name, d := range goldenDeployments {
+		name, d := name, d
+		t.Run(name, func(t *testing.T) {
+			tc := newTestContext(t, k8sVersion)
+			defer tc.UnsetEventWatcher()
+
+			dep := getDeployment(&d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			actual := goldenObjects(t, tc, dep)
+			dir := filepath.Join(goldenDir, name)
+			if *updateGolden {
+				require.NoError(t, os.RemoveAll(dir), "remove old golden files")
+				require.NoError(t, os.MkdirAll(dir, 0755), "create golden directory")
+				for fileName, content := range actual {
+					require.NoError(t, os.WriteFile(filepath.Join(dir, fileName), []byte(content), 0644), "write %s", fileName)
+				}
+				return
+			}
+
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err, "read golden directory, create it with -update-golden")
+			expected := map[string]string{}
+			for _, entry := range entries {
+				content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+				require.NoError(t, err, "read golden file")
+				expected[entry.Name()] = string(content)
+			}
+
+			assert.Equal(t, sortedKeys(expected), sortedKeys(actual), "generated objects")
+			for fileName, content := range actual {
+				if expectedContent, ok := expected[fileName]; ok {
+					assert.Equal(t, expectedContent, content, "content of %s", fileName)
+				}
+			}
+		})
+	}
+}
+
+// goldenObjects returns all objects owned by the deployment,
+// serialized as YAML with fields removed that change each time.
+// The key is the file name for the object.
+func goldenObjects(t *testing.T, tc *testContext, dep *api.PmemCSIDeployment) map[string]string {
+	objects := map[string]string{}
+	for _, list := range deployment.AllObjectLists() {
+		err := tc.c.List(tc.ctx, list, &client.ListOptions{})
+		require.NoError(t, err, "list %s", list.GetKind())
+		for _, obj := range list.Items {
+			if !isOwnedByDeployment(&obj, dep) {
+				continue
+			}
+			normalizeGoldenObject(&obj)
+			content, err := yaml.Marshal(obj.Object)
+			require.NoError(t, err, "encode %s %s", obj.GetKind(), obj.GetName())
+			fileName := strings.ToLower(obj.GetKind()) + "_" + obj.GetName() + ".yaml"
+			objects[fileName] = string(content)
+		}
+	}
+	return objects
+}
+
+func isOwnedByDeployment(obj *unstructured.Unstructured, dep *api.PmemCSIDeployment) bool {
+	for _, owner := range obj.GetOwnerReferences() {
+		if owner.UID == dep.UID {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeGoldenObject removes fields which are set by the API
+// server and replaces generated keys and certificates.
+func normalizeGoldenObject(obj *unstructured.Unstructured) {
+	unstructured.RemoveNestedField(obj.Object, "metadata", "resourceVersion")
+	unstructured.RemoveNestedField(obj.Object, "metadata", "creationTimestamp")
+	unstructured.RemoveNestedField(obj.Object, "metadata", "managedFields")
+	if obj.GetKind() == "Secret" {
+		if data, ok, _ := unstructured.NestedMap(obj.Object, "data"); ok {
+			for key := range data {
+				data[key] = "<generated>"
+			}
+			_ = unstructured.SetNestedMap(obj.Object, data, "data")
+		}
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"embed"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+//go:embed dashboards/*.json
+var dashboards embed.FS
+
+const (
+	// grafanaDashboardLabel is the label that the Grafana
+	// dashboard sidecar looks for by default.
+	grafanaDashboardLabel = "grafana_dashboard"
+
+	// dashboardDriverName gets replaced with the driver name in
+	// the dashboards. They only show metrics of that driver.
+	dashboardDriverName = "@DRIVER_NAME@"
+)
+
+// getGrafanaDashboards stores all dashboards in the ConfigMap, one
+// JSON file per dashboard.
+func (d *pmemCSIDeployment) getGrafanaDashboards(cm *corev1.ConfigMap) error {
+	entries, err := dashboards.ReadDir("dashboards")
+	if err != nil {
+		return err
+	}
+	cm.Data = map[string]string{}
+	for _, entry := range entries {
+		content, err := dashboards.ReadFile(path.Join("dashboards", entry.Name()))
+		if err != nil {
+			return err
+		}
+		cm.Data[entry.Name()] = strings.ReplaceAll(string(content), dashboardDriverName, d.GetName())
+	}
+	cm.Labels = joinMaps(cm.Labels, map[string]string{
+		grafanaDashboardLabel: "1",
+	})
+	return nil
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+
+	"k8s.io/klog/v2"
+)
+
+// recordAppliedSpec stores the spec of a successfully reconciled
+// deployment in the status. When it differs from the spec recorded
+// before, the changed fields get logged. The log is the audit trail
+// because events expire after a while.
+func recordAppliedSpec(ctx context.Context, spec *api.DeploymentSpec, status *api.DeploymentStatus) {
+	l := klog.FromContext(ctx)
+	applied, err := json.Marshal(spec)
+	if err != nil {
+		l.Error(err, "encode applied spec")
+		return
+	}
+	last := status.LastAppliedSpec
+	status.LastAppliedSpec = string(applied)
+	if last == "" || last == string(applied) {
+		return
+	}
+	changes, err := specChanges([]byte(last), applied)
+	if err != nil {
+		l.Error(err, "compare with last applied spec")
+		return
+	}
+	if len(changes) > 0 {
+		l.Info("applied spec changes", "changes", changes)
+	}
+}
+
+// specChanges compares two specs in JSON format and describes each
+// changed field as "<path>: <old value> -> <new value>", sorted by
+// path. Lists are compared as a whole.
+func specChanges(oldSpec, newSpec []byte) ([]string, error) {
+	var oldValue, newValue interface{}
+	if err := json.Unmarshal(oldSpec, &oldValue); err != nil {
+		return nil, fmt.Errorf("decode old spec: %v", err)
+	}
+	if err := json.Unmarshal(newSpec, &newValue); err != nil {
+		return nil, fmt.Errorf("decode new spec: %v", err)
+	}
+	var changes []string
+	diffJSON("", oldValue, newValue, &changes)
+	return changes, nil
+}
+
+func diffJSON(path string, oldValue, newValue interface{}, changes *[]string) {
+	oldMap, oldIsMap := oldValue.(map[string]interface{})
+	newMap, newIsMap := newValue.(map[string]interface{})
+	if oldIsMap && newIsMap {
+		keys := map[string]bool{}
+		for key := range oldMap {
+			keys[key] = true
+		}
+		for key := range newMap {
+			keys[key] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for key := range keys {
+			sorted = append(sorted, key)
+		}
+		sort.Strings(sorted)
+		for _, key := range sorted {
+			subPath := key
+			if path != "" {
+				subPath = path + "." + key
+			}
+			diffJSON(subPath, oldMap[key], newMap[key], changes)
+		}
+		return
+	}
+	if reflect.DeepEqual(oldValue, newValue) {
+		return
+	}
+	*changes = append(*changes, fmt.Sprintf("%s: %s -> %s", path, formatJSON(oldValue), formatJSON(newValue)))
+}
+
+func formatJSON(value interface{}) string {
+	if value == nil {
+		return "<unset>"
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(data)
+}
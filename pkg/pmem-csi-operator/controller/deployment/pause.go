@@ -0,0 +1,28 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// setPaused updates the Paused condition. Like the Degraded condition,
+// it only gets added when needed.
+func setPaused(dep *api.PmemCSIDeployment) {
+	if dep.Spec.Paused {
+		dep.SetCondition(api.Paused, corev1.ConditionTrue, "Reconciliation is paused, the operator does not change anything.")
+		return
+	}
+	for _, c := range dep.Status.Conditions {
+		if c.Type == api.Paused {
+			dep.SetCondition(api.Paused, corev1.ConditionFalse, "Reconciliation was resumed.")
+			return
+		}
+	}
+}
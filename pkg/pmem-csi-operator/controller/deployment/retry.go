@@ -0,0 +1,86 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Failed reconcile attempts are retried with exponential backoff,
+// starting at minRetryDelay and doubling up to maxRetryDelay. After
+// maxRetries consecutive failures the operator gives up until the
+// PmemCSIDeployment or one of its sub-objects changes.
+const (
+	minRetryDelay = 5 * time.Second
+	maxRetryDelay = 2 * time.Minute
+	maxRetries    = 10
+)
+
+// permanentError marks reconcile failures which trying again cannot
+// fix, for example an invalid spec.
+type permanentError struct {
+	error
+}
+
+func (p permanentError) Unwrap() error {
+	return p.error
+}
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+func isPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// retryDelay returns how long to wait before the next attempt after
+// the given number of consecutive failures.
+func retryDelay(retries int32) time.Duration {
+	delay := minRetryDelay
+	for i := int32(1); i < retries && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// failed records a reconcile failure in the status of the deployment
+// and decides whether and when to try again.
+func (r *ReconcileDeployment) failed(ctx context.Context, dep *api.PmemCSIDeployment, err error) reconcile.Result {
+	l := klog.FromContext(ctx)
+	l.Error(err, "reconcile failed")
+	dep.Status.Phase = api.DeploymentPhaseFailed
+	r.evRecorder.Event(dep, corev1.EventTypeWarning, api.EventReasonFailed, err.Error())
+
+	if isPermanent(err) {
+		dep.Status.Reason = err.Error()
+		return reconcile.Result{}
+	}
+
+	dep.Status.Retries++
+	if dep.Status.Retries > maxRetries {
+		dep.Status.Reason = fmt.Sprintf("%v (giving up after %d attempts)", err, dep.Status.Retries)
+		return reconcile.Result{}
+	}
+	delay := retryDelay(dep.Status.Retries)
+	dep.Status.Reason = fmt.Sprintf("%v (attempt %d, retrying in %s)", err, dep.Status.Retries, delay)
+	l.V(3).Info("retrying", "attempt", dep.Status.Retries, "delay", delay)
+	return reconcile.Result{RequeueAfter: delay}
+}
@@ -10,6 +10,7 @@ package testcases
 
 import (
 	"fmt"
+	"time"
 
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
 
@@ -75,6 +76,14 @@ func UpdateTests() []UpdateTest {
 				},
 			}
 		},
+		"nodeSetupResources": func(d *api.PmemCSIDeployment) {
+			d.Spec.NodeSetupResources = &corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("201m"),
+					corev1.ResourceMemory: resource.MustParse("201Mi"),
+				},
+			}
+		},
 		"logLevel": func(d *api.PmemCSIDeployment) {
 			d.Spec.LogLevel++
 		},
@@ -93,6 +102,26 @@ func UpdateTests() []UpdateTest {
 		"pmemPercentage": func(d *api.PmemCSIDeployment) {
 			d.Spec.PMEMPercentage++
 		},
+		"pmemPercentageNodeLabel": func(d *api.PmemCSIDeployment) {
+			d.Spec.PMEMPercentageNodeLabel = "example.com/pmem-percentage"
+		},
+		"dryRun": func(d *api.PmemCSIDeployment) {
+			d.Spec.DryRun = true
+		},
+		"driverFeatureGates": func(d *api.PmemCSIDeployment) {
+			// Expansion gets rejected in direct mode.
+			d.Spec.DriverFeatureGates = map[string]bool{"Expansion": d.Spec.DeviceMode != api.DeviceModeDirect}
+		},
+		"ephemeralQuota": func(d *api.PmemCSIDeployment) {
+			perPod := resource.MustParse("1Gi")
+			perNode := resource.MustParse("10Gi")
+			d.Spec.EphemeralQuotaPerPod = &perPod
+			d.Spec.EphemeralQuotaPerNode = &perNode
+		},
+		"lostVolumes": func(d *api.PmemCSIDeployment) {
+			d.Spec.LostNodeGracePeriod = &metav1.Duration{Duration: 24 * time.Hour}
+			d.Spec.DeleteLostVolumes = true
+		},
 		"labels": func(d *api.PmemCSIDeployment) {
 			if d.Spec.Labels == nil {
 				d.Spec.Labels = map[string]string{}
@@ -102,6 +131,44 @@ func UpdateTests() []UpdateTest {
 		"kubeletDir": func(d *api.PmemCSIDeployment) {
 			d.Spec.KubeletDir = "/foo/bar"
 		},
+		"sidecarLogging": func(d *api.PmemCSIDeployment) {
+			logLevel := uint16(1)
+			logToStderr := true
+			d.Spec.SidecarLogging = &api.SidecarLogging{
+				LogLevel:        &logLevel,
+				LogToStderr:     &logToStderr,
+				StderrThreshold: "ERROR",
+			}
+		},
+		"podSecurity": func(d *api.PmemCSIDeployment) {
+			d.Spec.Platform = api.PlatformKubernetes
+			d.Spec.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+			d.Spec.AppArmorProfile = "runtime/default"
+		},
+		"imageRegistry": func(d *api.PmemCSIDeployment) {
+			d.Spec.ImageRegistry = "mirror.example.com:5000"
+			d.Spec.ImageOverrides = map[string]string{
+				api.DefaultRegistrarImage: "mirror.example.com:5000/csi-node-driver-registrar@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			}
+			d.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "mirror-credentials"}}
+		},
+		"patches": func(d *api.PmemCSIDeployment) {
+			d.Spec.Patches = []api.ObjectPatch{
+				{
+					Kind: "DaemonSet",
+					Patch: `spec:
+  template:
+    spec:
+      priorityClassName: system-node-critical
+`,
+				},
+				{
+					Kind:  "Deployment",
+					Type:  api.PatchTypeJSON,
+					Patch: `[{"op": "add", "path": "/spec/template/metadata/annotations", "value": {"example.com/patched": "true"}}]`,
+				},
+			}
+		},
 	}
 
 	full := api.PmemCSIDeployment{
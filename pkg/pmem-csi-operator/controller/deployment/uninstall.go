@@ -0,0 +1,195 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+)
+
+// uninstall removes the driver from all nodes. The node driver
+// DaemonSets get deleted first because they must not modify PMEM
+// concurrently. Then a DaemonSet runs the driver in uninstall mode
+// on the same nodes. Once all of its pods are ready, the work is done
+// and the DaemonSet gets deleted again. It returns true when nothing
+// is left to do and a message for the user when it has to be called
+// again later.
+func (d *pmemCSIDeployment) uninstall(ctx context.Context, r *ReconcileDeployment, force bool) (bool, string, error) {
+	l := klog.FromContext(ctx).WithName("uninstall")
+
+	if err := d.findAdopted(ctx, r); err != nil {
+		return false, "", err
+	}
+	daemonSetType := reflect.TypeOf(&appsv1.DaemonSet{})
+	for name, handler := range d.allSubObjectHandlers() {
+		if handler.objType != daemonSetType {
+			continue
+		}
+		obj := handler.object(d)
+		d.useAdoptedName(ctx, obj)
+		if err := r.client.Delete(ctx, obj); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return false, "", fmt.Errorf("delete %s: %v", name, err)
+		}
+		l.V(3).Info("Deleted", "object", pmemlog.KObjWithType(obj))
+	}
+	pods := &corev1.PodList{}
+	if err := r.client.List(ctx, pods, client.InNamespace(d.namespace), client.MatchingLabels{
+		"app.kubernetes.io/name":     "pmem-csi-node",
+		"app.kubernetes.io/instance": d.Name,
+	}); err != nil {
+		return false, "", fmt.Errorf("list node driver pods: %v", err)
+	}
+	if len(pods.Items) > 0 {
+		return false, fmt.Sprintf("Waiting for %d node driver pod(s) to terminate before uninstalling.", len(pods.Items)), nil
+	}
+
+	ds := &appsv1.DaemonSet{ObjectMeta: d.getObjectMeta(d.NodeUninstallName(), false)}
+	err := r.client.Get(ctx, client.ObjectKeyFromObject(ds), ds)
+	switch {
+	case errors.IsNotFound(err):
+		d.getNodeUninstallDaemonSet(ds, force)
+		d.rewritePodReferences(&ds.Spec.Template.Spec)
+		if err := r.client.Create(ctx, ds); err != nil {
+			return false, "", fmt.Errorf("create uninstall DaemonSet: %v", err)
+		}
+		l.V(3).Info("Created", "object", pmemlog.KObjWithType(ds))
+		return false, "Started removing PMEM-CSI from the nodes.", nil
+	case err != nil:
+		return false, "", fmt.Errorf("get uninstall DaemonSet: %v", err)
+	}
+
+	status := ds.Status
+	if status.ObservedGeneration < ds.Generation || status.NumberReady < status.DesiredNumberScheduled {
+		return false, fmt.Sprintf("Waiting for PMEM-CSI removal on %d of %d node(s). Check the logs of the %s pods in case of problems.",
+			status.DesiredNumberScheduled-status.NumberReady, status.DesiredNumberScheduled, d.NodeUninstallName()), nil
+	}
+	if err := r.client.Delete(ctx, ds); err != nil && !errors.IsNotFound(err) {
+		return false, "", fmt.Errorf("delete uninstall DaemonSet: %v", err)
+	}
+	l.V(3).Info("Removed PMEM-CSI from all nodes", "nodes", status.DesiredNumberScheduled)
+	return true, "", nil
+}
+
+// getNodeUninstallDaemonSet runs the driver in uninstall mode on all
+// nodes of the deployment.
+func (d *pmemCSIDeployment) getNodeUninstallDaemonSet(ds *appsv1.DaemonSet, force bool) {
+	directoryOrCreate := corev1.HostPathDirectoryOrCreate
+	labels := map[string]string{
+		"app.kubernetes.io/name":      "pmem-csi-node-uninstall",
+		"app.kubernetes.io/part-of":   "pmem-csi",
+		"app.kubernetes.io/component": "node-uninstall",
+		"app.kubernetes.io/instance":  d.Name,
+	}
+	ds.Labels = labels
+	ds.Spec.Selector = &metav1.LabelSelector{
+		MatchLabels: map[string]string{
+			"app.kubernetes.io/name":     "pmem-csi-node-uninstall",
+			"app.kubernetes.io/instance": d.Name,
+		},
+	}
+	ds.Spec.Template.Labels = joinMaps(d.Spec.Labels, joinMaps(labels, map[string]string{
+		"pmem-csi.intel.com/webhook": "ignore",
+	}))
+	podSpec := &ds.Spec.Template.Spec
+	podSpec.ServiceAccountName = d.ProvisionerServiceAccountName()
+	podSpec.ImagePullSecrets = d.Spec.ImagePullSecrets
+	podSpec.NodeSelector = d.Spec.NodeSelector
+	setTolerations(podSpec)
+
+	c := d.getNodeSetupContainer()
+	c.Command = d.getNodeUninstallCommand(force)
+	c.Env = append(c.Env, corev1.EnvVar{Name: "PMEM_CSI_DRIVER_NAME", Value: d.GetName()})
+	c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+		Name:      "pmem-state-dir",
+		MountPath: "/var/lib/" + d.GetName(),
+	})
+	c.ReadinessProbe = &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			Exec: &corev1.ExecAction{
+				Command: []string{"test", "-e", api.UninstallDoneFile},
+			},
+		},
+		PeriodSeconds: 5,
+	}
+	podSpec.Containers = []corev1.Container{c}
+	d.setPodSecurity(&ds.Spec.Template)
+	d.setTerminationLog(&ds.Spec.Template)
+	d.setPodMetadata(&ds.Spec.Template)
+	podSpec.Volumes = []corev1.Volume{
+		{
+			Name: "dev-dir",
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: "/dev",
+					Type: &directoryOrCreate,
+				},
+			},
+		},
+		{
+			Name: "sys-dir",
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: "/sys",
+					Type: &directoryOrCreate,
+				},
+			},
+		},
+		{
+			Name: "pmem-state-dir",
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: "/var/lib/" + d.GetName(),
+					Type: &directoryOrCreate,
+				},
+			},
+		},
+	}
+	podSpec.Volumes = append(podSpec.Volumes, d.getScratchVolumes()...)
+}
+
+func (d *pmemCSIDeployment) getNodeUninstallCommand(force bool) []string {
+	args := []string{
+		"/usr/local/bin/pmem-csi-driver",
+		fmt.Sprintf("-v=%d", d.Spec.LogLevel),
+		"-logging-format=" + string(d.Spec.LogFormat),
+		"-mode=uninstall",
+		"-nodeid=$(KUBE_NODE_NAME)",
+		"-statePath=/var/lib/$(PMEM_CSI_DRIVER_NAME)",
+		"-drivername=$(PMEM_CSI_DRIVER_NAME)",
+	}
+	if force {
+		args = append(args, "-uninstallForce")
+	}
+	return args
+}
+
+// uninstallMode returns whether the deployment is meant to be
+// uninstalled and whether that is forced.
+func uninstallMode(deployment *api.PmemCSIDeployment) (bool, bool) {
+	switch deployment.Annotations[api.UninstallAnnotation] {
+	case "true":
+		return true, false
+	case "force":
+		return true, true
+	default:
+		return false, false
+	}
+}
@@ -0,0 +1,383 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	pmemcontroller "github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller"
+	"github.com/intel/pmem-csi/pkg/version"
+)
+
+// upgradeRetryDelay is how long to wait before checking again
+// whether the driver on the last upgraded node is back.
+const upgradeRetryDelay = 10 * time.Second
+
+// canaryTimeout is how long the driver on a canary node may take to
+// become ready and registered before the upgrade gets paused.
+// Restarted containers pause it immediately.
+const canaryTimeout = 5 * time.Minute
+
+// canaryRestartsAnnotation is set on canary pods which already
+// existed when the upgrade started to check them. It records how
+// often their containers had been restarted at that time, because
+// only restarts after that indicate a problem with the new driver.
+const canaryRestartsAnnotation = "pmem-csi.intel.com/canary-restarts"
+
+// stateFormatChanges lists the driver releases which write node
+// state that older releases cannot read. Since 1.1, volumes can have
+// parameters (integrity, zeroFill, nsmode, region, accessPattern)
+// which older releases reject as unknown when loading the state.
+var stateFormatChanges = []version.Version{
+	version.NewVersion(1, 1),
+}
+
+// driverVersion returns the version of the driver image. The second
+// return value is false if it is unknown, for example for "canary"
+// or images referenced by digest.
+func (d *pmemCSIDeployment) driverVersion() (version.Version, bool, error) {
+	if d.Spec.DriverVersion != "" {
+		v, err := version.Parse(d.Spec.DriverVersion)
+		if err != nil {
+			return version.Version{}, false, fmt.Errorf("driverVersion %q: %v", d.Spec.DriverVersion, err)
+		}
+		return v, true, nil
+	}
+	image := d.Spec.Image
+	if strings.Contains(image, "@") {
+		return version.Version{}, false, nil
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	i := strings.LastIndex(name, ":")
+	if i < 0 {
+		return version.Version{}, false, nil
+	}
+	v, err := version.Parse(strings.TrimPrefix(name[i+1:], "v"))
+	if err != nil {
+		return version.Version{}, false, nil
+	}
+	return v, true, nil
+}
+
+// runningDriverVersion returns the version recorded in the status,
+// if there is one.
+func (d *pmemCSIDeployment) runningDriverVersion() (version.Version, bool) {
+	if d.Status.DriverVersion == "" {
+		return version.Version{}, false
+	}
+	v, err := version.Parse(d.Status.DriverVersion)
+	if err != nil {
+		return version.Version{}, false
+	}
+	return v, true
+}
+
+// checkVersion returns an error if switching from the running to
+// the desired driver version is not supported.
+func (d *pmemCSIDeployment) checkVersion() error {
+	desired, known, err := d.driverVersion()
+	if err != nil || !known {
+		return err
+	}
+	running, known := d.runningDriverVersion()
+	if !known {
+		return nil
+	}
+	for _, v := range stateFormatChanges {
+		if running.CompareVersion(v) >= 0 && desired.CompareVersion(v) < 0 {
+			return fmt.Errorf("downgrade from driver %s to %s is not supported because %s changed the node state format, remove the deployment and the node state first",
+				running, desired, v)
+		}
+	}
+	return nil
+}
+
+// upgrading returns true while the node driver is being replaced
+// with a different version. Without the NodeUpgrades feature, the
+// DaemonSet always replaces pods with a rolling update.
+func (d *pmemCSIDeployment) upgrading() bool {
+	if !d.enabled(pmemcontroller.NodeUpgrades) {
+		return false
+	}
+	desired, known, err := d.driverVersion()
+	if err != nil || !known {
+		return false
+	}
+	running, known := d.runningDriverVersion()
+	return known && running != desired && d.checkVersion() == nil
+}
+
+// upgradeNodes replaces the node driver pods while the driver
+// version changes. During that time, the node DaemonSets use the
+// OnDelete strategy and the next pods only get deleted once the new
+// ones on the previous nodes are ready and kubelet has registered the
+// driver again. Nodes with Spec.CanaryNodeLabel go first, one at a
+// time. If the driver fails on one of them, the upgrade stops until
+// the user intervenes. When no upgrade is in progress, it just
+// records the version.
+func (d *pmemCSIDeployment) upgradeNodes(ctx context.Context, r *ReconcileDeployment) error {
+	desired, known, err := d.driverVersion()
+	if err != nil {
+		return err
+	}
+	if !known {
+		d.Status.DriverVersion = ""
+		d.setVersionSkew("")
+		return nil
+	}
+	if !d.upgrading() {
+		d.Status.DriverVersion = desired.String()
+		d.setVersionSkew("")
+		return nil
+	}
+	l := klog.FromContext(ctx).WithName("upgrade")
+	d.requeueAfter = upgradeRetryDelay
+
+	labels := client.MatchingLabels{
+		"app.kubernetes.io/name":     "pmem-csi-node",
+		"app.kubernetes.io/instance": d.Name,
+	}
+	daemonSets := &appsv1.DaemonSetList{}
+	if err := r.client.List(ctx, daemonSets, client.InNamespace(d.namespace), labels); err != nil {
+		return fmt.Errorf("list node DaemonSets: %v", err)
+	}
+	var numNodes int32
+	for _, ds := range daemonSets.Items {
+		numNodes += ds.Status.DesiredNumberScheduled
+	}
+	pods := &corev1.PodList{}
+	if err := r.client.List(ctx, pods, client.InNamespace(d.namespace), labels); err != nil {
+		return fmt.Errorf("list node driver pods: %v", err)
+	}
+	canaries, err := d.canaryNodes(ctx, r, pods.Items)
+	if err != nil {
+		return err
+	}
+	// Canary nodes first, otherwise sorted by name.
+	sort.Slice(pods.Items, func(i, j int) bool {
+		nodeI, nodeJ := pods.Items[i].Spec.NodeName, pods.Items[j].Spec.NodeName
+		if canaries[nodeI] != canaries[nodeJ] {
+			return canaries[nodeI]
+		}
+		return nodeI < nodeJ
+	})
+
+	image := d.ImageReference(d.Spec.Image)
+	var outdated []*corev1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil {
+			d.setVersionSkew(fmt.Sprintf("Upgrading to driver %s: waiting for the old driver on node %s to stop.", desired, pod.Spec.NodeName))
+			return nil
+		}
+		if driverImage(pod) != image {
+			outdated = append(outdated, pod)
+			continue
+		}
+		problem, err := d.nodeDriverProblem(ctx, r, pod)
+		if err != nil {
+			return err
+		}
+		if canaries[pod.Spec.NodeName] {
+			restarts, err := restartProblem(ctx, r, pod)
+			if err != nil {
+				return err
+			}
+			if restarts != "" {
+				problem = restarts
+			} else if problem != "" && time.Since(pod.CreationTimestamp.Time) < canaryTimeout {
+				d.setVersionSkew(fmt.Sprintf("Upgrading to driver %s: waiting for canary node %s, %s.", desired, pod.Spec.NodeName, problem))
+				return nil
+			}
+			if problem != "" {
+				msg := fmt.Sprintf("Upgrade to driver %s paused, canary node %s failed: %s.", desired, pod.Spec.NodeName, problem)
+				l.Info(msg, "pod", pmemlog.KObj(pod))
+				r.evRecorder.Event(d.PmemCSIDeployment, corev1.EventTypeWarning, api.EventReasonUpgradePaused, msg)
+				d.setVersionSkew(msg)
+				return nil
+			}
+		}
+		if problem != "" {
+			d.setVersionSkew(fmt.Sprintf("Upgrading to driver %s: waiting for node %s, %s.", desired, pod.Spec.NodeName, problem))
+			return nil
+		}
+	}
+	if int32(len(pods.Items)) < numNodes {
+		d.setVersionSkew(fmt.Sprintf("Upgrading to driver %s: waiting for %d driver pod(s) to be created.", desired, numNodes-int32(len(pods.Items))))
+		return nil
+	}
+
+	if len(outdated) == 0 {
+		l.Info("Upgrade complete", "version", desired)
+		d.Status.DriverVersion = desired.String()
+		d.setVersionSkew("")
+		// Switch the DaemonSets back to RollingUpdate.
+		d.requeueAfter = time.Second
+		return nil
+	}
+	// Canary nodes get upgraded one at a time, the rest as many at
+	// once as MaxUnavailable allows.
+	batch := 1
+	if !canaries[outdated[0].Spec.NodeName] && d.Spec.MaxUnavailable != nil {
+		batch, err = intstr.GetScaledValueFromIntOrPercent(d.Spec.MaxUnavailable, int(numNodes), true)
+		if err != nil {
+			return fmt.Errorf("maxUnavailable: %v", err)
+		}
+		if batch < 1 {
+			batch = 1
+		}
+	}
+	if batch > len(outdated) {
+		batch = len(outdated)
+	}
+	for _, pod := range outdated[:batch] {
+		if err := r.client.Delete(ctx, pod); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("delete pod %s: %v", pod.Name, err)
+		}
+		kind := "node"
+		if canaries[pod.Spec.NodeName] {
+			kind = "canary node"
+		}
+		msg := fmt.Sprintf("Upgrading %s %s from driver %s to %s, %d node(s) left.", kind, pod.Spec.NodeName, d.Status.DriverVersion, desired, len(outdated)-batch)
+		l.Info(msg, "pod", pmemlog.KObj(pod))
+		r.evRecorder.Event(d.PmemCSIDeployment, corev1.EventTypeNormal, api.EventReasonUpgrading, msg)
+		d.setVersionSkew(msg)
+	}
+	return nil
+}
+
+// nodeDriverProblem checks whether the driver in the pod is ready and
+// registered with kubelet. It returns a description of the problem
+// or an empty string.
+func (d *pmemCSIDeployment) nodeDriverProblem(ctx context.Context, r *ReconcileDeployment, pod *corev1.Pod) (string, error) {
+	ready := false
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady && condition.Status == corev1.ConditionTrue {
+			ready = true
+			break
+		}
+	}
+	if !ready {
+		return "pod not ready", nil
+	}
+	csiNode := &storagev1.CSINode{}
+	if err := r.client.Get(ctx, client.ObjectKey{Name: pod.Spec.NodeName}, csiNode); err != nil {
+		if errors.IsNotFound(err) {
+			return "no CSINode object", nil
+		}
+		return "", fmt.Errorf("get CSINode %s: %v", pod.Spec.NodeName, err)
+	}
+	for _, driver := range csiNode.Spec.Drivers {
+		if driver.Name == d.CSIDriverName() {
+			return "", nil
+		}
+	}
+	return "driver not registered by kubelet", nil
+}
+
+// canaryNodes returns the names of the nodes of the pods which have
+// Spec.CanaryNodeLabel.
+func (d *pmemCSIDeployment) canaryNodes(ctx context.Context, r *ReconcileDeployment, pods []corev1.Pod) (map[string]bool, error) {
+	canaries := map[string]bool{}
+	if d.Spec.CanaryNodeLabel == "" {
+		return canaries, nil
+	}
+	for _, pod := range pods {
+		node := &corev1.Node{}
+		if err := r.client.Get(ctx, client.ObjectKey{Name: pod.Spec.NodeName}, node); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("get node %s: %v", pod.Spec.NodeName, err)
+		}
+		if _, ok := node.Labels[d.Spec.CanaryNodeLabel]; ok {
+			canaries[node.Name] = true
+		}
+	}
+	return canaries, nil
+}
+
+// restartProblem reports containers of a canary pod which were
+// restarted since the upgrade started to check the pod. A driver
+// which crashes can still be ready in between. All restarts count
+// for pods created during the upgrade. For older pods, the current
+// restart count gets recorded in an annotation the first time and
+// only restarts beyond that count.
+func restartProblem(ctx context.Context, r *ReconcileDeployment, pod *corev1.Pod) (string, error) {
+	var restarts int32
+	for _, status := range pod.Status.ContainerStatuses {
+		restarts += status.RestartCount
+	}
+	var baseline int32
+	if value, ok := pod.Annotations[canaryRestartsAnnotation]; ok {
+		count, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return "", fmt.Errorf("pod %s: annotation %s: %v", pod.Name, canaryRestartsAnnotation, err)
+		}
+		baseline = int32(count)
+	} else if time.Since(pod.CreationTimestamp.Time) >= canaryTimeout {
+		patch := client.MergeFrom(pod.DeepCopy())
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		pod.Annotations[canaryRestartsAnnotation] = strconv.Itoa(int(restarts))
+		if err := r.client.Patch(ctx, pod, patch); err != nil {
+			return "", fmt.Errorf("record restart count of pod %s: %v", pod.Name, err)
+		}
+		baseline = restarts
+	}
+	if restarts <= baseline {
+		return "", nil
+	}
+	return fmt.Sprintf("containers restarted %d times since the upgrade started", restarts-baseline), nil
+}
+
+// driverImage returns the image of the PMEM-CSI container in a node
+// driver pod.
+func driverImage(pod *corev1.Pod) string {
+	for _, c := range pod.Spec.Containers {
+		if c.Name == "pmem-driver" {
+			return c.Image
+		}
+	}
+	return ""
+}
+
+// setVersionSkew sets the VersionSkew condition to true with the
+// message or, if the message is empty, to false. Like the Degraded
+// condition, it only gets added when needed.
+func (d *pmemCSIDeployment) setVersionSkew(msg string) {
+	if msg != "" {
+		d.SetCondition(api.VersionSkew, corev1.ConditionTrue, msg)
+		return
+	}
+	for _, c := range d.Status.Conditions {
+		if c.Type == api.VersionSkew {
+			msg = "Driver version is unknown."
+			if d.Status.DriverVersion != "" {
+				msg = fmt.Sprintf("All nodes run driver %s.", d.Status.DriverVersion)
+			}
+			d.SetCondition(api.VersionSkew, corev1.ConditionFalse, msg)
+			return
+		}
+	}
+}
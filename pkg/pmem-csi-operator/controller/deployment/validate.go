@@ -0,0 +1,207 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemcontroller "github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Finding is the result of one check done by Validate.
+type Finding struct {
+	// Check describes what was checked, for example an object.
+	Check string
+	// OK is true if the check passed.
+	OK bool
+	// Details explains the result.
+	Details string
+}
+
+// Findings is the result of Validate.
+type Findings []Finding
+
+// OK is true if all checks passed.
+func (f Findings) OK() bool {
+	for _, finding := range f {
+		if !finding.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// Print writes a human-readable report.
+func (f Findings) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tDETAILS")
+	for _, finding := range f {
+		result := "OK"
+		if !finding.OK {
+			result = "FAILED"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", finding.Check, result, finding.Details)
+	}
+	return tw.Flush()
+}
+
+// Validate compares the installation for the PmemCSIDeployment with
+// the given name against the state that the operator would produce
+// for it. It only reads from the API server. An error is returned
+// if the checks could not be run at all, problems with the
+// installation are reported as findings.
+func Validate(ctx context.Context, c client.Client, opts pmemcontroller.ControllerOptions, name string) (Findings, error) {
+	deployment := &api.PmemCSIDeployment{}
+	if err := c.Get(ctx, client.ObjectKey{Name: name}, deployment); err != nil {
+		return nil, fmt.Errorf("get PmemCSIDeployment %q: %v", name, err)
+	}
+	if deployment.Spec.HostLayout == "" {
+		deployment.Spec.HostLayout = opts.HostLayout
+	}
+	if err := deployment.EnsureDefaults(opts.DriverImage); err != nil {
+		return nil, fmt.Errorf("PmemCSIDeployment %q: %v", name, err)
+	}
+	features, err := deploymentFeatures(opts.FeatureGate, deployment)
+	if err != nil {
+		return nil, fmt.Errorf("PmemCSIDeployment %q: %v", name, err)
+	}
+	d := &pmemCSIDeployment{
+		PmemCSIDeployment: deployment,
+		namespace:         opts.Namespace,
+		k8sVersion:        opts.K8sVersion,
+		openShift:         opts.OpenShift,
+		features:          features,
+	}
+
+	var findings Findings
+	add := func(check string, ok bool, format string, args ...interface{}) {
+		findings = append(findings, Finding{Check: check, OK: ok, Details: fmt.Sprintf(format, args...)})
+	}
+
+	add("PmemCSIDeployment/"+name, d.Status.Phase == api.DeploymentPhaseRunning,
+		"phase %q %s", d.Status.Phase, d.Status.Reason)
+	for _, condition := range d.Status.Conditions {
+		add("condition "+string(condition.Type), condition.Status == corev1.ConditionTrue,
+			"%s %s", condition.Status, condition.Reason)
+	}
+
+	// Sort by name for a stable report.
+	handlers := d.allSubObjectHandlers()
+	names := make([]string, 0, len(handlers))
+	for handlerName := range handlers {
+		names = append(names, handlerName)
+	}
+	sort.Strings(names)
+	ownerRef := d.GetOwnerReference()
+	for _, handlerName := range names {
+		handler := handlers[handlerName]
+		if handler.enabled != nil && !handler.enabled(d) {
+			continue
+		}
+		o := handler.object(d)
+		check := fmt.Sprintf("%s %s", handlerName, client.ObjectKeyFromObject(o))
+		if err := c.Get(ctx, client.ObjectKeyFromObject(o), o); err != nil {
+			if errors.IsNotFound(err) {
+				add(check, false, "missing")
+				continue
+			}
+			return nil, fmt.Errorf("get %s: %v", check, err)
+		}
+		if !isOwnedBy(o, &ownerRef) {
+			add(check, false, "not owned by the PmemCSIDeployment")
+			continue
+		}
+		switch o := o.(type) {
+		case *appsv1.Deployment:
+			add(check, o.Status.Replicas > 0 && o.Status.ReadyReplicas == o.Status.Replicas,
+				"%d of %d replicas ready", o.Status.ReadyReplicas, o.Status.Replicas)
+		case *appsv1.DaemonSet:
+			add(check, o.Status.NumberReady == o.Status.DesiredNumberScheduled,
+				"%d of %d pods ready", o.Status.NumberReady, o.Status.DesiredNumberScheduled)
+		default:
+			add(check, true, "exists")
+		}
+	}
+
+	if err := d.validateNodes(ctx, c, add); err != nil {
+		return nil, err
+	}
+	return findings, nil
+}
+
+// validateNodes checks the node driver pods and whether the driver
+// is registered with the kubelet on the nodes where they run.
+func (d *pmemCSIDeployment) validateNodes(ctx context.Context, c client.Client, add func(check string, ok bool, format string, args ...interface{})) error {
+	pods := &corev1.PodList{}
+	if err := c.List(ctx, pods,
+		client.InNamespace(d.namespace),
+		client.MatchingLabels{
+			"app.kubernetes.io/name":     "pmem-csi-node",
+			"app.kubernetes.io/instance": d.Name,
+		},
+	); err != nil {
+		return fmt.Errorf("list node driver pods: %v", err)
+	}
+
+	for _, pod := range pods.Items {
+		check := fmt.Sprintf("node %s", pod.Spec.NodeName)
+		if pod.Status.Phase != corev1.PodRunning {
+			add(check, false, "pod %s is %s", pod.Name, pod.Status.Phase)
+			continue
+		}
+		// The driver socket cannot be reached from here.
+		// Container readiness and restarts are the closest
+		// indication of its health, combined with the
+		// registration check below, which only succeeds
+		// if the kubelet could talk to the driver.
+		healthy := true
+		for _, status := range pod.Status.ContainerStatuses {
+			if !status.Ready {
+				add(check, false, "container %s in pod %s is not ready", status.Name, pod.Name)
+				healthy = false
+			} else if status.RestartCount > 0 {
+				add(check, true, "container %s in pod %s was restarted %d times", status.Name, pod.Name, status.RestartCount)
+			}
+		}
+		if !healthy {
+			continue
+		}
+
+		csiNode := &storagev1.CSINode{}
+		if err := c.Get(ctx, client.ObjectKey{Name: pod.Spec.NodeName}, csiNode); err != nil {
+			if errors.IsNotFound(err) {
+				add(check, false, "no CSINode object")
+				continue
+			}
+			return fmt.Errorf("get CSINode %s: %v", pod.Spec.NodeName, err)
+		}
+		registered := false
+		for _, driver := range csiNode.Spec.Drivers {
+			if driver.Name == d.CSIDriverName() {
+				registered = true
+				break
+			}
+		}
+		if registered {
+			add(check, true, "driver registered, pod %s running", pod.Name)
+		} else {
+			add(check, false, "driver %s not registered in CSINode", d.CSIDriverName())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package controller
+
+import (
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/component-base/featuregate"
+)
+
+const (
+	// NodeUpgrades replaces the node driver pods node by node
+	// when the driver version changes, instead of letting the
+	// DaemonSet roll them out.
+	NodeUpgrades featuregate.Feature = "NodeUpgrades"
+
+	// Uninstall enables the uninstall annotation, which removes
+	// volumes and the PMEM setup from all nodes when deleting a
+	// deployment.
+	Uninstall featuregate.Feature = "Uninstall"
+)
+
+// DefaultFeatureGates lists all operator features and their defaults.
+var DefaultFeatureGates = map[featuregate.Feature]featuregate.FeatureSpec{
+	NodeUpgrades: {Default: true, PreRelease: featuregate.Beta},
+	Uninstall:    {Default: false, PreRelease: featuregate.Alpha},
+}
+
+// NewFeatureGate returns a feature gate which knows about all
+// operator features.
+func NewFeatureGate() featuregate.MutableFeatureGate {
+	featureGate := featuregate.NewFeatureGate()
+	utilruntime.Must(featureGate.Add(DefaultFeatureGates))
+	return featureGate
+}
@@ -11,13 +11,15 @@ import (
 	"flag"
 	"fmt"
 	"runtime"
+	"strings"
 
 	"github.com/intel/pmem-csi/pkg/apis"
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/hostpaths"
 	"github.com/intel/pmem-csi/pkg/k8sutil"
 	"github.com/intel/pmem-csi/pkg/logger"
-	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller"
+	"github.com/intel/pmem-csi/pkg/termination"
 
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
@@ -41,23 +43,31 @@ var (
 	driverImage    = flag.String("image", "", "docker container image used for deploying the operator.")
 	leaderElection = flag.Bool("leader-election", false, "Enable leader election for controller manager. "+
 		"Enabling this will ensure there is only one active controller manager.")
+	hostLayout  = flag.String("host-layout", "", "Directory layout on the nodes ("+strings.Join(hostpaths.Names(), ", ")+"), used for deployments which do not set one.")
 	metricsAddr = flag.String("metrics-addr", ":8080", "The address the metric endpoint binds to. Use \"0\" to disable metrics.")
 	logFormat   = logger.NewFlag()
+	featureGate = controller.NewFeatureGate()
 )
 
 func init() {
 	klog.InitFlags(nil)
+	flag.Func("feature-gates", "A set of key=value pairs that describe operator features for alpha/experimental or beta features. "+
+		"Options are:\n"+strings.Join(featureGate.KnownFeatures(), "\n"), featureGate.Set)
 }
 
 func Main() int {
 	flag.Parse()
 
+	if flag.Arg(0) == "validate" {
+		return validate(flag.Args()[1:])
+	}
+
 	printVersion()
 
 	// Get a config to talk to the apiserver
 	cfg, err := config.GetConfig()
 	if err != nil {
-		pmemcommon.ExitError("Failed to get configuration: ", err)
+		termination.ExitError("Failed to get configuration: ", err)
 		return 1
 	}
 
@@ -81,39 +91,57 @@ func Main() int {
 		},
 	})
 	if err != nil {
-		pmemcommon.ExitError("Failed to create controller manager: ", err)
+		termination.ExitError("Failed to create controller manager: ", err)
 		return 1
 	}
 
 	ver, err := k8sutil.GetKubernetesVersion(mgr.GetConfig())
 	if err != nil {
-		pmemcommon.ExitError("Failed retrieve kubernetes version: ", err)
+		termination.ExitError("Failed retrieve kubernetes version: ", err)
 		return 1
 	}
 	klog.Info("Kubernetes Version: ", ver)
 
+	openShift, err := k8sutil.IsOpenShift(mgr.GetConfig())
+	if err != nil {
+		termination.ExitError("Failed to detect OpenShift: ", err)
+		return 1
+	}
+	klog.Info("OpenShift: ", openShift)
+
+	layout := hostpaths.Layout(*hostLayout)
+	if _, err := hostpaths.Get(layout); err != nil {
+		termination.ExitError("Invalid -host-layout: ", err)
+		return 1
+	}
+	klog.Info("Host layout: ", layout)
+
 	klog.Info("Registering Components.")
 
 	// Setup Scheme for all resources
 	if err := apis.AddToScheme(mgr.GetScheme()); err != nil {
-		pmemcommon.ExitError("Failed to add API schema: ", err)
+		termination.ExitError("Failed to add API schema: ", err)
 		return 1
 	}
 
 	cs, err := kubernetes.NewForConfig(mgr.GetConfig())
 	if err != nil {
-		pmemcommon.ExitError("failed to get in-cluster client: %v", err)
+		termination.ExitError("failed to get in-cluster client: %v", err)
 		return 1
 	}
 	// Setup all Controllers
 	if err := controller.AddToManager(ctx, mgr, controller.ControllerOptions{
 		Config:       mgr.GetConfig(),
+		APIReader:    mgr.GetAPIReader(),
 		Namespace:    namespace,
 		K8sVersion:   *ver,
+		OpenShift:    openShift,
+		HostLayout:   layout,
 		DriverImage:  *driverImage,
 		EventsClient: cs.CoreV1().Events(""),
+		FeatureGate:  featureGate,
 	}); err != nil {
-		pmemcommon.ExitError("Failed to add controller to manager: ", err)
+		termination.ExitError("Failed to add controller to manager: ", err)
 		return 1
 	}
 
@@ -121,13 +149,13 @@ func Main() int {
 
 	// Start the Cmd
 	if err := mgr.Start(signals.SetupSignalHandler()); err != nil {
-		pmemcommon.ExitError("Manager exited non-zero: ", err)
+		termination.ExitError("Manager exited non-zero: ", err)
 		return 1
 	}
 
 	list := &api.PmemCSIDeploymentList{}
 	if err := mgr.GetClient().List(ctx, list); err != nil {
-		pmemcommon.ExitError("failed to get deployment list: %v", err)
+		termination.ExitError("failed to get deployment list: %v", err)
 		return 1
 	}
 
@@ -0,0 +1,96 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemoperator
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/intel/pmem-csi/pkg/apis"
+	"github.com/intel/pmem-csi/pkg/hostpaths"
+	"github.com/intel/pmem-csi/pkg/k8sutil"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller/deployment"
+	"github.com/intel/pmem-csi/pkg/termination"
+
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+// validate implements the "validate" sub-command: it checks the
+// installation for one PmemCSIDeployment and prints a report.
+// The exit code is 0 if all checks passed, 1 otherwise.
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	namespace := flags.String("namespace", "", "namespace of the driver objects, defaults to the namespace of the operator")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s validate [-namespace <namespace>] <PmemCSIDeployment name>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 1
+	}
+	name := flags.Arg(0)
+
+	ctx := context.Background()
+	cfg, err := config.GetConfig()
+	if err != nil {
+		termination.ExitError("Failed to get configuration: ", err)
+		return 1
+	}
+	if err := apis.AddToScheme(scheme.Scheme); err != nil {
+		termination.ExitError("Failed to add API schema: ", err)
+		return 1
+	}
+	c, err := client.New(cfg, client.Options{Scheme: scheme.Scheme})
+	if err != nil {
+		termination.ExitError("Failed to create client: ", err)
+		return 1
+	}
+	ver, err := k8sutil.GetKubernetesVersion(cfg)
+	if err != nil {
+		termination.ExitError("Failed retrieve kubernetes version: ", err)
+		return 1
+	}
+	openShift, err := k8sutil.IsOpenShift(cfg)
+	if err != nil {
+		termination.ExitError("Failed to detect OpenShift: ", err)
+		return 1
+	}
+	layout := hostpaths.Layout(*hostLayout)
+	if *namespace == "" {
+		*namespace = k8sutil.GetNamespace(ctx)
+	}
+
+	findings, err := deployment.Validate(ctx, c, controller.ControllerOptions{
+		Namespace:   *namespace,
+		K8sVersion:  *ver,
+		OpenShift:   openShift,
+		HostLayout:  layout,
+		DriverImage: *driverImage,
+		FeatureGate: featureGate,
+	}, name)
+	if err != nil {
+		termination.ExitError("Validation failed: ", err)
+		return 1
+	}
+	if err := findings.Print(os.Stdout); err != nil {
+		termination.ExitError("Printing report failed: ", err)
+		return 1
+	}
+	if !findings.OK() {
+		return 1
+	}
+	return 0
+}
@@ -8,6 +8,7 @@ package pmdmanager
 
 import (
 	"context"
+	"strconv"
 
 	"k8s.io/klog/v2"
 
@@ -35,6 +36,26 @@ var (
 		"Total amount of PMEM on the host.",
 		nil, nil,
 	)
+	pmemNUMAAvailableDesc = prometheus.NewDesc(
+		"pmem_numa_amount_available",
+		"Remaining amount of PMEM that can be used for new volumes, by NUMA node (-1 if unknown).",
+		[]string{"numa_node"}, nil,
+	)
+	pmemDimmFailingDesc = prometheus.NewDesc(
+		"pmem_dimm_failing",
+		"1 if the DIMM reports critical or fatal health or failed to map its capacity, 0 otherwise.",
+		[]string{"dimm", "health"}, nil,
+	)
+	pmemDimmSparesDesc = prometheus.NewDesc(
+		"pmem_dimm_spares_percentage",
+		"Remaining spare capacity of the DIMM.",
+		[]string{"dimm"}, nil,
+	)
+	pmemBadBlocksDesc = prometheus.NewDesc(
+		"pmem_namespace_badblocks",
+		"Number of 512 byte sectors with known media errors in the namespace.",
+		[]string{"namespace"}, nil,
+	)
 )
 
 // NodeLabel is a label used for Prometheus which identifies the
@@ -42,7 +63,9 @@ var (
 const NodeLabel = "node"
 
 // CapacityCollector is a wrapper around a PMEM device manager which
-// takes GetCapacity values and turns them into metrics data.
+// takes GetCapacity values and turns them into metrics data. If the
+// device manager also implements PmemDeviceNUMA or PmemDeviceHealth,
+// available PMEM per NUMA node or hardware health get reported, too.
 type CapacityCollector struct {
 	PmemDeviceCapacity
 }
@@ -91,6 +114,56 @@ func (cc CapacityCollector) Collect(ch chan<- prometheus.Metric) {
 		prometheus.GaugeValue,
 		float64(capacity.Total),
 	)
+
+	if dn, ok := cc.PmemDeviceCapacity.(PmemDeviceNUMA); ok {
+		if available, err := dn.AvailableByNUMANode(ctx); err == nil {
+			for node, amount := range available {
+				ch <- prometheus.MustNewConstMetric(
+					pmemNUMAAvailableDesc,
+					prometheus.GaugeValue,
+					float64(amount),
+					strconv.Itoa(node),
+				)
+			}
+		}
+	}
+
+	dh, ok := cc.PmemDeviceCapacity.(PmemDeviceHealth)
+	if !ok {
+		return
+	}
+	health, err := dh.GetHealth(ctx)
+	if err != nil {
+		return
+	}
+	for _, dimm := range health.Dimms {
+		failing := 0.0
+		if dimm.Failing() {
+			failing = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			pmemDimmFailingDesc,
+			prometheus.GaugeValue,
+			failing,
+			dimm.DeviceName, string(dimm.State),
+		)
+		if dimm.SparesPercentage >= 0 {
+			ch <- prometheus.MustNewConstMetric(
+				pmemDimmSparesDesc,
+				prometheus.GaugeValue,
+				float64(dimm.SparesPercentage),
+				dimm.DeviceName,
+			)
+		}
+	}
+	for _, ns := range health.Namespaces {
+		ch <- prometheus.MustNewConstMetric(
+			pmemBadBlocksDesc,
+			prometheus.GaugeValue,
+			float64(ns.BadBlocks),
+			ns.DeviceName,
+		)
+	}
 }
 
 var _ prometheus.Collector = CapacityCollector{}
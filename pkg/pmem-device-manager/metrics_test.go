@@ -0,0 +1,48 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// numaCapacity provides capacity per NUMA node, but no health.
+type numaCapacity map[int]uint64
+
+func (nc numaCapacity) GetCapacity(ctx context.Context) (Capacity, error) {
+	var capacity Capacity
+	for _, amount := range nc {
+		capacity.Available += amount
+		capacity.Managed += amount
+		capacity.Total += amount
+		if amount > capacity.MaxVolumeSize {
+			capacity.MaxVolumeSize = amount
+		}
+	}
+	return capacity, nil
+}
+
+func (nc numaCapacity) AvailableByNUMANode(ctx context.Context) (map[int]uint64, error) {
+	return nc, nil
+}
+
+func TestCapacityCollectorNUMA(t *testing.T) {
+	cc := CapacityCollector{PmemDeviceCapacity: numaCapacity{0: 1024, 1: 2048, -1: 512}}
+	expected := `
+# HELP pmem_numa_amount_available Remaining amount of PMEM that can be used for new volumes, by NUMA node (-1 if unknown).
+# TYPE pmem_numa_amount_available gauge
+pmem_numa_amount_available{numa_node="-1"} 512
+pmem_numa_amount_available{numa_node="0"} 1024
+pmem_numa_amount_available{numa_node="1"} 2048
+`
+	assert.NoError(t, testutil.CollectAndCompare(cc, strings.NewReader(expected), "pmem_numa_amount_available"))
+}
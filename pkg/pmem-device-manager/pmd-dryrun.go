@@ -0,0 +1,85 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+)
+
+// dryRunDM simulates creating and deleting devices in memory. It
+// starts with the capacity that a real device manager would have,
+// without creating one because that already modifies PMEM. Devices are assumed to be contiguous, so the
+// initial maximum volume size remains the limit for each device.
+type dryRunDM struct {
+	fakeDM
+	mode    api.DeviceMode
+	initial Capacity
+}
+
+var _ PmemDeviceManager = &dryRunDM{}
+
+// NewDryRun returns a device manager which behaves like one created
+// by New regarding mode and initial capacity, without ever touching
+// PMEM.
+func NewDryRun(ctx context.Context, mode api.DeviceMode, pmemPercentage uint) (PmemDeviceManager, error) {
+	if pmemPercentage > 100 {
+		return nil, fmt.Errorf("invalid pmemPercentage '%d'. Value must be 0..100", pmemPercentage)
+	}
+	var capacity Capacity
+	var err error
+	switch mode {
+	case api.DeviceModeFake:
+		capacity, err = (&fakeDM{capacity: uint64(pmemPercentage) * totalCapacity / 100}).GetCapacity(ctx)
+	case api.DeviceModeLVM:
+		capacity, err = lvmInitialCapacity(ctx, pmemPercentage)
+	case api.DeviceModeDirect:
+		// Only reads the regions.
+		capacity, err = (&pmemNdctl{pmemPercentage: pmemPercentage}).GetCapacity(ctx)
+	default:
+		return nil, fmt.Errorf("unsupported device mode %q", mode)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get initial capacity: %v", err)
+	}
+	return &dryRunDM{
+		fakeDM: fakeDM{
+			capacity: capacity.Available,
+			devices:  map[string]*PmemDeviceInfo{},
+		},
+		mode:    mode,
+		initial: capacity,
+	}, nil
+}
+
+func (dm *dryRunDM) GetMode() api.DeviceMode {
+	return dm.mode
+}
+
+func (dm *dryRunDM) GetCapacity(ctx context.Context) (Capacity, error) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	capacity := dm.initial
+	capacity.Available = dm.capacity - dm.used
+	if capacity.MaxVolumeSize > capacity.Available {
+		capacity.MaxVolumeSize = capacity.Available
+	}
+	return capacity, nil
+}
+
+func (dm *dryRunDM) CreateDevice(ctx context.Context, volumeId string, size uint64, usage parameters.Usage) (uint64, error) {
+	if size > dm.initial.MaxVolumeSize {
+		return 0, pmemerr.NotEnoughSpace
+	}
+	return dm.fakeDM.CreateDevice(ctx, volumeId, size, usage)
+}
@@ -19,12 +19,18 @@ import (
 
 type fakeDM struct {
 	capacity uint64
+	used     uint64
 	mutex    sync.Mutex
 
 	devices map[string]*PmemDeviceInfo
 }
 
 var _ PmemDeviceManager = &fakeDM{}
+var _ PmemDeviceRenamer = &fakeDM{}
+var _ PmemDeviceLayout = &fakeDM{}
+var _ PmemDeviceRegions = &fakeDM{}
+var _ PmemDeviceSignatures = &fakeDM{}
+var _ PmemDeviceMetadata = &fakeDM{}
 
 const totalCapacity uint64 = 1024 * 1024 * 1024 * 1024
 
@@ -55,10 +61,7 @@ func (dm *fakeDM) GetCapacity(ctx context.Context) (capacity Capacity, err error
 }
 
 func (dm *fakeDM) getCapacity() Capacity {
-	remaining := dm.capacity
-	for _, dev := range dm.devices {
-		remaining -= dev.Size
-	}
+	remaining := dm.capacity - dm.used
 	return Capacity{
 		Available:     remaining,
 		MaxVolumeSize: remaining,
@@ -85,6 +88,7 @@ func (dm *fakeDM) CreateDevice(ctx context.Context, volumeId string, size uint64
 		Size:     size,
 		Path:     FakeDevicePathPrefix + volumeId,
 	}
+	dm.used += size
 	return size, nil
 }
 
@@ -93,7 +97,10 @@ func (dm *fakeDM) DeleteDevice(ctx context.Context, volumeId string, flush bool)
 	defer dm.mutex.Unlock()
 
 	// Remove device, whether it exists or not.
-	delete(dm.devices, volumeId)
+	if dev, ok := dm.devices[volumeId]; ok {
+		dm.used -= dev.Size
+		delete(dm.devices, volumeId)
+	}
 
 	return nil
 }
@@ -120,3 +127,89 @@ func (dm *fakeDM) GetDevice(ctx context.Context, volumeId string) (*PmemDeviceIn
 	}
 	return dev, nil
 }
+
+func (dm *fakeDM) RenameDevice(ctx context.Context, oldName, newName string) error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	dev, ok := dm.devices[oldName]
+	if !ok {
+		return pmemerr.DeviceNotFound
+	}
+	if _, ok := dm.devices[newName]; ok {
+		return pmemerr.DeviceExists
+	}
+	delete(dm.devices, oldName)
+	dm.devices[newName] = &PmemDeviceInfo{
+		VolumeId:  newName,
+		Size:      dev.Size,
+		Path:      FakeDevicePathPrefix + newName,
+		Signature: dev.Signature,
+		Metadata:  dev.Metadata,
+	}
+	return nil
+}
+
+func (dm *fakeDM) SetSignature(ctx context.Context, volumeId string, signature string) error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	dev, ok := dm.devices[volumeId]
+	if !ok {
+		return pmemerr.DeviceNotFound
+	}
+	dev.Signature = signature
+	return nil
+}
+
+func (dm *fakeDM) ResizeDevice(ctx context.Context, volumeId string, size uint64) (uint64, error) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	dev, ok := dm.devices[volumeId]
+	if !ok {
+		return 0, pmemerr.DeviceNotFound
+	}
+	if size <= dev.Size {
+		return dev.Size, nil
+	}
+	if size-dev.Size > dm.getCapacity().Available {
+		return 0, pmemerr.NotEnoughSpace
+	}
+	dm.used += size - dev.Size
+	dev.Size = size
+	return size, nil
+}
+
+func (dm *fakeDM) SetMetadata(ctx context.Context, volumeId string, metadata map[string]string) error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	dev, ok := dm.devices[volumeId]
+	if !ok {
+		return pmemerr.DeviceNotFound
+	}
+	if dev.Metadata == nil {
+		dev.Metadata = map[string]string{}
+	}
+	for key, value := range metadata {
+		dev.Metadata[key] = value
+	}
+	return nil
+}
+
+func (dm *fakeDM) MaxVolumes(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+// RegionIDs returns a single region, region0.
+func (dm *fakeDM) RegionIDs(ctx context.Context) ([]uint, error) {
+	return []uint{0}, nil
+}
+
+func (dm *fakeDM) CreateDeviceInRegion(ctx context.Context, volumeId string, size uint64, usage parameters.Usage, region uint) (uint64, error) {
+	if region != 0 {
+		return 0, fmt.Errorf("no region%d: %w", region, pmemerr.NotEnoughSpace)
+	}
+	return dm.CreateDevice(ctx, volumeId, size, usage)
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+
+	"k8s.io/klog/v2"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// Health contains information about the state of the PMEM hardware.
+type Health struct {
+	Dimms      []DimmHealth
+	Namespaces []NamespaceHealth
+}
+
+// DimmHealth is the SMART health of one DIMM.
+type DimmHealth struct {
+	// DeviceName is the kernel name of the DIMM (for example, nmem0).
+	DeviceName string
+	ndctl.DimmHealth
+}
+
+// NamespaceHealth summarizes the media errors in one namespace.
+type NamespaceHealth struct {
+	// DeviceName is the kernel name of the namespace (for example, namespace0.0).
+	DeviceName string
+	// BadBlocks is the number of 512 byte sectors with known media errors.
+	BadBlocks uint64
+}
+
+// PmemDeviceHealth is implemented by device managers which have
+// access to PMEM hardware.
+type PmemDeviceHealth interface {
+	// GetHealth returns information about the hardware.
+	GetHealth(ctx context.Context) (Health, error)
+}
+
+func getHealth(ctx context.Context) (Health, error) {
+	_, logger := pmemlog.WithName(ctx, "getHealth")
+	ndctlMutex.Lock()
+	defer ndctlMutex.Unlock()
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return Health{}, err
+	}
+	defer ndctx.Free()
+
+	return healthOf(logger, ndctx), nil
+}
+
+func healthOf(logger klog.Logger, ndctx ndctl.Context) Health {
+	var health Health
+	for _, bus := range ndctx.GetBuses() {
+		for _, d := range bus.Dimms() {
+			h, err := d.Health()
+			if err != nil {
+				// Still report the failed map flag, which
+				// is known without SMART support.
+				logger.V(5).Info("No SMART data", "dimm", d.DeviceName(), "reason", err.Error())
+			}
+			health.Dimms = append(health.Dimms, DimmHealth{DeviceName: d.DeviceName(), DimmHealth: h})
+		}
+		for _, r := range bus.ActiveRegions() {
+			for _, ns := range r.ActiveNamespaces() {
+				nsHealth := NamespaceHealth{DeviceName: ns.DeviceName()}
+				for _, bb := range ns.BadBlocks() {
+					nsHealth.BadBlocks += bb.Length
+				}
+				health.Namespaces = append(health.Namespaces, nsHealth)
+			}
+		}
+	}
+	return health
+}
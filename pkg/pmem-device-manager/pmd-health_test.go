@@ -0,0 +1,71 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	"github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestHealth(t *testing.T) {
+	logger, _ := ktesting.NewTestContext(t)
+	ndctx := fake.NewContext(&fake.Context{
+		Buses: []ndctl.Bus{
+			&fake.Bus{
+				DeviceName_: "ndbus0",
+				Dimms_: []ndctl.Dimm{
+					&fake.Dimm{DeviceName_: "nmem0", Health_: ndctl.DimmHealth{State: ndctl.HealthOK, SparesPercentage: 90}},
+					&fake.Dimm{DeviceName_: "nmem1", Health_: ndctl.DimmHealth{State: ndctl.HealthUnknown, SparesPercentage: -1, Failed: true}, HealthErr_: errors.New("no SMART support")},
+				},
+				Regions_: []ndctl.Region{
+					&fake.Region{
+						DeviceName_: "region0",
+						Enabled_:    true,
+						Namespaces_: []ndctl.Namespace{
+							&fake.Namespace{
+								DeviceName_: "namespace0.0",
+								Size_:       1024 * 1024 * 1024,
+								Enabled_:    true,
+								BadBlocks_: []ndctl.BadBlock{
+									{Offset: 0, Length: 8},
+									{Offset: 1024, Length: 1},
+								},
+							},
+							&fake.Namespace{
+								DeviceName_: "namespace0.1",
+								Size_:       1024 * 1024 * 1024,
+								Enabled_:    true,
+							},
+							&fake.Namespace{
+								// Disabled, not reported.
+								DeviceName_: "namespace0.2",
+								BadBlocks_:  []ndctl.BadBlock{{Offset: 0, Length: 1}},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+
+	assert.Equal(t, Health{
+		Dimms: []DimmHealth{
+			{DeviceName: "nmem0", DimmHealth: ndctl.DimmHealth{State: ndctl.HealthOK, SparesPercentage: 90}},
+			{DeviceName: "nmem1", DimmHealth: ndctl.DimmHealth{State: ndctl.HealthUnknown, SparesPercentage: -1, Failed: true}},
+		},
+		Namespaces: []NamespaceHealth{
+			{DeviceName: "namespace0.0", BadBlocks: 9},
+			{DeviceName: "namespace0.1"},
+		},
+	}, healthOf(logger, ndctx))
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
+)
+
+// repairVG detects inconsistencies between the PMEM-CSI namespaces
+// in a region and the volume group for that region and fixes them
+// where that is safe. It returns descriptions of the problems which
+// need manual intervention.
+//
+// The following cases are handled:
+//   - Namespaces are in a PMEM-CSI volume group with a different name,
+//     because region or bus numbering changed. LVM identifies physical
+//     volumes by their UUID, so renamed block devices are not a problem,
+//     but the volume group name is derived from the region name.
+//     The volume group gets renamed unless the expected one also
+//     exists.
+//   - Physical volumes are missing because namespaces were deleted.
+//     They get removed from the volume group unless logical volumes
+//     still use them.
+func repairVG(ctx context.Context, r ndctl.Region, vgName string) []string {
+	ctx, logger := pmemlog.WithName(ctx, "repairVG")
+	var problems []string
+
+	for _, ns := range r.ActiveNamespaces() {
+		if ns.Name() != pmemCSINamespaceName {
+			continue
+		}
+		devName := "/dev/" + ns.BlockDeviceName()
+		output, err := pmemexec.RunCommand(ctx, "pvs", "--noheadings", "-o", "vg_name", devName)
+		if err != nil {
+			// Not a physical volume yet, setupVG will add it.
+			continue
+		}
+		otherVG := strings.TrimSpace(output)
+		rename, problem := checkVGMembership(devName, r.DeviceName(), otherVG, vgName, func() bool { return vgExists(ctx, vgName) })
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+		if !rename {
+			continue
+		}
+		if _, err := pmemexec.RunCommand(ctx, "vgrename", otherVG, vgName); err != nil {
+			problems = append(problems,
+				fmt.Sprintf("renaming volume group %s of region %s to %s failed: %v", otherVG, r.DeviceName(), vgName, err))
+			continue
+		}
+		logger.Info("Renamed volume group after region name change", "region", r.DeviceName(), "old-vg", otherVG, "vg", vgName)
+	}
+
+	if !vgExists(ctx, vgName) {
+		return problems
+	}
+	output, err := pmemexec.RunCommand(ctx, "vgs", "--noheadings", "-o", "vg_missing_pv_count", vgName)
+	if err != nil {
+		return append(problems, fmt.Sprintf("checking volume group %s for missing physical volumes failed: %v", vgName, err))
+	}
+	missing, err := parseMissingPVCount(output)
+	if err != nil {
+		return append(problems, fmt.Sprintf("volume group %s: %v", vgName, err))
+	}
+	if missing == 0 {
+		return problems
+	}
+	// Without --force, this only removes physical volumes
+	// which are not used by any logical volume.
+	if _, err := pmemexec.RunCommand(ctx, "vgreduce", "--removemissing", vgName); err != nil {
+		return append(problems, missingPVProblem(vgName, missing, err))
+	}
+	logger.Info("Removed missing physical volumes from volume group", "vg", vgName, "missing", missing)
+	return problems
+}
+
+// checkVGMembership decides what to do about a PMEM-CSI namespace
+// which is a physical volume in otherVG while it should be in
+// vgName. Renaming otherVG is only safe when it was created by
+// PMEM-CSI and vgName does not exist yet. Otherwise the returned
+// problem describes how to investigate without modifying any volume
+// group, because merging or removing them may lose data.
+func checkVGMembership(devName, region, otherVG, vgName string, vgExists func() bool) (rename bool, problem string) {
+	switch {
+	case otherVG == "" || otherVG == vgName:
+		return false, ""
+	case !pmemcommon.IsVgName(otherVG):
+		return false, fmt.Sprintf("namespace %s in region %s is used by volume group %s, which was not created by PMEM-CSI; check with \"lvs -o +devices %s\" whether that volume group is still needed before removing the namespace from it",
+			devName, region, otherVG, otherVG)
+	case vgExists():
+		return false, fmt.Sprintf("namespace %s in region %s belongs to volume group %s instead of %s, which also exists; check with \"lvs -o +devices %s %s\" which volumes are affected and delete them through their PersistentVolumeClaims",
+			devName, region, otherVG, vgName, otherVG, vgName)
+	default:
+		return true, ""
+	}
+}
+
+// parseMissingPVCount parses the output of "vgs -o vg_missing_pv_count".
+func parseMissingPVCount(output string) (int, error) {
+	missing, err := strconv.Atoi(strings.TrimSpace(output))
+	if err != nil {
+		return 0, fmt.Errorf("unexpected output of vgs: %q", output)
+	}
+	return missing, nil
+}
+
+// missingPVProblem describes missing physical volumes which could
+// not be removed because logical volumes still use them. Forcing the
+// removal would also delete those logical volumes, so the
+// suggestion is to delete the affected volumes through Kubernetes.
+func missingPVProblem(vgName string, missing int, err error) string {
+	return fmt.Sprintf("volume group %s has %d missing physical volume(s) which are still used by logical volumes, the data of those volumes is lost; find them with \"lvs -o +devices %s\" and delete their PersistentVolumeClaims: %v",
+		vgName, missing, vgName, err)
+}
+
+func vgExists(ctx context.Context, vgName string) bool {
+	_, err := pmemexec.RunCommand(ctx, "vgs", vgName)
+	return err == nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckVGMembership(t *testing.T) {
+	const (
+		devName = "/dev/pmem0"
+		region  = "region0"
+		vgName  = "ndbus0region0fsdax"
+	)
+	testcases := map[string]struct {
+		otherVG        string
+		expectedExists bool
+		rename         bool
+		problem        string
+	}{
+		"not in a volume group": {},
+		"expected volume group": {
+			otherVG: vgName,
+		},
+		"renumbered region": {
+			otherVG: "ndbus0region1fsdax",
+			rename:  true,
+		},
+		"renumbered region, both exist": {
+			otherVG:        "ndbus0region1fsdax",
+			expectedExists: true,
+			problem:        `belongs to volume group ndbus0region1fsdax instead of ndbus0region0fsdax, which also exists; check with "lvs -o +devices ndbus0region1fsdax ndbus0region0fsdax"`,
+		},
+		"foreign volume group": {
+			otherVG: "data",
+			problem: `used by volume group data, which was not created by PMEM-CSI; check with "lvs -o +devices data"`,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			rename, problem := checkVGMembership(devName, region, tc.otherVG, vgName, func() bool { return tc.expectedExists })
+			assert.Equal(t, tc.rename, rename, "rename")
+			if tc.problem == "" {
+				assert.Empty(t, problem, "problem")
+				return
+			}
+			assert.Contains(t, problem, tc.problem, "problem")
+			for _, unsafe := range []string{"vgmerge", "vgremove", "--force"} {
+				assert.NotContains(t, problem, unsafe, "suggestion")
+			}
+		})
+	}
+}
+
+func TestParseMissingPVCount(t *testing.T) {
+	missing, err := parseMissingPVCount("  0\n")
+	require.NoError(t, err, "none missing")
+	assert.Equal(t, 0, missing, "none missing")
+	missing, err = parseMissingPVCount("  2\n")
+	require.NoError(t, err, "two missing")
+	assert.Equal(t, 2, missing, "two missing")
+	_, err = parseMissingPVCount("WARNING: something\n  1\n")
+	assert.Error(t, err, "unexpected output")
+}
+
+func TestMissingPVProblem(t *testing.T) {
+	problem := missingPVProblem("ndbus0region0fsdax", 1, errors.New("exit status 5"))
+	assert.Contains(t, problem, `"lvs -o +devices ndbus0region0fsdax"`, "suggestion")
+	assert.Contains(t, problem, "exit status 5", "error")
+	assert.NotContains(t, problem, "--force", "suggestion")
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,6 +19,7 @@ import (
 	"github.com/intel/pmem-csi/pkg/ndctl"
 	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	"github.com/intel/pmem-csi/pkg/termination"
 )
 
 const (
@@ -25,15 +28,33 @@ const (
 
 	// special alt name that a namespace must have to be managed by PMEM-CSI.
 	pmemCSINamespaceName = "pmem-csi"
+
+	// signatureTagPrefix is the prefix of the LV tag which stores
+	// the device signature.
+	signatureTagPrefix = "pmem-csi.intel.com/signature="
+
+	// metadataTagPrefix is the prefix of the LV tags which store
+	// the device metadata as <prefix><key>=<value>.
+	metadataTagPrefix = "pmem-csi.intel.com/"
 )
 
 type pmemLvm struct {
 	volumeGroups []string
+	numaNodes    map[string]int // volume group name to NUMA node
 	devices      map[string]*PmemDeviceInfo
+	problems     []string
 }
 
 var _ PmemDeviceManager = &pmemLvm{}
-var lvsArgs = []string{"--noheadings", "--nosuffix", "-o", "lv_name,lv_path,lv_size", "--units", "B"}
+var _ PmemDeviceHealth = &pmemLvm{}
+var _ PmemDeviceProblems = &pmemLvm{}
+var _ PmemDeviceRenamer = &pmemLvm{}
+var _ PmemDeviceLayout = &pmemLvm{}
+var _ PmemDeviceNUMA = &pmemLvm{}
+var _ PmemDeviceRegions = &pmemLvm{}
+var _ PmemDeviceSignatures = &pmemLvm{}
+var _ PmemDeviceMetadata = &pmemLvm{}
+var lvsArgs = []string{"--noheadings", "--nosuffix", "-o", "lv_name,lv_path,lv_size,lv_tags", "--units", "B"}
 var vgsArgs = []string{"--noheadings", "--nosuffix", "-o", "vg_name,vg_size,vg_free", "--units", "B"}
 
 // mutex to synchronize all LVM calls
@@ -55,11 +76,17 @@ func newPmemDeviceManagerLVM(ctx context.Context, pmemPercentage uint) (PmemDevi
 
 	ndctx, err := ndctl.NewContext()
 	if err != nil {
-		return nil, err
+		return nil, &termination.Error{
+			Reason:     termination.ReasonNdctlFailed,
+			Suggestion: "check that the nvdimm kernel modules are loaded",
+			Err:        err,
+		}
 	}
 	defer ndctx.Free()
 
 	volumeGroups := []string{}
+	numaNodes := map[string]int{}
+	var problems []string
 	for _, bus := range ndctx.GetBuses() {
 		for _, r := range bus.ActiveRegions() {
 			vgName := pmemcommon.VgName(bus, r)
@@ -68,21 +95,61 @@ func newPmemDeviceManagerLVM(ctx context.Context, pmemPercentage uint) (PmemDevi
 				continue
 			}
 
-			if err := setupNS(ctx, r, pmemPercentage); err != nil {
-				return nil, err
+			// Existing namespaces remain in use, but no new ones
+			// are created on failing DIMMs or over damaged labels.
+			if err := ndctl.CheckRegionHealth(r); err != nil {
+				logger.Error(err, "Not adding namespaces to unhealthy region")
+			} else if err := ndctl.CheckRegionLabels(r); err != nil {
+				logger.Error(err, "Not adding namespaces to region with damaged labels")
+				problems = append(problems, err.Error())
+			} else if err := setupNS(ctx, r, pmemPercentage); err != nil {
+				return nil, &termination.Error{
+					Reason:     termination.ReasonNamespaceSetup,
+					Device:     r.DeviceName(),
+					Suggestion: "check the region and its namespaces with \"ndctl list -RN\"",
+					Err:        err,
+				}
 			}
+			problems = append(problems, repairVG(ctx, r, vgName)...)
 			if err := setupVG(ctx, r, vgName); err != nil {
-				return nil, err
+				return nil, &termination.Error{
+					Reason:     termination.ReasonVolumeGroupSetup,
+					Device:     vgName,
+					Suggestion: "check the volume group with \"vgs\" and \"pvs\" and see \"LVM volume group repair\" in the documentation",
+					Err:        err,
+				}
 			}
 			if _, err := pmemexec.RunCommand(ctx, "vgs", vgName); err != nil {
 				logger.V(5).Info("Volume group non-existent, skipping it", "vg", vgName)
 			} else {
 				volumeGroups = append(volumeGroups, vgName)
+				numaNodes[vgName] = r.NumaNode()
 			}
 		}
 	}
 
-	return newPmemDeviceManagerLVMForVGs(ctx, volumeGroups)
+	for _, problem := range problems {
+		logger.Error(nil, "Manual intervention required", "problem", problem)
+	}
+
+	dm, err := newPmemDeviceManagerLVMForVGs(ctx, volumeGroups)
+	if err != nil {
+		return nil, err
+	}
+	dm.(*pmemLvm).problems = problems
+	dm.(*pmemLvm).numaNodes = numaNodes
+	return dm, nil
+}
+
+func (lvm *pmemLvm) Problems() []string {
+	return lvm.problems
+}
+
+// MaxVolumes returns zero because logical volumes do not need
+// namespace labels. The number of volumes is only limited by the size
+// of the volume groups.
+func (lvm *pmemLvm) MaxVolumes(ctx context.Context) (int64, error) {
+	return 0, nil
 }
 
 func (pmem *pmemLvm) GetMode() api.DeviceMode {
@@ -121,8 +188,12 @@ func (lvm *pmemLvm) GetCapacity(ctx context.Context) (capacity Capacity, err err
 	}
 
 	for _, vg := range vgs {
-		if vg.free > capacity.MaxVolumeSize {
-			capacity.MaxVolumeSize = vg.free / lvmAlign * lvmAlign
+		// There is one volume group per region and logical
+		// volumes cannot span volume groups, so the largest
+		// volume is limited by the volume group with the
+		// most free space.
+		if maxVolumeSize := vg.free / lvmAlign * lvmAlign; maxVolumeSize > capacity.MaxVolumeSize {
+			capacity.MaxVolumeSize = maxVolumeSize
 		}
 		capacity.Available += vg.free
 		capacity.Managed += vg.size
@@ -135,7 +206,64 @@ func (lvm *pmemLvm) GetCapacity(ctx context.Context) (capacity Capacity, err err
 	return capacity, nil
 }
 
+func (lvm *pmemLvm) AvailableByNUMANode(ctx context.Context) (map[int]uint64, error) {
+	lvmMutex.Lock()
+	defer lvmMutex.Unlock()
+
+	vgs, err := getVolumeGroups(ctx, lvm.volumeGroups)
+	if err != nil {
+		return nil, err
+	}
+	return vgsByNUMANode(vgs, lvm.numaNodes), nil
+}
+
+// vgsByNUMANode sums up the free space of the volume groups per NUMA
+// node of their region.
+func vgsByNUMANode(vgs []vgInfo, numaNodes map[string]int) map[int]uint64 {
+	available := map[int]uint64{}
+	for _, vg := range vgs {
+		node, ok := numaNodes[vg.name]
+		if !ok {
+			node = -1
+		}
+		available[node] += vg.free
+	}
+	return available
+}
+
+func (lvm *pmemLvm) GetHealth(ctx context.Context) (Health, error) {
+	return getHealth(ctx)
+}
+
+func (lvm *pmemLvm) RegionIDs(ctx context.Context) ([]uint, error) {
+	var ids []uint
+	for _, vgName := range lvm.volumeGroups {
+		if id, ok := pmemcommon.VgRegionID(vgName); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
 func (lvm *pmemLvm) CreateDevice(ctx context.Context, volumeId string, size uint64, usage parameters.Usage) (uint64, error) {
+	return lvm.createDevice(ctx, volumeId, size, lvm.volumeGroups)
+}
+
+func (lvm *pmemLvm) CreateDeviceInRegion(ctx context.Context, volumeId string, size uint64, usage parameters.Usage, region uint) (uint64, error) {
+	var volumeGroups []string
+	for _, vgName := range lvm.volumeGroups {
+		if id, ok := pmemcommon.VgRegionID(vgName); ok && id == region {
+			volumeGroups = append(volumeGroups, vgName)
+		}
+	}
+	if len(volumeGroups) == 0 {
+		return 0, fmt.Errorf("no volume group for region%d: %w", region, pmemerr.NotEnoughSpace)
+	}
+	return lvm.createDevice(ctx, volumeId, size, volumeGroups)
+}
+
+// createDevice creates a logical volume in one of the given volume groups.
+func (lvm *pmemLvm) createDevice(ctx context.Context, volumeId string, size uint64, volumeGroups []string) (uint64, error) {
 	ctx, logger := pmemlog.WithName(ctx, "LVM-CreateDevice")
 
 	lvmMutex.Lock()
@@ -148,7 +276,7 @@ func (lvm *pmemLvm) CreateDevice(ctx context.Context, volumeId string, size uint
 	if _, err := lvm.getDevice(volumeId); err == nil {
 		return 0, pmemerr.DeviceExists
 	}
-	vgs, err := getVolumeGroups(ctx, lvm.volumeGroups)
+	vgs, err := getVolumeGroups(ctx, volumeGroups)
 	if err != nil {
 		return 0, err
 	}
@@ -165,13 +293,21 @@ func (lvm *pmemLvm) CreateDevice(ctx context.Context, volumeId string, size uint
 	}
 	strSz := strconv.FormatUint(actual, 10) + "B"
 
+	// Best fit: use the volume group with the least, but still
+	// enough available space. That keeps more space available
+	// elsewhere for larger volumes.
+	sort.SliceStable(vgs, func(i, j int) bool {
+		return vgs[i].free < vgs[j].free
+	})
 	for _, vg := range vgs {
-		// use first Vgroup with enough available space
 		if vg.free >= actual {
 			// In some container environments clearing device fails with race condition.
 			// So, we ask lvm not to clear(-Zn) the newly created device, instead we do ourself in later stage.
 			// lvcreate takes size in MBytes if no unit
-			if _, err := pmemexec.RunCommand(ctx, "lvcreate", "-Zn", "-L", strSz, "-n", volumeId, vg.name); err != nil {
+			if err := withRetries(ctx, "lvcreate", lvmMutex, func() error {
+				_, err := pmemexec.RunCommand(ctx, "lvcreate", "-Zn", "-L", strSz, "-n", volumeId, vg.name)
+				return err
+			}); err != nil {
 				logger.V(3).Info("lvcreate failed with error, trying next free region", "error", err)
 			} else {
 				// clear start of device to avoid old data being recognized as file system
@@ -219,7 +355,10 @@ func (lvm *pmemLvm) DeleteDevice(ctx context.Context, volumeId string, flush boo
 		return err
 	}
 
-	if _, err := pmemexec.RunCommand(ctx, "lvremove", "-fy", device.Path); err != nil {
+	if err := withRetries(ctx, "lvremove", lvmMutex, func() error {
+		_, err := pmemexec.RunCommand(ctx, "lvremove", "-fy", device.Path)
+		return err
+	}); err != nil {
 		return err
 	}
 
@@ -229,6 +368,152 @@ func (lvm *pmemLvm) DeleteDevice(ctx context.Context, volumeId string, flush boo
 	return nil
 }
 
+func (lvm *pmemLvm) RenameDevice(ctx context.Context, oldName, newName string) error {
+	ctx, _ = pmemlog.WithName(ctx, "LVM-RenameDevice")
+
+	lvmMutex.Lock()
+	defer lvmMutex.Unlock()
+
+	device, err := lvm.getDevice(oldName)
+	if err != nil {
+		return err
+	}
+	if _, err := lvm.getDevice(newName); err == nil {
+		return pmemerr.DeviceExists
+	}
+	if err := withRetries(ctx, "lvrename", lvmMutex, func() error {
+		_, err := pmemexec.RunCommand(ctx, "lvrename", device.Path, newName)
+		return err
+	}); err != nil {
+		return err
+	}
+	delete(lvm.devices, oldName)
+
+	// The device path contains the name and thus has changed, too.
+	vgName := filepath.Base(filepath.Dir(device.Path))
+	renamed, err := getUncachedDevice(ctx, newName, vgName)
+	if err != nil {
+		return err
+	}
+	lvm.devices[newName] = renamed
+	return nil
+}
+
+// SetSignature stores the signature as LV tag. Tags are kept when
+// the volume gets renamed.
+func (lvm *pmemLvm) SetSignature(ctx context.Context, volumeId string, signature string) error {
+	ctx, _ = pmemlog.WithName(ctx, "LVM-SetSignature")
+
+	lvmMutex.Lock()
+	defer lvmMutex.Unlock()
+
+	device, err := lvm.getDevice(volumeId)
+	if err != nil {
+		return err
+	}
+	args := []string{}
+	if device.Signature != "" {
+		args = append(args, "--deltag", signatureTagPrefix+device.Signature)
+	}
+	args = append(args, "--addtag", signatureTagPrefix+signature, device.Path)
+	if err := withRetries(ctx, "lvchange", lvmMutex, func() error {
+		_, err := pmemexec.RunCommand(ctx, "lvchange", args...)
+		return err
+	}); err != nil {
+		return err
+	}
+	device.Signature = signature
+	return nil
+}
+
+// ResizeDevice grows the logical volume to at least the given size,
+// rounded up to the LVM alignment, and returns the actual size. A
+// volume which is already large enough is left unchanged.
+func (lvm *pmemLvm) ResizeDevice(ctx context.Context, volumeId string, size uint64) (uint64, error) {
+	ctx, logger := pmemlog.WithName(ctx, "LVM-ResizeDevice")
+
+	lvmMutex.Lock()
+	defer lvmMutex.Unlock()
+
+	device, err := lvm.getDevice(volumeId)
+	if err != nil {
+		return 0, err
+	}
+	if size <= device.Size {
+		return device.Size, nil
+	}
+	// The logical volume can only grow inside its own volume group.
+	vgName := filepath.Base(filepath.Dir(device.Path))
+	vgs, err := getVolumeGroups(ctx, []string{vgName})
+	if err != nil {
+		return 0, err
+	}
+	actual := (size + lvmAlign - 1) / lvmAlign * lvmAlign
+	if len(vgs) != 1 || vgs[0].free < actual-device.Size {
+		return 0, pmemerr.NotEnoughSpace
+	}
+	logger.V(3).Info("Extending logical volume",
+		"old-size", pmemlog.CapacityRef(int64(device.Size)),
+		"new-size", pmemlog.CapacityRef(int64(actual)))
+	strSz := strconv.FormatUint(actual, 10) + "B"
+	if err := withRetries(ctx, "lvextend", lvmMutex, func() error {
+		_, err := pmemexec.RunCommand(ctx, "lvextend", "-L", strSz, device.Path)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	resized, err := getUncachedDevice(ctx, volumeId, vgName)
+	if err != nil {
+		return 0, err
+	}
+	lvm.devices[volumeId] = resized
+	return resized.Size, nil
+}
+
+// SetMetadata stores each key/value pair as LV tag. The characters
+// in Kubernetes object names are all allowed in tags, so "lvs -o
+// +lv_tags" shows them as they are.
+func (lvm *pmemLvm) SetMetadata(ctx context.Context, volumeId string, metadata map[string]string) error {
+	ctx, _ = pmemlog.WithName(ctx, "LVM-SetMetadata")
+
+	lvmMutex.Lock()
+	defer lvmMutex.Unlock()
+
+	device, err := lvm.getDevice(volumeId)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := []string{}
+	for _, key := range keys {
+		if old, ok := device.Metadata[key]; ok {
+			args = append(args, "--deltag", metadataTagPrefix+key+"="+old)
+		}
+		args = append(args, "--addtag", metadataTagPrefix+key+"="+metadata[key])
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	args = append(args, device.Path)
+	if err := withRetries(ctx, "lvchange", lvmMutex, func() error {
+		_, err := pmemexec.RunCommand(ctx, "lvchange", args...)
+		return err
+	}); err != nil {
+		return err
+	}
+	if device.Metadata == nil {
+		device.Metadata = map[string]string{}
+	}
+	for key, value := range metadata {
+		device.Metadata[key] = value
+	}
+	return nil
+}
+
 func (lvm *pmemLvm) ListDevices(ctx context.Context) ([]*PmemDeviceInfo, error) {
 	lvmMutex.Lock()
 	defer lvmMutex.Unlock()
@@ -256,8 +541,11 @@ func (lvm *pmemLvm) getDevice(volumeId string) (*PmemDeviceInfo, error) {
 	return nil, pmemerr.DeviceNotFound
 }
 
+// getUncachedDevice retrieves information about one logical volume.
+// Only that volume is listed, which keeps the cost independent of
+// the number of volumes in the volume group.
 func getUncachedDevice(ctx context.Context, volumeId string, volumeGroup string) (*PmemDeviceInfo, error) {
-	devices, err := listDevices(ctx, volumeGroup)
+	devices, err := listDevices(ctx, volumeGroup+"/"+volumeId)
 	if err != nil {
 		return nil, err
 	}
@@ -270,6 +558,7 @@ func getUncachedDevice(ctx context.Context, volumeId string, volumeGroup string)
 }
 
 // listDevices Lists available logical devices in given volume groups
+// or, when given as <volume group>/<name>, individual logical volumes.
 func listDevices(ctx context.Context, volumeGroups ...string) (map[string]*PmemDeviceInfo, error) {
 	args := append(lvsArgs, volumeGroups...)
 	output, err := pmemexec.RunCommand(ctx, "lvs", args...)
@@ -279,13 +568,14 @@ func listDevices(ctx context.Context, volumeGroups ...string) (map[string]*PmemD
 	return parseLVSOutput(output)
 }
 
-// lvs options "lv_name,lv_path,lv_size,lv_free"
+// lvs options "lv_name,lv_path,lv_size,lv_tags", the tags column is
+// empty for volumes without tags.
 func parseLVSOutput(output string) (map[string]*PmemDeviceInfo, error) {
 	devices := map[string]*PmemDeviceInfo{}
 	lines := strings.Split(output, "\n")
 	for _, line := range lines {
 		fields := strings.Fields(strings.TrimSpace(line))
-		if len(fields) != 3 {
+		if len(fields) != 3 && len(fields) != 4 {
 			continue
 		}
 
@@ -293,6 +583,23 @@ func parseLVSOutput(output string) (map[string]*PmemDeviceInfo, error) {
 		dev.VolumeId = fields[0]
 		dev.Path = fields[1]
 		dev.Size, _ = strconv.ParseUint(fields[2], 10, 64)
+		if len(fields) == 4 {
+			for _, tag := range strings.Split(fields[3], ",") {
+				switch {
+				case strings.HasPrefix(tag, signatureTagPrefix):
+					dev.Signature = strings.TrimPrefix(tag, signatureTagPrefix)
+				case strings.HasPrefix(tag, metadataTagPrefix):
+					parts := strings.SplitN(strings.TrimPrefix(tag, metadataTagPrefix), "=", 2)
+					if len(parts) != 2 {
+						continue
+					}
+					if dev.Metadata == nil {
+						dev.Metadata = map[string]string{}
+					}
+					dev.Metadata[parts[0]] = parts[1]
+				}
+			}
+		}
 
 		devices[dev.VolumeId] = dev
 	}
@@ -324,9 +631,57 @@ func getVolumeGroups(ctx context.Context, groups []string) ([]vgInfo, error) {
 	return vgs, nil
 }
 
-// setupNS checks if a namespace needs to be created in the region and if so, does that.
-func setupNS(ctx context.Context, r ndctl.Region, percentage uint) error {
-	ctx, logger := pmemlog.WithName(ctx, "setupNS")
+// lvmInitialCapacity determines the capacity that a device manager
+// created by newPmemDeviceManagerLVM would have, without creating
+// namespaces or volume groups: existing volume groups count with
+// their current size, plus the namespaces that setupNS would add.
+func lvmInitialCapacity(ctx context.Context, percentage uint) (capacity Capacity, err error) {
+	ctx, logger := pmemlog.WithName(ctx, "LVM-InitialCapacity")
+	lvmMutex.Lock()
+	defer lvmMutex.Unlock()
+
+	var ndctx ndctl.Context
+	ndctx, err = ndctl.NewContext()
+	if err != nil {
+		return
+	}
+	defer ndctx.Free()
+
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.AllRegions() {
+			capacity.Total += r.Size()
+		}
+		for _, r := range bus.ActiveRegions() {
+			if r.Type() != ndctl.PmemRegion {
+				continue
+			}
+			vgName := pmemcommon.VgName(bus, r)
+			var size, free uint64
+			if vgs, err := getVolumeGroups(ctx, []string{vgName}); err == nil && len(vgs) == 1 {
+				size, free = vgs[0].size, vgs[0].free
+			}
+			if ndctl.CheckRegionHealth(r) == nil {
+				added := namespaceSize(ctx, r, percentage)
+				size += added
+				free += added
+			}
+			logger.V(3).Info("Simulated volume group", "vg", vgName,
+				"size", pmemlog.CapacityRef(int64(size)),
+				"free", pmemlog.CapacityRef(int64(free)))
+			if maxVolumeSize := free / lvmAlign * lvmAlign; maxVolumeSize > capacity.MaxVolumeSize {
+				capacity.MaxVolumeSize = maxVolumeSize
+			}
+			capacity.Available += free
+			capacity.Managed += size
+		}
+	}
+	return capacity, nil
+}
+
+// namespaceSize calculates the size of the namespace which setupNS
+// creates in the region, zero if none is needed.
+func namespaceSize(ctx context.Context, r ndctl.Region, percentage uint) uint64 {
+	logger := klog.FromContext(ctx)
 	canUse := uint64(percentage) * r.Size() / 100
 	logger.V(3).Info("Checking region for fsdax namespaces",
 		"region", r.DeviceName(),
@@ -366,6 +721,13 @@ func setupNS(ctx context.Context, r ndctl.Region, percentage uint) error {
 			"max-available-extent", pmemlog.CapacityRef(int64(r.MaxAvailableExtent())))
 		canUse = r.MaxAvailableExtent()
 	}
+	return canUse
+}
+
+// setupNS checks if a namespace needs to be created in the region and if so, does that.
+func setupNS(ctx context.Context, r ndctl.Region, percentage uint) error {
+	ctx, logger := pmemlog.WithName(ctx, "setupNS")
+	canUse := namespaceSize(ctx, r, percentage)
 	if canUse > 0 {
 		logger.V(3).Info("Create fsdax namespace", "size", pmemlog.CapacityRef(int64(canUse)))
 		ns, err := r.CreateNamespace(ctx, ndctl.CreateNamespaceOpts{
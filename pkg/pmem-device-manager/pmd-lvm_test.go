@@ -0,0 +1,55 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLVSOutput(t *testing.T) {
+	output := `  pvc-1 /dev/ndbus0region0fsdax/pvc-1 4194304
+  pvc-2 /dev/ndbus0region0fsdax/pvc-2 8388608 pmem-csi.intel.com/pv=pv-2,pmem-csi.intel.com/pvc=default/data,pmem-csi.intel.com/signature=1234
+`
+	devices, err := parseLVSOutput(output)
+	require.NoError(t, err, "parse")
+	assert.Equal(t, map[string]*PmemDeviceInfo{
+		"pvc-1": {
+			VolumeId: "pvc-1",
+			Path:     "/dev/ndbus0region0fsdax/pvc-1",
+			Size:     4194304,
+		},
+		"pvc-2": {
+			VolumeId:  "pvc-2",
+			Path:      "/dev/ndbus0region0fsdax/pvc-2",
+			Size:      8388608,
+			Signature: "1234",
+			Metadata: map[string]string{
+				MetadataPV:  "pv-2",
+				MetadataPVC: "default/data",
+			},
+		},
+	}, devices, "devices")
+}
+
+func TestVGsByNUMANode(t *testing.T) {
+	vgs := []vgInfo{
+		{name: "ndbus0region0fsdax", size: 100, free: 10},
+		{name: "ndbus0region1fsdax", size: 100, free: 20},
+		{name: "ndbus1region2fsdax", size: 100, free: 30},
+		{name: "ndbus1region3fsdax", size: 100, free: 40},
+	}
+	numaNodes := map[string]int{
+		"ndbus0region0fsdax": 0,
+		"ndbus0region1fsdax": 0,
+		"ndbus1region2fsdax": 1,
+	}
+	assert.Equal(t, map[int]uint64{0: 30, 1: 30, -1: 40}, vgsByNUMANode(vgs, numaNodes))
+	assert.Empty(t, vgsByNUMANode(nil, numaNodes), "no volume groups")
+}
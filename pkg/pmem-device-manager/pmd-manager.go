@@ -28,6 +28,16 @@ type PmemDeviceInfo struct {
 
 	// Size allocated for block device in bytes.
 	Size uint64
+
+	// Signature identifies the volume for which the device was
+	// created. Empty if the device manager does not support
+	// signatures or none was set.
+	Signature string
+
+	// Metadata describes the Kubernetes objects for which the
+	// device was created. Empty if the device manager does not
+	// support metadata or none was set.
+	Metadata map[string]string
 }
 
 // Capacity contains information about PMEM. All sizes count bytes.
@@ -71,6 +81,88 @@ type PmemDeviceCapacity interface {
 	GetCapacity(ctx context.Context) (Capacity, error)
 }
 
+// PmemDeviceProblems is implemented by device managers which detect
+// problems that cannot be fixed automatically.
+type PmemDeviceProblems interface {
+	// Problems returns descriptions of the problems that were
+	// found while initializing the device manager.
+	Problems() []string
+}
+
+// PmemDeviceRenamer is implemented by device managers which can
+// change the name of an existing device without touching its data.
+type PmemDeviceRenamer interface {
+	// RenameDevice gives the device a new name.
+	// Possible errors: ErrDeviceNotFound, ErrDeviceExists
+	RenameDevice(ctx context.Context, oldName, newName string) error
+}
+
+// PmemDeviceSignatures is implemented by device managers which can
+// store a signature together with a device.
+type PmemDeviceSignatures interface {
+	// SetSignature stores the signature. It is returned as
+	// PmemDeviceInfo.Signature afterwards.
+	// Possible errors: ErrDeviceNotFound
+	SetSignature(ctx context.Context, volumeId string, signature string) error
+}
+
+// Keys for PmemDeviceMetadata.
+const (
+	// MetadataPVC is the PVC as <namespace>/<name>.
+	MetadataPVC = "pvc"
+	// MetadataPV is the name of the PV.
+	MetadataPV = "pv"
+)
+
+// PmemDeviceMetadata is implemented by device managers which can
+// store information about the Kubernetes objects together with a
+// device, for administrators who inspect devices on the node.
+type PmemDeviceMetadata interface {
+	// SetMetadata adds the key/value pairs. Keys and values
+	// must be valid parts of Kubernetes object names.
+	// Possible errors: ErrDeviceNotFound
+	SetMetadata(ctx context.Context, volumeId string, metadata map[string]string) error
+}
+
+// PmemDeviceResizer is implemented by device managers which can
+// grow an existing device without losing its content.
+type PmemDeviceResizer interface {
+	// ResizeDevice grows the device to at least the given size and
+	// returns the actual size. A device which is already large
+	// enough is left unchanged.
+	// Possible errors: ErrDeviceNotFound, ErrNotEnoughSpace
+	ResizeDevice(ctx context.Context, volumeId string, size uint64) (uint64, error)
+}
+
+// PmemDeviceLayout is implemented by device managers which can
+// describe how PMEM is organized on the node.
+type PmemDeviceLayout interface {
+	// MaxVolumes returns the maximum number of volumes that
+	// the node can hold, zero if there is no fixed limit.
+	MaxVolumes(ctx context.Context) (int64, error)
+}
+
+// PmemDeviceRegions is implemented by device managers which can
+// place devices in a specific PMEM region.
+type PmemDeviceRegions interface {
+	// RegionIDs returns the IDs of the regions which provide
+	// space for volumes (N in regionN).
+	RegionIDs(ctx context.Context) ([]uint, error)
+	// CreateDeviceInRegion works like CreateDevice, but only uses
+	// the region with the given ID.
+	// Possible errors: ErrNotEnoughSpace, ErrDeviceExists
+	CreateDeviceInRegion(ctx context.Context, name string, size uint64, usage parameters.Usage, region uint) (uint64, error)
+}
+
+// PmemDeviceNUMA is implemented by device managers which know
+// which NUMA node provides the PMEM.
+type PmemDeviceNUMA interface {
+	// AvailableByNUMANode returns the amount of PMEM that could
+	// be used for new volumes, by NUMA node. Key -1 stands for
+	// PMEM with unknown NUMA node.
+	AvailableByNUMANode(ctx context.Context) (map[int]uint64, error)
+}
+
 // PmemDeviceManager interface to manage the PMEM block devices
 type PmemDeviceManager interface {
 	PmemDeviceCapacity
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"time"
 
 	"k8s.io/klog/v2"
 
@@ -14,15 +15,30 @@ import (
 	pmemlog "github.com/intel/pmem-csi/pkg/logger"
 	"github.com/intel/pmem-csi/pkg/ndctl"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	"github.com/intel/pmem-csi/pkg/termination"
 
 	"k8s.io/utils/mount"
 )
 
 type pmemNdctl struct {
 	pmemPercentage uint
+
+	// inventory speeds up GetDevice and ListDevices. Must be
+	// invalidated after creating or deleting namespaces.
+	inventory *ndctl.Inventory
 }
 
+// inventoryMaxAge limits how long cached namespaces are used in case
+// that uevents are not delivered, for example because the node
+// driver runs in a separate user namespace.
+const inventoryMaxAge = time.Minute
+
 var _ PmemDeviceManager = &pmemNdctl{}
+var _ PmemDeviceHealth = &pmemNdctl{}
+var _ PmemDeviceRenamer = &pmemNdctl{}
+var _ PmemDeviceLayout = &pmemNdctl{}
+var _ PmemDeviceRegions = &pmemNdctl{}
+var _ PmemDeviceNUMA = &pmemNdctl{}
 
 // mutex to synchronize all ndctl calls
 // https://github.com/pmem/ndctl/issues/96
@@ -33,7 +49,7 @@ var ndctlMutex = &sync.Mutex{}
 // NewPmemDeviceManagerNdctl Instantiates a new ndctl based pmem device manager
 // FIXME(avalluri): consider pmemPercentage while calculating available space
 func newPmemDeviceManagerNdctl(ctx context.Context, pmemPercentage uint) (PmemDeviceManager, error) {
-	ctx, _ = pmemlog.WithName(ctx, "ndctl-New")
+	ctx, logger := pmemlog.WithName(ctx, "ndctl-New")
 	if pmemPercentage > 100 {
 		return nil, fmt.Errorf("invalid pmemPercentage '%d'. Value must be 0..100", pmemPercentage)
 	}
@@ -65,13 +81,22 @@ func newPmemDeviceManagerNdctl(ctx context.Context, pmemPercentage uint) (PmemDe
 			}
 		case os.IsNotExist(err):
 			// Can't fix the write-only /sys.
-			return nil, errors.New("/sys mounted read-only, can not operate")
+			return nil, &termination.Error{
+				Reason:     termination.ReasonSysReadOnly,
+				Suggestion: "run the container privileged or mount the /sys of the host at /host-sys",
+				Err:        errors.New("/sys mounted read-only, can not operate"),
+			}
 		default:
 			return nil, fmt.Errorf("/sys mounted read-only and access to /host-sys fallback failed: %v", err)
 		}
 	}
 
-	return &pmemNdctl{pmemPercentage: pmemPercentage}, nil
+	inventory := ndctl.NewInventory(inventoryMaxAge)
+	if err := inventory.WatchUevents(ctx); err != nil {
+		logger.Error(err, "Cannot watch for namespace changes, relying on periodic refresh", "max-age", inventoryMaxAge)
+	}
+
+	return &pmemNdctl{pmemPercentage: pmemPercentage, inventory: inventory}, nil
 }
 
 // sysIsWritable returns true if any of the /sys mounts is writable.
@@ -122,23 +147,35 @@ func (pmem *pmemNdctl) GetCapacity(ctx context.Context) (capacity Capacity, err
 				continue
 			}
 
+			capacity.Managed += r.Size()
+			if err := ndctl.CheckRegionHealth(r); err != nil {
+				// No new volumes will be created there.
+				logger.V(3).Info("Ignoring free space in unhealthy region", "region", r.DeviceName(), "reason", err.Error())
+				continue
+			}
+
 			align, alignInfo := ndctl.CalculateAlignment(r)
-			maxVolumeSize := r.MaxAvailableExtent()
+			// Already aligned down by the region's alignment, avoid claiming
+			// having more than what we really can serve.
+			maxVolumeSize := ndctl.MaxNamespaceSize(r)
 			available := r.AvailableSize()
 			size := r.Size()
 			logger.V(4).WithValues("region", r.DeviceName()).WithValues(alignInfo...).Info("Found a region",
-				"max-available-extent", pmemlog.CapacityRef(int64(maxVolumeSize)),
+				"max-available-extent", pmemlog.CapacityRef(int64(r.MaxAvailableExtent())),
+				"max-namespace-size", pmemlog.CapacityRef(int64(maxVolumeSize)),
 				"available", pmemlog.CapacityRef(int64(available)),
 				"size", pmemlog.CapacityRef(int64(size)),
 			)
+			if r.Readonly() {
+				continue
+			}
 
-			// align down by the region's alignment, avoid claiming having more than what we really can serve
-			maxVolumeSize = maxVolumeSize / align * align
+			// A volume cannot span regions, so the largest
+			// volume is limited by the largest region.
 			if maxVolumeSize > capacity.MaxVolumeSize {
 				capacity.MaxVolumeSize = maxVolumeSize
 			}
 			capacity.Available += available / align * align
-			capacity.Managed += size
 		}
 	}
 	// TODO: we should maintain capacity when adding or subtracting
@@ -146,10 +183,73 @@ func (pmem *pmemNdctl) GetCapacity(ctx context.Context) (capacity Capacity, err
 	return capacity, nil
 }
 
+func (pmem *pmemNdctl) AvailableByNUMANode(ctx context.Context) (map[int]uint64, error) {
+	ndctlMutex.Lock()
+	defer ndctlMutex.Unlock()
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return nil, err
+	}
+	defer ndctx.Free()
+
+	return regionsByNUMANode(ndctx), nil
+}
+
+// regionsByNUMANode sums up the aligned free space of the usable
+// regions per NUMA node. Same regions as in GetCapacity.
+func regionsByNUMANode(ndctx ndctl.Context) map[int]uint64 {
+	available := map[int]uint64{}
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.AllRegions() {
+			if !r.Enabled() || r.Readonly() || ndctl.CheckRegionHealth(r) != nil {
+				continue
+			}
+			align, _ := ndctl.CalculateAlignment(r)
+			available[r.NumaNode()] += r.AvailableSize() / align * align
+		}
+	}
+	return available
+}
+
+func (pmem *pmemNdctl) GetHealth(ctx context.Context) (Health, error) {
+	return getHealth(ctx)
+}
+
 func (pmem *pmemNdctl) CreateDevice(ctx context.Context, volumeId string, size uint64, usage parameters.Usage) (uint64, error) {
+	return pmem.createDevice(ctx, volumeId, size, usage, "")
+}
+
+func (pmem *pmemNdctl) CreateDeviceInRegion(ctx context.Context, volumeId string, size uint64, usage parameters.Usage, region uint) (uint64, error) {
+	return pmem.createDevice(ctx, volumeId, size, usage, fmt.Sprintf("region%d", region))
+}
+
+func (pmem *pmemNdctl) RegionIDs(ctx context.Context) ([]uint, error) {
+	ndctlMutex.Lock()
+	defer ndctlMutex.Unlock()
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return nil, err
+	}
+	defer ndctx.Free()
+
+	var ids []uint
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			if r.Type() == ndctl.PmemRegion {
+				ids = append(ids, r.ID())
+			}
+		}
+	}
+	return ids, nil
+}
+
+func (pmem *pmemNdctl) createDevice(ctx context.Context, volumeId string, size uint64, usage parameters.Usage, region string) (uint64, error) {
 	ctx, _ = pmemlog.WithName(ctx, "ndctl-CreateDevice")
 	ndctlMutex.Lock()
 	defer ndctlMutex.Unlock()
+	defer pmem.inventory.Invalidate()
 
 	ndctx, err := ndctl.NewContext()
 	if err != nil {
@@ -167,8 +267,9 @@ func (pmem *pmemNdctl) CreateDevice(ctx context.Context, volumeId string, size u
 	}
 
 	opts := ndctl.CreateNamespaceOpts{
-		Name: volumeId,
-		Size: size,
+		Name:   volumeId,
+		Size:   size,
+		Region: region,
 	}
 	switch usage {
 	case parameters.UsageAppDirect:
@@ -179,14 +280,35 @@ func (pmem *pmemNdctl) CreateDevice(ctx context.Context, volumeId string, size u
 		return 0, fmt.Errorf("unsupported usage %s for direct mode", usage)
 	}
 
-	ns, err := ndctl.CreateNamespace(ctx, ndctx, opts)
+	var actual uint64
+	if err := withRetries(ctx, "create-namespace", ndctlMutex, func() error {
+		// The state cached by a context becomes stale while
+		// waiting for the next attempt without the lock, so
+		// each attempt needs its own.
+		ndctx, err := ndctl.NewContext()
+		if err != nil {
+			return err
+		}
+		defer ndctx.Free()
+		ns, err := ndctl.CreateNamespace(ctx, ndctx, opts)
+		if err != nil {
+			return err
+		}
+		actual = ns.RawSize()
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	// The initial context was created before the namespace.
+	newctx, err := ndctl.NewContext()
 	if err != nil {
 		return 0, err
 	}
-	actual := ns.RawSize()
+	defer newctx.Free()
 
 	// clear start of device to avoid old data being recognized as file system
-	device, err := getDevice(ndctx, volumeId)
+	device, err := getDevice(newctx, volumeId)
 	if err != nil {
 		return 0, err
 	}
@@ -201,6 +323,7 @@ func (pmem *pmemNdctl) DeleteDevice(ctx context.Context, volumeId string, flush
 	ctx, _ = pmemlog.WithName(ctx, "ndctl-DeleteDevice")
 	ndctlMutex.Lock()
 	defer ndctlMutex.Unlock()
+	defer pmem.inventory.Invalidate()
 
 	ndctx, err := ndctl.NewContext()
 	if err != nil {
@@ -221,35 +344,119 @@ func (pmem *pmemNdctl) DeleteDevice(ctx context.Context, volumeId string, flush
 		}
 		return err
 	}
-	return ndctl.DestroyNamespaceByName(ndctx, volumeId)
+	return withRetries(ctx, "destroy-namespace", ndctlMutex, func() error {
+		ndctx, err := ndctl.NewContext()
+		if err != nil {
+			return err
+		}
+		defer ndctx.Free()
+		err = ndctl.DestroyNamespaceByName(ndctx, volumeId)
+		if errors.Is(err, pmemerr.DeviceNotFound) {
+			// Removed by an earlier attempt.
+			return nil
+		}
+		return err
+	})
 }
 
-func (pmem *pmemNdctl) GetDevice(ctx context.Context, volumeId string) (*PmemDeviceInfo, error) {
+// MaxVolumes is based on the number of namespace labels. Namespaces
+// which were not created by PMEM-CSI are included in the count.
+func (pmem *pmemNdctl) MaxVolumes(ctx context.Context) (int64, error) {
 	ndctlMutex.Lock()
 	defer ndctlMutex.Unlock()
 
 	ndctx, err := ndctl.NewContext()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	defer ndctx.Free()
 
-	return getDevice(ndctx, volumeId)
+	var maxVolumes int64
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			if r.Type() != ndctl.PmemRegion {
+				continue
+			}
+			maxVolumes += int64(ndctl.MaxNamespaces(r))
+		}
+	}
+	return maxVolumes, nil
 }
 
-func (pmem *pmemNdctl) ListDevices(ctx context.Context) ([]*PmemDeviceInfo, error) {
+// RenameDevice changes the name of a namespace. Namespaces which
+// were created without a name can be referenced by their device name
+// (for example, namespace0.1). The namespace gets disabled
+// temporarily because the kernel does not allow changing the name
+// of an active namespace.
+func (pmem *pmemNdctl) RenameDevice(ctx context.Context, oldName, newName string) error {
+	ctx, logger := pmemlog.WithName(ctx, "ndctl-RenameDevice")
 	ndctlMutex.Lock()
 	defer ndctlMutex.Unlock()
+	defer pmem.inventory.Invalidate()
 
 	ndctx, err := ndctl.NewContext()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer ndctx.Free()
 
-	devices := []*PmemDeviceInfo{}
+	if _, err := ndctl.GetNamespaceByName(ndctx, newName); err == nil {
+		return pmemerr.DeviceExists
+	}
+	ns, err := ndctl.GetNamespaceByName(ndctx, oldName)
+	if errors.Is(err, pmemerr.DeviceNotFound) {
+		ns, err = getNamespaceByDeviceName(ndctx, oldName)
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.V(3).Info("Renaming namespace", "namespace", ns.DeviceName(), "name", newName)
+	if err := ns.Disable(); err != nil {
+		return fmt.Errorf("disable namespace %s: %v", ns.DeviceName(), err)
+	}
+	renameErr := ns.SetAltName(newName)
+	if err := ns.Enable(); err != nil {
+		return fmt.Errorf("enable namespace %s: %v", ns.DeviceName(), err)
+	}
+	if renameErr != nil {
+		return fmt.Errorf("rename namespace %s: %v", ns.DeviceName(), renameErr)
+	}
+	return nil
+}
+
+func getNamespaceByDeviceName(ndctx ndctl.Context, deviceName string) (ndctl.Namespace, error) {
 	for _, ns := range ndctl.GetAllNamespaces(ndctx) {
-		devices = append(devices, namespaceToPmemInfo(ns))
+		if ns.DeviceName() == deviceName {
+			return ns, nil
+		}
+	}
+	return nil, pmemerr.DeviceNotFound
+}
+
+func (pmem *pmemNdctl) GetDevice(ctx context.Context, volumeId string) (*PmemDeviceInfo, error) {
+	ndctlMutex.Lock()
+	defer ndctlMutex.Unlock()
+
+	ns, err := pmem.inventory.NamespaceByName(volumeId)
+	if err != nil {
+		return nil, fmt.Errorf("error getting device %q: %w", volumeId, err)
+	}
+	return namespaceInfoToPmemInfo(ns), nil
+}
+
+func (pmem *pmemNdctl) ListDevices(ctx context.Context) ([]*PmemDeviceInfo, error) {
+	ndctlMutex.Lock()
+	defer ndctlMutex.Unlock()
+
+	namespaces, err := pmem.inventory.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+
+	devices := []*PmemDeviceInfo{}
+	for i := range namespaces {
+		devices = append(devices, namespaceInfoToPmemInfo(&namespaces[i]))
 	}
 	return devices, nil
 }
@@ -271,6 +478,14 @@ func namespaceToPmemInfo(ns ndctl.Namespace) *PmemDeviceInfo {
 	}
 }
 
+func namespaceInfoToPmemInfo(ns *ndctl.NamespaceInfo) *PmemDeviceInfo {
+	return &PmemDeviceInfo{
+		VolumeId: ns.Name,
+		Path:     "/dev/" + ns.BlockDeviceName,
+		Size:     ns.Size,
+	}
+}
+
 // totalSize sums up all PMEM regions, regardless whether they are
 // enabled and regardless of their mode.
 func totalSize() (size uint64, err error) {
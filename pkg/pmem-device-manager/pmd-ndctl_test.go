@@ -0,0 +1,55 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	"github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestRegionsByNUMANode(t *testing.T) {
+	const gib = uint64(1024 * 1024 * 1024)
+	region := func(name string, numaNode int, available uint64) *fake.Region {
+		return &fake.Region{
+			DeviceName_:     name,
+			Enabled_:        true,
+			NumaNode_:       numaNode,
+			AvailableSize_:  available,
+			InterleaveWays_: 1,
+			RegionAlign_:    2 * 1024 * 1024,
+		}
+	}
+	readonly := region("region4", 1, 8*gib)
+	readonly.Readonly_ = true
+	disabled := region("region5", 1, 8*gib)
+	disabled.Enabled_ = false
+	failing := region("region6", 1, 8*gib)
+	failing.Mappings_ = []ndctl.Mapping{&fake.Mapping{Dimm_: &fake.Dimm{DeviceName_: "nmem6", Health_: ndctl.DimmHealth{State: ndctl.HealthFatal}}}}
+	ndctx := fake.NewContext(&fake.Context{
+		Buses: []ndctl.Bus{
+			&fake.Bus{
+				DeviceName_: "ndbus0",
+				Regions_: []ndctl.Region{
+					region("region0", 0, 4*gib),
+					// Not aligned, the remainder cannot be used.
+					region("region1", 0, 2*gib+1024),
+					region("region2", 1, 1*gib),
+					region("region3", -1, 3*gib),
+					readonly,
+					disabled,
+					failing,
+				},
+			},
+		},
+	})
+
+	assert.Equal(t, map[int]uint64{0: 6 * gib, 1: 1 * gib, -1: 3 * gib}, regionsByNUMANode(ndctx))
+}
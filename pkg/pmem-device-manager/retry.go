@@ -0,0 +1,148 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+)
+
+// RetryPolicy determines how device operations get repeated when
+// they fail with a transient error.
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts, including the
+	// first one. One or less disables retrying.
+	Attempts int
+	// Delay is the time to wait before the first retry. It
+	// doubles for each further retry.
+	Delay time.Duration
+	// MaxDelay limits the time between retries.
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is used unless SetRetryPolicy is called.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts: 3,
+	Delay:    100 * time.Millisecond,
+	MaxDelay: 2 * time.Second,
+}
+
+var (
+	retryMutex  sync.Mutex
+	retryPolicy = DefaultRetryPolicy
+
+	deviceOperationRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pmem_device_operation_retries_total",
+		Help: "Number of times that a device operation was repeated after a transient error.",
+	}, []string{"operation"})
+)
+
+// SetRetryPolicy changes the policy for all device managers.
+func SetRetryPolicy(policy RetryPolicy) {
+	retryMutex.Lock()
+	defer retryMutex.Unlock()
+	retryPolicy = policy
+}
+
+func getRetryPolicy() RetryPolicy {
+	retryMutex.Lock()
+	defer retryMutex.Unlock()
+	return retryPolicy
+}
+
+// MustRegisterRetries adds the retry metrics to the registry, using
+// labels to tag each sample with node and driver name.
+func MustRegisterRetries(reg prometheus.Registerer, nodeName, driverName string) {
+	labels := prometheus.Labels{
+		NodeLabel:     nodeName,
+		"driver_name": driverName,
+	}
+	prometheus.WrapRegistererWith(labels, reg).MustRegister(deviceOperationRetries)
+}
+
+// transientErrors are substrings of error messages from LVM
+// commands and libndctl which indicate that the operation may
+// succeed when tried again: another process holds a lock or udev has
+// not finished processing a device yet.
+var transientErrors = []string{
+	"Device or resource busy",
+	"Resource temporarily unavailable",
+	"Interrupted system call",
+	"Failed to lock",
+	"Can't get lock",
+	"Can't lock",
+	"not initialized in udev database",
+}
+
+// IsTransient determines whether an error might go away when the
+// operation gets repeated. The well-known errors from
+// pkg/errors are never transient: for example, running out of
+// space needs a different request and not a retry.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, permanent := range []error{
+		pmemerr.NotEnoughSpace,
+		pmemerr.DeviceExists,
+		pmemerr.DeviceNotFound,
+		pmemerr.DeviceInUse,
+	} {
+		if errors.Is(err, permanent) {
+			return false
+		}
+	}
+	msg := err.Error()
+	for _, transient := range transientErrors {
+		if strings.Contains(msg, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRetries calls op until it succeeds, fails with an error that
+// is not transient, the retry policy gives up or the context is
+// done. It returns the last error of op.
+//
+// The caller must hold the lock. It gets released while waiting
+// between attempts, so op must not rely on state that it looked up
+// before an earlier attempt.
+func withRetries(ctx context.Context, operation string, lock sync.Locker, op func() error) error {
+	logger := klog.FromContext(ctx)
+	policy := getRetryPolicy()
+	delay := policy.Delay
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= policy.Attempts || !IsTransient(err) || ctx.Err() != nil {
+			return err
+		}
+		logger.V(3).Info("Transient error, retrying", "operation", operation, "attempt", attempt, "delay", delay, "error", err.Error())
+		deviceOperationRetries.WithLabelValues(operation).Inc()
+		lock.Unlock()
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		lock.Lock()
+		if ctx.Err() != nil {
+			return err
+		}
+		delay *= 2
+		if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/klog/v2/ktesting"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+)
+
+func TestIsTransient(t *testing.T) {
+	assert.False(t, IsTransient(nil), "nil")
+	assert.False(t, IsTransient(errors.New("Volume group \"vg\" has insufficient free space")), "unknown error")
+	assert.False(t, IsTransient(fmt.Errorf("Device or resource busy: %w", pmemerr.NotEnoughSpace)), "out of space")
+	assert.True(t, IsTransient(errors.New("\"lvcreate\": command failed: exit status 5\nCombined stderr/stdout output: Failed to lock logical volume vg/lv.")), "LVM lock")
+	assert.True(t, IsTransient(errors.New("failed to disable namespace: Device or resource busy")), "busy namespace")
+}
+
+func TestWithRetries(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	defer SetRetryPolicy(getRetryPolicy())
+	SetRetryPolicy(RetryPolicy{Attempts: 3})
+	retries := func() float64 {
+		return testutil.ToFloat64(deviceOperationRetries.WithLabelValues("test"))
+	}
+	start := retries()
+
+	// The caller holds the mutex, withRetries must release it
+	// only while waiting.
+	var mutex sync.Mutex
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	calls := 0
+	err := withRetries(ctx, "test", &mutex, func() error {
+		calls++
+		if calls < 2 {
+			return errors.New("Resource temporarily unavailable")
+		}
+		return nil
+	})
+	assert.NoError(t, err, "success after retry")
+	assert.Equal(t, 2, calls, "calls until success")
+	assert.Equal(t, start+1, retries(), "retries after success")
+	assert.False(t, mutex.TryLock(), "locked after retries")
+
+	SetRetryPolicy(RetryPolicy{Attempts: 2, Delay: time.Second})
+	calls = 0
+	err = withRetries(ctx, "test", &mutex, func() error {
+		calls++
+		if calls < 2 {
+			// Someone else must be able to get the lock
+			// while waiting for the next attempt.
+			go func() {
+				mutex.Lock()
+				defer mutex.Unlock()
+				calls += 10
+			}()
+			return errors.New("Resource temporarily unavailable")
+		}
+		return nil
+	})
+	assert.NoError(t, err, "success after waiting")
+	assert.Equal(t, 12, calls, "calls with concurrent lock user")
+	SetRetryPolicy(RetryPolicy{Attempts: 3})
+
+	calls = 0
+	err = withRetries(ctx, "test", &mutex, func() error {
+		calls++
+		return errors.New("Can't get lock for vg")
+	})
+	assert.Error(t, err, "transient error until the end")
+	assert.Equal(t, 3, calls, "calls with transient error")
+	assert.Equal(t, start+4, retries(), "retries after giving up")
+
+	calls = 0
+	err = withRetries(ctx, "test", &mutex, func() error {
+		calls++
+		return pmemerr.NotEnoughSpace
+	})
+	assert.ErrorIs(t, err, pmemerr.NotEnoughSpace, "permanent error")
+	assert.Equal(t, 1, calls, "calls with permanent error")
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	calls = 0
+	err = withRetries(ctx, "test", &mutex, func() error {
+		calls++
+		return errors.New("Device or resource busy")
+	})
+	assert.Error(t, err, "canceled")
+	assert.Equal(t, 1, calls, "calls after cancellation")
+}
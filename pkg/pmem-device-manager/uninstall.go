@@ -0,0 +1,60 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
+)
+
+// RemoveLVMSetup undoes what the LVM device manager sets up on a
+// node: it removes the volume groups of all regions and then
+// destroys the namespaces that PMEM-CSI created for them. Logical
+// volumes must have been deleted before, otherwise vgremove fails.
+// Namespaces of other owners are left alone.
+func RemoveLVMSetup(ctx context.Context) error {
+	ctx, logger := pmemlog.WithName(ctx, "RemoveLVMSetup")
+	lvmMutex.Lock()
+	defer lvmMutex.Unlock()
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return err
+	}
+	defer ndctx.Free()
+
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			vgName := pmemcommon.VgName(bus, r)
+			if vgExists(ctx, vgName) {
+				logger.V(2).Info("Removing volume group", "vg", vgName)
+				if _, err := pmemexec.RunCommand(ctx, "vgremove", "--yes", vgName); err != nil {
+					return fmt.Errorf("remove volume group %s: %v", vgName, err)
+				}
+			}
+			for _, ns := range r.ActiveNamespaces() {
+				if ns.Name() != pmemCSINamespaceName {
+					continue
+				}
+				devName := "/dev/" + ns.BlockDeviceName()
+				logger.V(2).Info("Destroying namespace", "namespace", ns.DeviceName(), "device", devName)
+				if _, err := pmemexec.RunCommand(ctx, "wipefs", "--all", "--force", devName); err != nil {
+					return fmt.Errorf("wipe namespace %s: %v", ns.DeviceName(), err)
+				}
+				if err := r.DestroyNamespace(ns, true); err != nil {
+					return fmt.Errorf("destroy namespace %s: %v", ns.DeviceName(), err)
+				}
+			}
+		}
+	}
+	return nil
+}
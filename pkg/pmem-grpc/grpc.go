@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -21,6 +22,7 @@ import (
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/resolver"
 	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/klog/v2"
 
 	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
@@ -36,7 +38,7 @@ func unixDialer(ctx context.Context, addr string) (net.Conn, error) {
 
 // Connect is a helper function to initiate a grpc client connection to server running at endpoint using tlsConfig
 func Connect(endpoint string, tlsConfig *tls.Config, dialOptions ...grpc.DialOption) (*grpc.ClientConn, error) {
-	proto, address, err := parseEndpoint(endpoint)
+	proto, address, err := ParseEndpoint(endpoint)
 	if err != nil {
 		return nil, err
 	}
@@ -69,7 +71,7 @@ func Connect(endpoint string, tlsConfig *tls.Config, dialOptions ...grpc.DialOpt
 // NewServer is a helper function to start a grpc server at the given endpoint.
 // The error prefix is added to all error messages if not empty.
 func NewServer(endpoint, errorPrefix string, tlsConfig *tls.Config, csiMetricsManager metrics.CSIMetricsManager, opts ...grpc.ServerOption) (*grpc.Server, net.Listener, error) {
-	proto, addr, err := parseEndpoint(endpoint)
+	proto, addr, err := ParseEndpoint(endpoint)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -283,12 +285,50 @@ func loadCertificate(caFile, certFile, keyFile string) (certPool *x509.CertPool,
 	return
 }
 
-func parseEndpoint(ep string) (string, string, error) {
-	if strings.HasPrefix(strings.ToLower(ep), "unix://") || strings.HasPrefix(strings.ToLower(ep), "tcp://") {
-		s := strings.SplitN(ep, "://", 2)
-		if s[1] != "" {
-			return s[0], s[1], nil
+// ParseEndpoint splits a gRPC endpoint into protocol ("unix" or
+// "tcp") and address. Supported are:
+//   - unix:///path/to/socket or just /path/to/socket
+//   - tcp://host:port or just host:port, where host is a hostname,
+//     an IPv4 address, an IPv6 address in brackets or empty
+//     (= all addresses when listening)
+func ParseEndpoint(ep string) (string, string, error) {
+	proto, address := "", ep
+	if s := strings.SplitN(ep, "://", 2); len(s) == 2 {
+		proto, address = strings.ToLower(s[0]), s[1]
+	}
+	switch proto {
+	case "":
+		if strings.HasPrefix(address, "/") {
+			proto = "unix"
+		} else {
+			proto = "tcp"
+		}
+	case "unix", "tcp":
+	default:
+		return "", "", fmt.Errorf("invalid endpoint %q: unsupported scheme %q, must be unix or tcp", ep, proto)
+	}
+
+	if proto == "unix" {
+		if address == "" {
+			return "", "", fmt.Errorf("invalid endpoint %q: empty socket path", ep)
+		}
+		return proto, address, nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		if strings.Count(address, ":") > 1 && !strings.HasPrefix(address, "[") {
+			return "", "", fmt.Errorf("invalid endpoint %q: IPv6 addresses must be enclosed in brackets, as in [::1]:10000", ep)
+		}
+		return "", "", fmt.Errorf("invalid endpoint %q: expected host:port or an absolute socket path: %v", ep, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", "", fmt.Errorf("invalid endpoint %q: port %q is not a number between 0 and 65535", ep, port)
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		if errs := validation.IsDNS1123Subdomain(strings.ToLower(host)); len(errs) > 0 {
+			return "", "", fmt.Errorf("invalid endpoint %q: %q is neither an IP address nor a valid hostname: %s", ep, host, strings.Join(errs, ", "))
 		}
 	}
-	return "", "", fmt.Errorf("Invalid endpoint: %v", ep)
+	return proto, net.JoinHostPort(host, port), nil
 }
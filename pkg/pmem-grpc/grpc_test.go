@@ -0,0 +1,96 @@
+package pmemgrpc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	testcases := map[string]struct {
+		endpoint      string
+		expectProto   string
+		expectAddress string
+		expectError   string
+	}{
+		"unix": {
+			endpoint:      "unix:///csi/csi.sock",
+			expectProto:   "unix",
+			expectAddress: "/csi/csi.sock",
+		},
+		"unix-upper-case": {
+			endpoint:      "UNIX:///csi/csi.sock",
+			expectProto:   "unix",
+			expectAddress: "/csi/csi.sock",
+		},
+		"unix-without-scheme": {
+			endpoint:      "/csi/csi.sock",
+			expectProto:   "unix",
+			expectAddress: "/csi/csi.sock",
+		},
+		"unix-empty": {
+			endpoint:    "unix://",
+			expectError: `invalid endpoint "unix://": empty socket path`,
+		},
+		"ipv4": {
+			endpoint:      "tcp://127.0.0.1:10000",
+			expectProto:   "tcp",
+			expectAddress: "127.0.0.1:10000",
+		},
+		"ipv6": {
+			endpoint:      "tcp://[::1]:10000",
+			expectProto:   "tcp",
+			expectAddress: "[::1]:10000",
+		},
+		"ipv6-without-brackets": {
+			endpoint:    "tcp://::1:10000",
+			expectError: `invalid endpoint "tcp://::1:10000": IPv6 addresses must be enclosed in brackets, as in [::1]:10000`,
+		},
+		"hostname": {
+			endpoint:      "tcp://pmem-csi-controller.pmem-csi.svc:10000",
+			expectProto:   "tcp",
+			expectAddress: "pmem-csi-controller.pmem-csi.svc:10000",
+		},
+		"hostname-without-scheme": {
+			endpoint:      "localhost:10000",
+			expectProto:   "tcp",
+			expectAddress: "localhost:10000",
+		},
+		"all-addresses": {
+			endpoint:      "tcp://:10000",
+			expectProto:   "tcp",
+			expectAddress: ":10000",
+		},
+		"invalid-hostname": {
+			endpoint:    "tcp://foo_bar:10000",
+			expectError: `invalid endpoint "tcp://foo_bar:10000": "foo_bar" is neither an IP address nor a valid hostname: a lowercase RFC 1123 subdomain must consist of lower case alphanumeric characters, '-' or '.', and must start and end with an alphanumeric character (e.g. 'example.com', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*')`,
+		},
+		"missing-port": {
+			endpoint:    "tcp://localhost",
+			expectError: `invalid endpoint "tcp://localhost": expected host:port or an absolute socket path: address localhost: missing port in address`,
+		},
+		"invalid-port": {
+			endpoint:    "tcp://localhost:100000",
+			expectError: `invalid endpoint "tcp://localhost:100000": port "100000" is not a number between 0 and 65535`,
+		},
+		"unknown-scheme": {
+			endpoint:    "http://localhost:10000",
+			expectError: `invalid endpoint "http://localhost:10000": unsupported scheme "http", must be unix or tcp`,
+		},
+	}
+
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			proto, address, err := ParseEndpoint(tc.endpoint)
+			if tc.expectError != "" {
+				assert.EqualError(t, err, tc.expectError)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.expectProto, proto, "protocol")
+				assert.Equal(t, tc.expectAddress, address, "address")
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package termination writes the reason why a PMEM-CSI binary failed
+// to the termination log of its container. Kubernetes stores the
+// content in the container status, where the operator and admins
+// can find it after the container was restarted.
+package termination
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// PathEnv is the environment variable which contains the path of the
+// termination log. Nothing gets written when it is not set.
+const PathEnv = "TERMINATION_LOG_PATH"
+
+// maxSize is the limit enforced by Kubernetes for the termination
+// message of a single container.
+const maxSize = 4096
+
+// Message is stored in JSON format in the termination log.
+type Message struct {
+	// Reason is a short, CamelCase identifier for the problem.
+	Reason string `json:"reason"`
+	// Message is the full error message.
+	Message string `json:"message"`
+	// Device is the PMEM region, namespace or volume group that
+	// caused the problem, if known.
+	Device string `json:"device,omitempty"`
+	// Suggestion tells an admin how to fix the problem, if known.
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+// String formats the message for humans.
+func (m Message) String() string {
+	var parts []string
+	if m.Reason != "" {
+		parts = append(parts, m.Reason+": ")
+	}
+	parts = append(parts, m.Message)
+	if m.Device != "" {
+		parts = append(parts, fmt.Sprintf(" (device %s)", m.Device))
+	}
+	if m.Suggestion != "" {
+		parts = append(parts, ". "+m.Suggestion)
+	}
+	return strings.Join(parts, "")
+}
+
+// Error adds information for the termination log to an error. It
+// can be wrapped by other errors.
+type Error struct {
+	Reason     string
+	Device     string
+	Suggestion string
+	Err        error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Reasons for common problems.
+const (
+	// ReasonUnknown is used for errors without additional information.
+	ReasonUnknown = "Failed"
+	// ReasonSysReadOnly means that the driver cannot modify /sys.
+	ReasonSysReadOnly = "SysReadOnly"
+	// ReasonNdctlFailed means that the PMEM hardware could not be
+	// enumerated.
+	ReasonNdctlFailed = "NdctlFailed"
+	// ReasonNamespaceSetup means that creating a namespace for LVM
+	// failed.
+	ReasonNamespaceSetup = "NamespaceSetupFailed"
+	// ReasonVolumeGroupSetup means that creating or extending a
+	// volume group failed.
+	ReasonVolumeGroupSetup = "VolumeGroupSetupFailed"
+	// ReasonStateDirectory means that the directory for the
+	// driver state is not usable.
+	ReasonStateDirectory = "StateDirectoryFailed"
+)
+
+// NewMessage creates the termination message for an error.
+func NewMessage(msg string, err error) Message {
+	m := Message{
+		Reason:  ReasonUnknown,
+		Message: msg + ": " + err.Error(),
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		m.Reason = e.Reason
+		m.Device = e.Device
+		m.Suggestion = e.Suggestion
+	}
+	return m
+}
+
+// ParseMessage decodes the content of a termination log. Content that
+// is not in JSON format, for example from an older PMEM-CSI release
+// or the end of the container log, is returned as message without
+// reason.
+func ParseMessage(data string) Message {
+	var m Message
+	if err := json.Unmarshal([]byte(data), &m); err != nil || m.Message == "" {
+		return Message{Message: strings.TrimSpace(data)}
+	}
+	return m
+}
+
+// ExitError prints the error and writes it to the termination log.
+// The caller then must exit with a non-zero exit code.
+func ExitError(msg string, err error) {
+	m := NewMessage(msg, err)
+	fmt.Println(m.String())
+	path := os.Getenv(PathEnv)
+	if path == "" {
+		return
+	}
+	if len(m.Message) > maxSize/2 {
+		// Kubernetes would truncate the JSON, which then cannot
+		// be decoded anymore.
+		m.Message = m.Message[:maxSize/2]
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		fmt.Println("Can not encode termination message: " + err.Error())
+		return
+	}
+	if err := ioutil.WriteFile(path, data, os.FileMode(0644)); err != nil {
+		fmt.Println("Can not create termination log file:" + path)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package termination
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMessage(t *testing.T) {
+	err := &Error{
+		Reason:     ReasonVolumeGroupSetup,
+		Device:     "bus0region0fsdax",
+		Suggestion: "check the volume group",
+		Err:        errors.New("vgcreate failed"),
+	}
+	m := NewMessage("failed to run driver", fmt.Errorf("setup: %w", err))
+	assert.Equal(t, Message{
+		Reason:     ReasonVolumeGroupSetup,
+		Message:    "failed to run driver: setup: vgcreate failed",
+		Device:     "bus0region0fsdax",
+		Suggestion: "check the volume group",
+	}, m)
+	assert.Equal(t, "VolumeGroupSetupFailed: failed to run driver: setup: vgcreate failed (device bus0region0fsdax). check the volume group", m.String())
+
+	m = NewMessage("failed to run driver", errors.New("some error"))
+	assert.Equal(t, Message{Reason: ReasonUnknown, Message: "failed to run driver: some error"}, m)
+}
+
+func TestParseMessage(t *testing.T) {
+	for name, tc := range map[string]struct {
+		data     string
+		expected Message
+	}{
+		"json": {
+			data:     `{"reason":"SysReadOnly","message":"failed","suggestion":"run privileged"}`,
+			expected: Message{Reason: ReasonSysReadOnly, Message: "failed", Suggestion: "run privileged"},
+		},
+		"text": {
+			data:     "failed to run driver: some error\n",
+			expected: Message{Message: "failed to run driver: some error"},
+		},
+		"other-json": {
+			data:     `{"foo":"bar"}`,
+			expected: Message{Message: `{"foo":"bar"}`},
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, ParseMessage(tc.data))
+		})
+	}
+}
+
+func TestExitError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "termination-log")
+	t.Setenv(PathEnv, path)
+
+	ExitError("failed", &Error{Reason: ReasonNdctlFailed, Err: errors.New(strings.Repeat("x", 2*maxSize))})
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err, "read termination log")
+	assert.LessOrEqual(t, len(data), maxSize, "size of termination log")
+	m := ParseMessage(string(data))
+	assert.Equal(t, ReasonNdctlFailed, m.Reason, "reason")
+}
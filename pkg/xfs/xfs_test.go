@@ -19,3 +19,13 @@ func Test_ConfigureFS(t *testing.T) {
 	}
 	t.Logf("got expected error: %v", err)
 }
+
+func Test_EnableDAX(t *testing.T) {
+	// tmpfs has neither xattr nor DAX support.
+	tmp := t.TempDir()
+	err := EnableDAX(tmp)
+	if err == nil {
+		t.Fatal("did not get expected error")
+	}
+	t.Logf("got expected error: %v", err)
+}
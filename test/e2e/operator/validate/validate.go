@@ -20,6 +20,7 @@ import (
 
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
 	"github.com/intel/pmem-csi/pkg/deployments"
+	"github.com/intel/pmem-csi/pkg/k8sutil"
 	operatordeployment "github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller/deployment"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-operator/metrics"
 	"github.com/intel/pmem-csi/pkg/version"
@@ -27,6 +28,7 @@ import (
 
 	cm "github.com/prometheus/client_model/go"
 	"gopkg.in/yaml.v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -51,6 +53,22 @@ func DriverDeploymentEventually(ctx context.Context, c *deploy.Cluster, client c
 	return endCount, nil
 }
 
+// isOpenShift does the same auto-detection as the operator.
+func isOpenShift(ctx context.Context, c client.Client) (bool, error) {
+	crd := &unstructured.Unstructured{}
+	crd.SetAPIVersion("apiextensions.k8s.io/v1")
+	crd.SetKind("CustomResourceDefinition")
+	err := c.Get(ctx, client.ObjectKey{Name: k8sutil.OpenShiftCRDName}, crd)
+	switch {
+	case err == nil:
+		return true, nil
+	case apierrors.IsNotFound(err):
+		return false, nil
+	default:
+		return false, fmt.Errorf("check for OpenShift CRD: %v", err)
+	}
+}
+
 // WaitForDeploymentReconciled waits and checks till the context timedout
 // that if given deployment got reconciled by the operator.
 // It checks in the operator metrics for a new 'pmem_csi_deployment_reconcile'
@@ -222,13 +240,29 @@ func DriverDeployment(ctx context.Context, c client.Client, k8sver version.Versi
 		return err
 	}
 
-	expectedObjects, err := deployments.LoadAndCustomizeObjects(k8sver, deployment.Spec.DeviceMode, namespace, deployment)
+	openShift, err := isOpenShift(ctx, c)
+	if err != nil {
+		return err
+	}
+	expectedObjects, err := deployments.LoadAndCustomizeObjects(k8sver, deployment.Spec.DeviceMode, namespace, deployment, openShift)
 	if err != nil {
 		return fmt.Errorf("customize expected objects: %v", err)
 	}
 
 	var diffs []string
+	dashboardsFound := false
 	for _, actual := range objects {
+		if deployment.Spec.GrafanaDashboards &&
+			actual.GetKind() == "ConfigMap" &&
+			actual.GetName() == deployment.GrafanaDashboardsName() {
+			// The dashboards are not part of the reference
+			// YAMLs, their content comes from the operator.
+			dashboardsFound = true
+			if actual.GetLabels()["grafana_dashboard"] != "1" {
+				diffs = append(diffs, fmt.Sprintf("label grafana_dashboard missing for %s", prettyPrintObjectID(actual)))
+			}
+			continue
+		}
 		expected := findObject(expectedObjects, actual)
 		if expected == nil {
 			diffs = append(diffs, fmt.Sprintf("unexpected object was deployed: %s", prettyPrintObjectID(actual)))
@@ -285,6 +319,9 @@ func DriverDeployment(ctx context.Context, c client.Client, k8sver version.Versi
 			diffs = append(diffs, fmt.Sprintf("expected object was not deployed: %v", prettyPrintObjectID(expected)))
 		}
 	}
+	if deployment.Spec.GrafanaDashboards && !dashboardsFound {
+		diffs = append(diffs, fmt.Sprintf("expected object was not deployed: ConfigMap %q", deployment.GrafanaDashboardsName()))
+	}
 	if diffs != nil {
 		return fmt.Errorf("deployed driver different from expected deployment:\n%s", strings.Join(diffs, "\n"))
 	}